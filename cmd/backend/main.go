@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
+	"sciedu-backend/internal/auth"
 	"sciedu-backend/internal/chat"
 	"sciedu-backend/internal/config"
 	"sciedu-backend/internal/content"
@@ -30,6 +34,11 @@ func main() {
 	cfg, configLogger := config.Load()
 	configLogger.FlushToZap(logger)
 
+	// Anyone who knows the secret can sign access tokens for any user.
+	if cfg.Secret == "" || cfg.Secret == config.DefaultSecret {
+		logger.Fatal("Refusing to verify access tokens with an empty or default secret, set SECRET")
+	}
+
 	err = databaseutil.MigrationUp(cfg.MigrationSource, cfg.DatabaseURL, logger)
 	if err != nil {
 		logger.Fatal("Failed to run database migration", zap.Error(err))
@@ -48,23 +57,88 @@ func main() {
 	questionStore := question.NewStore(pool)
 	optionService := question.NewOptionService(questionStore, logger)
 	questionService := question.NewQuestionService(questionStore, optionService, logger)
-	questionHandler := question.NewHandler(questionService, logger)
+	tutorPolicyService := question.NewTutorPolicyService(questionStore, questionService, logger)
+	questionHandler := question.NewHandler(questionService, tutorPolicyService, logger)
 
-	contentQueries := content.New(pool)
-	contentService := content.NewService(contentQueries, logger)
+	contentStore := content.NewStore(pool)
+	contentService := content.NewService(contentStore, logger)
+	storageQuotas, err := content.ParseStorageQuotas(cfg.StorageQuotas)
+	if err != nil {
+		logger.Fatal("Failed to parse storage quotas", zap.Error(err))
+	}
+	contentService.SetStorageQuotas(storageQuotas)
 	contentHandler := content.NewHandler(contentService, logger)
 
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "reconcile-media":
+			if err := runReconcileMedia(context.Background(), args[1:], contentService, os.Stdout); err != nil {
+				logger.Fatal("Failed to reconcile media", zap.Error(err))
+			}
+			return
+		default:
+			logger.Fatal("Unknown subcommand", zap.String("subcommand", args[0]))
+		}
+	}
+
+	resumedVariants, err := contentService.ResumeVariants(context.Background())
+	if err != nil {
+		logger.Error("Failed to resume media variants", zap.Error(err))
+	} else if resumedVariants > 0 {
+		logger.Info("Resumed interrupted media variants", zap.Int("count", resumedVariants))
+	}
+
 	chatQueriers := chat.New(pool)
 	chatProvider := chat.NewProvider(cfg.LLMURL+"/chat", &http.Client{}, nil)
-	chatStreamHub := chat.NewStreamHub()
-	chatService := chat.NewService(chatProvider, chatQueriers, chatStreamHub, logger)
+	streamMaxLag, err := time.ParseDuration(cfg.StreamMaxLag)
+	if err != nil {
+		logger.Fatal("Failed to parse stream max lag", zap.Error(err))
+	}
+	var chatStreamHub chat.Hub
+	switch cfg.StreamHub {
+	case "memory":
+		memoryHub := chat.NewStreamHub()
+		memoryHub.SetMaxLag(streamMaxLag)
+		chatStreamHub = memoryHub
+	case "postgres":
+		postgresHub := chat.NewPostgresHub(pool, logger)
+		postgresHub.SetMaxLag(streamMaxLag)
+		go postgresHub.Run(context.Background())
+		chatStreamHub = postgresHub
+	default:
+		logger.Fatal("Unknown stream hub", zap.String("stream_hub", cfg.StreamHub))
+	}
+	chatService := chat.NewService(chatProvider, chatQueriers, chatStreamHub, contentService, logger)
+	contextBudgets, err := chat.ParseContextBudgets(cfg.ContextBudgets)
+	if err != nil {
+		logger.Fatal("Failed to parse context budgets", zap.Error(err))
+	}
+	chatService.SetContextBudgets(contextBudgets)
+	chatModels, err := chat.ParseModels(cfg.LLMModels)
+	if err != nil {
+		logger.Fatal("Failed to parse LLM models", zap.Error(err))
+	}
+	chatService.SetModels(chatModels)
+	chatService.SetQuestions(chat.QuestionServices{
+		QuestionService: questionService,
+		TutorPolicies:   tutorPolicyService,
+	})
+	chatService.SetRetriever(chat.NewContentRetriever(contentService))
+	chatService.SetTools(chat.NewToolRegistry(
+		chat.NewQuestionTool(questionService),
+		chat.NewTextContentTool(contentService),
+		chat.NewCalculatorTool(),
+	))
+	go chatService.WatchOrphanedStreams(context.Background())
 	chatHandler := chat.NewHandler(chatService, logger)
 	mux := http.NewServeMux()
 
 	allowOrigins := parseAllowOrigins(cfg.AllowOrigins)
 	corsMiddleware := cors.NewMiddleware(logger, allowOrigins)
+	authMiddleware := auth.NewMiddleware(logger, cfg.Secret)
 	middlewareSet := middlewareutil.NewSet(
 		corsMiddleware.HandlerFunc,
+		authMiddleware.HandlerFunc,
 	)
 
 	// Health check route
@@ -78,10 +152,22 @@ func main() {
 
 	questionHandler.RegisterRoutes(mux, middlewareSet)
 	contentHandler.RegisterRoutes(mux, middlewareSet)
+	mux.HandleFunc("GET /api/chats", chatHandler.ListChats)
 	mux.HandleFunc("POST /api/chat", chatHandler.CreateChat)
 	mux.HandleFunc("GET /api/chat/stream/{messageID}", chatHandler.Stream)
+	mux.HandleFunc("POST /api/chat/stream/{messageID}/cancel", chatHandler.CancelStream)
 	mux.HandleFunc("GET /api/chat/{chatID}", chatHandler.GetChat)
 	mux.HandleFunc("POST /api/chat/{chatID}", chatHandler.CreateMessage)
+	mux.HandleFunc("GET /api/chat/{chatID}/messages/tree", chatHandler.GetChatTree)
+	mux.HandleFunc("GET /api/chat/{chatID}/messages/{messageID}/path", chatHandler.GetChatPath)
+	mux.HandleFunc("PUT /api/chat/{chatID}/current-leaf", chatHandler.SetCurrentLeaf)
+	mux.HandleFunc("POST /api/chat/{chatID}/messages/{messageID}/regenerate", chatHandler.RegenerateMessage)
+	mux.HandleFunc("POST /api/chat/{chatID}/messages/{messageID}/edit", chatHandler.EditMessage)
+	mux.HandleFunc("GET /api/personas", chatHandler.ListPersonas)
+	mux.HandleFunc("POST /api/personas", chatHandler.CreatePersona)
+	mux.HandleFunc("GET /api/personas/{personaID}", chatHandler.GetPersona)
+	mux.HandleFunc("PUT /api/personas/{personaID}", chatHandler.UpdatePersona)
+	mux.HandleFunc("DELETE /api/personas/{personaID}", chatHandler.DeletePersona)
 
 	logger.Info("Start listening on port: 8080")
 
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"sciedu-backend/internal/content"
+)
+
+// runReconcileMedia implements "backend reconcile-media": it compares the media
+// directory with the contents table and prints the report as JSON.
+func runReconcileMedia(ctx context.Context, args []string, service *content.Service, out io.Writer) error {
+	flags := flag.NewFlagSet("reconcile-media", flag.ContinueOnError)
+	action := flags.String("action", content.ReconcileActionReport, "report, quarantine or delete")
+	dir := flags.String("dir", "contents", "media directory to scan")
+	grace := flags.Duration("grace", content.DefaultReconcileGracePeriod, "ignore files modified more recently than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := service.ReconcileMedia(ctx, content.ReconcileOptions{
+		Action:      *action,
+		Dir:         *dir,
+		GracePeriod: *grace,
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("write reconcile report: %w", err)
+	}
+	return nil
+}
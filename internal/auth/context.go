@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"context"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RoleStudent      = "STUDENT"
+	RoleExperimenter = "EXPERIMENTER"
+	RoleAdmin        = "ADMIN"
+)
+
+// User is the authenticated caller that the auth middleware attaches to the request context.
+type User struct {
+	ID    uuid.UUID
+	Roles []string
+}
+
+type userContextKey struct{}
+
+func (u User) HasRole(role string) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(User)
+	if !ok || user.ID == uuid.Nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+func UserIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return uuid.Nil, false
+	}
+	return user.ID, true
+}
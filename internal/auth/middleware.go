@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	logutil "github.com/NYCU-SDC/summer/pkg/log"
+	problemutil "github.com/NYCU-SDC/summer/pkg/problem"
+	"go.uber.org/zap"
+)
+
+// Middleware authenticates requests by their access token cookie and attaches the
+// caller to the request context. Requests without the cookie pass through
+// anonymously; handlers that need a caller reject them.
+type Middleware struct {
+	logger        *zap.Logger
+	secret        []byte
+	now           func() time.Time
+	problemWriter *problemutil.HttpWriter
+}
+
+func NewMiddleware(logger *zap.Logger, secret string) Middleware {
+	return Middleware{
+		logger:        logger,
+		secret:        []byte(secret),
+		now:           time.Now,
+		problemWriter: problemutil.New(),
+	}
+}
+
+func (m Middleware) HandlerFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(AccessTokenCookie)
+		if errors.Is(err, http.ErrNoCookie) || (err == nil && cookie.Value == "") {
+			next(w, r)
+			return
+		}
+
+		var user User
+		if err == nil {
+			user, err = ParseAccessToken(m.secret, cookie.Value, m.now())
+		}
+		if err != nil {
+			ctx := r.Context()
+			m.problemWriter.WriteError(ctx, w, fmt.Errorf("%w: %v", handlerutil.ErrUnauthorized, err),
+				logutil.WithContext(ctx, m.logger))
+			return
+		}
+
+		next(w, r.WithContext(WithUser(r.Context(), user)))
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func TestMiddleware(t *testing.T) {
+	secret := "test-secret"
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := User{ID: uuid.New(), Roles: []string{RoleStudent, RoleAdmin}}
+
+	signed := func(t *testing.T, secret string, user User, issued time.Time) string {
+		t.Helper()
+		token, err := SignAccessToken([]byte(secret), user, issued)
+		if err != nil {
+			t.Fatalf("sign access token: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name       string
+		cookie     func(t *testing.T) string
+		wantStatus int
+		wantUser   *User
+	}{
+		{
+			name:       "no cookie passes through anonymously",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "valid token attaches the user",
+			cookie: func(t *testing.T) string {
+				return signed(t, secret, user, now.Add(-time.Minute))
+			},
+			wantStatus: http.StatusOK,
+			wantUser:   &user,
+		},
+		{
+			name: "expired token",
+			cookie: func(t *testing.T) string {
+				return signed(t, secret, user, now.Add(-AccessTokenTTL))
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "token signed with another secret",
+			cookie: func(t *testing.T) string {
+				return signed(t, "other-secret", user, now)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered claims",
+			cookie: func(t *testing.T) string {
+				parts := strings.Split(signed(t, secret, user, now), ".")
+				forged := strings.Split(signed(t, "other-secret", User{ID: user.ID, Roles: []string{RoleAdmin, RoleExperimenter}}, now), ".")
+				return parts[0] + "." + forged[1] + "." + parts[2]
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "malformed token",
+			cookie: func(*testing.T) string {
+				return "not-a-jwt"
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "token without a subject",
+			cookie: func(t *testing.T) string {
+				return signed(t, secret, User{}, now)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := NewMiddleware(zap.NewNop(), secret)
+			middleware.now = func() time.Time { return now }
+
+			var got *User
+			handler := middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if user, ok := UserFromContext(r.Context()); ok {
+					got = &user
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/api/chats", nil)
+			if tt.cookie != nil {
+				req.AddCookie(&http.Cookie{Name: AccessTokenCookie, Value: tt.cookie(t)})
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			switch {
+			case tt.wantUser == nil && got != nil:
+				t.Fatalf("expected no user, got %+v", *got)
+			case tt.wantUser != nil && got == nil:
+				t.Fatal("expected a user in the context")
+			case tt.wantUser != nil && (got.ID != tt.wantUser.ID || !slices.Equal(got.Roles, tt.wantUser.Roles)):
+				t.Fatalf("user mismatch: want %+v got %+v", *tt.wantUser, *got)
+			}
+		})
+	}
+}
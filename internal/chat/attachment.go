@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"sciedu-backend/internal/content"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	AttachmentKindImage = "image"
+	AttachmentKindAudio = "audio"
+)
+
+const (
+	maxAttachments = 4
+	// maxAttachmentBytes bounds one attachment inlined into an LLM request.
+	maxAttachmentBytes = 20 << 20
+	// attachmentImageWidth is the media variant sent for images, to keep requests small.
+	attachmentImageWidth = 1280
+	// attachmentTokens is a rough cost of one attachment against the context budget.
+	attachmentTokens = 1000
+)
+
+var ErrInvalidAttachment = errors.New("invalid attachment")
+
+// MediaStore opens uploaded media; content.Service implements it.
+type MediaStore interface {
+	OpenMediaContent(ctx context.Context, id uuid.UUID, width int) (content.Content, *os.File, error)
+}
+
+type AttachmentReturn struct {
+	ContentID uuid.UUID `json:"contentID"`
+	Kind      string    `json:"kind"`
+	MimeType  string    `json:"mimeType"`
+}
+
+// inspectAttachments checks that every content ID is an image or audio upload that
+// the LLM accepts, and returns how each would be attached.
+func (s *ChatService) inspectAttachments(ctx context.Context, contentIDs []uuid.UUID) ([]AttachmentReturn, error) {
+	if len(contentIDs) == 0 {
+		return nil, nil
+	}
+	if s.media == nil {
+		return nil, fmt.Errorf("%w: attachments are not supported", ErrInvalidAttachment)
+	}
+	if len(contentIDs) > maxAttachments {
+		return nil, fmt.Errorf("%w: at most %d attachments per message", ErrInvalidAttachment, maxAttachments)
+	}
+
+	attachments := make([]AttachmentReturn, 0, len(contentIDs))
+	for i, id := range contentIDs {
+		if slices.Contains(contentIDs[:i], id) {
+			return nil, fmt.Errorf("%w: content %s is attached twice", ErrInvalidAttachment, id)
+		}
+		item, f, err := s.media.OpenMediaContent(ctx, id, 0)
+		if err != nil {
+			return nil, err
+		}
+		mimeType, err := detectMimeType(item.Content, f)
+		if cerr := f.Close(); cerr != nil {
+			s.logger.Warn("failed to close media file", zap.String("content_id", id.String()), zap.Error(cerr))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read media %s: %w", id, err)
+		}
+
+		kind := attachmentKind(mimeType)
+		if kind == "" {
+			return nil, fmt.Errorf("%w: content %s is %s, only images and wav or mp3 audio can be attached",
+				ErrInvalidAttachment, id, mimeType)
+		}
+		attachments = append(attachments, AttachmentReturn{ContentID: id, Kind: kind, MimeType: mimeType})
+	}
+	return attachments, nil
+}
+
+func (s *ChatService) createAttachments(ctx context.Context, messageID uuid.UUID, attachments []AttachmentReturn) error {
+	for i, attachment := range attachments {
+		_, err := s.querier.CreateMessageAttachment(ctx, CreateMessageAttachmentParams{
+			MessageID: messageID,
+			Position:  int32(i),
+			ContentID: attachment.ContentID,
+			Kind:      attachment.Kind,
+			MimeType:  attachment.MimeType,
+		})
+		if err != nil {
+			return databaseutil.WrapDBErrorWithKeyValue(err, "message_attachments", "message_id", messageID.String(),
+				s.logger, "create message attachment")
+		}
+	}
+	return nil
+}
+
+// fetchAttachments returns the attachments of every message in a chat, by message.
+func (s *ChatService) fetchAttachments(ctx context.Context, chatID uuid.UUID) (map[uuid.UUID][]AttachmentReturn, error) {
+	rows, err := s.querier.GetChatAttachments(ctx, chatID)
+	if err != nil {
+		return nil, databaseutil.WrapDBErrorWithKeyValue(err, "message_attachments", "chat_id", chatID.String(),
+			s.logger, "get chat attachments")
+	}
+	result := make(map[uuid.UUID][]AttachmentReturn)
+	for _, row := range rows {
+		result[row.MessageID] = append(result[row.MessageID], AttachmentReturn{
+			ContentID: row.ContentID,
+			Kind:      row.Kind,
+			MimeType:  row.MimeType,
+		})
+	}
+	return result, nil
+}
+
+// attachmentPart loads an attachment and inlines it as an LLM content part: images as
+// a data URL, audio as base64 input audio.
+func (s *ChatService) attachmentPart(ctx context.Context, attachment AttachmentReturn) (ContentPart, error) {
+	if s.media == nil {
+		return ContentPart{}, fmt.Errorf("%w: attachments are not supported", ErrInvalidAttachment)
+	}
+	width := 0
+	if attachment.Kind == AttachmentKindImage {
+		width = attachmentImageWidth
+	}
+	_, f, err := s.media.OpenMediaContent(ctx, attachment.ContentID, width)
+	if err != nil {
+		return ContentPart{}, err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil {
+			s.logger.Warn("failed to close media file", zap.String("content_id", attachment.ContentID.String()), zap.Error(cerr))
+		}
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxAttachmentBytes+1))
+	if err != nil {
+		return ContentPart{}, fmt.Errorf("read media %s: %w", attachment.ContentID, err)
+	}
+	if len(data) > maxAttachmentBytes {
+		return ContentPart{}, fmt.Errorf("%w: content %s is larger than %d bytes", ErrInvalidAttachment,
+			attachment.ContentID, maxAttachmentBytes)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if attachment.Kind == AttachmentKindAudio {
+		return ContentPart{
+			Type:       "input_audio",
+			InputAudio: &InputAudio{Data: encoded, Format: audioFormat(attachment.MimeType)},
+		}, nil
+	}
+	return ContentPart{
+		Type:     "image_url",
+		ImageURL: &ImageURL{URL: "data:" + attachment.MimeType + ";base64," + encoded},
+	}, nil
+}
+
+// detectMimeType names the media type of a blob from its extension, sniffing the
+// content when the extension is unknown.
+func detectMimeType(path string, r io.Reader) (string, error) {
+	if byExt := mime.TypeByExtension(filepath.Ext(path)); byExt != "" {
+		if mediaType, _, err := mime.ParseMediaType(byExt); err == nil {
+			return mediaType, nil
+		}
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if err != nil {
+		return "", err
+	}
+	return mediaType, nil
+}
+
+// attachmentKind tells how a media type is sent to the LLM, or "" when it cannot be.
+func attachmentKind(mimeType string) string {
+	switch mimeType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return AttachmentKindImage
+	case "audio/wav", "audio/wave", "audio/x-wav", "audio/mpeg", "audio/mp3":
+		return AttachmentKindAudio
+	default:
+		return ""
+	}
+}
+
+func audioFormat(mimeType string) string {
+	if mimeType == "audio/mpeg" || mimeType == "audio/mp3" {
+		return "mp3"
+	}
+	return "wav"
+}
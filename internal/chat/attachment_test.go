@@ -0,0 +1,250 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sciedu-backend/internal/content"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+)
+
+// pngHeader is enough of a PNG for content sniffing.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// fakeMediaStore serves media blobs written to a temporary directory.
+type fakeMediaStore struct {
+	dir   string
+	paths map[uuid.UUID]string
+	// widths records the variant width each open asked for.
+	widths []int
+}
+
+func newFakeMediaStore(t *testing.T) *fakeMediaStore {
+	return &fakeMediaStore{dir: t.TempDir(), paths: map[uuid.UUID]string{}}
+}
+
+// add stores a blob under name and returns its content ID.
+func (m *fakeMediaStore) add(t *testing.T, name string, data []byte) uuid.UUID {
+	t.Helper()
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write media: %v", err)
+	}
+	id := uuid.New()
+	m.paths[id] = path
+	return id
+}
+
+func (m *fakeMediaStore) OpenMediaContent(_ context.Context, id uuid.UUID, width int) (content.Content, *os.File, error) {
+	m.widths = append(m.widths, width)
+	path, ok := m.paths[id]
+	if !ok {
+		return content.Content{}, nil, handlerutil.NewNotFoundError("contents", "id", id.String(), "")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return content.Content{}, nil, err
+	}
+	return content.Content{ID: id, Type: "MEDIA", Content: path}, f, nil
+}
+
+func TestInspectAttachments_TableDriven(t *testing.T) {
+	tests := []struct {
+		name string
+		// files are the blobs attached, by file name; "unknown" attaches a missing
+		// content and "twice" attaches the first file again.
+		files     []string
+		noMedia   bool
+		wantKinds []string
+		wantMimes []string
+		wantErr   error
+	}{
+		{name: "none", wantKinds: nil},
+		{name: "image by extension", files: []string{"a.png"}, wantKinds: []string{"image"}, wantMimes: []string{"image/png"}},
+		{name: "image by content", files: []string{"blob"}, wantKinds: []string{"image"}, wantMimes: []string{"image/png"}},
+		{name: "audio", files: []string{"a.wav", "b.mp3"}, wantKinds: []string{"audio", "audio"}, wantMimes: []string{"audio/wav", "audio/mpeg"}},
+		{name: "unsupported type", files: []string{"a.pdf"}, wantErr: ErrInvalidAttachment},
+		{name: "same content twice", files: []string{"a.png", "twice"}, wantErr: ErrInvalidAttachment},
+		{name: "too many", files: []string{"a.png", "b.png", "c.png", "d.png", "e.png"}, wantErr: ErrInvalidAttachment},
+		{name: "unknown content", files: []string{"unknown"}, wantErr: handlerutil.NotFoundError{}},
+		{name: "no media store", files: []string{"a.png"}, noMedia: true, wantErr: ErrInvalidAttachment},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			media := newFakeMediaStore(t)
+			var ids []uuid.UUID
+			for _, name := range tt.files {
+				switch name {
+				case "unknown":
+					ids = append(ids, uuid.New())
+				case "twice":
+					ids = append(ids, ids[0])
+				default:
+					ids = append(ids, media.add(t, name, pngHeader))
+				}
+			}
+			service := newTestService(newFakeChatQuerier())
+			if !tt.noMedia {
+				service.media = media
+			}
+
+			got, err := service.inspectAttachments(context.Background(), ids)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.wantKinds) {
+				t.Fatalf("got %d attachments, want %d", len(got), len(tt.wantKinds))
+			}
+			for i, attachment := range got {
+				if attachment.ContentID != ids[i] || attachment.Kind != tt.wantKinds[i] || attachment.MimeType != tt.wantMimes[i] {
+					t.Errorf("attachment %d: got %+v, want %s %s", i, attachment, tt.wantKinds[i], tt.wantMimes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAttachmentPart_TableDriven(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		attachment AttachmentReturn
+		size       int
+		wantWidth  int
+		wantPart   ContentPart
+		wantErr    error
+	}{
+		{
+			name:       "image as a data URL of the resized variant",
+			file:       "a.png",
+			attachment: AttachmentReturn{Kind: AttachmentKindImage, MimeType: "image/png"},
+			wantWidth:  attachmentImageWidth,
+			wantPart: ContentPart{Type: "image_url", ImageURL: &ImageURL{
+				URL: "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngHeader),
+			}},
+		},
+		{
+			name:       "mp3 audio",
+			file:       "a.mp3",
+			attachment: AttachmentReturn{Kind: AttachmentKindAudio, MimeType: "audio/mpeg"},
+			wantPart: ContentPart{Type: "input_audio", InputAudio: &InputAudio{
+				Data: base64.StdEncoding.EncodeToString(pngHeader), Format: "mp3",
+			}},
+		},
+		{
+			name:       "too large",
+			file:       "big.wav",
+			attachment: AttachmentReturn{Kind: AttachmentKindAudio, MimeType: "audio/wav"},
+			size:       maxAttachmentBytes + 1,
+			wantErr:    ErrInvalidAttachment,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			media := newFakeMediaStore(t)
+			data := pngHeader
+			if tt.size > 0 {
+				data = bytes.Repeat([]byte{0}, tt.size)
+			}
+			tt.attachment.ContentID = media.add(t, tt.file, data)
+			service := newTestService(newFakeChatQuerier())
+			service.media = media
+
+			got, err := service.attachmentPart(context.Background(), tt.attachment)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(media.widths) != 1 || media.widths[0] != tt.wantWidth {
+				t.Errorf("opened widths %v, want [%d]", media.widths, tt.wantWidth)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.wantPart)
+			if !bytes.Equal(gotJSON, wantJSON) {
+				t.Errorf("got part %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestChatMessageMarshalJSON_TableDriven(t *testing.T) {
+	image := ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: "data:image/png;base64,AA=="}}
+	tests := []struct {
+		name    string
+		message ChatMessage
+		want    string
+	}{
+		{
+			name:    "text only",
+			message: ChatMessage{Role: MessageRoleUser, Content: "hi"},
+			want:    `{"role":"user","content":"hi"}`,
+		},
+		{
+			name:    "text and media",
+			message: ChatMessage{Role: MessageRoleUser, Content: "what is this?", Parts: []ContentPart{image}},
+			want:    `{"role":"user","content":[{"type":"text","text":"what is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AA=="}}]}`,
+		},
+		{
+			name:    "media only",
+			message: ChatMessage{Role: MessageRoleUser, Parts: []ContentPart{image}},
+			want:    `{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,AA=="}}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.message)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateMessageWithAttachments(t *testing.T) {
+	user := uuid.New()
+	querier := newFakeChatQuerier()
+	chat := querier.addChat(user)
+	media := newFakeMediaStore(t)
+	imageID := media.add(t, "cell.png", pngHeader)
+	provider := &fakeProvider{deltas: []string{"a cell"}}
+	service := newTestService(querier)
+	service.provider = provider
+	service.media = media
+
+	created, err := service.CreateMessage(userContext(user), chat.ID, "what is this?", uuid.Nil, []uuid.UUID{imageID}, GenerationOptions{})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	querier.waitFinished(t, created.ReplyMessageID)
+
+	if len(created.Message.Attachments) != 1 || created.Message.Attachments[0].ContentID != imageID {
+		t.Errorf("got attachments %+v, want the image", created.Message.Attachments)
+	}
+	if len(querier.attachments) != 1 || querier.attachments[0].MessageID != created.Message.ID {
+		t.Errorf("stored attachments %+v, want one on the prompt", querier.attachments)
+	}
+	body, err := json.Marshal(provider.lastRequest())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !strings.Contains(string(body), `"image_url":{"url":"data:image/png;base64,`) {
+		t.Errorf("the request does not inline the image: %s", body)
+	}
+}
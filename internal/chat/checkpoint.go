@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+const (
+	// streamCheckpointInterval is how often a generation stores its partial content
+	// and shows that its process is alive.
+	streamCheckpointInterval = 3 * time.Second
+	// orphanedStreamAge is how long a generation may go without a checkpoint before
+	// its message is considered abandoned by a process that died.
+	orphanedStreamAge = 30 * time.Second
+)
+
+// orphanedStreamReason is the error reason of messages whose generation was lost.
+const orphanedStreamReason = "The reply was interrupted because the server generating it stopped."
+
+// checkpointStream stores the partial content of a generation every
+// streamCheckpointInterval until ctx is done, so that other replicas can show it and
+// a crash keeps it. The final content is stored by streamProcessor.
+func (s *ChatService) checkpointStream(ctx context.Context, messageID uuid.UUID, stream *StreamEvent) {
+	ticker := time.NewTicker(streamCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			status, content, _ := stream.Get()
+			if status != MessageStatusStreaming {
+				return
+			}
+			err := s.querier.CheckpointMessageStream(ctx, CheckpointMessageStreamParams{
+				MessageID: messageID,
+				Content:   pgtype.Text{String: content, Valid: true},
+			})
+			if err != nil && ctx.Err() == nil {
+				s.logger.Warn("failed to checkpoint stream", zap.String("message_id", messageID.String()), zap.Error(err))
+			}
+		}
+	}
+}
+
+// FailOrphanedStreams marks as failed the streaming messages whose generation has not
+// checkpointed for orphanedStreamAge, keeping their last checkpointed content. It
+// returns how many there were. Ages are measured by the database clock, which the
+// checkpoints are stamped with, so that replica clock skew does not matter.
+func (s *ChatService) FailOrphanedStreams(ctx context.Context) (int, error) {
+	ids, err := s.querier.FailOrphanedMessages(ctx, FailOrphanedMessagesParams{
+		ErrorReason: pgtype.Text{String: orphanedStreamReason, Valid: true},
+		MaxAge:      pgtype.Interval{Microseconds: orphanedStreamAge.Microseconds(), Valid: true},
+	})
+	if err != nil {
+		return 0, databaseutil.WrapDBError(err, s.logger, "fail orphaned streams")
+	}
+	for _, id := range ids {
+		s.logger.Info("marked orphaned stream as failed", zap.String("message_id", id.String()))
+	}
+	return len(ids), nil
+}
+
+// WatchOrphanedStreams runs FailOrphanedStreams at once and then periodically until
+// ctx is done. Generations cut off by a restart are failed at startup, or once they
+// are orphanedStreamAge old when the restart was quicker than that; those of a replica
+// that died are failed by the others.
+func (s *ChatService) WatchOrphanedStreams(ctx context.Context) {
+	ticker := time.NewTicker(orphanedStreamAge / 2)
+	defer ticker.Stop()
+	for {
+		if _, err := s.FailOrphanedStreams(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Warn("failed to sweep orphaned streams", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxExpressionLength bounds the expressions the calculator tool accepts.
+const maxExpressionLength = 1000
+
+var errInvalidExpression = errors.New("invalid expression")
+
+var expressionConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+var expressionFunctions = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"sqrt":  math.Sqrt,
+	"cbrt":  math.Cbrt,
+	"exp":   math.Exp,
+	"ln":    math.Log,
+	"log":   math.Log10,
+	"log2":  math.Log2,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"asin":  math.Asin,
+	"acos":  math.Acos,
+	"atan":  math.Atan,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"round": math.Round,
+}
+
+// evaluateExpression computes an arithmetic expression with + - * / % ^, parentheses,
+// the constants pi and e, and one-argument functions such as sqrt and sin (radians).
+// ^ is right-associative and binds tighter than unary minus, so -2^2 is -4.
+func evaluateExpression(expression string) (float64, error) {
+	if len(expression) > maxExpressionLength {
+		return 0, fmt.Errorf("%w: longer than %d characters", errInvalidExpression, maxExpressionLength)
+	}
+	p := &expressionParser{input: expression}
+	value, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("%w: unexpected %q at %d", errInvalidExpression, p.input[p.pos], p.pos)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%w: the result is not a finite number", errInvalidExpression)
+	}
+	return value, nil
+}
+
+// expressionParser is a recursive-descent parser that evaluates as it parses.
+type expressionParser struct {
+	input string
+	pos   int
+	depth int
+}
+
+// maxExpressionDepth bounds nesting so that hostile input cannot exhaust the stack.
+const maxExpressionDepth = 100
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte, or 0 at the end of the input.
+func (p *expressionParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *expressionParser) parseSum() (float64, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+}
+
+func (p *expressionParser) parseProduct() (float64, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case op == '*':
+			left *= right
+		case right == 0:
+			return 0, fmt.Errorf("%w: division by zero", errInvalidExpression)
+		case op == '/':
+			left /= right
+		default:
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *expressionParser) parseUnary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		value, err := p.parseUnary()
+		return -value, err
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	default:
+		return p.parsePower()
+	}
+}
+
+func (p *expressionParser) parsePower() (float64, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *expressionParser) parsePrimary() (float64, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExpressionDepth {
+		return 0, fmt.Errorf("%w: nested too deeply", errInvalidExpression)
+	}
+
+	c := p.peek()
+	switch {
+	case c == 0:
+		return 0, fmt.Errorf("%w: unexpected end", errInvalidExpression)
+	case c == '(':
+		p.pos++
+		value, err := p.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("%w: missing )", errInvalidExpression)
+		}
+		p.pos++
+		return value, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case isIdentifierByte(c):
+		return p.parseIdentifier()
+	default:
+		return 0, fmt.Errorf("%w: unexpected %q at %d", errInvalidExpression, c, p.pos)
+	}
+}
+
+func (p *expressionParser) parseNumber() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] == '.' || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+		p.pos++
+	}
+	// An exponent such as 1e-3; an e without digits is left unparsed.
+	if p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+		end := p.pos + 1
+		if end < len(p.input) && (p.input[end] == '+' || p.input[end] == '-') {
+			end++
+		}
+		if end < len(p.input) && p.input[end] >= '0' && p.input[end] <= '9' {
+			for end < len(p.input) && p.input[end] >= '0' && p.input[end] <= '9' {
+				end++
+			}
+			p.pos = end
+		}
+	}
+	value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad number %q", errInvalidExpression, p.input[start:p.pos])
+	}
+	return value, nil
+}
+
+func (p *expressionParser) parseIdentifier() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (isIdentifierByte(p.input[p.pos]) || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+		p.pos++
+	}
+	name := strings.ToLower(p.input[start:p.pos])
+	if value, ok := expressionConstants[name]; ok {
+		return value, nil
+	}
+	fn, ok := expressionFunctions[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown name %q", errInvalidExpression, name)
+	}
+	if p.peek() != '(' {
+		return 0, fmt.Errorf("%w: %s needs an argument in parentheses", errInvalidExpression, name)
+	}
+	argument, err := p.parsePrimary()
+	if err != nil {
+		return 0, err
+	}
+	return fn(argument), nil
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
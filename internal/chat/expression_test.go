@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateExpression_TableDriven(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       float64
+		wantErr    bool
+	}{
+		{name: "precedence", expression: "1 + 2 * 3", want: 7},
+		{name: "parentheses", expression: "(1 + 2) * 3", want: 9},
+		{name: "power is right-associative", expression: "2 ^ 3 ^ 2", want: 512},
+		{name: "power binds tighter than unary minus", expression: "-2^2", want: -4},
+		{name: "modulo", expression: "7 % 3", want: 1},
+		{name: "scientific notation", expression: "3.2e-3 * 1000", want: 3.2},
+		{name: "constants and functions", expression: "round(sqrt(16) + cos(pi))", want: 3},
+		{name: "case-insensitive names", expression: "ABS(-2)", want: 2},
+		{name: "repeated unary minus", expression: strings.Repeat("-", 998) + "1", want: 1},
+		{name: "nesting within the limit", expression: strings.Repeat("(", 90) + "1" + strings.Repeat(")", 90), want: 1},
+		{name: "division by zero", expression: "1 / 0", wantErr: true},
+		{name: "division by an expression that is zero", expression: "1 / (2 - 2)", wantErr: true},
+		{name: "modulo by zero", expression: "5 % 0", wantErr: true},
+		{name: "overflow", expression: "10 ^ 400", wantErr: true},
+		{name: "outside a function's domain", expression: "sqrt(-1)", wantErr: true},
+		{name: "nested too deeply", expression: strings.Repeat("(", 200) + "1" + strings.Repeat(")", 200), wantErr: true},
+		{name: "functions nested too deeply", expression: strings.Repeat("abs(", 150) + "1" + strings.Repeat(")", 150), wantErr: true},
+		{name: "too long", expression: "1" + strings.Repeat(" + 1", maxExpressionLength), wantErr: true},
+		{name: "very large input", expression: strings.Repeat("9", 1<<20), wantErr: true},
+		{name: "empty", expression: "", wantErr: true},
+		{name: "unknown name", expression: "foo(1)", wantErr: true},
+		{name: "function without parentheses", expression: "sqrt 4", wantErr: true},
+		{name: "missing closing parenthesis", expression: "(1 + 2", wantErr: true},
+		{name: "trailing input", expression: "1 2", wantErr: true},
+		{name: "bad number", expression: "1.2.3", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evaluateExpression(tt.expression)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidExpression) {
+					t.Fatalf("got %v, %v, want %v", got, err, errInvalidExpression)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("evaluateExpression: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
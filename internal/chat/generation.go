@@ -0,0 +1,95 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var ErrModelNotAllowed = errors.New("model is not allowed")
+
+// Models is the allowlist of LLM models users may pick. Default is used when neither
+// the message nor the chat picks one.
+type Models struct {
+	Default string
+	Allowed []string
+}
+
+// ParseModels parses a comma-separated model allowlist; the first model is the default.
+func ParseModels(spec string) (Models, error) {
+	var models Models
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || slices.Contains(models.Allowed, name) {
+			continue
+		}
+		models.Allowed = append(models.Allowed, name)
+	}
+	if len(models.Allowed) == 0 {
+		return Models{}, fmt.Errorf("%w: the model allowlist is empty", ErrModelNotAllowed)
+	}
+	models.Default = models.Allowed[0]
+	return models, nil
+}
+
+func (m Models) check(model string) error {
+	if model != "" && !slices.Contains(m.Allowed, model) {
+		return fmt.Errorf("%w: %q, choose one of %s", ErrModelNotAllowed, model, strings.Join(m.Allowed, ", "))
+	}
+	return nil
+}
+
+// SetModels replaces the model allowlist.
+func (s *ChatService) SetModels(models Models) {
+	s.models = models
+}
+
+// GenerationOptions are the LLM settings of a chat or of a single reply. Unset fields
+// fall back to the chat's settings, then to the default model and the provider's own
+// defaults.
+type GenerationOptions struct {
+	Model       string   `json:"model,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty" validate:"omitempty,gte=0,lte=2"`
+	MaxTokens   *int32   `json:"maxTokens,omitempty" validate:"omitempty,gte=1,lte=32768"`
+}
+
+// generationOptions resolves the settings of a reply in chat, overridden by options.
+func (s *ChatService) generationOptions(chat Chat, options GenerationOptions) (GenerationOptions, error) {
+	if options.Model == "" && chat.Model.Valid {
+		options.Model = chat.Model.String
+	}
+	if options.Model == "" {
+		options.Model = s.models.Default
+	}
+	if err := s.models.check(options.Model); err != nil {
+		return GenerationOptions{}, err
+	}
+	if options.Temperature == nil && chat.Temperature.Valid {
+		options.Temperature = &chat.Temperature.Float32
+	}
+	if options.MaxTokens == nil && chat.MaxTokens.Valid {
+		options.MaxTokens = &chat.MaxTokens.Int32
+	}
+	return options, nil
+}
+
+func (o GenerationOptions) modelText() pgtype.Text {
+	return pgtype.Text{String: o.Model, Valid: o.Model != ""}
+}
+
+func (o GenerationOptions) temperatureFloat() pgtype.Float4 {
+	if o.Temperature == nil {
+		return pgtype.Float4{}
+	}
+	return pgtype.Float4{Float32: *o.Temperature, Valid: true}
+}
+
+func (o GenerationOptions) maxTokensInt() pgtype.Int4 {
+	if o.MaxTokens == nil {
+		return pgtype.Int4{}
+	}
+	return pgtype.Int4{Int32: *o.MaxTokens, Valid: true}
+}
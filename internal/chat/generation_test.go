@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestGenerationOptions_TableDriven(t *testing.T) {
+	temperature, maxTokens := float32(0.2), int32(256)
+	chat := Chat{
+		Model:       pgtype.Text{String: "chat-model", Valid: true},
+		Temperature: pgtype.Float4{Float32: 0.7, Valid: true},
+	}
+	tests := []struct {
+		name      string
+		chat      Chat
+		options   GenerationOptions
+		wantModel string
+		wantJSON  map[string]bool
+		wantErr   error
+	}{
+		{
+			name:      "nothing set sends only the default model",
+			wantModel: "default-model",
+			wantJSON:  map[string]bool{"model": true, "temperature": false, "max_tokens": false, "tools": false},
+		},
+		{
+			name:      "chat settings",
+			chat:      chat,
+			wantModel: "chat-model",
+			wantJSON:  map[string]bool{"model": true, "temperature": true, "max_tokens": false},
+		},
+		{
+			name:      "message settings override the chat",
+			chat:      chat,
+			options:   GenerationOptions{Model: "default-model", Temperature: &temperature, MaxTokens: &maxTokens},
+			wantModel: "default-model",
+			wantJSON:  map[string]bool{"model": true, "temperature": true, "max_tokens": true},
+		},
+		{
+			name:    "model outside the allowlist",
+			options: GenerationOptions{Model: "other-model"},
+			wantErr: ErrModelNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(newFakeChatQuerier())
+			service.SetModels(Models{Default: "default-model", Allowed: []string{"default-model", "chat-model"}})
+
+			options, err := service.generationOptions(tt.chat, tt.options)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if options.Model != tt.wantModel {
+				t.Errorf("got model %q, want %q", options.Model, tt.wantModel)
+			}
+
+			body, err := json.Marshal(CreateChatCompletionRequest{
+				Model:       options.Model,
+				Stream:      true,
+				Temperature: options.Temperature,
+				MaxTokens:   options.MaxTokens,
+			})
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(body, &fields); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			for field, want := range tt.wantJSON {
+				if _, got := fields[field]; got != want {
+					t.Errorf("%s sent: %t, want %t in %s", field, got, want, body)
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package chat
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
 	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
 	logutil "github.com/NYCU-SDC/summer/pkg/log"
 	problemutil "github.com/NYCU-SDC/summer/pkg/problem"
@@ -16,11 +21,24 @@ import (
 )
 
 type Store interface {
-	CreateChat(ctx context.Context) (uuid.UUID, error)
+	CreateChat(ctx context.Context, personaID uuid.UUID, questionID uuid.UUID, options GenerationOptions) (uuid.UUID, error)
 	GetChat(ctx context.Context, chatID uuid.UUID) ([]MessageReturn, error)
-	CreateMessage(ctx context.Context, chatID uuid.UUID, content string, previousID uuid.UUID) (CreateMessageReturn, error)
-	Stream(ctx context.Context, messageID uuid.UUID) (bool, <-chan StreamDelta, <-chan error, func())
+	CreateMessage(ctx context.Context, chatID uuid.UUID, content string, previousID uuid.UUID, attachmentIDs []uuid.UUID, options GenerationOptions) (CreateMessageReturn, error)
+	Stream(ctx context.Context, messageID uuid.UUID, offset int) (bool, <-chan StreamDelta, <-chan error, func())
 	ValidatePreviousID(ctx context.Context, previousID uuid.UUID, chatID uuid.UUID) error
+	GetChatTree(ctx context.Context, chatID uuid.UUID) (ChatTree, error)
+	GetChatPath(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID) ([]MessageReturn, error)
+	SetCurrentLeaf(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID) ([]MessageReturn, error)
+	RegenerateMessage(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID, options GenerationOptions) (CreateMessageReturn, error)
+	EditMessage(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID, content string, attachmentIDs []uuid.UUID, options GenerationOptions) (CreateMessageReturn, error)
+	CancelStream(ctx context.Context, messageID uuid.UUID) error
+	ListChats(ctx context.Context, page, pageSize int32) (ChatPage, error)
+	AuthorizeMessage(ctx context.Context, messageID uuid.UUID) error
+	ListPersonas(ctx context.Context) ([]PersonaReturn, error)
+	GetPersona(ctx context.Context, personaID uuid.UUID) (PersonaReturn, error)
+	CreatePersona(ctx context.Context, input PersonaInput) (PersonaReturn, error)
+	UpdatePersona(ctx context.Context, personaID uuid.UUID, input PersonaInput) (PersonaReturn, error)
+	DeletePersona(ctx context.Context, personaID uuid.UUID) error
 }
 
 type Handler struct {
@@ -30,13 +48,53 @@ type Handler struct {
 	validator     *validator.Validate
 }
 
+type CreateChatRequest struct {
+	PersonaID uuid.UUID `json:"personaID,omitempty"`
+	// QuestionID binds the chat to the question the student is working on.
+	QuestionID uuid.UUID `json:"questionID,omitempty"`
+	GenerationOptions
+}
+
+type PersonaRequest struct {
+	Name         string `json:"name" validate:"required,max=100"`
+	Description  string `json:"description" validate:"max=500"`
+	SystemPrompt string `json:"systemPrompt" validate:"required,max=8000"`
+}
+
 type CreateMessageRequest struct {
 	Content    string    `json:"content" validate:"required"`
 	PreviousID uuid.UUID `json:"previousID,omitempty"`
+	// Attachments are IDs of uploaded media contents, images or wav/mp3 audio.
+	Attachments []uuid.UUID `json:"attachments,omitempty" validate:"max=4,dive,required"`
+	GenerationOptions
+}
+
+type EditMessageRequest struct {
+	Content     string      `json:"content" validate:"required"`
+	Attachments []uuid.UUID `json:"attachments,omitempty" validate:"max=4,dive,required"`
+	GenerationOptions
+}
+
+type RegenerateMessageRequest struct {
+	GenerationOptions
+}
+
+type SetCurrentLeafRequest struct {
+	MessageID uuid.UUID `json:"messageID" validate:"required"`
 }
 
 type bodyParseError struct{ err error }
 
+// errInvalidPagination marks page or pageSize query values that are not positive integers.
+var errInvalidPagination = errors.New("page and pageSize must be positive integers")
+
+// errBodyTooLarge marks request bodies longer than maxOptionalBodyBytes.
+var errBodyTooLarge = errors.New("request body is too large")
+
+// maxOptionalBodyBytes bounds the bodies read by parseOptionalBody, which only carry
+// generation settings and IDs.
+const maxOptionalBodyBytes = 64 << 10
+
 func (e bodyParseError) Error() string { return e.err.Error() }
 func (e bodyParseError) Unwrap() error { return e.err }
 
@@ -44,10 +102,32 @@ func NewHandler(store Store, logger *zap.Logger) *Handler {
 	return &Handler{
 		logger: logger,
 		problemWriter: problemutil.NewWithMapping(func(err error) problemutil.Problem {
+			if errors.Is(err, errBodyTooLarge) {
+				return problemutil.Problem{
+					Title:  "Payload Too Large",
+					Status: http.StatusRequestEntityTooLarge,
+					Type:   "https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/413",
+					Detail: err.Error(),
+				}
+			}
 			var bpe bodyParseError
 			if errors.As(err, &bpe) {
 				return problemutil.NewBadRequestProblem(bpe.Error())
 			}
+			if errors.Is(err, errInvalidPagination) {
+				return problemutil.NewBadRequestProblem(err.Error())
+			}
+			if errors.Is(err, ErrInvalidBranch) || errors.Is(err, ErrModelNotAllowed) || errors.Is(err, ErrInvalidAttachment) {
+				return problemutil.NewBadRequestProblem(err.Error())
+			}
+			if errors.Is(err, databaseutil.ErrUniqueViolation) {
+				return problemutil.Problem{
+					Title:  "Conflict",
+					Status: http.StatusConflict,
+					Type:   "https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/409",
+					Detail: "a persona with this name already exists",
+				}
+			}
 			return problemutil.Problem{}
 		}),
 		store:     store,
@@ -59,7 +139,14 @@ func (h *Handler) CreateChat(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
 
-	chatID, err := h.store.CreateChat(ctx)
+	// An empty body creates a chat without a persona or question, using the default settings.
+	var req CreateChatRequest
+	if err := h.parseOptionalBody(ctx, w, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, bodyParseError{err}, logger)
+		return
+	}
+
+	chatID, err := h.store.CreateChat(ctx, req.PersonaID, req.QuestionID, req.GenerationOptions)
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
@@ -67,6 +154,26 @@ func (h *Handler) CreateChat(w http.ResponseWriter, r *http.Request) {
 	handlerutil.WriteJSONResponse(w, http.StatusCreated, map[string]uuid.UUID{"chatID": chatID})
 }
 
+// ListChats returns the caller's chats, most recently active first.
+func (h *Handler) ListChats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	page, pageSize, err := parsePaginationParams(r)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	chats, err := h.store.ListChats(ctx, page, pageSize)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, chats)
+}
+
 func (h *Handler) GetChat(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
@@ -93,6 +200,82 @@ func (h *Handler) GetChat(w http.ResponseWriter, r *http.Request) {
 	handlerutil.WriteJSONResponse(w, status, map[string][]MessageReturn{"messages": messages})
 }
 
+func (h *Handler) GetChatTree(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	chatID, err := handlerutil.ParseUUID(r.PathValue("chatID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	tree, err := h.store.GetChatTree(ctx, chatID)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, tree)
+}
+
+// GetChatPath returns the branch through messageID, down to its newest leaf.
+func (h *Handler) GetChatPath(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	chatID, err := handlerutil.ParseUUID(r.PathValue("chatID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+	messageID, err := handlerutil.ParseUUID(r.PathValue("messageID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	messages, err := h.store.GetChatPath(ctx, chatID, messageID)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+	if messages == nil {
+		messages = []MessageReturn{}
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, map[string][]MessageReturn{"messages": messages})
+}
+
+// SetCurrentLeaf switches the chat to another branch and returns that branch.
+func (h *Handler) SetCurrentLeaf(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	chatID, err := handlerutil.ParseUUID(r.PathValue("chatID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	var req SetCurrentLeafRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, bodyParseError{err}, logger)
+		return
+	}
+
+	messages, err := h.store.SetCurrentLeaf(ctx, chatID, req.MessageID)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+	if messages == nil {
+		messages = []MessageReturn{}
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, map[string][]MessageReturn{"messages": messages})
+}
+
 func (h *Handler) CreateMessage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
@@ -115,7 +298,71 @@ func (h *Handler) CreateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	message, err := h.store.CreateMessage(ctx, chatID, req.Content, req.PreviousID)
+	message, err := h.store.CreateMessage(ctx, chatID, req.Content, req.PreviousID, req.Attachments, req.GenerationOptions)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusCreated, message)
+}
+
+// RegenerateMessage streams a new answer to the prompt behind messageID as a sibling
+// of the previous answers.
+func (h *Handler) RegenerateMessage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	chatID, err := handlerutil.ParseUUID(r.PathValue("chatID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+	messageID, err := handlerutil.ParseUUID(r.PathValue("messageID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	var req RegenerateMessageRequest
+	if err := h.parseOptionalBody(ctx, w, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, bodyParseError{err}, logger)
+		return
+	}
+
+	message, err := h.store.RegenerateMessage(ctx, chatID, messageID, req.GenerationOptions)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusCreated, message)
+}
+
+// EditMessage creates an edited copy of a user prompt as a new branch and streams
+// the reply to it.
+func (h *Handler) EditMessage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	chatID, err := handlerutil.ParseUUID(r.PathValue("chatID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+	messageID, err := handlerutil.ParseUUID(r.PathValue("messageID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	var req EditMessageRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, bodyParseError{err}, logger)
+		return
+	}
+
+	message, err := h.store.EditMessage(ctx, chatID, messageID, req.Content, req.Attachments, req.GenerationOptions)
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
@@ -134,7 +381,19 @@ func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ok, chunks, errs, cleanup := h.store.Stream(ctx, messageID)
+	if err := h.store.AuthorizeMessage(ctx, messageID); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	// Event IDs are content offsets, so a reconnecting client resumes after the last
+	// event it got instead of receiving the whole content again.
+	offset, err := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	ok, chunks, errs, cleanup := h.store.Stream(ctx, messageID, offset)
 	if !ok {
 		h.problemWriter.WriteError(ctx, w, handlerutil.NewNotFoundError("stream", "messageID", messageID.String(), ""), logger)
 		return
@@ -162,7 +421,14 @@ func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
 				errs = nil
 				continue
 			}
-			h.problemWriter.WriteError(ctx, w, err, logger)
+			// The response has started, so the failure goes out as an error event.
+			problem := NewStreamProblem(err)
+			logger.Info("stream ended with an error", zap.String("message_id", messageID.String()),
+				zap.Int("status", problem.Status), zap.Error(err))
+			if err := writeSSEEvent(w, flusher, offset, sseEventError, problem); err != nil {
+				logger.Warn("failed to write stream error", zap.Error(err))
+			}
+			cleanup()
 			return
 		case chunk, ok := <-chunks:
 			if !ok {
@@ -170,8 +436,14 @@ func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			if err := writeSSEData(w, flusher, chunk); err != nil {
-				h.problemWriter.WriteError(ctx, w, err, logger)
+			event := sseEventDelta
+			if chunk.IsFinished {
+				event = sseEventDone
+			}
+			offset = chunk.Offset
+			if err := writeSSEEvent(w, flusher, chunk.Offset, event, chunk); err != nil {
+				logger.Warn("failed to write stream event", zap.String("message_id", messageID.String()), zap.Error(err))
+				cleanup()
 				return
 			}
 			if chunk.IsFinished {
@@ -180,22 +452,189 @@ func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+}
+
+// CancelStream stops the generation streaming into messageID. Subscribers receive a
+// final event with status "cancelled".
+func (h *Handler) CancelStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
 
+	messageID, err := handlerutil.ParseUUID(r.PathValue("messageID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	if err := h.store.CancelStream(ctx, messageID); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusAccepted, map[string]any{
+		"messageID": messageID,
+		"status":    MessageStatusCancelled,
+	})
 }
 
-func writeSSEData(w http.ResponseWriter, flusher http.Flusher, chunk StreamDelta) error {
-	b, err := json.Marshal(chunk)
+func (h *Handler) ListPersonas(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	personas, err := h.store.ListPersonas(ctx)
 	if err != nil {
-		return err
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, map[string][]PersonaReturn{"personas": personas})
+}
+
+func (h *Handler) GetPersona(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	personaID, err := handlerutil.ParseUUID(r.PathValue("personaID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	persona, err := h.store.GetPersona(ctx, personaID)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, persona)
+}
+
+// CreatePersona adds a tutor persona. Only admins may call it.
+func (h *Handler) CreatePersona(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	var req PersonaRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, bodyParseError{err}, logger)
+		return
+	}
+
+	persona, err := h.store.CreatePersona(ctx, req.toInput())
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusCreated, persona)
+}
+
+// UpdatePersona replaces a tutor persona. Only admins may call it.
+func (h *Handler) UpdatePersona(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	personaID, err := handlerutil.ParseUUID(r.PathValue("personaID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
 	}
-	// SSE format: data: <json>\n\n
-	if _, err := w.Write([]byte("data: ")); err != nil {
+
+	var req PersonaRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, bodyParseError{err}, logger)
+		return
+	}
+
+	persona, err := h.store.UpdatePersona(ctx, personaID, req.toInput())
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, persona)
+}
+
+// DeletePersona removes a tutor persona. Only admins may call it.
+func (h *Handler) DeletePersona(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	personaID, err := handlerutil.ParseUUID(r.PathValue("personaID"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	if err := h.store.DeletePersona(ctx, personaID); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (req PersonaRequest) toInput() PersonaInput {
+	return PersonaInput{
+		Name:         strings.TrimSpace(req.Name),
+		Description:  strings.TrimSpace(req.Description),
+		SystemPrompt: strings.TrimSpace(req.SystemPrompt),
+	}
+}
+
+// parseOptionalBody is ParseAndValidateRequestBody for endpoints whose body may be
+// left out entirely. Bodies longer than maxOptionalBodyBytes are refused.
+func (h *Handler) parseOptionalBody(ctx context.Context, w http.ResponseWriter, r *http.Request, dst any) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOptionalBodyBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return fmt.Errorf("%w: maximum size is %d bytes", errBodyTooLarge, maxOptionalBodyBytes)
+		}
 		return err
 	}
-	if _, err := w.Write(b); err != nil {
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, dst); err != nil {
+			return err
+		}
+	}
+	return h.validator.StructCtx(ctx, dst)
+}
+
+// parsePaginationParams reads the optional page and pageSize queries; zero means the
+// service default.
+func parsePaginationParams(r *http.Request) (int32, int32, error) {
+	var values [2]int32
+	for i, key := range []string{"page", "pageSize"} {
+		raw := r.URL.Query().Get(key)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil || parsed < 1 {
+			return 0, 0, fmt.Errorf("%w: invalid %s query", errInvalidPagination, key)
+		}
+		values[i] = int32(parsed)
+	}
+	return values[0], values[1], nil
+}
+
+// SSE event names.
+const (
+	sseEventDelta = "delta"
+	sseEventDone  = "done"
+	sseEventError = "error"
+)
+
+// writeSSEEvent writes a named SSE event with data as JSON, using the content offset
+// reached as the event ID.
+func writeSSEEvent(w http.ResponseWriter, flusher http.Flusher, offset int, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte("\n\n")); err != nil {
+	// SSE format: id: <offset>\nevent: <name>\ndata: <json>\n\n
+	if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", offset, event, b); err != nil {
 		return err
 	}
 	flusher.Flush()
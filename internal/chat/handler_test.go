@@ -0,0 +1,317 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// fakeStore records the chats created and serves a stream from a script of deltas
+// and a failure. Methods a test does not expect are left to the embedded nil Store,
+// so they fail loudly.
+type fakeStore struct {
+	Store
+
+	authorizeErr error
+	// missing reports that the message is not being generated.
+	missing bool
+	deltas  []StreamDelta
+	err     error
+
+	// offset is the offset Stream was called with.
+	offset int
+	// unsubscribed reports that the handler released the stream.
+	unsubscribed bool
+	// createChatOptions are the settings of the chats created.
+	createChatOptions []GenerationOptions
+}
+
+func (f *fakeStore) CreateChat(_ context.Context, _ uuid.UUID, _ uuid.UUID, options GenerationOptions) (uuid.UUID, error) {
+	f.createChatOptions = append(f.createChatOptions, options)
+	return uuid.New(), nil
+}
+
+func (f *fakeStore) AuthorizeMessage(context.Context, uuid.UUID) error {
+	return f.authorizeErr
+}
+
+func (f *fakeStore) Stream(_ context.Context, _ uuid.UUID, offset int) (bool, <-chan StreamDelta, <-chan error, func()) {
+	f.offset = offset
+	if f.missing {
+		return false, nil, nil, func() {}
+	}
+	// Like StreamEvent.Subscribe, the failure follows every delta.
+	ch := make(chan StreamDelta)
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for _, delta := range f.deltas {
+			select {
+			case ch <- delta:
+			case <-done:
+				return
+			}
+		}
+		if f.err != nil {
+			errCh <- f.err
+		}
+	}()
+	return true, ch, errCh, func() {
+		f.unsubscribed = true
+		close(done)
+	}
+}
+
+// sseEvent is an event of a text/event-stream response.
+type sseEvent struct {
+	id, event, data string
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		if block == "" {
+			continue
+		}
+		var event sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			field, value, ok := strings.Cut(line, ": ")
+			if !ok {
+				t.Fatalf("malformed SSE line %q", line)
+			}
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				event.data = value
+			default:
+				t.Fatalf("unexpected SSE field %q", field)
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestHandlerStream_TableDriven(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastEventID string
+		store       fakeStore
+		wantStatus  int
+		wantOffset  int
+		// wantEvents are the IDs and names of the events, and part of their data.
+		wantEvents []sseEvent
+	}{
+		{
+			name: "deltas numbered by content offset",
+			store: fakeStore{deltas: []StreamDelta{
+				{Delta: "Hello", Offset: 5},
+				{Delta: ", 世界", Offset: 13},
+				{IsFinished: true, Status: MessageStatusDone, Offset: 13},
+			}},
+			wantStatus: http.StatusOK,
+			wantEvents: []sseEvent{
+				{id: "5", event: sseEventDelta, data: `"delta":"Hello"`},
+				{id: "13", event: sseEventDelta, data: `"delta":", 世界"`},
+				{id: "13", event: sseEventDone, data: `"status":"completed"`},
+			},
+		},
+		{
+			name:        "resuming from Last-Event-ID",
+			lastEventID: "5",
+			store: fakeStore{deltas: []StreamDelta{
+				{Delta: " world", Offset: 11},
+				{IsFinished: true, Status: MessageStatusCancelled, Offset: 11},
+			}},
+			wantStatus: http.StatusOK,
+			wantOffset: 5,
+			wantEvents: []sseEvent{
+				{id: "11", event: sseEventDelta, data: `"delta":" world"`},
+				{id: "11", event: sseEventDone, data: `"status":"cancelled"`},
+			},
+		},
+		{
+			name:        "malformed Last-Event-ID starts over",
+			lastEventID: "abc",
+			store:       fakeStore{deltas: []StreamDelta{{IsFinished: true, Status: MessageStatusDone}}},
+			wantStatus:  http.StatusOK,
+			wantEvents:  []sseEvent{{id: "0", event: sseEventDone, data: `"isFinished":true`}},
+		},
+		{
+			name:        "negative Last-Event-ID starts over",
+			lastEventID: "-3",
+			store:       fakeStore{deltas: []StreamDelta{{IsFinished: true, Status: MessageStatusDone}}},
+			wantStatus:  http.StatusOK,
+			wantEvents:  []sseEvent{{id: "0", event: sseEventDone, data: `"isFinished":true`}},
+		},
+		{
+			name: "failure as an error event at the offset reached",
+			store: fakeStore{
+				deltas: []StreamDelta{{Delta: "Hi", Offset: 2}},
+				err:    &UpstreamError{StatusCode: http.StatusServiceUnavailable},
+			},
+			wantStatus: http.StatusOK,
+			wantEvents: []sseEvent{
+				{id: "2", event: sseEventDelta, data: `"delta":"Hi"`},
+				{id: "2", event: sseEventError, data: `"status":502`},
+			},
+		},
+		{
+			name:       "lagging subscriber",
+			store:      fakeStore{err: ErrSubscriberLagging},
+			wantStatus: http.StatusOK,
+			wantEvents: []sseEvent{{id: "0", event: sseEventError, data: `"retryable":true`}},
+		},
+		{
+			name:       "message not being generated",
+			store:      fakeStore{missing: true},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "message of another user",
+			store:      fakeStore{authorizeErr: handlerutil.ErrForbidden},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := tt.store
+			handler := NewHandler(&store, zap.NewNop())
+			r := httptest.NewRequest(http.MethodGet, "/api/messages/stream", nil)
+			r.SetPathValue("messageID", uuid.New().String())
+			if tt.lastEventID != "" {
+				r.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			w := httptest.NewRecorder()
+
+			handler.Stream(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("got content type %q", got)
+			}
+			if store.offset != tt.wantOffset {
+				t.Errorf("streamed from offset %d, want %d", store.offset, tt.wantOffset)
+			}
+
+			events := parseSSE(t, w.Body.String())
+			if len(events) != len(tt.wantEvents) {
+				t.Fatalf("got events %+v, want %+v", events, tt.wantEvents)
+			}
+			for i, want := range tt.wantEvents {
+				got := events[i]
+				if got.id != want.id || got.event != want.event {
+					t.Errorf("event %d: got id %s named %q, want id %s named %q", i, got.id, got.event, want.id, want.event)
+				}
+				if !json.Valid([]byte(got.data)) || !strings.Contains(got.data, want.data) {
+					t.Errorf("event %d: got data %s, want it to contain %s", i, got.data, want.data)
+				}
+			}
+		})
+	}
+}
+
+// failingWriter is a streaming response whose client went away: every write of the
+// body fails.
+type failingWriter struct {
+	header http.Header
+}
+
+func (w *failingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func (w *failingWriter) WriteHeader(int) {}
+
+func (w *failingWriter) Flush() {}
+
+func TestHandlerStreamWriteFailure_TableDriven(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas []StreamDelta
+	}{
+		{name: "delta event", deltas: []StreamDelta{{Delta: "Hello", Offset: 5}, {IsFinished: true, Status: MessageStatusDone, Offset: 5}}},
+		{name: "done event", deltas: []StreamDelta{{IsFinished: true, Status: MessageStatusDone}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{deltas: tt.deltas}
+			handler := NewHandler(store, zap.NewNop())
+			r := httptest.NewRequest(http.MethodGet, "/api/messages/stream", nil)
+			r.SetPathValue("messageID", uuid.New().String())
+
+			handler.Stream(&failingWriter{header: http.Header{}}, r)
+
+			if !store.unsubscribed {
+				t.Error("the handler returned without releasing the stream")
+			}
+		})
+	}
+}
+
+func TestHandlerCreateChatBody_TableDriven(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantOptions GenerationOptions
+	}{
+		{name: "no body", wantStatus: http.StatusCreated},
+		{name: "settings", body: `{"model": "tutor-large"}`, wantStatus: http.StatusCreated, wantOptions: GenerationOptions{Model: "tutor-large"}},
+		{name: "malformed body", body: `{"model":`, wantStatus: http.StatusBadRequest},
+		{name: "invalid settings", body: `{"maxTokens": 0}`, wantStatus: http.StatusBadRequest},
+		{
+			name:       "body over the limit",
+			body:       `{"model": "` + strings.Repeat("a", maxOptionalBodyBytes) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{}
+			handler := NewHandler(store, zap.NewNop())
+			r := httptest.NewRequest(http.MethodPost, "/api/chats", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			handler.CreateChat(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusCreated {
+				if len(store.createChatOptions) != 0 {
+					t.Error("created a chat from a refused body")
+				}
+				return
+			}
+			if len(store.createChatOptions) != 1 || store.createChatOptions[0] != tt.wantOptions {
+				t.Errorf("got chats created with %+v, want %+v", store.createChatOptions, tt.wantOptions)
+			}
+		})
+	}
+}
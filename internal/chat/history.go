@@ -0,0 +1,329 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultContextBudget is the prompt budget, in tokens, of models without one of their own.
+	defaultContextBudget = 16000
+	// defaultModelKey names the budget of models that are not listed.
+	defaultModelKey = "default"
+	// messageOverheadTokens approximates the role and framing tokens of each message.
+	messageOverheadTokens = 4
+	// summaryTimeout bounds one summarization request.
+	summaryTimeout = 30 * time.Second
+	summaryPrefix  = "Summary of the earlier conversation:\n"
+)
+
+const summaryInstruction = "You summarize tutoring conversations for the tutor's own memory. " +
+	"Keep the student's goals, what they already understood, their misconceptions, and any " +
+	"answers or hints already given. Write plain prose in the conversation's language, at most %d words."
+
+var errInvalidContextBudget = errors.New("invalid context budget")
+
+// ContextBudgets holds the prompt token budget of each model. Models that are not
+// listed get Default.
+type ContextBudgets struct {
+	Default int
+	Models  map[string]int
+}
+
+// ParseContextBudgets parses a comma-separated list of model=tokens pairs such as
+// "default=16000,gpt-4o=120000".
+func ParseContextBudgets(spec string) (ContextBudgets, error) {
+	budgets := ContextBudgets{Default: defaultContextBudget, Models: map[string]int{}}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return ContextBudgets{}, fmt.Errorf("%w: %q is not model=tokens", errInvalidContextBudget, part)
+		}
+		tokens, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || tokens <= 0 {
+			return ContextBudgets{}, fmt.Errorf("%w: %s: %q is not a positive token count", errInvalidContextBudget, key, value)
+		}
+		if key == defaultModelKey {
+			budgets.Default = tokens
+		} else {
+			budgets.Models[key] = tokens
+		}
+	}
+	return budgets, nil
+}
+
+func (b ContextBudgets) forModel(model string) int {
+	if tokens, ok := b.Models[model]; ok {
+		return tokens
+	}
+	return b.Default
+}
+
+// SetContextBudgets replaces the prompt token budgets used to build LLM requests.
+func (s *ChatService) SetContextBudgets(budgets ContextBudgets) {
+	s.contextBudgets = budgets
+}
+
+// buildHistory fits the branch ending at the prompt into a token budget. The system
+// messages and the newest turns are always sent verbatim; older turns are replaced by
+// a summary, or dropped when no summary can be made.
+func (s *ChatService) buildHistory(ctx context.Context, system []ChatMessage, path []MessageReturn, budget int) []ChatMessage {
+	history := append([]ChatMessage{}, system...)
+	available := budget - countTokens(system)
+	pathTokens := 0
+	for _, msg := range path {
+		pathTokens += returnTokens(msg)
+	}
+	if pathTokens <= available {
+		return append(history, s.chatMessages(ctx, path)...)
+	}
+
+	summaryBudget := summaryTokens(budget)
+	cut := keepFrom(path, available-summaryBudget-messageOverheadTokens)
+	if summary := s.summaryOf(ctx, path[:cut], budget, summaryBudget); summary != "" {
+		history = append(history, ChatMessage{Role: MessageRoleSystem, Content: summaryPrefix + summary})
+	}
+	return append(history, s.chatMessages(ctx, path[cut:])...)
+}
+
+// keepFrom returns the index of the oldest message of the longest suffix of path that
+// fits in available tokens. The last message, the prompt, is always kept, and the
+// suffix never starts with tool results cut off from the call they answer.
+func keepFrom(path []MessageReturn, available int) int {
+	used := 0
+	for i := len(path) - 1; i >= 0; i-- {
+		used += returnTokens(path[i])
+		if used > available && i < len(path)-1 {
+			cut := i + 1
+			for cut < len(path)-1 && path[cut].Role == MessageRoleTool {
+				cut++
+			}
+			return cut
+		}
+	}
+	return 0
+}
+
+// summaryOf returns a summary of dropped, the oldest turns of a branch. Summaries are
+// cached on the last message they cover, so each turn only summarizes the messages
+// dropped since the newest cached summary on the branch. Failures fall back to that
+// older summary, or to none.
+func (s *ChatService) summaryOf(ctx context.Context, dropped []MessageReturn, budget, summaryBudget int) string {
+	if len(dropped) == 0 {
+		return ""
+	}
+
+	ids := make([]uuid.UUID, 0, len(dropped))
+	for _, msg := range dropped {
+		ids = append(ids, msg.ID)
+	}
+	cached := map[uuid.UUID]string{}
+	rows, err := s.querier.GetMessageSummaries(ctx, ids)
+	if err != nil {
+		s.logger.Warn("failed to load message summaries", zap.Error(err))
+	}
+	for _, row := range rows {
+		cached[row.MessageID] = row.Content
+	}
+
+	start, summary := 0, ""
+	for i := len(dropped) - 1; i >= 0; i-- {
+		if content, ok := cached[dropped[i].ID]; ok {
+			start, summary = i+1, content
+			break
+		}
+	}
+
+	// Summarize in chunks so that no summarization request outgrows the budget itself.
+	chunkBudget := budget/2 - summaryBudget
+	for start < len(dropped) {
+		end := start + 1
+		used := returnTokens(dropped[start])
+		for end < len(dropped) && used+returnTokens(dropped[end]) <= chunkBudget {
+			used += returnTokens(dropped[end])
+			end++
+		}
+
+		next, err := s.summarize(ctx, summary, dropped[start:end], summaryBudget)
+		if err != nil {
+			s.logger.Warn("failed to summarize conversation",
+				zap.String("message_id", dropped[end-1].ID.String()), zap.Error(err))
+			return summary
+		}
+		summary = next
+
+		err = s.querier.UpsertMessageSummary(ctx, UpsertMessageSummaryParams{
+			MessageID: dropped[end-1].ID,
+			Content:   summary,
+		})
+		if err != nil {
+			s.logger.Warn("failed to cache message summary",
+				zap.String("message_id", dropped[end-1].ID.String()), zap.Error(err))
+		}
+		start = end
+	}
+	return summary
+}
+
+// summarize asks the LLM to fold messages into the previous summary.
+func (s *ChatService) summarize(ctx context.Context, previous string, messages []MessageReturn, maxTokens int) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, summaryTimeout)
+	defer cancel()
+
+	var transcript strings.Builder
+	if previous != "" {
+		transcript.WriteString("Summary so far:\n")
+		transcript.WriteString(previous)
+		transcript.WriteString("\n\nConversation since then:\n")
+	}
+	for _, msg := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+		for _, attachment := range msg.Attachments {
+			fmt.Fprintf(&transcript, "(attached %s)\n", attachment.Kind)
+		}
+		for _, call := range msg.ToolCalls {
+			fmt.Fprintf(&transcript, "(called %s with %s)\n", call.Function.Name, call.Function.Arguments)
+		}
+	}
+
+	llmCh, errCh := s.provider.Stream(ctx, CreateChatCompletionRequest{
+		Messages: []ChatMessage{
+			// A word is often more than one token; ask for fewer words so the result fits.
+			{Role: MessageRoleSystem, Content: fmt.Sprintf(summaryInstruction, maxTokens/2)},
+			{Role: MessageRoleUser, Content: transcript.String()},
+		},
+		Stream: true,
+	})
+
+	var summary strings.Builder
+	for llmCh != nil || errCh != nil {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			return "", err
+		case chunk, ok := <-llmCh:
+			if !ok {
+				llmCh = nil
+				continue
+			}
+			summary.WriteString(chunk.Delta)
+		}
+	}
+
+	result := truncateTokens(strings.TrimSpace(summary.String()), maxTokens)
+	if result == "" {
+		return "", errors.New("empty summary")
+	}
+	return result, nil
+}
+
+// summaryTokens is how much of a budget a summary may take.
+func summaryTokens(budget int) int {
+	return min(budget/5, 1024)
+}
+
+// chatMessages turns a branch into LLM messages with their attachments inlined. An
+// attachment that cannot be loaded any more is left out. A reply that used tools
+// repeats the text stored with its tool calls, so that text is only sent once.
+func (s *ChatService) chatMessages(ctx context.Context, path []MessageReturn) []ChatMessage {
+	messages := make([]ChatMessage, 0, len(path))
+	toolText := ""
+	for _, msg := range path {
+		message := ChatMessage{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			ToolCalls:  msg.ToolCalls,
+			ToolCallID: msg.ToolCallID,
+		}
+		switch {
+		case msg.Role == MessageRoleUser:
+			toolText = ""
+		case msg.Role == MessageRoleAssistant && len(msg.ToolCalls) > 0:
+			toolText += msg.Content
+		case msg.Role == MessageRoleAssistant:
+			message.Content = strings.TrimPrefix(msg.Content, toolText)
+			toolText = ""
+		}
+		for _, attachment := range msg.Attachments {
+			part, err := s.attachmentPart(ctx, attachment)
+			if err != nil {
+				s.logger.Warn("failed to load attachment", zap.String("message_id", msg.ID.String()),
+					zap.String("content_id", attachment.ContentID.String()), zap.Error(err))
+				continue
+			}
+			message.Parts = append(message.Parts, part)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func countTokens(messages []ChatMessage) int {
+	total := 0
+	for _, msg := range messages {
+		total += messageTokens(msg.Content)
+	}
+	return total
+}
+
+// returnTokens estimates a stored message, counting each attachment at a flat rate.
+func returnTokens(msg MessageReturn) int {
+	tokens := messageTokens(msg.Content) + len(msg.Attachments)*attachmentTokens
+	for _, call := range msg.ToolCalls {
+		tokens += estimateTokens(call.Function.Name) + estimateTokens(call.Function.Arguments)
+	}
+	return tokens
+}
+
+func messageTokens(content string) int {
+	return estimateTokens(content) + messageOverheadTokens
+}
+
+// estimateTokens approximates a tokenizer without depending on one: about four
+// characters per token for ASCII text and a token per character otherwise, which
+// holds up for CJK and errs high for accented Latin text.
+func estimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// truncateTokens cuts text to at most maxTokens estimated tokens.
+func truncateTokens(text string, maxTokens int) string {
+	ascii, other := 0, 0
+	for i, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+		if (ascii+3)/4+other > maxTokens {
+			return strings.TrimSpace(text[:i]) + "…"
+		}
+	}
+	return text
+}
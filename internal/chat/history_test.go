@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestEstimateTokens_TableDriven(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{name: "empty", text: "", want: 0},
+		{name: "one ascii token", text: "abcd", want: 1},
+		{name: "partial ascii token rounds up", text: "abcde", want: 2},
+		{name: "cjk counts per character", text: "光合作用", want: 4},
+		{name: "mixed", text: "ATP 是能量", want: 1 + 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateTokens(tt.text); got != tt.want {
+				t.Errorf("got %d tokens, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateTokens_TableDriven(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxTokens int
+		want      string
+	}{
+		{name: "fits", text: "abcdefgh", maxTokens: 2, want: "abcdefgh"},
+		{name: "ascii is cut", text: "abcd efgh ijkl", maxTokens: 2, want: "abcd efg…"},
+		{name: "cjk is cut on a character", text: "光合作用", maxTokens: 2, want: "光合…"},
+		{name: "nothing fits", text: "光合", maxTokens: 0, want: "…"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateTokens(tt.text, tt.maxTokens)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if trimmed := strings.TrimSuffix(got, "…"); estimateTokens(trimmed) > tt.maxTokens {
+				t.Errorf("%q is over %d tokens", trimmed, tt.maxTokens)
+			}
+		})
+	}
+}
+
+func TestParseContextBudgets_TableDriven(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        string
+		wantDefault int
+		wantModels  map[string]int
+		wantErr     bool
+	}{
+		{name: "empty keeps the default", spec: "", wantDefault: defaultContextBudget, wantModels: map[string]int{}},
+		{name: "default and models", spec: "default=8000,gpt-4o=120000", wantDefault: 8000, wantModels: map[string]int{"gpt-4o": 120000}},
+		{name: "spaces and empty parts", spec: " gpt-4o = 1000 ,, ", wantDefault: defaultContextBudget, wantModels: map[string]int{"gpt-4o": 1000}},
+		{name: "missing tokens", spec: "gpt-4o", wantErr: true},
+		{name: "missing model", spec: "=1000", wantErr: true},
+		{name: "zero tokens", spec: "gpt-4o=0", wantErr: true},
+		{name: "negative tokens", spec: "default=-5", wantErr: true},
+		{name: "not a number", spec: "gpt-4o=lots", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseContextBudgets(tt.spec)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidContextBudget) {
+					t.Fatalf("got error %v, want %v", err, errInvalidContextBudget)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseContextBudgets: %v", err)
+			}
+			if got.Default != tt.wantDefault || len(got.Models) != len(tt.wantModels) {
+				t.Fatalf("got %+v, want default %d and models %v", got, tt.wantDefault, tt.wantModels)
+			}
+			for model, tokens := range tt.wantModels {
+				if got.Models[model] != tokens || got.forModel(model) != tokens {
+					t.Errorf("%s: got %d tokens, want %d", model, got.Models[model], tokens)
+				}
+			}
+			if got.forModel("unlisted") != tt.wantDefault {
+				t.Errorf("an unlisted model got %d tokens, want %d", got.forModel("unlisted"), tt.wantDefault)
+			}
+		})
+	}
+}
+
+// turns builds a branch of one message per role, each costing turnTokens.
+func turns(roles ...MessageRole) []MessageReturn {
+	path := make([]MessageReturn, 0, len(roles))
+	for i, role := range roles {
+		path = append(path, MessageReturn{
+			ID:      uuid.New(),
+			Role:    role,
+			Content: strings.Repeat(string(rune('a'+i)), 40),
+		})
+	}
+	return path
+}
+
+// turnTokens is what each message built by turns costs.
+const turnTokens = 10 + messageOverheadTokens
+
+func TestKeepFrom_TableDriven(t *testing.T) {
+	user, assistant, tool := MessageRoleUser, MessageRoleAssistant, MessageRoleTool
+	tests := []struct {
+		name      string
+		roles     []MessageRole
+		available int
+		want      int
+	}{
+		{name: "everything fits", roles: []MessageRole{user, assistant, user}, available: 3 * turnTokens, want: 0},
+		{name: "oldest turns are cut", roles: []MessageRole{user, assistant, user, assistant, user}, available: 2 * turnTokens, want: 3},
+		{name: "prompt is kept when nothing fits", roles: []MessageRole{user, assistant, user}, available: 0, want: 2},
+		{name: "cut skips tool results", roles: []MessageRole{user, assistant, tool, tool, assistant, user}, available: 4 * turnTokens, want: 4},
+		{name: "cut at a tool result keeps the prompt", roles: []MessageRole{user, assistant, tool, tool}, available: 2 * turnTokens, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keepFrom(turns(tt.roles...), tt.available); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildHistory_TableDriven(t *testing.T) {
+	// The branch costs 5 turns; the budget of 4 keeps the newest 3 and summarizes the
+	// first 2.
+	const budget = 4*turnTokens + 4
+	tests := []struct {
+		name   string
+		budget int
+		// cachedAt is the index of the message carrying a cached summary, or -1.
+		cachedAt    int
+		providerErr error
+		// wantSummary is the summary sent ahead of the kept turns; "" sends none.
+		wantSummary string
+		// wantTranscripts are what the summarization requests start with. Each request
+		// fits half the budget, so the two dropped turns are summarized one at a time.
+		wantTranscripts []string
+		wantKept        int
+	}{
+		{name: "fits the budget", budget: 1000, cachedAt: -1, wantKept: 5},
+		{name: "older turns are summarized", budget: budget, cachedAt: -1, wantSummary: "new summary", wantTranscripts: []string{"user: aaaa", "Summary so far:\nnew summary\n\nConversation since then:\nassistant: bbbb"}, wantKept: 3},
+		{name: "cached summary is extended", budget: budget, cachedAt: 0, wantSummary: "new summary", wantTranscripts: []string{"Summary so far:\ncached\n\nConversation since then:\nassistant: bbbb"}, wantKept: 3},
+		{name: "cached summary covers every dropped turn", budget: budget, cachedAt: 1, wantSummary: "cached", wantKept: 3},
+		{name: "failure falls back to the cached summary", budget: budget, cachedAt: 0, providerErr: errors.New("down"), wantSummary: "cached", wantTranscripts: []string{"Summary so far:\ncached"}, wantKept: 3},
+		{name: "failure without a cached summary drops the turns", budget: budget, cachedAt: -1, providerErr: errors.New("down"), wantTranscripts: []string{"user: aaaa"}, wantKept: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, assistant := MessageRoleUser, MessageRoleAssistant
+			path := turns(user, assistant, user, assistant, user)
+			querier := newFakeChatQuerier()
+			if tt.cachedAt >= 0 {
+				querier.summaries[path[tt.cachedAt].ID] = "cached"
+			}
+			provider := &fakeProvider{deltas: []string{"new ", "summary"}, err: tt.providerErr}
+			service := newTestService(querier)
+			service.provider = provider
+
+			history := service.buildHistory(context.Background(), nil, path, tt.budget)
+
+			var want []string
+			if tt.wantSummary != "" {
+				want = append(want, summaryPrefix+tt.wantSummary)
+			}
+			for _, msg := range path[len(path)-tt.wantKept:] {
+				want = append(want, msg.Content)
+			}
+			var got []string
+			for _, msg := range history {
+				got = append(got, msg.Content)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("got history %q, want %q", got, want)
+			}
+
+			if len(provider.requests) != len(tt.wantTranscripts) {
+				t.Fatalf("got %d summarization requests, want %d", len(provider.requests), len(tt.wantTranscripts))
+			}
+			for i, prefix := range tt.wantTranscripts {
+				if transcript := provider.requests[i].Messages[1].Content; !strings.HasPrefix(transcript, prefix) {
+					t.Errorf("request %d: got transcript %q, want it to start with %q", i, transcript, prefix)
+				}
+			}
+			if tt.wantSummary == "new summary" && querier.summaries[path[1].ID] != "new summary" {
+				t.Errorf("the new summary was not cached on the last dropped turn: %v", querier.summaries)
+			}
+		})
+	}
+}
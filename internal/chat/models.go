@@ -55,24 +55,85 @@ func (ns NullContentType) Value() (driver.Value, error) {
 }
 
 type Chat struct {
-	ID        uuid.UUID
-	CreatedAt pgtype.Timestamptz
+	ID            uuid.UUID
+	CreatedAt     pgtype.Timestamptz
+	CurrentLeafID pgtype.UUID
+	UserID        pgtype.UUID
+	Title         pgtype.Text
+	UpdatedAt     pgtype.Timestamptz
+	PersonaID     pgtype.UUID
+	Model         pgtype.Text
+	Temperature   pgtype.Float4
+	MaxTokens     pgtype.Int4
+	QuestionID    pgtype.UUID
 }
 
 type Content struct {
-	ID      uuid.UUID
-	Type    string
-	Content string
+	ID            uuid.UUID
+	Type          string
+	Content       string
+	Sha256        pgtype.Text
+	VariantStatus pgtype.Text
+	VariantWidths []int32
+	Title         pgtype.Text
+	Description   pgtype.Text
+	AltText       pgtype.Text
+	Tags          []string
+	CreatedBy     pgtype.UUID
+	CreatedAt     pgtype.Timestamptz
+	UpdatedAt     pgtype.Timestamptz
+	Format        string
+	Revision      int32
+	SizeBytes     int64
+}
+
+type ContentSearch struct {
+	ContentID uuid.UUID
+	Document  interface{}
+	Body      string
 }
 
 type Message struct {
-	ID         uuid.UUID
-	ChatID     uuid.UUID
-	PreviousID pgtype.UUID
-	Content    pgtype.Text
-	Role       string
-	Status     string
-	CreatedAt  pgtype.Timestamptz
+	ID          uuid.UUID
+	ChatID      uuid.UUID
+	PreviousID  pgtype.UUID
+	Content     pgtype.Text
+	Role        string
+	Status      string
+	CreatedAt   pgtype.Timestamptz
+	Model       pgtype.Text
+	Temperature pgtype.Float4
+	MaxTokens   pgtype.Int4
+	ToolCalls   []byte
+	ToolCallID  pgtype.Text
+	ErrorReason pgtype.Text
+}
+
+type MessageAttachment struct {
+	MessageID uuid.UUID
+	Position  int32
+	ContentID uuid.UUID
+	Kind      string
+	MimeType  string
+	CreatedAt pgtype.Timestamptz
+}
+
+type MessageCitation struct {
+	MessageID uuid.UUID
+	Position  int32
+	ContentID uuid.UUID
+	CreatedAt pgtype.Timestamptz
+}
+
+type MessageStream struct {
+	MessageID      uuid.UUID
+	CheckpointedAt pgtype.Timestamptz
+}
+
+type MessageSummary struct {
+	MessageID uuid.UUID
+	Content   string
+	CreatedAt pgtype.Timestamptz
 }
 
 type Option struct {
@@ -84,6 +145,16 @@ type Option struct {
 	UpdatedAt  pgtype.Timestamptz
 }
 
+type Persona struct {
+	ID           uuid.UUID
+	Name         string
+	Description  string
+	SystemPrompt string
+	CreatedBy    pgtype.UUID
+	CreatedAt    pgtype.Timestamptz
+	UpdatedAt    pgtype.Timestamptz
+}
+
 type Question struct {
 	ID        uuid.UUID
 	Content   string
@@ -91,3 +162,19 @@ type Question struct {
 	CreatedAt pgtype.Timestamptz
 	UpdatedAt pgtype.Timestamptz
 }
+
+type QuestionTutorPolicy struct {
+	QuestionID       uuid.UUID
+	HintLevel        string
+	AnswerKey        pgtype.Text
+	IncludeAnswerKey bool
+	CreatedAt        pgtype.Timestamptz
+	UpdatedAt        pgtype.Timestamptz
+}
+
+type UserStorage struct {
+	UserID     uuid.UUID
+	UsedBytes  int64
+	QuotaBytes pgtype.Int8
+	UpdatedAt  pgtype.Timestamptz
+}
@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"sciedu-backend/internal/auth"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultChatPage     int32 = 1
+	defaultChatPageSize int32 = 20
+	maxChatPageSize     int32 = 100
+)
+
+// maxChatTitleRunes bounds the title generated from the first prompt.
+const maxChatTitleRunes = 60
+
+type ChatSummary struct {
+	ID         uuid.UUID `json:"id"`
+	Title      string    `json:"title"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	PersonaID  uuid.UUID `json:"personaID,omitempty"`
+	QuestionID uuid.UUID `json:"questionID,omitempty"`
+}
+
+type ChatPage struct {
+	Items       []ChatSummary `json:"items"`
+	TotalPages  int32         `json:"totalPages"`
+	TotalItems  int32         `json:"totalItems"`
+	CurrentPage int32         `json:"currentPage"`
+	PageSize    int32         `json:"pageSize"`
+	HasNextPage bool          `json:"hasNextPage"`
+}
+
+// authorizeChat loads a chat and checks that the caller may use it: its owner and
+// admins may. Chats left without an owner by older versions are only open to admins.
+func (s *ChatService) authorizeChat(ctx context.Context, chatID uuid.UUID) (Chat, error) {
+	user, ok := auth.UserFromContext(ctx)
+	if !ok {
+		return Chat{}, handlerutil.ErrUnauthorized
+	}
+	chat, err := s.getChatRow(ctx, chatID)
+	if err != nil {
+		return Chat{}, err
+	}
+	if !user.HasRole(auth.RoleAdmin) && (!chat.UserID.Valid || user.ID != uuid.UUID(chat.UserID.Bytes)) {
+		return Chat{}, handlerutil.ErrForbidden
+	}
+	return chat, nil
+}
+
+// AuthorizeMessage checks that the caller may use the chat the message belongs to.
+func (s *ChatService) AuthorizeMessage(ctx context.Context, messageID uuid.UUID) error {
+	if _, ok := auth.UserFromContext(ctx); !ok {
+		return handlerutil.ErrUnauthorized
+	}
+	msg, err := s.querier.GetMessage(ctx, messageID)
+	if err != nil {
+		return databaseutil.WrapDBErrorWithKeyValue(err, "message", "message_id", messageID.String(), s.logger, "get message")
+	}
+	_, err = s.authorizeChat(ctx, msg.ChatID)
+	return err
+}
+
+// ListChats returns the caller's chats, most recently active first.
+func (s *ChatService) ListChats(ctx context.Context, page, pageSize int32) (ChatPage, error) {
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok {
+		return ChatPage{}, handlerutil.ErrUnauthorized
+	}
+	if page < 1 {
+		page = defaultChatPage
+	}
+	if pageSize < 1 {
+		pageSize = defaultChatPageSize
+	}
+	pageSize = min(pageSize, maxChatPageSize)
+	owner := pgtype.UUID{Bytes: userID, Valid: true}
+
+	chats, err := s.querier.ListChatsByUser(ctx, ListChatsByUserParams{
+		UserID: owner,
+		Limit:  pageSize,
+		Offset: (page - 1) * pageSize,
+	})
+	if err != nil {
+		return ChatPage{}, databaseutil.WrapDBError(err, s.logger, "list chats")
+	}
+	total, err := s.querier.CountChatsByUser(ctx, owner)
+	if err != nil {
+		return ChatPage{}, databaseutil.WrapDBError(err, s.logger, "count chats")
+	}
+
+	totalPages := int32((total + int64(pageSize) - 1) / int64(pageSize))
+	result := ChatPage{
+		Items:       make([]ChatSummary, 0, len(chats)),
+		TotalPages:  totalPages,
+		TotalItems:  int32(total),
+		CurrentPage: page,
+		PageSize:    pageSize,
+		HasNextPage: page < totalPages,
+	}
+	for _, chat := range chats {
+		result.Items = append(result.Items, ChatSummary{
+			ID:         chat.ID,
+			Title:      chat.Title.String,
+			CreatedAt:  chat.CreatedAt.Time,
+			UpdatedAt:  chat.UpdatedAt.Time,
+			PersonaID:  chat.PersonaID.Bytes,
+			QuestionID: chat.QuestionID.Bytes,
+		})
+	}
+	return result, nil
+}
+
+// setTitle names an untitled chat after its first prompt. A failure leaves the chat
+// untitled, so it is logged rather than returned.
+func (s *ChatService) setTitle(ctx context.Context, chatID uuid.UUID, prompt string) {
+	title := titleFromPrompt(prompt)
+	if title == "" {
+		return
+	}
+	err := s.querier.SetChatTitleIfEmpty(ctx, SetChatTitleIfEmptyParams{
+		ID:    chatID,
+		Title: pgtype.Text{String: title, Valid: true},
+	})
+	if err != nil {
+		s.logger.Warn("failed to set chat title", zap.String("chat_id", chatID.String()), zap.Error(err))
+	}
+}
+
+// titleFromPrompt makes a chat title out of the first line of a prompt.
+func titleFromPrompt(content string) string {
+	title := strings.TrimSpace(content)
+	if line, _, ok := strings.Cut(title, "\n"); ok {
+		title = strings.TrimSpace(line)
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	if utf8.RuneCountInString(title) > maxChatTitleRunes {
+		runes := []rune(title)
+		title = strings.TrimSpace(string(runes[:maxChatTitleRunes-1])) + "…"
+	}
+	return title
+}
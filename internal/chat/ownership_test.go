@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"sciedu-backend/internal/auth"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+)
+
+func TestAuthorizeChat_TableDriven(t *testing.T) {
+	owner := uuid.New()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		// ownerless asks for a chat left without an owner.
+		ownerless bool
+		wantErr   error
+	}{
+		{name: "owner", ctx: userContext(owner)},
+		{name: "admin", ctx: userContext(uuid.New(), auth.RoleAdmin)},
+		{name: "another user", ctx: userContext(uuid.New()), wantErr: handlerutil.ErrForbidden},
+		{name: "anonymous", ctx: context.Background(), wantErr: handlerutil.ErrUnauthorized},
+		{name: "ownerless chat, owner of another", ctx: userContext(owner), ownerless: true, wantErr: handlerutil.ErrForbidden},
+		{name: "ownerless chat, admin", ctx: userContext(uuid.New(), auth.RoleAdmin), ownerless: true},
+		{name: "ownerless chat, anonymous", ctx: context.Background(), ownerless: true, wantErr: handlerutil.ErrUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			chatOwner := owner
+			if tt.ownerless {
+				chatOwner = uuid.Nil
+			}
+			chat := querier.addChat(chatOwner)
+			msg := querier.addMessage(chat.ID, uuid.Nil, MessageRoleUser, "hello")
+			service := newTestService(querier)
+
+			if _, err := service.GetChat(tt.ctx, chat.ID); !errors.Is(err, tt.wantErr) {
+				t.Errorf("GetChat: got error %v, want %v", err, tt.wantErr)
+			}
+			if err := service.AuthorizeMessage(tt.ctx, msg.ID); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AuthorizeMessage: got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateChat_TableDriven(t *testing.T) {
+	user := uuid.New()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr error
+	}{
+		{name: "signed in", ctx: userContext(user)},
+		{name: "anonymous", ctx: context.Background(), wantErr: handlerutil.ErrUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			chatID, err := newTestService(querier).CreateChat(tt.ctx, uuid.Nil, uuid.Nil, GenerationOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(querier.chats) != 0 {
+					t.Error("a chat was created for an anonymous caller")
+				}
+				return
+			}
+			chat := querier.chats[chatID]
+			if !chat.UserID.Valid || chat.UserID.Bytes != user {
+				t.Errorf("got owner %v, want %v", chat.UserID, user)
+			}
+		})
+	}
+}
+
+func TestListChats_TableDriven(t *testing.T) {
+	user := uuid.New()
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		page      int32
+		pageSize  int32
+		wantItems int
+		wantPages int32
+		wantNext  bool
+		wantErr   error
+	}{
+		{name: "defaults", ctx: userContext(user), wantItems: 5, wantPages: 1},
+		{name: "first page", ctx: userContext(user), page: 1, pageSize: 2, wantItems: 2, wantPages: 3, wantNext: true},
+		{name: "last page", ctx: userContext(user), page: 3, pageSize: 2, wantItems: 1, wantPages: 3},
+		{name: "page size is capped", ctx: userContext(user), pageSize: maxChatPageSize + 1, wantItems: 5, wantPages: 1},
+		{name: "another user has none", ctx: userContext(uuid.New()), wantItems: 0, wantPages: 0},
+		{name: "anonymous", ctx: context.Background(), wantErr: handlerutil.ErrUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			for range 5 {
+				querier.addChat(user)
+			}
+			querier.addChat(uuid.New())
+
+			page, err := newTestService(querier).ListChats(tt.ctx, tt.page, tt.pageSize)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if len(page.Items) != tt.wantItems || page.TotalPages != tt.wantPages || page.HasNextPage != tt.wantNext {
+				t.Errorf("got %d items of %d pages (next %t), want %d of %d (next %t)",
+					len(page.Items), page.TotalPages, page.HasNextPage, tt.wantItems, tt.wantPages, tt.wantNext)
+			}
+		})
+	}
+}
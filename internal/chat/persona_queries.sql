@@ -0,0 +1,18 @@
+-- name: GetPersona :one
+SELECT * FROM personas
+WHERE id = $1;
+-- name: ListPersonas :many
+SELECT * FROM personas
+ORDER BY name;
+-- name: CreatePersona :one
+INSERT INTO personas (name, description, system_prompt, created_by)
+VALUES ($1, $2, $3, $4)
+RETURNING *;
+-- name: UpdatePersona :one
+UPDATE personas
+SET name = $2, description = $3, system_prompt = $4, updated_at = now()
+WHERE id = $1
+RETURNING *;
+-- name: DeletePersona :exec
+DELETE FROM personas
+WHERE id = $1;
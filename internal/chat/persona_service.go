@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"sciedu-backend/internal/auth"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+type PersonaQuerier interface {
+	GetPersona(ctx context.Context, id uuid.UUID) (Persona, error)
+	ListPersonas(ctx context.Context) ([]Persona, error)
+	CreatePersona(ctx context.Context, arg CreatePersonaParams) (Persona, error)
+	UpdatePersona(ctx context.Context, arg UpdatePersonaParams) (Persona, error)
+	DeletePersona(ctx context.Context, id uuid.UUID) error
+}
+
+// PersonaReturn is a tutor persona. SystemPrompt is only filled in for admins.
+type PersonaReturn struct {
+	ID           uuid.UUID `json:"id"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	SystemPrompt string    `json:"systemPrompt,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+type PersonaInput struct {
+	Name         string
+	Description  string
+	SystemPrompt string
+}
+
+func (s *ChatService) ListPersonas(ctx context.Context) ([]PersonaReturn, error) {
+	personas, err := s.querier.ListPersonas(ctx)
+	if err != nil {
+		return nil, databaseutil.WrapDBError(err, s.logger, "list personas")
+	}
+	result := make([]PersonaReturn, 0, len(personas))
+	for _, persona := range personas {
+		result = append(result, toPersonaReturn(ctx, persona))
+	}
+	return result, nil
+}
+
+func (s *ChatService) GetPersona(ctx context.Context, personaID uuid.UUID) (PersonaReturn, error) {
+	persona, err := s.getPersona(ctx, personaID)
+	if err != nil {
+		return PersonaReturn{}, err
+	}
+	return toPersonaReturn(ctx, persona), nil
+}
+
+func (s *ChatService) CreatePersona(ctx context.Context, input PersonaInput) (PersonaReturn, error) {
+	userID, err := requireAdmin(ctx)
+	if err != nil {
+		return PersonaReturn{}, err
+	}
+	persona, err := s.querier.CreatePersona(ctx, CreatePersonaParams{
+		Name:         input.Name,
+		Description:  input.Description,
+		SystemPrompt: input.SystemPrompt,
+		CreatedBy:    pgtype.UUID{Bytes: userID, Valid: true},
+	})
+	if err != nil {
+		return PersonaReturn{}, databaseutil.WrapDBError(err, s.logger, "create persona")
+	}
+	return toPersonaReturn(ctx, persona), nil
+}
+
+// UpdatePersona replaces a persona. Chats using it get the new prompt from their
+// next reply on.
+func (s *ChatService) UpdatePersona(ctx context.Context, personaID uuid.UUID, input PersonaInput) (PersonaReturn, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return PersonaReturn{}, err
+	}
+	persona, err := s.querier.UpdatePersona(ctx, UpdatePersonaParams{
+		ID:           personaID,
+		Name:         input.Name,
+		Description:  input.Description,
+		SystemPrompt: input.SystemPrompt,
+	})
+	if err != nil {
+		return PersonaReturn{}, databaseutil.WrapDBErrorWithKeyValue(err, "persona", "persona_id", personaID.String(), s.logger, "update persona")
+	}
+	return toPersonaReturn(ctx, persona), nil
+}
+
+// DeletePersona removes a persona. Chats using it carry on without a system prompt.
+func (s *ChatService) DeletePersona(ctx context.Context, personaID uuid.UUID) error {
+	if _, err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if _, err := s.getPersona(ctx, personaID); err != nil {
+		return err
+	}
+	if err := s.querier.DeletePersona(ctx, personaID); err != nil {
+		return databaseutil.WrapDBErrorWithKeyValue(err, "persona", "persona_id", personaID.String(), s.logger, "delete persona")
+	}
+	return nil
+}
+
+func (s *ChatService) getPersona(ctx context.Context, personaID uuid.UUID) (Persona, error) {
+	persona, err := s.querier.GetPersona(ctx, personaID)
+	if err != nil {
+		return Persona{}, databaseutil.WrapDBErrorWithKeyValue(err, "persona", "persona_id", personaID.String(), s.logger, "get persona")
+	}
+	return persona, nil
+}
+
+// systemMessages returns the instructions sent ahead of the chat history: the
+// prompt of the chat's persona and the question the chat is about, if it has them.
+func (s *ChatService) systemMessages(ctx context.Context, chat Chat) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	if chat.PersonaID.Valid {
+		persona, err := s.getPersona(ctx, chat.PersonaID.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, ChatMessage{Role: MessageRoleSystem, Content: persona.SystemPrompt})
+	}
+	if chat.QuestionID.Valid {
+		prompt, err := s.questionPrompt(ctx, chat.QuestionID.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, ChatMessage{Role: MessageRoleSystem, Content: prompt})
+	}
+	return messages, nil
+}
+
+// requireAdmin returns the caller's ID when they are an admin.
+func requireAdmin(ctx context.Context) (uuid.UUID, error) {
+	user, ok := auth.UserFromContext(ctx)
+	if !ok {
+		return uuid.Nil, handlerutil.ErrUnauthorized
+	}
+	if !user.HasRole(auth.RoleAdmin) {
+		return uuid.Nil, handlerutil.ErrForbidden
+	}
+	return user.ID, nil
+}
+
+func toPersonaReturn(ctx context.Context, persona Persona) PersonaReturn {
+	ret := PersonaReturn{
+		ID:          persona.ID,
+		Name:        persona.Name,
+		Description: persona.Description,
+		CreatedAt:   persona.CreatedAt.Time,
+		UpdatedAt:   persona.UpdatedAt.Time,
+	}
+	if user, ok := auth.UserFromContext(ctx); ok && user.HasRole(auth.RoleAdmin) {
+		ret.SystemPrompt = persona.SystemPrompt
+	}
+	return ret
+}
@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"sciedu-backend/internal/auth"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+)
+
+func TestCreatePersona_TableDriven(t *testing.T) {
+	admin := uuid.New()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr error
+	}{
+		{name: "admin", ctx: userContext(admin, auth.RoleAdmin)},
+		{name: "student", ctx: userContext(uuid.New()), wantErr: handlerutil.ErrForbidden},
+		{name: "anonymous", ctx: context.Background(), wantErr: handlerutil.ErrUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			got, err := newTestService(querier).CreatePersona(tt.ctx, PersonaInput{
+				Name:         "Socratic tutor",
+				SystemPrompt: "Never give the answer directly.",
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(querier.personas) != 0 {
+					t.Error("the persona was created")
+				}
+				return
+			}
+			persona := querier.personas[got.ID]
+			if persona.CreatedBy.Bytes != admin || got.SystemPrompt != "Never give the answer directly." {
+				t.Errorf("got persona %+v created by %v, want the prompt created by the admin", got, persona.CreatedBy)
+			}
+		})
+	}
+}
+
+func TestListPersonasSystemPrompt_TableDriven(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		wantPrompt string
+	}{
+		{name: "admin sees the prompt", ctx: userContext(uuid.New(), auth.RoleAdmin), wantPrompt: "secret"},
+		{name: "student does not", ctx: userContext(uuid.New())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			id := uuid.New()
+			querier.personas[id] = Persona{ID: id, Name: "tutor", SystemPrompt: "secret"}
+
+			personas, err := newTestService(querier).ListPersonas(tt.ctx)
+			if err != nil {
+				t.Fatalf("ListPersonas: %v", err)
+			}
+			if len(personas) != 1 || personas[0].SystemPrompt != tt.wantPrompt {
+				t.Errorf("got %+v, want one persona with prompt %q", personas, tt.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestDeletePersona_TableDriven(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		unknown bool
+		wantErr error
+	}{
+		{name: "admin", ctx: userContext(uuid.New(), auth.RoleAdmin)},
+		{name: "unknown persona", ctx: userContext(uuid.New(), auth.RoleAdmin), unknown: true, wantErr: handlerutil.NotFoundError{}},
+		{name: "student", ctx: userContext(uuid.New()), wantErr: handlerutil.ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			id := uuid.New()
+			querier.personas[id] = Persona{ID: id, Name: "tutor"}
+			target := id
+			if tt.unknown {
+				target = uuid.New()
+			}
+
+			err := newTestService(querier).DeletePersona(tt.ctx, target)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if _, kept := querier.personas[id]; kept != (tt.wantErr != nil) {
+				t.Errorf("persona kept: %t", kept)
+			}
+		})
+	}
+}
+
+func TestPersonaSystemMessage_TableDriven(t *testing.T) {
+	tests := []struct {
+		name        string
+		persona     bool
+		wantHistory []string
+		wantRoles   []MessageRole
+	}{
+		{
+			name:        "persona prompt comes first",
+			persona:     true,
+			wantHistory: []string{"Never give the answer directly.", "what is ATP?"},
+			wantRoles:   []MessageRole{MessageRoleSystem, MessageRoleUser},
+		},
+		{
+			name:        "no persona",
+			wantHistory: []string{"what is ATP?"},
+			wantRoles:   []MessageRole{MessageRoleUser},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := uuid.New()
+			querier := newFakeChatQuerier()
+			var personaID uuid.UUID
+			if tt.persona {
+				personaID = uuid.New()
+				querier.personas[personaID] = Persona{ID: personaID, SystemPrompt: "Never give the answer directly."}
+			}
+			provider := &fakeProvider{deltas: []string{"energy"}}
+			service := newTestService(querier)
+			service.provider = provider
+
+			chatID, err := service.CreateChat(userContext(user), personaID, uuid.Nil, GenerationOptions{})
+			if err != nil {
+				t.Fatalf("CreateChat: %v", err)
+			}
+			created, err := service.CreateMessage(userContext(user), chatID, "what is ATP?", uuid.Nil, nil, GenerationOptions{})
+			if err != nil {
+				t.Fatalf("CreateMessage: %v", err)
+			}
+			querier.waitFinished(t, created.ReplyMessageID)
+
+			req := provider.lastRequest()
+			var history []string
+			var roles []MessageRole
+			for _, msg := range req.Messages {
+				history = append(history, msg.Content)
+				roles = append(roles, msg.Role)
+			}
+			if !slices.Equal(history, tt.wantHistory) || !slices.Equal(roles, tt.wantRoles) {
+				t.Errorf("got history %v with roles %v, want %v with %v", history, roles, tt.wantHistory, tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestCreateChatUnknownPersona(t *testing.T) {
+	querier := newFakeChatQuerier()
+	_, err := newTestService(querier).CreateChat(userContext(uuid.New()), uuid.New(), uuid.Nil, GenerationOptions{})
+	if !errors.Is(err, handlerutil.NotFoundError{}) {
+		t.Fatalf("got error %v, want a not found error", err)
+	}
+	if len(querier.chats) != 0 {
+		t.Error("a chat was created with an unknown persona")
+	}
+}
@@ -0,0 +1,525 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const (
+	// streamChannel is the PostgreSQL notification channel replicas relay streams on.
+	streamChannel = "chat_streams"
+	// maxNotificationPayload is the size of the notification payloads PostgreSQL
+	// refuses, in bytes of encoded JSON.
+	maxNotificationPayload = 8000
+	// followerPollInterval is how often a follower checks the stored message, which
+	// fills the text of dropped notifications and ends the follow when the generating
+	// replica finished or died unnoticed.
+	followerPollInterval = 5 * time.Second
+	// relayQueueSize bounds the notifications waiting to be sent; content past it is
+	// dropped.
+	relayQueueSize = 1024
+	// listenRetryDelay is the pause before listening again after losing the connection.
+	listenRetryDelay = time.Second
+)
+
+// Kinds of stream notifications.
+const (
+	// notificationContent carries text at an offset of the accumulated content.
+	notificationContent = "content"
+	// notificationFinish carries the final status and content length, and the
+	// problem of a failed stream.
+	notificationFinish = "finish"
+	// notificationSync asks the generating replica for the content so far.
+	notificationSync = "sync"
+	// notificationCancel asks the generating replica to stop.
+	notificationCancel = "cancel"
+)
+
+type streamNotification struct {
+	Kind      string        `json:"k"`
+	MessageID uuid.UUID     `json:"m"`
+	Offset    int           `json:"o,omitempty"`
+	Text      string        `json:"t,omitempty"`
+	Status    MessageStatus `json:"s,omitempty"`
+	// Problem is why a failed stream failed.
+	Problem *StreamProblem `json:"p,omitempty"`
+}
+
+// PostgresHub is a Hub for several replicas sharing a database. Generations run on
+// the replica that started them and are relayed to the others with LISTEN/NOTIFY: a
+// follower on another replica asks for the content so far, then receives every delta
+// tagged with its offset, so that it can join at any time without losing text. Run
+// must be running for the relay to work.
+type PostgresHub struct {
+	local   *StreamHub
+	pool    *pgxpool.Pool
+	querier ChatQuerier
+	logger  *zap.Logger
+	maxLag  time.Duration
+	// pollInterval is how often followers check the stored message.
+	pollInterval time.Duration
+
+	// outbox holds the notifications waiting to be sent; ready is signalled when it
+	// gets some. dropping is set once content is dropped, until the outbox drains.
+	outboxLock sync.Mutex
+	outbox     []streamNotification
+	ready      chan struct{}
+	dropping   bool
+
+	lock      sync.Mutex
+	followers map[uuid.UUID]map[*streamFollower]struct{}
+}
+
+func NewPostgresHub(pool *pgxpool.Pool, logger *zap.Logger) *PostgresHub {
+	return &PostgresHub{
+		local:        NewStreamHub(),
+		pool:         pool,
+		querier:      New(pool),
+		logger:       logger,
+		maxLag:       DefaultMaxSubscriberLag,
+		pollInterval: followerPollInterval,
+		ready:        make(chan struct{}, 1),
+		followers:    make(map[uuid.UUID]map[*streamFollower]struct{}),
+	}
+}
+
+// SetMaxLag sets how long content may wait for a subscriber before the subscriber is
+// disconnected; 0 never disconnects. Call it before the hub is used.
+func (h *PostgresHub) SetMaxLag(maxLag time.Duration) {
+	h.maxLag = maxLag
+	h.local.SetMaxLag(maxLag)
+}
+
+// Run relays streams until ctx is done.
+func (h *PostgresHub) Run(ctx context.Context) {
+	go h.send(ctx)
+	for ctx.Err() == nil {
+		err := h.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		h.logger.Warn("lost stream notifications, listening again", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (h *PostgresHub) CreateStream(messageID uuid.UUID, cancel context.CancelFunc) *StreamEvent {
+	stream := h.local.CreateStream(messageID, cancel)
+	stream.lock.Lock()
+	stream.relay = h
+	stream.lock.Unlock()
+	return stream
+}
+
+func (h *PostgresHub) GetStream(messageID uuid.UUID) (*StreamEvent, bool) {
+	return h.local.GetStream(messageID)
+}
+
+func (h *PostgresHub) DeleteStream(messageID uuid.UUID) {
+	h.local.DeleteStream(messageID)
+}
+
+func (h *PostgresHub) Subscribe(ctx context.Context, messageID uuid.UUID, offset int) (bool, <-chan StreamDelta, <-chan error, func()) {
+	if ok, ch, errCh, cancel := h.local.Subscribe(ctx, messageID, offset); ok {
+		return ok, ch, errCh, cancel
+	}
+	msg, err := h.querier.GetMessage(ctx, messageID)
+	if err != nil || MessageStatus(msg.Status) != MessageStatusStreaming {
+		return false, nil, nil, func() {}
+	}
+
+	follower := &streamFollower{
+		messageID: messageID,
+		ch:        make(chan StreamDelta),
+		errCh:     make(chan error, 1),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	h.lock.Lock()
+	if h.followers[messageID] == nil {
+		h.followers[messageID] = make(map[*streamFollower]struct{})
+	}
+	h.followers[messageID][follower] = struct{}{}
+	h.lock.Unlock()
+
+	// Followers register before asking, so no delta after the answer is missed.
+	h.enqueue(streamNotification{Kind: notificationSync, MessageID: messageID})
+	go h.follow(follower, max(0, offset))
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			h.unfollow(follower)
+			close(follower.done)
+		})
+	}
+	return true, follower.ch, follower.errCh, cancel
+}
+
+// Cancel stops a generation of this replica directly and asks the others to stop
+// theirs. For the latter it can only tell whether the message is still streaming.
+func (h *PostgresHub) Cancel(ctx context.Context, messageID uuid.UUID) bool {
+	if stream, ok := h.local.GetStream(messageID); ok {
+		return stream.Cancel()
+	}
+	msg, err := h.querier.GetMessage(ctx, messageID)
+	if err != nil || MessageStatus(msg.Status) != MessageStatusStreaming {
+		return false
+	}
+	h.enqueue(streamNotification{Kind: notificationCancel, MessageID: messageID})
+	return true
+}
+
+// content implements streamRelay.
+func (h *PostgresHub) content(messageID uuid.UUID, offset int, text string) {
+	if text != "" {
+		h.enqueue(streamNotification{Kind: notificationContent, MessageID: messageID, Offset: offset, Text: text})
+	}
+}
+
+// finish implements streamRelay.
+func (h *PostgresHub) finish(messageID uuid.UUID, status MessageStatus, length int, err error) {
+	note := streamNotification{Kind: notificationFinish, MessageID: messageID, Offset: length, Status: status}
+	if status == MessageStatusError {
+		problem := NewStreamProblem(err)
+		note.Problem = &problem
+	}
+	h.enqueue(note)
+}
+
+// enqueue queues a notification for send without blocking, since streams relay with
+// their lock held. Content that continues the last content queued for its message is
+// merged into it, so a burst of deltas goes out as one notification, and a sync or
+// cancel already waiting is not queued twice. Content that finds the outbox full is
+// dropped; followers notice the gap and fill it from the stored message.
+func (h *PostgresHub) enqueue(note streamNotification) {
+	h.outboxLock.Lock()
+	defer h.outboxLock.Unlock()
+	for i := len(h.outbox) - 1; i >= 0; i-- {
+		queued := &h.outbox[i]
+		if queued.MessageID != note.MessageID {
+			continue
+		}
+		if note.Kind == notificationContent {
+			if queued.Kind == notificationContent && queued.Offset+len(queued.Text) == note.Offset {
+				queued.Text += note.Text
+				return
+			}
+			break
+		}
+		if (note.Kind == notificationSync || note.Kind == notificationCancel) && queued.Kind == note.Kind {
+			return
+		}
+	}
+	if note.Kind == notificationContent && len(h.outbox) >= relayQueueSize {
+		if !h.dropping {
+			h.logger.Warn("stream relay is falling behind, dropping content", zap.String("message_id", note.MessageID.String()))
+			h.dropping = true
+		}
+		return
+	}
+	h.outbox = append(h.outbox, note)
+	select {
+	case h.ready <- struct{}{}:
+	default: // a wake-up is already pending
+	}
+}
+
+// send publishes queued notifications, keeping their order. One that cannot be sent is
+// dropped; followers then fall back to the stored message.
+func (h *PostgresHub) send(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.ready:
+		}
+		h.outboxLock.Lock()
+		batch := h.outbox
+		h.outbox = nil
+		h.dropping = false
+		h.outboxLock.Unlock()
+
+		for _, note := range batch {
+			payloads, err := notificationPayloads(note)
+			if err != nil {
+				h.logger.Error("failed to encode stream notification", zap.Error(err))
+				continue
+			}
+			for _, payload := range payloads {
+				if _, err := h.pool.Exec(ctx, "SELECT pg_notify($1, $2)", streamChannel, payload); err != nil {
+					h.logger.Warn("failed to relay stream", zap.String("message_id", note.MessageID.String()),
+						zap.String("kind", note.Kind), zap.Error(err))
+					break
+				}
+			}
+		}
+	}
+}
+
+// notificationPayloads encodes a notification, splitting content whose payload is too
+// large into several. The payload is measured encoded, since escaping can make text
+// several times longer.
+func notificationPayloads(note streamNotification) ([]string, error) {
+	payload, err := json.Marshal(note)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < maxNotificationPayload || note.Kind != notificationContent {
+		return []string{string(payload)}, nil
+	}
+	cut := len(note.Text) / 2
+	for cut > 0 && !utf8.RuneStart(note.Text[cut]) {
+		cut--
+	}
+	if cut == 0 {
+		return []string{string(payload)}, nil
+	}
+	head, tail := note, note
+	head.Text = note.Text[:cut]
+	tail.Offset += cut
+	tail.Text = note.Text[cut:]
+	payloads, err := notificationPayloads(head)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := notificationPayloads(tail)
+	if err != nil {
+		return nil, err
+	}
+	return append(payloads, rest...), nil
+}
+
+// listen dispatches notifications until the connection fails or ctx is done.
+func (h *PostgresHub) listen(ctx context.Context) error {
+	conn, err := h.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "LISTEN "+streamChannel); err != nil {
+		return err
+	}
+
+	// Notifications sent while the connection was down are lost; followers ask again.
+	h.lock.Lock()
+	for messageID := range h.followers {
+		h.enqueue(streamNotification{Kind: notificationSync, MessageID: messageID})
+	}
+	h.lock.Unlock()
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var note streamNotification
+		if err := json.Unmarshal([]byte(notification.Payload), &note); err != nil {
+			h.logger.Warn("ignoring malformed stream notification", zap.Error(err))
+			continue
+		}
+		h.dispatch(note)
+	}
+}
+
+func (h *PostgresHub) dispatch(note streamNotification) {
+	switch note.Kind {
+	case notificationSync:
+		if stream, ok := h.local.GetStream(note.MessageID); ok {
+			stream.relaySnapshot()
+		}
+	case notificationCancel:
+		if stream, ok := h.local.GetStream(note.MessageID); ok {
+			stream.Cancel()
+		}
+	case notificationContent, notificationFinish:
+		h.lock.Lock()
+		for follower := range h.followers[note.MessageID] {
+			follower.push(note)
+		}
+		h.lock.Unlock()
+	}
+}
+
+// follow turns the notifications of a generation on another replica into deltas,
+// starting at byte offset of its content. Like StreamEvent.Subscribe, it sends the
+// text a slow follower has not taken yet as one delta, and disconnects a follower
+// that leaves text waiting for longer than the maximum lag. Text whose notifications
+// were dropped leaves a gap that the stored content fills at the next poll.
+func (h *PostgresHub) follow(f *streamFollower, offset int) {
+	ticker := time.NewTicker(h.pollInterval)
+	defer ticker.Stop()
+	defer close(f.ch)
+
+	content := contentAssembler{length: offset}
+	// pending is the text assembled but not sent yet. ending is the finish
+	// notification, which ends the stream once the text before it is assembled.
+	// final is the last delta once known, with failure set when the stream failed.
+	var pending string
+	var ending *streamNotification
+	var final *StreamDelta
+	var failure error
+	var lag <-chan time.Time
+	var lagTimer *time.Timer
+	defer func() {
+		if lagTimer != nil {
+			lagTimer.Stop()
+		}
+	}()
+
+	for {
+		if final == nil && ending != nil && content.length >= ending.Offset {
+			final = &StreamDelta{IsFinished: true, Status: ending.Status, Offset: content.length}
+			if ending.Problem != nil {
+				failure = &StreamError{Problem: *ending.Problem}
+			}
+		}
+
+		var out chan<- StreamDelta
+		var delta StreamDelta
+		switch {
+		case pending != "":
+			out, delta = f.ch, StreamDelta{Delta: pending, Offset: content.length}
+		case failure != nil:
+			f.errCh <- failure
+			return
+		case final != nil:
+			out, delta = f.ch, *final
+		}
+		if out != nil && lag == nil && h.maxLag > 0 {
+			lagTimer = time.NewTimer(h.maxLag)
+			lag = lagTimer.C
+		}
+
+		select {
+		case out <- delta:
+			if delta.IsFinished {
+				return
+			}
+			pending = ""
+			if lagTimer != nil {
+				lagTimer.Stop()
+				lagTimer, lag = nil, nil
+			}
+		case <-f.done:
+			return
+		case <-lag:
+			h.unfollow(f)
+			f.errCh <- ErrSubscriberLagging
+			return
+		case <-f.wake:
+			for _, note := range f.drain() {
+				if final != nil {
+					break
+				}
+				switch note.Kind {
+				case notificationContent:
+					pending += content.add(note.Offset, note.Text)
+				case notificationFinish:
+					ending = &note
+				}
+			}
+		case <-ticker.C:
+			if final != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), h.pollInterval)
+			msg, err := h.querier.GetMessage(ctx, f.messageID)
+			cancel()
+			if err != nil {
+				continue
+			}
+			// The stored content, checkpointed while streaming, fills dropped text.
+			pending += content.add(0, msg.Content.String)
+			if MessageStatus(msg.Status) == MessageStatusStreaming {
+				continue
+			}
+			final = &StreamDelta{IsFinished: true, Status: MessageStatus(msg.Status), Offset: content.length}
+			if final.Status == MessageStatusError {
+				failure = storedStreamError(msg.ErrorReason.String)
+			}
+		}
+	}
+}
+
+func (h *PostgresHub) unfollow(f *streamFollower) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.followers[f.messageID], f)
+	if len(h.followers[f.messageID]) == 0 {
+		delete(h.followers, f.messageID)
+	}
+}
+
+// streamFollower is a subscriber to a generation running on another replica. The
+// listener queues notifications without blocking; follow delivers them.
+type streamFollower struct {
+	messageID uuid.UUID
+	ch        chan StreamDelta
+	errCh     chan error
+	wake      chan struct{}
+	done      chan struct{}
+
+	lock  sync.Mutex
+	queue []streamNotification
+}
+
+func (f *streamFollower) push(note streamNotification) {
+	f.lock.Lock()
+	f.queue = append(f.queue, note)
+	f.lock.Unlock()
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *streamFollower) drain() []streamNotification {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	queue := f.queue
+	f.queue = nil
+	return queue
+}
+
+// contentAssembler rebuilds accumulated content from pieces tagged with their byte
+// offset, which may overlap or arrive ahead of a gap. It returns the text that became
+// contiguous; pieces past a gap wait for the gap to fill.
+type contentAssembler struct {
+	length  int
+	pending []streamNotification
+}
+
+func (a *contentAssembler) add(offset int, text string) string {
+	a.pending = append(a.pending, streamNotification{Offset: offset, Text: text})
+	var out []byte
+	for progress := true; progress; {
+		progress = false
+		kept := a.pending[:0]
+		for _, piece := range a.pending {
+			end := piece.Offset + len(piece.Text)
+			switch {
+			case end <= a.length:
+			case piece.Offset <= a.length:
+				out = append(out, piece.Text[a.length-piece.Offset:]...)
+				a.length = end
+				progress = true
+			default:
+				kept = append(kept, piece)
+			}
+		}
+		a.pending = kept
+	}
+	return string(out)
+}
@@ -0,0 +1,241 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+// newTestPostgresHub returns a hub that reads messages from querier and is never run,
+// so its notifications stay in the outbox.
+func newTestPostgresHub(querier ChatQuerier) *PostgresHub {
+	hub := NewPostgresHub(nil, zap.NewNop())
+	hub.querier = querier
+	return hub
+}
+
+func TestPostgresHubEnqueue_TableDriven(t *testing.T) {
+	first, second := uuid.New(), uuid.New()
+	content := func(messageID uuid.UUID, offset int, text string) streamNotification {
+		return streamNotification{Kind: notificationContent, MessageID: messageID, Offset: offset, Text: text}
+	}
+	tests := []struct {
+		name  string
+		notes []streamNotification
+		want  []streamNotification
+	}{
+		{
+			name:  "contiguous deltas are merged",
+			notes: []streamNotification{content(first, 0, "ab"), content(first, 2, "cd"), content(first, 4, "e")},
+			want:  []streamNotification{content(first, 0, "abcde")},
+		},
+		{
+			name:  "deltas of interleaved messages are merged per message",
+			notes: []streamNotification{content(first, 0, "ab"), content(second, 0, "x"), content(first, 2, "cd"), content(second, 1, "y")},
+			want:  []streamNotification{content(first, 0, "abcd"), content(second, 0, "xy")},
+		},
+		{
+			name:  "a snapshot is not merged into live deltas",
+			notes: []streamNotification{content(first, 4, "ef"), content(first, 0, "abcdef")},
+			want:  []streamNotification{content(first, 4, "ef"), content(first, 0, "abcdef")},
+		},
+		{
+			name: "content after a finish is not merged into the content before it",
+			notes: []streamNotification{
+				content(first, 0, "ab"),
+				{Kind: notificationFinish, MessageID: first, Offset: 2, Status: MessageStatusDone},
+				content(first, 2, "cd"),
+			},
+			want: []streamNotification{
+				content(first, 0, "ab"),
+				{Kind: notificationFinish, MessageID: first, Offset: 2, Status: MessageStatusDone},
+				content(first, 2, "cd"),
+			},
+		},
+		{
+			name: "waiting syncs and cancels are not repeated",
+			notes: []streamNotification{
+				{Kind: notificationSync, MessageID: first},
+				{Kind: notificationSync, MessageID: second},
+				{Kind: notificationSync, MessageID: first},
+				{Kind: notificationCancel, MessageID: first},
+				{Kind: notificationCancel, MessageID: first},
+			},
+			want: []streamNotification{
+				{Kind: notificationSync, MessageID: first},
+				{Kind: notificationSync, MessageID: second},
+				{Kind: notificationCancel, MessageID: first},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newTestPostgresHub(nil)
+			for _, note := range tt.notes {
+				hub.enqueue(note)
+			}
+			if len(hub.outbox) != len(tt.want) {
+				t.Fatalf("got outbox %+v, want %+v", hub.outbox, tt.want)
+			}
+			for i := range tt.want {
+				if hub.outbox[i] != tt.want[i] {
+					t.Errorf("notification %d: got %+v, want %+v", i, hub.outbox[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPostgresHubEnqueueFullOutbox(t *testing.T) {
+	hub := newTestPostgresHub(nil)
+	for range relayQueueSize {
+		hub.enqueue(streamNotification{Kind: notificationSync, MessageID: uuid.New()})
+	}
+
+	messageID := uuid.New()
+	done := make(chan struct{})
+	go func() {
+		hub.enqueue(streamNotification{Kind: notificationContent, MessageID: messageID, Text: "dropped"})
+		hub.enqueue(streamNotification{Kind: notificationFinish, MessageID: messageID, Offset: 7, Status: MessageStatusDone})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue blocked on a full outbox")
+	}
+
+	if len(hub.outbox) != relayQueueSize+1 {
+		t.Fatalf("got %d notifications, want %d", len(hub.outbox), relayQueueSize+1)
+	}
+	if last := hub.outbox[len(hub.outbox)-1]; last.Kind != notificationFinish {
+		t.Errorf("got last notification %+v, want the finish", last)
+	}
+	if !hub.dropping {
+		t.Error("the hub did not note that it dropped content")
+	}
+}
+
+func TestNotificationPayloads_TableDriven(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		wantPayloads int
+	}{
+		{name: "short text", text: "hello", wantPayloads: 1},
+		{name: "long text", text: strings.Repeat("a", 20000), wantPayloads: 4},
+		// Each < is escaped to six bytes, so 2000 of them do not fit in one payload.
+		{name: "text that grows when escaped", text: strings.Repeat("<", 2000), wantPayloads: 2},
+		{name: "multibyte text", text: strings.Repeat("光", 5000), wantPayloads: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageID := uuid.New()
+			payloads, err := notificationPayloads(streamNotification{
+				Kind: notificationContent, MessageID: messageID, Offset: 10, Text: tt.text,
+			})
+			if err != nil {
+				t.Fatalf("notificationPayloads: %v", err)
+			}
+			if len(payloads) != tt.wantPayloads {
+				t.Errorf("got %d payloads, want %d", len(payloads), tt.wantPayloads)
+			}
+
+			var text strings.Builder
+			for i, payload := range payloads {
+				if len(payload) >= maxNotificationPayload {
+					t.Errorf("payload %d is %d bytes long", i, len(payload))
+				}
+				var note streamNotification
+				if err := json.Unmarshal([]byte(payload), &note); err != nil {
+					t.Fatalf("payload %d: %v", i, err)
+				}
+				if note.MessageID != messageID || note.Offset != 10+text.Len() {
+					t.Errorf("payload %d: got message %s at offset %d, want offset %d", i, note.MessageID, note.Offset, 10+text.Len())
+				}
+				text.WriteString(note.Text)
+			}
+			if text.String() != tt.text {
+				t.Error("the payloads do not add up to the text")
+			}
+		})
+	}
+}
+
+func TestPostgresHubFollowFillsGaps(t *testing.T) {
+	querier := newFakeChatQuerier()
+	chat := querier.addChat(uuid.New())
+	msg := querier.addMessage(chat.ID, uuid.Nil, MessageRoleAssistant, "")
+	querier.messages[0].Status = string(MessageStatusStreaming)
+	setStored := func(content string) {
+		querier.lock.Lock()
+		defer querier.lock.Unlock()
+		querier.messages[0].Content = pgtype.Text{String: content, Valid: true}
+	}
+
+	hub := newTestPostgresHub(querier)
+	hub.pollInterval = 10 * time.Millisecond
+	ok, ch, errCh, cancel := hub.Subscribe(context.Background(), msg.ID, 0)
+	if !ok {
+		t.Fatal("could not follow the streaming message")
+	}
+	defer cancel()
+
+	// The notification of ", big " was dropped; the checkpoint has it.
+	hub.dispatch(streamNotification{Kind: notificationContent, MessageID: msg.ID, Offset: 0, Text: "Hello"})
+	hub.dispatch(streamNotification{Kind: notificationContent, MessageID: msg.ID, Offset: 11, Text: "world"})
+	hub.dispatch(streamNotification{Kind: notificationFinish, MessageID: msg.ID, Offset: 16, Status: MessageStatusDone})
+	setStored("Hello, big ")
+
+	text, status := collect(t, ch, 0)
+	if text != "Hello, big world" || status != MessageStatusDone {
+		t.Errorf("got %q ending %s, want %q ending %s", text, status, "Hello, big world", MessageStatusDone)
+	}
+	select {
+	case err := <-errCh:
+		t.Errorf("got error %v", err)
+	default:
+	}
+}
+
+// orphanQuerier records the sweeps of orphaned streams.
+type orphanQuerier struct {
+	ChatQuerier
+	args []FailOrphanedMessagesParams
+}
+
+func (q *orphanQuerier) FailOrphanedMessages(_ context.Context, arg FailOrphanedMessagesParams) ([]uuid.UUID, error) {
+	q.args = append(q.args, arg)
+	return []uuid.UUID{uuid.New(), uuid.New()}, nil
+}
+
+func TestFailOrphanedStreams(t *testing.T) {
+	querier := &orphanQuerier{}
+	service := newTestService(querier)
+
+	count, err := service.FailOrphanedStreams(context.Background())
+	if err != nil {
+		t.Fatalf("FailOrphanedStreams: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("got %d orphaned streams, want 2", count)
+	}
+	if len(querier.args) != 1 {
+		t.Fatalf("got %d sweeps, want 1", len(querier.args))
+	}
+	arg := querier.args[0]
+	if !arg.MaxAge.Valid || arg.MaxAge.Microseconds != orphanedStreamAge.Microseconds() || arg.MaxAge.Days != 0 || arg.MaxAge.Months != 0 {
+		t.Errorf("got max age %+v, want %s", arg.MaxAge, orphanedStreamAge)
+	}
+	if arg.ErrorReason.String != orphanedStreamReason {
+		t.Errorf("got error reason %q", arg.ErrorReason.String)
+	}
+}
@@ -115,7 +115,7 @@ func (p *Provider) Stream(ctx context.Context, req CreateChatCompletionRequest)
 			if ctx.Err() != nil {
 				return
 			}
-			errs <- err
+			errs <- &UpstreamError{Detail: err.Error()}
 			return
 		}
 		defer func() {
@@ -129,7 +129,7 @@ func (p *Provider) Stream(ctx context.Context, req CreateChatCompletionRequest)
 
 		if resp.StatusCode != http.StatusOK {
 			b, _ := io.ReadAll(io.LimitReader(resp.Body, 8<<10))
-			errs <- fmt.Errorf("upstream status=%d body=%q", resp.StatusCode, string(b))
+			errs <- &UpstreamError{StatusCode: resp.StatusCode, Detail: upstreamDetail(b)}
 			return
 		}
 
@@ -153,7 +153,7 @@ func (p *Provider) Stream(ctx context.Context, req CreateChatCompletionRequest)
 				if err == io.EOF {
 					return
 				}
-				errs <- err
+				errs <- &UpstreamError{Detail: err.Error()}
 				return
 			}
 
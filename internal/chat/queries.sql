@@ -2,7 +2,8 @@
 SELECT * FROM chats
 WHERE id = $1;
 -- name: CreateChat :one
-INSERT INTO chats DEFAULT VALUES
+INSERT INTO chats (user_id, persona_id, model, temperature, max_tokens, question_id)
+VALUES ($1, $2, $3, $4, $5, $6)
 RETURNING *;
 -- name: GetMessage :one
 SELECT * FROM messages
@@ -12,11 +13,87 @@ SELECT * FROM messages
 WHERE chat_id = $1
 ORDER BY created_at;
 -- name: CreateMessage :one
-INSERT INTO messages (chat_id, previous_id, content, role, status)
-VALUES ($1, $2, $3, $4, $5)
+INSERT INTO messages (chat_id, previous_id, content, role, status, model, temperature, max_tokens, tool_calls, tool_call_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 RETURNING *;
 -- name: UpdateMessage :one
 UPDATE messages
-SET content = $2, status = $3
+SET content = $2, status = $3, error_reason = $4
 WHERE id = $1
-RETURNING *;
\ No newline at end of file
+RETURNING *;
+-- name: UpdateMessageParent :exec
+UPDATE messages
+SET previous_id = $2
+WHERE id = $1;
+-- name: UpdateChatCurrentLeaf :exec
+UPDATE chats
+SET current_leaf_id = $2, updated_at = now()
+WHERE id = $1;
+-- name: SetChatTitleIfEmpty :exec
+UPDATE chats
+SET title = $2
+WHERE id = $1 AND title IS NULL;
+-- name: ListChatsByUser :many
+SELECT * FROM chats
+WHERE user_id = $1
+ORDER BY updated_at DESC, id
+LIMIT $2 OFFSET $3;
+-- name: CountChatsByUser :one
+SELECT COUNT(*) FROM chats
+WHERE user_id = $1;
+-- name: GetMessageSummaries :many
+SELECT * FROM message_summaries
+WHERE message_id = ANY(sqlc.arg('message_ids')::uuid[]);
+-- name: UpsertMessageSummary :exec
+INSERT INTO message_summaries (message_id, content)
+VALUES ($1, $2)
+ON CONFLICT (message_id) DO UPDATE
+SET content = EXCLUDED.content, created_at = now();
+-- name: CreateMessageAttachment :one
+INSERT INTO message_attachments (message_id, position, content_id, kind, mime_type)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *;
+-- name: GetChatAttachments :many
+SELECT message_attachments.* FROM message_attachments
+JOIN messages ON messages.id = message_attachments.message_id
+WHERE messages.chat_id = $1
+ORDER BY message_attachments.message_id, message_attachments.position;
+-- name: CreateMessageCitation :exec
+INSERT INTO message_citations (message_id, position, content_id)
+VALUES ($1, $2, $3);
+-- name: GetChatCitations :many
+SELECT message_citations.* FROM message_citations
+JOIN messages ON messages.id = message_citations.message_id
+WHERE messages.chat_id = $1
+ORDER BY message_citations.message_id, message_citations.position;
+-- name: CreateMessageStream :exec
+INSERT INTO message_streams (message_id)
+VALUES ($1);
+-- name: CheckpointMessageStream :exec
+WITH stream AS (
+    UPDATE message_streams
+    SET checkpointed_at = now()
+    WHERE message_id = $1
+    RETURNING message_id
+)
+UPDATE messages
+SET content = $2
+WHERE id IN (SELECT message_id FROM stream) AND status = 'streaming';
+-- name: DeleteMessageStream :exec
+DELETE FROM message_streams
+WHERE message_id = $1;
+-- name: FailOrphanedMessages :many
+WITH stale AS (
+    DELETE FROM message_streams
+    WHERE checkpointed_at < now() - sqlc.arg('max_age')::interval
+)
+UPDATE messages
+SET status = 'failed', error_reason = sqlc.arg('error_reason')
+WHERE status = 'streaming'
+  AND created_at < now() - sqlc.arg('max_age')::interval
+  AND NOT EXISTS (
+      SELECT 1 FROM message_streams
+      WHERE message_streams.message_id = messages.id
+        AND message_streams.checkpointed_at >= now() - sqlc.arg('max_age')::interval
+  )
+RETURNING id;
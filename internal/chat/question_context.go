@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"sciedu-backend/internal/question"
+
+	"github.com/google/uuid"
+)
+
+// QuestionSource reads the question a chat is about and how the tutor may help with
+// it; question.QuestionService and question.TutorPolicyService implement it together.
+type QuestionSource interface {
+	QuestionLookup
+	GetTutorPolicy(ctx context.Context, questionID uuid.UUID) (question.TutorPolicy, error)
+}
+
+// QuestionServices joins the question services into a QuestionSource.
+type QuestionServices struct {
+	*question.QuestionService
+	TutorPolicies *question.TutorPolicyService
+}
+
+func (q QuestionServices) GetTutorPolicy(ctx context.Context, questionID uuid.UUID) (question.TutorPolicy, error) {
+	return q.TutorPolicies.Get(ctx, questionID)
+}
+
+// SetQuestions enables chats about a question; without it they cannot be created.
+func (s *ChatService) SetQuestions(questions QuestionSource) {
+	s.questions = questions
+}
+
+var hintLevelInstructions = map[string]string{
+	question.HintLevelNone: "Do not give hints toward the answer. You may clarify what the question " +
+		"asks and explain terms it uses, then leave the solving to the student.",
+	question.HintLevelNudge: "Give small nudges only: point to the relevant idea or ask a guiding " +
+		"question. Do not lay out solution steps or state the answer.",
+	question.HintLevelGuided: "Guide the student through the reasoning one step at a time, letting " +
+		"them do each step. Do not state the final answer.",
+	question.HintLevelFull: "You may explain the full solution, including the final answer, once the " +
+		"student has tried it themselves.",
+}
+
+func (s *ChatService) checkQuestion(ctx context.Context, questionID uuid.UUID) error {
+	if s.questions == nil {
+		return errors.New("chats about questions are not supported")
+	}
+	_, err := s.questions.Get(ctx, questionID)
+	return err
+}
+
+// questionPrompt tells the tutor which question the student is working on and how
+// much help to give. The answer key is only included when the question's tutor
+// policy says so.
+func (s *ChatService) questionPrompt(ctx context.Context, questionID uuid.UUID) (string, error) {
+	if s.questions == nil {
+		return "", errors.New("chats about questions are not supported")
+	}
+	q, err := s.questions.Get(ctx, questionID)
+	if err != nil {
+		return "", err
+	}
+	options, err := s.questions.ListOptionsByQuestion(ctx, questionID)
+	if err != nil {
+		return "", err
+	}
+	policy, err := s.questions.GetTutorPolicy(ctx, questionID)
+	if err != nil {
+		return "", err
+	}
+
+	var prompt strings.Builder
+	prompt.WriteString("The student is working on this question:\n")
+	prompt.WriteString(q.Content)
+	prompt.WriteString("\n")
+	if len(options) > 0 {
+		prompt.WriteString("\nChoices:\n")
+		for _, option := range options {
+			fmt.Fprintf(&prompt, "%s. %s\n", option.Label, option.Content)
+		}
+	}
+	instruction, ok := hintLevelInstructions[policy.HintLevel]
+	if !ok {
+		instruction = hintLevelInstructions[question.DefaultHintLevel]
+	}
+	prompt.WriteString("\n")
+	prompt.WriteString(instruction)
+	if policy.IncludeAnswerKey && policy.AnswerKey != "" {
+		prompt.WriteString("\n\nAnswer key, for checking the student's work; follow the rule above before revealing it:\n")
+		prompt.WriteString(policy.AnswerKey)
+	}
+	return prompt.String(), nil
+}
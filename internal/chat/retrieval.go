@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"sciedu-backend/internal/content"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxRetrievedPassages bounds the lesson materials sent with a prompt.
+	maxRetrievedPassages = 3
+	// passageTokens bounds the text of each material.
+	passageTokens = 600
+)
+
+const retrievalInstruction = "Lesson materials that may help with the student's message follow. " +
+	"Ground your answer in them when they are relevant, cite them as [1], [2] and so on, " +
+	"and ignore them when they are not."
+
+// Passage is lesson material relevant to a prompt.
+type Passage struct {
+	ContentID uuid.UUID
+	Title     string
+	Text      string
+}
+
+// Retriever finds lesson material relevant to a prompt, best first. ContentRetriever
+// searches text contents in PostgreSQL; an embedding index could stand in for it.
+type Retriever interface {
+	Retrieve(ctx context.Context, query string, limit int) ([]Passage, error)
+}
+
+// ContentSearcher ranks text contents against free text; content.Service implements it.
+type ContentSearcher interface {
+	RetrieveTextContents(ctx context.Context, text string, limit int32) ([]content.SearchResult, error)
+}
+
+// ContentRetriever retrieves text contents through full-text and trigram search.
+type ContentRetriever struct {
+	contents ContentSearcher
+}
+
+func NewContentRetriever(contents ContentSearcher) *ContentRetriever {
+	return &ContentRetriever{contents: contents}
+}
+
+func (r *ContentRetriever) Retrieve(ctx context.Context, query string, limit int) ([]Passage, error) {
+	results, err := r.contents.RetrieveTextContents(ctx, query, int32(limit))
+	if err != nil {
+		return nil, err
+	}
+	passages := make([]Passage, 0, len(results))
+	for _, result := range results {
+		passages = append(passages, Passage{
+			ContentID: result.Content.ID,
+			Title:     result.Content.Title.String,
+			Text:      result.Content.Content,
+		})
+	}
+	return passages, nil
+}
+
+// SetRetriever enables grounding replies in lesson materials; nil disables it.
+func (s *ChatService) SetRetriever(retriever Retriever) {
+	s.retriever = retriever
+}
+
+// retrieveContext finds lesson material for a prompt and records it as the citations
+// of the reply. It returns the material as a system message, or nothing when none was
+// found. A failure only costs the reply its grounding, so it is logged instead.
+func (s *ChatService) retrieveContext(ctx context.Context, replyID uuid.UUID, prompt string) []ChatMessage {
+	if s.retriever == nil || strings.TrimSpace(prompt) == "" {
+		return nil
+	}
+	passages, err := s.retriever.Retrieve(ctx, prompt, maxRetrievedPassages)
+	if err != nil {
+		s.logger.Warn("failed to retrieve lesson materials", zap.String("message_id", replyID.String()), zap.Error(err))
+		return nil
+	}
+	if len(passages) == 0 {
+		return nil
+	}
+
+	var material strings.Builder
+	material.WriteString(retrievalInstruction)
+	for i, passage := range passages {
+		title := passage.Title
+		if title == "" {
+			title = "Untitled"
+		}
+		fmt.Fprintf(&material, "\n\n[%d] %s (content %s)\n%s", i+1, title, passage.ContentID,
+			truncateTokens(strings.TrimSpace(passage.Text), passageTokens))
+
+		err := s.querier.CreateMessageCitation(ctx, CreateMessageCitationParams{
+			MessageID: replyID,
+			Position:  int32(i),
+			ContentID: passage.ContentID,
+		})
+		if err != nil {
+			s.logger.Warn("failed to record citation", zap.String("message_id", replyID.String()),
+				zap.String("content_id", passage.ContentID.String()), zap.Error(err))
+		}
+	}
+	return []ChatMessage{{Role: MessageRoleSystem, Content: material.String()}}
+}
+
+// fetchCitations returns the cited contents of every message in a chat, by message.
+func (s *ChatService) fetchCitations(ctx context.Context, chatID uuid.UUID) (map[uuid.UUID][]uuid.UUID, error) {
+	rows, err := s.querier.GetChatCitations(ctx, chatID)
+	if err != nil {
+		return nil, databaseutil.WrapDBErrorWithKeyValue(err, "message_citations", "chat_id", chatID.String(),
+			s.logger, "get chat citations")
+	}
+	result := make(map[uuid.UUID][]uuid.UUID)
+	for _, row := range rows {
+		result[row.MessageID] = append(result[row.MessageID], row.ContentID)
+	}
+	return result, nil
+}
@@ -0,0 +1,178 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"sciedu-backend/internal/content"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// fakeRetriever returns the same passages for every query and records the queries.
+type fakeRetriever struct {
+	passages []Passage
+	err      error
+	queries  []string
+}
+
+func (r *fakeRetriever) Retrieve(_ context.Context, query string, limit int) ([]Passage, error) {
+	r.queries = append(r.queries, query)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.passages[:min(limit, len(r.passages))], nil
+}
+
+func TestRetrieveContext_TableDriven(t *testing.T) {
+	photosynthesis := Passage{ContentID: uuid.New(), Title: "Photosynthesis", Text: "  Plants make sugar from light.  "}
+	untitled := Passage{ContentID: uuid.New(), Text: "Chlorophyll is green."}
+	long := Passage{ContentID: uuid.New(), Title: "Long", Text: strings.Repeat("word ", 4*passageTokens)}
+	tests := []struct {
+		name       string
+		retriever  *fakeRetriever
+		prompt     string
+		wantParts  []string
+		wantCited  []uuid.UUID
+		wantQuery  bool
+		wantLength int
+	}{
+		{name: "no retriever", prompt: "why are leaves green?"},
+		{name: "blank prompt", retriever: &fakeRetriever{passages: []Passage{photosynthesis}}, prompt: "  "},
+		{name: "failure", retriever: &fakeRetriever{err: errors.New("down")}, prompt: "leaves", wantQuery: true},
+		{name: "nothing found", retriever: &fakeRetriever{}, prompt: "leaves", wantQuery: true},
+		{
+			name:      "numbered passages",
+			retriever: &fakeRetriever{passages: []Passage{photosynthesis, untitled}},
+			prompt:    "why are leaves green?",
+			wantParts: []string{
+				retrievalInstruction,
+				"\n\n[1] Photosynthesis (content " + photosynthesis.ContentID.String() + ")\nPlants make sugar from light.",
+				"\n\n[2] Untitled (content " + untitled.ContentID.String() + ")\nChlorophyll is green.",
+			},
+			wantCited: []uuid.UUID{photosynthesis.ContentID, untitled.ContentID},
+			wantQuery: true,
+		},
+		{
+			name:      "at most three passages, each cut short",
+			retriever: &fakeRetriever{passages: []Passage{long, long, long, photosynthesis}},
+			prompt:    "leaves",
+			wantParts: []string{"[1] Long", "[3] Long", "…"},
+			wantCited: []uuid.UUID{long.ContentID, long.ContentID, long.ContentID},
+			wantQuery: true,
+			// The instruction and three passages of at most passageTokens each.
+			wantLength: len(retrievalInstruction) + 3*(4*passageTokens+100),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			service := newTestService(querier)
+			if tt.retriever != nil {
+				service.SetRetriever(tt.retriever)
+			}
+			replyID := uuid.New()
+
+			messages := service.retrieveContext(context.Background(), replyID, tt.prompt)
+			if tt.retriever != nil && (len(tt.retriever.queries) == 1) != tt.wantQuery {
+				t.Errorf("got queries %q, want a query: %t", tt.retriever.queries, tt.wantQuery)
+			}
+			if len(tt.wantParts) == 0 {
+				if len(messages) != 0 {
+					t.Errorf("got %+v, want no messages", messages)
+				}
+				return
+			}
+			if len(messages) != 1 || messages[0].Role != MessageRoleSystem {
+				t.Fatalf("got %+v, want one system message", messages)
+			}
+			for _, part := range tt.wantParts {
+				if !strings.Contains(messages[0].Content, part) {
+					t.Errorf("the material lacks %q:\n%s", part, messages[0].Content)
+				}
+			}
+			if tt.wantLength > 0 && len(messages[0].Content) > tt.wantLength {
+				t.Errorf("got %d bytes of material, want at most %d", len(messages[0].Content), tt.wantLength)
+			}
+
+			var cited []uuid.UUID
+			for i, citation := range querier.citations {
+				if citation.MessageID != replyID || citation.Position != int32(i) {
+					t.Errorf("citation %d: got %+v", i, citation)
+				}
+				cited = append(cited, citation.ContentID)
+			}
+			if !slices.Equal(cited, tt.wantCited) {
+				t.Errorf("got citations %v, want %v", cited, tt.wantCited)
+			}
+		})
+	}
+}
+
+// fakeContentSearcher answers every search with the same results.
+type fakeContentSearcher struct {
+	results []content.SearchResult
+	limits  []int32
+}
+
+func (s *fakeContentSearcher) RetrieveTextContents(_ context.Context, _ string, limit int32) ([]content.SearchResult, error) {
+	s.limits = append(s.limits, limit)
+	return s.results, nil
+}
+
+func TestContentRetriever(t *testing.T) {
+	id := uuid.New()
+	searcher := &fakeContentSearcher{results: []content.SearchResult{{
+		Content: content.Content{ID: id, Title: pgtype.Text{String: "Cells", Valid: true}, Content: "Cells are small."},
+		Snippet: "small",
+	}}}
+
+	passages, err := NewContentRetriever(searcher).Retrieve(context.Background(), "cells", 2)
+	if err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	want := []Passage{{ContentID: id, Title: "Cells", Text: "Cells are small."}}
+	if !slices.Equal(passages, want) || !slices.Equal(searcher.limits, []int32{2}) {
+		t.Errorf("got %+v with limits %v, want %+v with [2]", passages, searcher.limits, want)
+	}
+}
+
+func TestReplyCitations(t *testing.T) {
+	user := uuid.New()
+	querier := newFakeChatQuerier()
+	chat := querier.addChat(user)
+	passage := Passage{ContentID: uuid.New(), Title: "Cells", Text: "Cells are small."}
+	provider := &fakeProvider{deltas: []string{"They are small [1]."}}
+	service := newTestService(querier)
+	service.provider = provider
+	service.SetRetriever(&fakeRetriever{passages: []Passage{passage}})
+
+	created, err := service.CreateMessage(userContext(user), chat.ID, "how big are cells?", uuid.Nil, nil, GenerationOptions{})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	querier.waitFinished(t, created.ReplyMessageID)
+
+	messages := provider.lastRequest().Messages
+	if len(messages) != 2 || messages[0].Role != MessageRoleSystem || !strings.Contains(messages[0].Content, "[1] Cells") {
+		t.Errorf("the lesson material does not precede the prompt: %+v", messages)
+	}
+	history, err := service.GetChat(userContext(user), chat.ID)
+	if err != nil {
+		t.Fatalf("GetChat: %v", err)
+	}
+	for _, msg := range history {
+		want := []uuid.UUID(nil)
+		if msg.ID == created.ReplyMessageID {
+			want = []uuid.UUID{passage.ContentID}
+		}
+		if !slices.Equal(msg.Citations, want) {
+			t.Errorf("%s message: got citations %v, want %v", msg.Role, msg.Citations, want)
+		}
+	}
+}
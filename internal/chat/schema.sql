@@ -1,3 +1,13 @@
+CREATE TABLE IF NOT EXISTS personas (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    system_prompt TEXT NOT NULL,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 CREATE TABLE IF NOT EXISTS chats (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
@@ -11,4 +21,71 @@ CREATE TABLE IF NOT EXISTS messages (
     role VARCHAR(20) NOT NULL CHECK (role IN ('user', 'assistant', 'system')),
     status TEXT NOT NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
\ No newline at end of file
+);
+
+ALTER TABLE chats
+    ADD COLUMN IF NOT EXISTS current_leaf_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    ADD COLUMN IF NOT EXISTS title TEXT,
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS persona_id UUID REFERENCES personas(id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS model TEXT,
+    ADD COLUMN IF NOT EXISTS temperature REAL,
+    ADD COLUMN IF NOT EXISTS max_tokens INTEGER,
+    ADD COLUMN IF NOT EXISTS question_id UUID REFERENCES questions(id) ON DELETE SET NULL;
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS model TEXT,
+    ADD COLUMN IF NOT EXISTS temperature REAL,
+    ADD COLUMN IF NOT EXISTS max_tokens INTEGER,
+    ADD COLUMN IF NOT EXISTS tool_calls JSONB,
+    ADD COLUMN IF NOT EXISTS tool_call_id TEXT,
+    ADD COLUMN IF NOT EXISTS error_reason TEXT;
+
+ALTER TABLE messages
+    DROP CONSTRAINT IF EXISTS messages_role_check,
+    ADD CONSTRAINT messages_role_check CHECK (role IN ('user', 'assistant', 'system', 'tool'));
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat_id_created_at
+ON messages(chat_id, created_at);
+
+CREATE INDEX IF NOT EXISTS idx_chats_user_id_updated_at
+ON chats(user_id, updated_at DESC, id);
+
+CREATE TABLE IF NOT EXISTS message_summaries (
+    message_id UUID PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS message_attachments (
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    content_id UUID NOT NULL REFERENCES contents(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL CHECK (kind IN ('image', 'audio')),
+    mime_type TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_attachments_content_id
+ON message_attachments(content_id);
+
+CREATE TABLE IF NOT EXISTS message_citations (
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    content_id UUID NOT NULL REFERENCES contents(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_citations_content_id
+ON message_citations(content_id);
+
+CREATE TABLE IF NOT EXISTS message_streams (
+    message_id UUID PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    checkpointed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_streaming
+ON messages(created_at) WHERE status = 'streaming';
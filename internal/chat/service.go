@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"sciedu-backend/internal/auth"
+
 	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
 	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
 	"github.com/google/uuid"
@@ -14,19 +17,42 @@ import (
 )
 
 type ChatQuerier interface {
-	CreateChat(ctx context.Context) (Chat, error)
+	PersonaQuerier
+	CreateChat(ctx context.Context, arg CreateChatParams) (Chat, error)
 	CreateMessage(ctx context.Context, arg CreateMessageParams) (Message, error)
 	GetChat(ctx context.Context, id uuid.UUID) (Chat, error)
 	GetMessage(ctx context.Context, id uuid.UUID) (Message, error)
 	GetMessages(ctx context.Context, chatID uuid.UUID) ([]Message, error)
 	UpdateMessage(ctx context.Context, arg UpdateMessageParams) (Message, error)
+	UpdateMessageParent(ctx context.Context, arg UpdateMessageParentParams) error
+	UpdateChatCurrentLeaf(ctx context.Context, arg UpdateChatCurrentLeafParams) error
+	CreateMessageAttachment(ctx context.Context, arg CreateMessageAttachmentParams) (MessageAttachment, error)
+	GetChatAttachments(ctx context.Context, chatID uuid.UUID) ([]MessageAttachment, error)
+	CreateMessageCitation(ctx context.Context, arg CreateMessageCitationParams) error
+	GetChatCitations(ctx context.Context, chatID uuid.UUID) ([]MessageCitation, error)
+	CreateMessageStream(ctx context.Context, messageID uuid.UUID) error
+	CheckpointMessageStream(ctx context.Context, arg CheckpointMessageStreamParams) error
+	DeleteMessageStream(ctx context.Context, messageID uuid.UUID) error
+	FailOrphanedMessages(ctx context.Context, arg FailOrphanedMessagesParams) ([]uuid.UUID, error)
+	GetMessageSummaries(ctx context.Context, messageIds []uuid.UUID) ([]MessageSummary, error)
+	UpsertMessageSummary(ctx context.Context, arg UpsertMessageSummaryParams) error
+	SetChatTitleIfEmpty(ctx context.Context, arg SetChatTitleIfEmptyParams) error
+	ListChatsByUser(ctx context.Context, arg ListChatsByUserParams) ([]Chat, error)
+	CountChatsByUser(ctx context.Context, userID pgtype.UUID) (int64, error)
 }
 
 type ChatService struct {
 	provider  LLMProvider
 	querier   ChatQuerier
-	streamHub *StreamHub
+	streamHub Hub
+	media     MediaStore
+	tools     *ToolRegistry
+	questions QuestionSource
+	retriever Retriever
 	logger    *zap.Logger
+
+	contextBudgets ContextBudgets
+	models         Models
 }
 
 type MessageReturn struct {
@@ -36,6 +62,18 @@ type MessageReturn struct {
 	PreviousID uuid.UUID     `json:"previousID,omitempty"`
 	Status     MessageStatus `json:"status"`
 	CreatedAt  time.Time     `json:"createdAt"`
+	// Attachments are the media sent with a user message.
+	Attachments []AttachmentReturn `json:"attachments,omitempty"`
+	// Model is the model that generated an assistant message.
+	Model string `json:"model,omitempty"`
+	// ToolCalls are the tools an assistant message called; the results follow it as
+	// tool messages answering ToolCallID.
+	ToolCalls  []ToolCall `json:"toolCalls,omitempty"`
+	ToolCallID string     `json:"toolCallID,omitempty"`
+	// Citations are the lesson contents an assistant reply was given as context.
+	Citations []uuid.UUID `json:"citations,omitempty"`
+	// ErrorReason tells why a failed message failed.
+	ErrorReason string `json:"errorReason,omitempty"`
 }
 
 type CreateMessageReturn struct {
@@ -43,17 +81,47 @@ type CreateMessageReturn struct {
 	ReplyMessageID uuid.UUID     `json:"replyMessageID"`
 }
 
-func NewService(provider LLMProvider, querier ChatQuerier, streamHub *StreamHub, logger *zap.Logger) *ChatService {
+func NewService(provider LLMProvider, querier ChatQuerier, streamHub Hub, media MediaStore, logger *zap.Logger) *ChatService {
 	return &ChatService{
 		provider:  provider,
 		querier:   querier,
 		streamHub: streamHub,
+		media:     media,
 		logger:    logger,
+
+		contextBudgets: ContextBudgets{Default: defaultContextBudget},
 	}
 }
 
-func (s *ChatService) CreateChat(ctx context.Context) (uuid.UUID, error) {
-	chat, err := s.querier.CreateChat(ctx)
+// CreateChat creates a chat owned by the signed-in caller. A non-nil personaID sets
+// the tutor persona of the chat, a non-nil questionID the question it is about, and
+// options its default generation settings.
+func (s *ChatService) CreateChat(ctx context.Context, personaID uuid.UUID, questionID uuid.UUID, options GenerationOptions) (uuid.UUID, error) {
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok {
+		return uuid.Nil, handlerutil.ErrUnauthorized
+	}
+	if err := s.models.check(options.Model); err != nil {
+		return uuid.Nil, err
+	}
+	if personaID != uuid.Nil {
+		if _, err := s.getPersona(ctx, personaID); err != nil {
+			return uuid.Nil, err
+		}
+	}
+	if questionID != uuid.Nil {
+		if err := s.checkQuestion(ctx, questionID); err != nil {
+			return uuid.Nil, err
+		}
+	}
+	chat, err := s.querier.CreateChat(ctx, CreateChatParams{
+		UserID:      pgtype.UUID{Bytes: userID, Valid: true},
+		PersonaID:   pgtype.UUID{Bytes: personaID, Valid: personaID != uuid.Nil},
+		Model:       options.modelText(),
+		Temperature: options.temperatureFloat(),
+		MaxTokens:   options.maxTokensInt(),
+		QuestionID:  pgtype.UUID{Bytes: questionID, Valid: questionID != uuid.Nil},
+	})
 	if err != nil {
 		return uuid.New(), databaseutil.WrapDBError(err, s.logger, "create chat")
 	}
@@ -65,22 +133,23 @@ func (s *ChatService) fetchMessages(ctx context.Context, chatID uuid.UUID) ([]Me
 	if err != nil {
 		return nil, databaseutil.WrapDBErrorWithKeyValue(err, "messages", "chat_id", chatID.String(), s.logger, "get messages")
 	}
+	attachments, err := s.fetchAttachments(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	citations, err := s.fetchCitations(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
 	result := make([]MessageReturn, 0, len(messages))
 	for _, msg := range messages {
-		ret := MessageReturn{
-			ID:        msg.ID,
-			Content:   msg.Content.String,
-			Role:      MessageRole(msg.Role),
-			Status:    MessageStatus(msg.Status),
-			CreatedAt: msg.CreatedAt.Time,
-		}
-		if msg.PreviousID.Valid {
-			ret.PreviousID = uuid.UUID(msg.PreviousID.Bytes)
-		}
-		if msg.Content.String == "" {
-			if stream, ok := s.streamHub.GetStream(msg.ID); ok {
-				_, ret.Content, _ = stream.Get()
-			}
+		ret := toMessageReturn(msg)
+		ret.Attachments = attachments[msg.ID]
+		ret.Citations = citations[msg.ID]
+		// The stored content of a streaming message is its last checkpoint; a
+		// generation running here has fresher text.
+		if stream, ok := s.streamHub.GetStream(msg.ID); ok {
+			_, ret.Content, _ = stream.Get()
 		}
 		result = append(result, ret)
 	}
@@ -88,12 +157,8 @@ func (s *ChatService) fetchMessages(ctx context.Context, chatID uuid.UUID) ([]Me
 }
 
 func (s *ChatService) GetChat(ctx context.Context, chatID uuid.UUID) ([]MessageReturn, error) {
-	chat, err := s.querier.GetChat(ctx, chatID)
-	if err != nil {
-		return nil, databaseutil.WrapDBErrorWithKeyValue(err, "chat", "chat_id", chatID.String(), s.logger, "get chat")
-	}
-	if chat.ID == uuid.Nil {
-		return nil, handlerutil.NewNotFoundError("chat", "chat_id", chatID.String(), "")
+	if _, err := s.authorizeChat(ctx, chatID); err != nil {
+		return nil, err
 	}
 	result, err := s.fetchMessages(ctx, chatID)
 	if err != nil {
@@ -102,14 +167,22 @@ func (s *ChatService) GetChat(ctx context.Context, chatID uuid.UUID) ([]MessageR
 	return result, nil
 }
 
-func (s *ChatService) CreateMessage(ctx context.Context, chatID uuid.UUID, content string, previousID uuid.UUID) (CreateMessageReturn, error) {
+// CreateMessage adds a user prompt under previousID, with the given media contents
+// attached, and starts the reply to it. options override the chat's generation
+// settings for this reply.
+func (s *ChatService) CreateMessage(ctx context.Context, chatID uuid.UUID, content string, previousID uuid.UUID, attachmentIDs []uuid.UUID, options GenerationOptions) (CreateMessageReturn, error) {
 
-	chat, err := s.querier.GetChat(ctx, chatID)
+	chat, err := s.authorizeChat(ctx, chatID)
+	if err != nil {
+		return CreateMessageReturn{}, err
+	}
+	options, err = s.generationOptions(chat, options)
 	if err != nil {
-		return CreateMessageReturn{}, databaseutil.WrapDBErrorWithKeyValue(err, "chat", "chat_id", chatID.String(), s.logger, "get chat")
+		return CreateMessageReturn{}, err
 	}
-	if chat.ID == uuid.Nil {
-		return CreateMessageReturn{}, handlerutil.NewNotFoundError("chat", "chat_id", chatID.String(), "")
+	attachments, err := s.inspectAttachments(ctx, attachmentIDs)
+	if err != nil {
+		return CreateMessageReturn{}, err
 	}
 
 	// Create message in DB
@@ -129,12 +202,115 @@ func (s *ChatService) CreateMessage(ctx context.Context, chatID uuid.UUID, conte
 	if err != nil {
 		return CreateMessageReturn{}, databaseutil.WrapDBError(err, s.logger, "create message")
 	}
+	if err := s.createAttachments(ctx, userMessage.ID, attachments); err != nil {
+		return CreateMessageReturn{}, err
+	}
+	if !chat.Title.Valid {
+		s.setTitle(ctx, chatID, content)
+	}
 
-	allMessages, err := s.fetchMessages(ctx, chatID)
+	replyID, err := s.startReply(ctx, chat, userMessage.ID, options)
+	if err != nil {
+		return CreateMessageReturn{}, err
+	}
+
+	return CreateMessageReturn{
+		Message: MessageReturn{
+			ID:          userMessage.ID,
+			Content:     userMessage.Content.String,
+			Role:        MessageRole(userMessage.Role),
+			Status:      MessageStatus(userMessage.Status),
+			CreatedAt:   userMessage.CreatedAt.Time,
+			PreviousID:  previousID, //!
+			Attachments: attachments,
+		},
+		ReplyMessageID: replyID,
+	}, nil
+
+}
+
+// RegenerateMessage asks the LLM again for the prompt behind messageID. messageID is
+// either an assistant reply, which gets a new sibling, or a user prompt, which gets
+// another reply. Earlier replies stay in the tree as branches.
+func (s *ChatService) RegenerateMessage(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID, options GenerationOptions) (CreateMessageReturn, error) {
+	chat, err := s.authorizeChat(ctx, chatID)
+	if err != nil {
+		return CreateMessageReturn{}, err
+	}
+	options, err = s.generationOptions(chat, options)
+	if err != nil {
+		return CreateMessageReturn{}, err
+	}
+	msg, err := s.getChatMessage(ctx, chatID, messageID)
 	if err != nil {
 		return CreateMessageReturn{}, err
 	}
-	history := createChatHistory(allMessages)
+
+	// A reply may sit below the tool calls and results it used; the prompt is above them.
+	prompt := msg
+	for MessageRole(prompt.Role) != MessageRoleUser {
+		if !prompt.PreviousID.Valid {
+			return CreateMessageReturn{}, fmt.Errorf("%w: message %s has no prompt to answer", ErrInvalidBranch, messageID)
+		}
+		previous, err := s.getChatMessage(ctx, chatID, prompt.PreviousID.Bytes)
+		if err != nil {
+			return CreateMessageReturn{}, err
+		}
+		if MessageRole(previous.Role) != MessageRoleUser && !isToolStep(previous) {
+			return CreateMessageReturn{}, fmt.Errorf("%w: message %s does not answer a user prompt", ErrInvalidBranch, messageID)
+		}
+		prompt = previous
+	}
+
+	replyID, err := s.startReply(ctx, chat, prompt.ID, options)
+	if err != nil {
+		return CreateMessageReturn{}, err
+	}
+
+	return CreateMessageReturn{
+		Message:        toMessageReturn(prompt),
+		ReplyMessageID: replyID,
+	}, nil
+}
+
+// EditMessage adds content as a new version of the user prompt messageID: a sibling
+// under the same previous message, answered from that branch only. The original
+// prompt and its replies stay in the tree.
+func (s *ChatService) EditMessage(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID, content string, attachmentIDs []uuid.UUID, options GenerationOptions) (CreateMessageReturn, error) {
+	if _, err := s.authorizeChat(ctx, chatID); err != nil {
+		return CreateMessageReturn{}, err
+	}
+	original, err := s.getChatMessage(ctx, chatID, messageID)
+	if err != nil {
+		return CreateMessageReturn{}, err
+	}
+	if MessageRole(original.Role) != MessageRoleUser {
+		return CreateMessageReturn{}, fmt.Errorf("%w: only user prompts can be edited", ErrInvalidBranch)
+	}
+
+	var previousID uuid.UUID
+	if original.PreviousID.Valid {
+		previousID = original.PreviousID.Bytes
+	}
+	return s.CreateMessage(ctx, chatID, content, previousID, attachmentIDs, options)
+}
+
+// startReply creates an assistant placeholder under promptID, makes it the chat's
+// current leaf and streams the LLM answer into it. The LLM context is the branch
+// ending at promptID, preceded by the chat's system messages and the lesson materials
+// retrieved for the prompt, and fitted into the model's context budget. options are
+// the resolved generation settings, which the reply records.
+func (s *ChatService) startReply(ctx context.Context, chat Chat, promptID uuid.UUID, options GenerationOptions) (uuid.UUID, error) {
+	chatID := chat.ID
+	allMessages, err := s.fetchMessages(ctx, chatID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	system, err := s.systemMessages(ctx, chat)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	path := newMessageTree(allMessages).pathTo(promptID)
 
 	// create response message in DB
 	llmMessage, err := s.querier.CreateMessage(ctx, CreateMessageParams{
@@ -146,54 +322,163 @@ func (s *ChatService) CreateMessage(ctx context.Context, chatID uuid.UUID, conte
 		Role:   string(MessageRoleAssistant),
 		Status: string(MessageStatusStreaming),
 		PreviousID: pgtype.UUID{
-			Bytes: [16]byte(userMessage.ID),
+			Bytes: [16]byte(promptID),
 			Valid: true,
 		},
+		Model:       options.modelText(),
+		Temperature: options.temperatureFloat(),
+		MaxTokens:   options.maxTokensInt(),
 	})
 	if err != nil {
-		return CreateMessageReturn{}, databaseutil.WrapDBError(err, s.logger, "create response message")
+		return uuid.Nil, databaseutil.WrapDBError(err, s.logger, "create response message")
+	}
+	if err := s.updateCurrentLeaf(ctx, chatID, llmMessage.ID); err != nil {
+		return uuid.Nil, err
+	}
+
+	// The generation outlives the request; it ends on completion, failure or Cancel.
+	// Retrieval and summarizing older turns take time, so the history is built there too.
+	streamCtx, cancel := context.WithCancel(context.Background())
+	streamEvent := s.streamHub.CreateStream(llmMessage.ID, cancel)
+	if err := s.querier.CreateMessageStream(ctx, llmMessage.ID); err != nil {
+		s.logger.Warn("failed to record stream", zap.String("message_id", llmMessage.ID.String()), zap.Error(err))
 	}
+	go func() {
+		defer cancel()
+		go s.checkpointStream(streamCtx, llmMessage.ID, streamEvent)
+		if len(path) > 0 {
+			system = append(system, s.retrieveContext(streamCtx, llmMessage.ID, path[len(path)-1].Content)...)
+		}
+		providerReq := CreateChatCompletionRequest{
+			Model:       options.Model,
+			Messages:    s.buildHistory(streamCtx, system, path, s.contextBudgets.forModel(options.Model)),
+			Stream:      true,
+			Temperature: options.Temperature,
+			MaxTokens:   options.MaxTokens,
+		}
+		s.streamProcessor(streamCtx, llmMessage, streamEvent, providerReq)
+	}()
+
+	return llmMessage.ID, nil
+}
 
-	// create provider request
-	providerReq := CreateChatCompletionRequest{
-		Messages: history,
-		Stream:   true,
+// getChatMessage loads a message and checks that it belongs to the chat.
+func (s *ChatService) getChatMessage(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID) (Message, error) {
+	msg, err := s.querier.GetMessage(ctx, messageID)
+	if err != nil {
+		return Message{}, databaseutil.WrapDBErrorWithKeyValue(err, "message", "message_id", messageID.String(), s.logger, "get message")
+	}
+	if msg.ID == uuid.Nil || msg.ChatID != chatID {
+		return Message{}, handlerutil.NewNotFoundError("message", "message_id", messageID.String(), "message does not belong to this chat")
 	}
+	return msg, nil
+}
 
-	streamEvent := s.streamHub.CreateStream(llmMessage.ID)
-	go s.streamProcessor(context.Background(), llmMessage.ID, streamEvent, providerReq)
+func toMessageReturn(msg Message) MessageReturn {
+	ret := MessageReturn{
+		ID:          msg.ID,
+		Content:     msg.Content.String,
+		Role:        MessageRole(msg.Role),
+		Status:      MessageStatus(msg.Status),
+		CreatedAt:   msg.CreatedAt.Time,
+		Model:       msg.Model.String,
+		ToolCalls:   decodeToolCalls(msg.ToolCalls),
+		ErrorReason: msg.ErrorReason.String,
+	}
+	if msg.ToolCallID.Valid {
+		ret.ToolCallID = msg.ToolCallID.String
+	}
+	if msg.PreviousID.Valid {
+		ret.PreviousID = uuid.UUID(msg.PreviousID.Bytes)
+	}
+	return ret
+}
 
-	return CreateMessageReturn{
-		Message: MessageReturn{
-			ID:         userMessage.ID,
-			Content:    userMessage.Content.String,
-			Role:       MessageRole(userMessage.Role),
-			Status:     MessageStatus(userMessage.Status),
-			CreatedAt:  userMessage.CreatedAt.Time,
-			PreviousID: previousID, //!
-		},
-		ReplyMessageID: llmMessage.ID,
-	}, nil
+// Stream follows the generation of messageID from byte offset of its content, so that
+// a client reconnecting with the ID of the last event it got continues where it was.
+func (s *ChatService) Stream(ctx context.Context, messageID uuid.UUID, offset int) (bool, <-chan StreamDelta, <-chan error, func()) {
+	return s.streamHub.Subscribe(ctx, messageID, offset)
+}
 
+// CancelStream stops an in-flight generation. The message keeps its partial content
+// and is stored with the cancelled status once the stream shuts down.
+func (s *ChatService) CancelStream(ctx context.Context, messageID uuid.UUID) error {
+	if err := s.AuthorizeMessage(ctx, messageID); err != nil {
+		return err
+	}
+	if !s.streamHub.Cancel(ctx, messageID) {
+		return handlerutil.NewNotFoundError("stream", "messageID", messageID.String(), "no generation in progress")
+	}
+	return nil
 }
 
-func (s *ChatService) Stream(ctx context.Context, messageID uuid.UUID) (bool, <-chan StreamDelta, <-chan error, func()) {
-	streamEvent, ok := s.streamHub.GetStream(messageID)
-	if !ok {
-		return false, nil, nil, func() {}
+// streamProcessor streams the LLM answer into reply. When the model calls tools, the
+// calls are run and the model is asked again with their results, up to maxToolRounds
+// times. The text of every round is streamed to reply; the text of a round that called
+// tools is also stored with the calls, so that the next round sees it.
+func (s *ChatService) streamProcessor(ctx context.Context, reply Message, streamEvent *StreamEvent, providerReq CreateChatCompletionRequest) {
+	providerReq.Tools = s.tools.definitions()
+	parentID := uuid.UUID(reply.PreviousID.Bytes)
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			providerReq.Tools = nil
+		}
+		text, calls, ok := s.streamRound(ctx, streamEvent, providerReq)
+		if !ok {
+			break
+		}
+		if len(calls) == 0 || providerReq.Tools == nil {
+			streamEvent.Complete()
+			break
+		}
+		messages, lastID, err := s.runTools(ctx, reply, parentID, text, calls)
+		if err != nil {
+			streamEvent.Fail(err)
+			break
+		}
+		parentID = lastID
+		providerReq.Messages = append(providerReq.Messages, messages...)
+	}
+
+	status, fullChunk, err := streamEvent.Get()
+	var errorReason pgtype.Text
+	if status == MessageStatusError {
+		SSEError(err, s.logger)
+		errorReason = pgtype.Text{String: NewStreamProblem(err).Detail, Valid: true}
+	}
+	s.streamHub.DeleteStream(reply.ID)
+	// Use a fresh context so client disconnect doesn't prevent persisting the final state.
+	updateCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = s.querier.UpdateMessage(updateCtx, UpdateMessageParams{
+		ID: reply.ID,
+		Content: pgtype.Text{
+			String: fullChunk,
+			Valid:  true,
+		},
+		Status:      string(status),
+		ErrorReason: errorReason,
+	})
+	if err != nil {
+		SSEError(err, s.logger)
+	}
+	if err := s.querier.DeleteMessageStream(updateCtx, reply.ID); err != nil {
+		SSEError(err, s.logger)
 	}
-	llmCh, errCh, cancel := streamEvent.Subscribe()
-	return ok, llmCh, errCh, cancel
 }
 
-func (s *ChatService) streamProcessor(ctx context.Context, messageID uuid.UUID, streamEvent *StreamEvent, providerReq CreateChatCompletionRequest) {
+// streamRound streams one model response into streamEvent and returns its text and the
+// tool calls it made. It reports false when the stream failed or was cancelled, also
+// when it ended while the round was running.
+func (s *ChatService) streamRound(ctx context.Context, streamEvent *StreamEvent, providerReq CreateChatCompletionRequest) (string, []ToolCall, bool) {
 	llmCh, errCh := s.provider.Stream(ctx, providerReq)
-	endFlag := false
-	for !endFlag && (llmCh != nil || errCh != nil) {
+	var text strings.Builder
+	var calls toolCallBuilder
+	for llmCh != nil || errCh != nil {
 		select {
 		case <-ctx.Done():
 			streamEvent.Fail(ctx.Err())
-			endFlag = true
+			return "", nil, false
 		case err, ok := <-errCh:
 			if !ok {
 				errCh = nil
@@ -201,43 +486,39 @@ func (s *ChatService) streamProcessor(ctx context.Context, messageID uuid.UUID,
 			}
 			if err != nil {
 				streamEvent.Fail(err)
-				endFlag = true
+				return "", nil, false
 			}
 		case chunk, ok := <-llmCh:
 			if !ok {
 				llmCh = nil
 				continue
-			} else {
-				if chunk.IsFinished {
-					streamEvent.Complete()
-					endFlag = true
-				} else {
-					streamEvent.AppendDelta(chunk)
+			}
+			calls.add(chunk.ToolCalls)
+			if chunk.IsFinished {
+				return text.String(), calls.build(), true
+			}
+			if chunk.Delta != "" {
+				// Tool call fragments stay with the service.
+				text.WriteString(chunk.Delta)
+				if err := streamEvent.AppendDelta(StreamDelta{Delta: chunk.Delta}); err != nil {
+					// The stream was cancelled or failed; its final status stands.
+					return "", nil, false
 				}
 			}
 		}
 	}
-
-	status, fullChunk, err := streamEvent.Get()
-	if err != nil {
-		SSEError(err, s.logger)
-	}
-	s.streamHub.DeleteStream(messageID)
-	// Use a fresh context so client disconnect doesn't prevent persisting the final state.
-	updateCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	_, err = s.querier.UpdateMessage(updateCtx, UpdateMessageParams{
-		ID: messageID,
-		Content: pgtype.Text{
-			String: fullChunk,
-			Valid:  true,
-		},
-		Status: string(status),
-	})
-	if err != nil {
-		SSEError(err, s.logger)
+	if ctx.Err() != nil {
+		streamEvent.Fail(ctx.Err())
+		return "", nil, false
 	}
+	return text.String(), calls.build(), true
+}
 
+// isToolStep tells whether msg is part of a reply's tool use: an assistant message
+// calling tools or a tool result.
+func isToolStep(msg Message) bool {
+	return MessageRole(msg.Role) == MessageRoleTool ||
+		(MessageRole(msg.Role) == MessageRoleAssistant && len(msg.ToolCalls) > 0)
 }
 
 func (s *ChatService) ValidatePreviousID(ctx context.Context, previousID uuid.UUID, chatID uuid.UUID) error {
@@ -257,45 +538,19 @@ func (s *ChatService) ValidatePreviousID(ctx context.Context, previousID uuid.UU
 	return nil
 }
 
-func createChatHistory(allMessages []MessageReturn) []ChatMessage {
-	if len(allMessages) == 0 {
-		return nil
-	}
-
-	allMessagesMap := make(map[uuid.UUID]MessageReturn, len(allMessages))
-	for _, msg := range allMessages {
-		allMessagesMap[msg.ID] = msg
-	}
-
-	history := make([]ChatMessage, 0, len(allMessages))
-	idNow := allMessages[len(allMessages)-1].ID
-
-	for {
-		msg, ok := allMessagesMap[idNow]
-		if !ok {
-			break
-		}
-		history = append(history, ChatMessage{
-			Role:    msg.Role,
-			Content: msg.Content,
-		})
-		if msg.PreviousID == uuid.Nil {
-			break
-		}
-		idNow = msg.PreviousID
-	}
-
-	result := make([]ChatMessage, 0, len(history))
-	for i := len(history) - 1; i >= 0; i-- {
-		result = append(result, history[i])
+// SSEError logs a stream failure, with the detail of an LLM service error response,
+// which NewStreamProblem keeps from users.
+func SSEError(err error, logger *zap.Logger) {
+	fields := []zap.Field{zap.String("problem", "SSE Error"), zap.Error(err)}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		fields = append(fields, zap.Int("upstream_status", upstreamErr.StatusCode), zap.String("upstream_detail", upstreamErr.Detail))
 	}
-
-	return result
+	logger.Warn("Handling SSE Error", fields...)
 }
 
-func SSEError(err error, logger *zap.Logger) {
-	logger.Warn("Handling SSE Error", zap.String("problem", "SSE Error"), zap.Error(err))
-}
+// ErrInvalidBranch is returned when a message cannot be branched from as requested.
+var ErrInvalidBranch = errors.New("invalid branch")
 
 // temp
 var ErrStatus502 = errors.New("message has error status")
@@ -0,0 +1,657 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sciedu-backend/internal/auth"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+// fakeChatQuerier serves a chat and its messages from memory. Queries a test does not
+// expect are left to the embedded nil ChatQuerier, so they fail loudly.
+type fakeChatQuerier struct {
+	ChatQuerier
+
+	// lock guards the messages, which generations update in the background.
+	lock     sync.Mutex
+	chats    map[uuid.UUID]Chat
+	messages []Message
+	personas map[uuid.UUID]Persona
+	// summaries are the cached summaries by the last message they cover.
+	summaries   map[uuid.UUID]string
+	attachments []MessageAttachment
+	citations   []MessageCitation
+	// finished receives every message a generation stores its final state in.
+	finished chan Message
+
+	getChatFn                 func(ctx context.Context, id uuid.UUID) (Chat, error)
+	getMessagesFn             func(ctx context.Context, chatID uuid.UUID) ([]Message, error)
+	updateChatCurrentLeafArgs []UpdateChatCurrentLeafParams
+}
+
+func newFakeChatQuerier() *fakeChatQuerier {
+	return &fakeChatQuerier{
+		chats:     map[uuid.UUID]Chat{},
+		personas:  map[uuid.UUID]Persona{},
+		summaries: map[uuid.UUID]string{},
+		finished:  make(chan Message, 16),
+	}
+}
+
+func (f *fakeChatQuerier) GetChat(ctx context.Context, id uuid.UUID) (Chat, error) {
+	if f.getChatFn != nil {
+		return f.getChatFn(ctx, id)
+	}
+	chat, ok := f.chats[id]
+	if !ok {
+		return Chat{}, pgx.ErrNoRows
+	}
+	return chat, nil
+}
+
+func (f *fakeChatQuerier) CreateChat(_ context.Context, arg CreateChatParams) (Chat, error) {
+	chat := Chat{
+		ID:          uuid.New(),
+		UserID:      arg.UserID,
+		PersonaID:   arg.PersonaID,
+		Model:       arg.Model,
+		Temperature: arg.Temperature,
+		MaxTokens:   arg.MaxTokens,
+		QuestionID:  arg.QuestionID,
+	}
+	f.chats[chat.ID] = chat
+	return chat, nil
+}
+
+func (f *fakeChatQuerier) ListChatsByUser(_ context.Context, arg ListChatsByUserParams) ([]Chat, error) {
+	var owned []Chat
+	for _, chat := range f.chats {
+		if chat.UserID == arg.UserID {
+			owned = append(owned, chat)
+		}
+	}
+	start := min(int(arg.Offset), len(owned))
+	end := min(start+int(arg.Limit), len(owned))
+	return owned[start:end], nil
+}
+
+func (f *fakeChatQuerier) CountChatsByUser(_ context.Context, userID pgtype.UUID) (int64, error) {
+	var count int64
+	for _, chat := range f.chats {
+		if chat.UserID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakeChatQuerier) GetPersona(_ context.Context, id uuid.UUID) (Persona, error) {
+	persona, ok := f.personas[id]
+	if !ok {
+		return Persona{}, pgx.ErrNoRows
+	}
+	return persona, nil
+}
+
+func (f *fakeChatQuerier) ListPersonas(context.Context) ([]Persona, error) {
+	result := make([]Persona, 0, len(f.personas))
+	for _, persona := range f.personas {
+		result = append(result, persona)
+	}
+	return result, nil
+}
+
+func (f *fakeChatQuerier) CreatePersona(_ context.Context, arg CreatePersonaParams) (Persona, error) {
+	persona := Persona{
+		ID:           uuid.New(),
+		Name:         arg.Name,
+		Description:  arg.Description,
+		SystemPrompt: arg.SystemPrompt,
+		CreatedBy:    arg.CreatedBy,
+	}
+	f.personas[persona.ID] = persona
+	return persona, nil
+}
+
+func (f *fakeChatQuerier) DeletePersona(_ context.Context, id uuid.UUID) error {
+	delete(f.personas, id)
+	return nil
+}
+
+func (f *fakeChatQuerier) GetMessage(_ context.Context, id uuid.UUID) (Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, msg := range f.messages {
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+	return Message{}, pgx.ErrNoRows
+}
+
+func (f *fakeChatQuerier) GetMessages(ctx context.Context, chatID uuid.UUID) ([]Message, error) {
+	if f.getMessagesFn != nil {
+		return f.getMessagesFn(ctx, chatID)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var result []Message
+	for _, msg := range f.messages {
+		if msg.ChatID == chatID {
+			result = append(result, msg)
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeChatQuerier) CreateMessage(_ context.Context, arg CreateMessageParams) (Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	msg := Message{
+		ID:          uuid.New(),
+		ChatID:      arg.ChatID,
+		PreviousID:  arg.PreviousID,
+		Content:     arg.Content,
+		Role:        arg.Role,
+		Status:      arg.Status,
+		CreatedAt:   pgtype.Timestamptz{Time: time.Unix(int64(len(f.messages)), 0), Valid: true},
+		Model:       arg.Model,
+		Temperature: arg.Temperature,
+		MaxTokens:   arg.MaxTokens,
+		ToolCalls:   arg.ToolCalls,
+		ToolCallID:  arg.ToolCallID,
+	}
+	f.messages = append(f.messages, msg)
+	return msg, nil
+}
+
+func (f *fakeChatQuerier) UpdateMessage(_ context.Context, arg UpdateMessageParams) (Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, msg := range f.messages {
+		if msg.ID == arg.ID {
+			msg.Content = arg.Content
+			msg.Status = arg.Status
+			msg.ErrorReason = arg.ErrorReason
+			f.messages[i] = msg
+			f.finished <- msg
+			return msg, nil
+		}
+	}
+	return Message{}, pgx.ErrNoRows
+}
+
+func (f *fakeChatQuerier) UpdateMessageParent(_ context.Context, arg UpdateMessageParentParams) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i := range f.messages {
+		if f.messages[i].ID == arg.ID {
+			f.messages[i].PreviousID = arg.PreviousID
+			return nil
+		}
+	}
+	return pgx.ErrNoRows
+}
+
+func (f *fakeChatQuerier) SetChatTitleIfEmpty(_ context.Context, arg SetChatTitleIfEmptyParams) error {
+	if chat, ok := f.chats[arg.ID]; ok && !chat.Title.Valid {
+		chat.Title = arg.Title
+		f.chats[arg.ID] = chat
+	}
+	return nil
+}
+
+func (f *fakeChatQuerier) GetMessageSummaries(_ context.Context, messageIDs []uuid.UUID) ([]MessageSummary, error) {
+	var result []MessageSummary
+	for _, id := range messageIDs {
+		if content, ok := f.summaries[id]; ok {
+			result = append(result, MessageSummary{MessageID: id, Content: content})
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeChatQuerier) UpsertMessageSummary(_ context.Context, arg UpsertMessageSummaryParams) error {
+	f.summaries[arg.MessageID] = arg.Content
+	return nil
+}
+
+func (f *fakeChatQuerier) CreateMessageStream(context.Context, uuid.UUID) error {
+	return nil
+}
+
+func (f *fakeChatQuerier) CheckpointMessageStream(context.Context, CheckpointMessageStreamParams) error {
+	return nil
+}
+
+func (f *fakeChatQuerier) DeleteMessageStream(context.Context, uuid.UUID) error {
+	return nil
+}
+
+func (f *fakeChatQuerier) CreateMessageAttachment(_ context.Context, arg CreateMessageAttachmentParams) (MessageAttachment, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	attachment := MessageAttachment{
+		MessageID: arg.MessageID,
+		Position:  arg.Position,
+		ContentID: arg.ContentID,
+		Kind:      arg.Kind,
+		MimeType:  arg.MimeType,
+	}
+	f.attachments = append(f.attachments, attachment)
+	return attachment, nil
+}
+
+func (f *fakeChatQuerier) GetChatAttachments(_ context.Context, chatID uuid.UUID) ([]MessageAttachment, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var result []MessageAttachment
+	for _, attachment := range f.attachments {
+		for _, msg := range f.messages {
+			if msg.ID == attachment.MessageID && msg.ChatID == chatID {
+				result = append(result, attachment)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeChatQuerier) CreateMessageCitation(_ context.Context, arg CreateMessageCitationParams) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.citations = append(f.citations, MessageCitation{MessageID: arg.MessageID, Position: arg.Position, ContentID: arg.ContentID})
+	return nil
+}
+
+func (f *fakeChatQuerier) GetChatCitations(_ context.Context, chatID uuid.UUID) ([]MessageCitation, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var result []MessageCitation
+	for _, citation := range f.citations {
+		for _, msg := range f.messages {
+			if msg.ID == citation.MessageID && msg.ChatID == chatID {
+				result = append(result, citation)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeChatQuerier) UpdateChatCurrentLeaf(_ context.Context, arg UpdateChatCurrentLeafParams) error {
+	f.updateChatCurrentLeafArgs = append(f.updateChatCurrentLeafArgs, arg)
+	if chat, ok := f.chats[arg.ID]; ok {
+		chat.CurrentLeafID = arg.CurrentLeafID
+		f.chats[arg.ID] = chat
+	}
+	return nil
+}
+
+// addChat stores a chat owned by owner.
+func (f *fakeChatQuerier) addChat(owner uuid.UUID) Chat {
+	chat := Chat{
+		ID:     uuid.New(),
+		UserID: pgtype.UUID{Bytes: owner, Valid: owner != uuid.Nil},
+	}
+	f.chats[chat.ID] = chat
+	return chat
+}
+
+// addMessage stores a message of chatID under previousID, created after the ones
+// before it.
+func (f *fakeChatQuerier) addMessage(chatID, previousID uuid.UUID, role MessageRole, content string) Message {
+	msg := Message{
+		ID:         uuid.New(),
+		ChatID:     chatID,
+		PreviousID: pgtype.UUID{Bytes: previousID, Valid: previousID != uuid.Nil},
+		Content:    pgtype.Text{String: content, Valid: true},
+		Role:       string(role),
+		Status:     string(MessageStatusDone),
+		CreatedAt:  pgtype.Timestamptz{Time: time.Unix(int64(len(f.messages)), 0), Valid: true},
+	}
+	f.messages = append(f.messages, msg)
+	return msg
+}
+
+// waitFinished returns the final state of the generation of messageID.
+func (f *fakeChatQuerier) waitFinished(t *testing.T, messageID uuid.UUID) Message {
+	t.Helper()
+	for {
+		select {
+		case msg := <-f.finished:
+			if msg.ID == messageID {
+				return msg
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the generation of %s did not finish", messageID)
+			return Message{}
+		}
+	}
+}
+
+// fakeProvider answers every request with the same deltas, then err if set, and
+// records the requests it got. With hold set it then waits for the request to be
+// cancelled and sends the reason to hold. rounds, when set, script the chunks of each
+// request in turn instead of deltas.
+type fakeProvider struct {
+	deltas []string
+	rounds [][]StreamDelta
+	err    error
+	hold   chan error
+
+	lock     sync.Mutex
+	requests []CreateChatCompletionRequest
+}
+
+func (p *fakeProvider) Stream(ctx context.Context, req CreateChatCompletionRequest) (<-chan StreamDelta, <-chan error) {
+	p.lock.Lock()
+	p.requests = append(p.requests, req)
+	var chunks []StreamDelta
+	if len(p.rounds) > 0 {
+		chunks = p.rounds[min(len(p.requests), len(p.rounds))-1]
+	}
+	p.lock.Unlock()
+	for _, delta := range p.deltas {
+		chunks = append(chunks, StreamDelta{Delta: delta})
+	}
+
+	ch := make(chan StreamDelta)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		defer close(errCh)
+		for _, chunk := range chunks {
+			select {
+			case ch <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if p.hold != nil {
+			<-ctx.Done()
+			p.hold <- ctx.Err()
+			return
+		}
+		if p.err != nil {
+			errCh <- p.err
+			return
+		}
+		select {
+		case ch <- StreamDelta{IsFinished: true}:
+		case <-ctx.Done():
+		}
+	}()
+	return ch, errCh
+}
+
+func (p *fakeProvider) lastRequest() CreateChatCompletionRequest {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.requests) == 0 {
+		return CreateChatCompletionRequest{}
+	}
+	return p.requests[len(p.requests)-1]
+}
+
+func newTestService(querier ChatQuerier) *ChatService {
+	return NewService(&fakeProvider{}, querier, NewStreamHub(), nil, zap.NewNop())
+}
+
+// userContext is a request context signed in as userID with the given roles.
+func userContext(userID uuid.UUID, roles ...string) context.Context {
+	return auth.WithUser(context.Background(), auth.User{ID: userID, Roles: roles})
+}
+
+// historyOf lists the contents of the messages of a provider request.
+func historyOf(req CreateChatCompletionRequest) []string {
+	result := make([]string, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		result = append(result, msg.Content)
+	}
+	return result
+}
+
+func TestRegenerateMessage_TableDriven(t *testing.T) {
+	tests := []struct {
+		name string
+		// message is the message to regenerate; "other chat" is a message of another
+		// chat.
+		message     string
+		wantPrompt  string
+		wantHistory []string
+		wantErr     error
+	}{
+		{name: "assistant reply gets a sibling", message: "a2", wantPrompt: "q2", wantHistory: []string{"q1", "a1", "q2"}},
+		{name: "user prompt gets another reply", message: "q3", wantPrompt: "q3", wantHistory: []string{"q1", "a1'", "q3"}},
+		{name: "reply after tool use answers the prompt above it", message: "t-answer", wantPrompt: "q4", wantHistory: []string{"q4"}},
+		{name: "reply without a prompt", message: "orphan", wantErr: ErrInvalidBranch},
+		{name: "message of another chat", message: "other chat", wantErr: handlerutil.NotFoundError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner := uuid.New()
+			querier := newFakeChatQuerier()
+			chat, ids := branchedChat(querier, owner)
+			call := querier.addMessage(chat.ID, ids["q4"], MessageRoleAssistant, "")
+			querier.messages[len(querier.messages)-1].ToolCalls = []byte(`[{"id":"c1","type":"function","function":{"name":"calculate","arguments":"{}"}}]`)
+			result := querier.addMessage(chat.ID, call.ID, MessageRoleTool, "42")
+			ids["t-answer"] = querier.addMessage(chat.ID, result.ID, MessageRoleAssistant, "t-answer").ID
+			ids["orphan"] = querier.addMessage(chat.ID, uuid.Nil, MessageRoleAssistant, "orphan").ID
+			ids["other chat"] = querier.addMessage(uuid.New(), uuid.Nil, MessageRoleUser, "other chat").ID
+			before := len(querier.messages)
+
+			provider := &fakeProvider{deltas: []string{"new ", "answer"}}
+			service := newTestService(querier)
+			service.provider = provider
+
+			got, err := service.RegenerateMessage(userContext(owner), chat.ID, ids[tt.message], GenerationOptions{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if len(querier.messages) != before {
+					t.Errorf("a failed regeneration created %d messages", len(querier.messages)-before)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegenerateMessage: %v", err)
+			}
+			if got.Message.ID != ids[tt.wantPrompt] {
+				t.Errorf("got prompt %q, want %q", got.Message.Content, tt.wantPrompt)
+			}
+
+			reply := querier.waitFinished(t, got.ReplyMessageID)
+			if reply.Content.String != "new answer" || MessageStatus(reply.Status) != MessageStatusDone {
+				t.Errorf("got reply %q with status %s, want %q done", reply.Content.String, reply.Status, "new answer")
+			}
+			if uuid.UUID(reply.PreviousID.Bytes) != ids[tt.wantPrompt] || MessageRole(reply.Role) != MessageRoleAssistant {
+				t.Errorf("the reply is a %s message under %v, want an assistant message under %s", reply.Role, reply.PreviousID, tt.wantPrompt)
+			}
+			if history := historyOf(provider.lastRequest()); !slices.Equal(history, tt.wantHistory) {
+				t.Errorf("got history %v, want %v", history, tt.wantHistory)
+			}
+			if leaf := querier.chats[chat.ID].CurrentLeafID.Bytes; leaf != got.ReplyMessageID {
+				t.Errorf("the current leaf is %v, want the new reply", leaf)
+			}
+			if tt.message != tt.wantPrompt {
+				if msg, _ := querier.GetMessage(context.Background(), ids[tt.message]); msg.Content.String != tt.message {
+					t.Errorf("the earlier reply changed to %q", msg.Content.String)
+				}
+			}
+		})
+	}
+}
+
+func TestEditMessage_TableDriven(t *testing.T) {
+	tests := []struct {
+		name        string
+		message     string
+		wantParent  string
+		wantHistory []string
+		wantErr     error
+	}{
+		{name: "prompt in a branch", message: "q2", wantParent: "a1", wantHistory: []string{"q1", "a1", "edited"}},
+		{name: "prompt on another branch", message: "q3", wantParent: "a1'", wantHistory: []string{"q1", "a1'", "edited"}},
+		{name: "first prompt", message: "q1", wantParent: "", wantHistory: []string{"edited"}},
+		{name: "assistant reply", message: "a1", wantErr: ErrInvalidBranch},
+		{name: "unknown message", message: "unknown", wantErr: handlerutil.NotFoundError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner := uuid.New()
+			querier := newFakeChatQuerier()
+			chat, ids := branchedChat(querier, owner)
+			ids["unknown"] = uuid.New()
+			before := len(querier.messages)
+
+			provider := &fakeProvider{deltas: []string{"reply"}}
+			service := newTestService(querier)
+			service.provider = provider
+
+			got, err := service.EditMessage(userContext(owner), chat.ID, ids[tt.message], "edited", nil, GenerationOptions{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if len(querier.messages) != before {
+					t.Errorf("a failed edit created %d messages", len(querier.messages)-before)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EditMessage: %v", err)
+			}
+
+			if got.Message.ID == ids[tt.message] || got.Message.Content != "edited" || got.Message.PreviousID != ids[tt.wantParent] {
+				t.Errorf("got edited message %+v, want a new sibling of %s", got.Message, tt.message)
+			}
+			reply := querier.waitFinished(t, got.ReplyMessageID)
+			if uuid.UUID(reply.PreviousID.Bytes) != got.Message.ID || reply.Content.String != "reply" {
+				t.Errorf("got reply %q under %v, want %q under the edited prompt", reply.Content.String, reply.PreviousID, "reply")
+			}
+			if history := historyOf(provider.lastRequest()); !slices.Equal(history, tt.wantHistory) {
+				t.Errorf("got history %v, want %v", history, tt.wantHistory)
+			}
+			if original, _ := querier.GetMessage(context.Background(), ids[tt.message]); original.Content.String != tt.message {
+				t.Errorf("the original prompt changed to %q", original.Content.String)
+			}
+		})
+	}
+}
+
+func TestStreamRoundStopsOnFinishedStream(t *testing.T) {
+	provider := &fakeProvider{deltas: []string{"a", "b", "c"}, hold: make(chan error, 1)}
+	service := NewService(provider, newFakeChatQuerier(), NewStreamHub(), nil, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := service.streamHub.CreateStream(uuid.New(), nil)
+	stream.Fail(errors.New("boom"))
+
+	done := make(chan bool, 1)
+	go func() {
+		_, _, ok := service.streamRound(ctx, stream, CreateChatCompletionRequest{})
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("the round went on after the stream ended")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the round did not stop when the stream ended")
+	}
+	if status, content, _ := stream.Get(); status != MessageStatusError || content != "" {
+		t.Errorf("got %q ending %s, want an empty failed stream", content, status)
+	}
+}
+
+func TestCancelStream_TableDriven(t *testing.T) {
+	owner := uuid.New()
+	tests := []struct {
+		name   string
+		userID uuid.UUID
+		// finished cancels after the generation ended.
+		finished bool
+		wantErr  error
+	}{
+		{name: "owner cancels", userID: owner},
+		{name: "another user", userID: uuid.New(), wantErr: handlerutil.ErrForbidden},
+		{name: "generation already ended", userID: owner, finished: true, wantErr: handlerutil.NotFoundError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			chat, ids := branchedChat(querier, owner)
+			provider := &fakeProvider{deltas: []string{"part", "ial"}, hold: make(chan error, 1)}
+			if tt.finished {
+				provider.hold = nil
+			}
+			service := newTestService(querier)
+			service.provider = provider
+
+			created, err := service.RegenerateMessage(userContext(owner), chat.ID, ids["a2"], GenerationOptions{})
+			if err != nil {
+				t.Fatalf("RegenerateMessage: %v", err)
+			}
+			replyID := created.ReplyMessageID
+			if tt.finished {
+				querier.waitFinished(t, replyID)
+			}
+
+			ok, deltas, _, unsubscribe := service.Stream(context.Background(), replyID, 0)
+			defer unsubscribe()
+			if !tt.finished {
+				if !ok {
+					t.Fatal("the generation is not streaming")
+				}
+				var received strings.Builder
+				for received.String() != "partial" {
+					delta := <-deltas
+					received.WriteString(delta.Delta)
+				}
+			}
+
+			err = service.CancelStream(userContext(tt.userID), replyID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if stream, ok := service.streamHub.GetStream(replyID); ok {
+					stream.Cancel()
+				}
+				return
+			}
+
+			select {
+			case err := <-provider.hold:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("the provider request ended with %v, want %v", err, context.Canceled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the provider request was not cancelled")
+			}
+			final := <-deltas
+			if !final.IsFinished || final.Status != MessageStatusCancelled {
+				t.Errorf("got final delta %+v, want a finished delta with status %s", final, MessageStatusCancelled)
+			}
+			reply := querier.waitFinished(t, replyID)
+			if MessageStatus(reply.Status) != MessageStatusCancelled || reply.Content.String != "partial" {
+				t.Errorf("got reply %q with status %s, want %q %s", reply.Content.String, reply.Status, "partial", MessageStatusCancelled)
+			}
+		})
+	}
+}
@@ -1,31 +1,91 @@
 package chat
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
 
+// DefaultMaxSubscriberLag is how long content may wait for a stream subscriber before
+// it is disconnected, unless configured otherwise.
+const DefaultMaxSubscriberLag = 30 * time.Second
+
+// ErrSubscriberLagging is sent to a subscriber that fell too far behind its stream.
+var ErrSubscriberLagging = errors.New("stream subscriber is lagging behind")
+
+// ErrStreamFinished is returned when content arrives for a stream that has ended.
+var ErrStreamFinished = errors.New("stream finished")
+
+// Hub keeps track of the generations in progress and lets clients follow them.
+// StreamHub only knows the generations of its own process; PostgresHub relays them
+// between the replicas sharing a database.
+type Hub interface {
+	// CreateStream registers a generation running in this process; cancel stops it.
+	CreateStream(messageID uuid.UUID, cancel context.CancelFunc) *StreamEvent
+	// GetStream returns a generation running in this process.
+	GetStream(messageID uuid.UUID) (*StreamEvent, bool)
+	// DeleteStream forgets a finished generation.
+	DeleteStream(messageID uuid.UUID)
+	// Subscribe follows a generation wherever it runs, from byte offset of its
+	// content. It reports false when messageID is not being generated.
+	Subscribe(ctx context.Context, messageID uuid.UUID, offset int) (bool, <-chan StreamDelta, <-chan error, func())
+	// Cancel stops a generation wherever it runs. It reports false when messageID is
+	// not being generated.
+	Cancel(ctx context.Context, messageID uuid.UUID) bool
+}
+
+// StreamHub is the in-process Hub. A client routed to another replica, or arriving
+// after a restart, cannot follow the generation.
 type StreamHub struct {
 	lock    sync.RWMutex
 	streams map[uuid.UUID]*StreamEvent
+	maxLag  time.Duration
 }
 
 func NewStreamHub() *StreamHub {
 	return &StreamHub{
 		streams: make(map[uuid.UUID]*StreamEvent),
+		maxLag:  DefaultMaxSubscriberLag,
 	}
 }
 
+// SetMaxLag sets how long content may wait for a subscriber before the subscriber is
+// disconnected; 0 never disconnects. It applies to streams created afterwards.
+func (s *StreamHub) SetMaxLag(maxLag time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxLag = maxLag
+}
+
 type StreamEvent struct {
 	lock        sync.RWMutex
+	messageID   uuid.UUID
 	status      MessageStatus
 	fullContent string
-	subscribers map[chan StreamDelta]struct{}
+	subscribers map[*streamSubscriber]struct{}
+	maxLag      time.Duration
 	err         error
+	// cancel stops the provider request feeding this stream.
+	cancel context.CancelFunc
+	// relay, when set, forwards the stream to other processes.
+	relay streamRelay
+}
+
+// streamRelay forwards a stream to other processes. It is called with the stream
+// locked, so calls arrive in stream order.
+type streamRelay interface {
+	// content relays the text at byte offset of the accumulated content.
+	content(messageID uuid.UUID, offset int, text string)
+	// finish relays the final status, the length of the accumulated content and, for
+	// a failed stream, the failure.
+	finish(messageID uuid.UUID, status MessageStatus, length int, err error)
 }
 
-func (s *StreamHub) CreateStream(messageID uuid.UUID) *StreamEvent {
+func (s *StreamHub) CreateStream(messageID uuid.UUID, cancel context.CancelFunc) *StreamEvent {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	if _, ok := s.streams[messageID]; ok {
@@ -33,9 +93,12 @@ func (s *StreamHub) CreateStream(messageID uuid.UUID) *StreamEvent {
 	}
 
 	stream := &StreamEvent{
+		messageID:   messageID,
 		status:      MessageStatusStreaming,
 		fullContent: "",
-		subscribers: make(map[chan StreamDelta]struct{}),
+		subscribers: make(map[*streamSubscriber]struct{}),
+		maxLag:      s.maxLag,
+		cancel:      cancel,
 	}
 	s.streams[messageID] = stream
 	return stream
@@ -56,76 +119,203 @@ func (s *StreamHub) DeleteStream(messageID uuid.UUID) {
 	delete(s.streams, messageID)
 }
 
-func (s *StreamEvent) Subscribe() (<-chan StreamDelta, <-chan error, func()) {
-	ch := make(chan StreamDelta, 16)
-	errCh := make(chan error, 1)
+func (s *StreamHub) Subscribe(ctx context.Context, messageID uuid.UUID, offset int) (bool, <-chan StreamDelta, <-chan error, func()) {
+	stream, ok := s.GetStream(messageID)
+	if !ok {
+		return false, nil, nil, func() {}
+	}
+	ch, errCh, cancel := stream.Subscribe(offset)
+	return true, ch, errCh, cancel
+}
+
+func (s *StreamHub) Cancel(ctx context.Context, messageID uuid.UUID) bool {
+	stream, ok := s.GetStream(messageID)
+	return ok && stream.Cancel()
+}
+
+// Subscribe follows the stream from byte offset of its content: the first delta
+// carries the content from offset received so far, if any, and the following ones
+// what arrives next. The stream ends with a final delta, or, when it failed, with the
+// failure on the error channel. A subscriber to an ended stream only gets the rest and
+// the end. Nothing is dropped for a slow subscriber; the content it has not taken yet
+// is sent as one delta when it catches up. A subscriber that leaves content waiting
+// for longer than the maximum lag gets ErrSubscriberLagging and its channel closes.
+func (s *StreamEvent) Subscribe(offset int) (<-chan StreamDelta, <-chan error, func()) {
+	sub := &streamSubscriber{
+		ch:    make(chan StreamDelta),
+		errCh: make(chan error, 1),
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
 
 	s.lock.Lock()
-	s.subscribers[ch] = struct{}{}
-	fullContent := s.fullContent
+	offset = max(0, min(offset, len(s.fullContent)))
+	for offset > 0 && offset < len(s.fullContent) && !utf8.RuneStart(s.fullContent[offset]) {
+		offset--
+	}
+	sub.sent = offset
+	s.subscribers[sub] = struct{}{}
 	s.lock.Unlock()
 
+	go s.deliver(sub)
+
+	var once sync.Once
 	cancel := func() {
-		s.lock.Lock()
-		if _, ok := s.subscribers[ch]; ok {
-			delete(s.subscribers, ch)
-			close(ch)
-		}
-		s.lock.Unlock()
+		once.Do(func() {
+			s.unsubscribe(sub)
+			close(sub.done)
+		})
 	}
 
-	ch <- StreamDelta{
-		Delta:      fullContent,
-		IsFinished: false,
-	}
+	return sub.ch, sub.errCh, cancel
+}
 
-	return ch, errCh, cancel
+// streamSubscriber tracks how much of the content a subscriber has been sent.
+type streamSubscriber struct {
+	ch    chan StreamDelta
+	errCh chan error
+	// wake is signalled when there is something new to send.
+	wake chan struct{}
+	// done is closed when the subscriber leaves.
+	done chan struct{}
+	// sent is the byte offset of the content sent so far; only deliver touches it.
+	sent int
 }
 
-func (s *StreamEvent) Publish(stream StreamDelta) {
+// next returns what sub has not been sent yet: the content after sub.sent, else
+// the final delta of an ended stream, or its failure. It reports false when there is
+// nothing.
+func (s *StreamEvent) next(sub *streamSubscriber) (StreamDelta, bool, error) {
 	s.lock.RLock()
-	subs := make([]chan StreamDelta, 0, len(s.subscribers))
-	for ch := range s.subscribers {
-		subs = append(subs, ch)
+	defer s.lock.RUnlock()
+	switch {
+	case sub.sent < len(s.fullContent):
+		return StreamDelta{Delta: s.fullContent[sub.sent:], Offset: len(s.fullContent)}, true, nil
+	case s.status == MessageStatusError:
+		if s.err == nil {
+			return StreamDelta{}, true, errors.New("generation failed")
+		}
+		return StreamDelta{}, true, s.err
+	case s.status != MessageStatusStreaming:
+		return StreamDelta{IsFinished: true, Status: s.status, Offset: len(s.fullContent)}, true, nil
 	}
-	s.lock.RUnlock()
+	return StreamDelta{}, false, nil
+}
+
+// deliver sends sub the stream until it ends or sub leaves, then closes sub.ch.
+func (s *StreamEvent) deliver(sub *streamSubscriber) {
+	defer close(sub.ch)
+
+	var lag <-chan time.Time
+	var lagTimer *time.Timer
+	defer func() {
+		if lagTimer != nil {
+			lagTimer.Stop()
+		}
+	}()
 
-	for _, ch := range subs {
+	for {
+		delta, ok, err := s.next(sub)
+		if err != nil {
+			sub.errCh <- err
+			return
+		}
+		var out chan<- StreamDelta
+		if ok {
+			out = sub.ch
+			if lag == nil && s.maxLag > 0 {
+				lagTimer = time.NewTimer(s.maxLag)
+				lag = lagTimer.C
+			}
+		}
 		select {
-		case ch <- stream:
-		default: //avoid blocking
+		case out <- delta:
+			if delta.IsFinished {
+				return
+			}
+			sub.sent = delta.Offset
+			if lagTimer != nil {
+				lagTimer.Stop()
+				lagTimer, lag = nil, nil
+			}
+		case <-sub.wake:
+		case <-sub.done:
+			return
+		case <-lag:
+			s.unsubscribe(sub)
+			sub.errCh <- ErrSubscriberLagging
+			return
 		}
+	}
+}
+
+func (s *StreamEvent) unsubscribe(sub *streamSubscriber) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscribers, sub)
+}
 
+// publish tells every subscriber that there is something new. s.lock must be held.
+func (s *StreamEvent) publish() {
+	for sub := range s.subscribers {
+		select {
+		case sub.wake <- struct{}{}:
+		default: // a wake-up is already pending
+		}
 	}
 }
 
-func (s *StreamEvent) AppendDelta(stream StreamDelta) {
+// AppendDelta adds content to the stream. Once the stream has ended the content is
+// dropped and ErrStreamFinished is returned, so the generation can stop.
+func (s *StreamEvent) AppendDelta(stream StreamDelta) error {
 	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status != MessageStatusStreaming {
+		return ErrStreamFinished
+	}
+	if s.relay != nil {
+		s.relay.content(s.messageID, len(s.fullContent), stream.Delta)
+	}
 	s.fullContent += stream.Delta
-	s.lock.Unlock()
-	s.Publish(stream)
+	s.publish()
+	return nil
 }
 
-func (s *StreamEvent) Complete() {
+// finish moves a streaming event to its final status. Only the first call wins, so
+// a cancelled stream is not reported as failed once its provider request aborts.
+func (s *StreamEvent) finish(status MessageStatus, err error) bool {
 	s.lock.Lock()
-	s.status = MessageStatusDone
-	s.lock.Unlock()
-	s.Publish(StreamDelta{
-		Delta:      "",
-		IsFinished: true,
-	})
+	defer s.lock.Unlock()
+	if s.status != MessageStatusStreaming {
+		return false
+	}
+	s.status = status
+	s.err = err
+	if s.relay != nil {
+		s.relay.finish(s.messageID, status, len(s.fullContent), err)
+	}
+	s.publish()
+	return true
+}
+
+func (s *StreamEvent) Complete() {
+	s.finish(MessageStatusDone, nil)
 }
 
 func (s *StreamEvent) Fail(err error) {
-	s.lock.Lock()
-	s.err = err
-	s.status = MessageStatusError
-	s.lock.Unlock()
+	s.finish(MessageStatusError, err)
+}
 
-	s.Publish(StreamDelta{
-		Delta:      "",
-		IsFinished: true,
-	})
+// Cancel stops the generation, keeping the content received so far. It reports
+// false when the stream had already ended.
+func (s *StreamEvent) Cancel() bool {
+	if !s.finish(MessageStatusCancelled, nil) {
+		return false
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return true
 }
 
 func (s *StreamEvent) Get() (MessageStatus, string, error) {
@@ -133,3 +323,13 @@ func (s *StreamEvent) Get() (MessageStatus, string, error) {
 	defer s.lock.RUnlock()
 	return s.status, s.fullContent, s.err
 }
+
+// relaySnapshot relays the whole content received so far, for followers that joined
+// late. It does nothing once the stream has ended.
+func (s *StreamEvent) relaySnapshot() {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.relay != nil && s.status == MessageStatusStreaming {
+		s.relay.content(s.messageID, 0, s.fullContent)
+	}
+}
@@ -0,0 +1,308 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// collect reads a subscription until its final delta and returns the text received.
+func collect(t *testing.T, ch <-chan StreamDelta, delay time.Duration) (string, MessageStatus) {
+	t.Helper()
+	var text strings.Builder
+	offset := -1
+	for delta := range ch {
+		if delta.Offset < offset {
+			t.Errorf("offset went back from %d to %d", offset, delta.Offset)
+		}
+		offset = delta.Offset
+		if delta.IsFinished {
+			return text.String(), delta.Status
+		}
+		text.WriteString(delta.Delta)
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	t.Error("subscription closed before the final delta")
+	return text.String(), ""
+}
+
+// appendDelta streams delta, which must be accepted.
+func appendDelta(t *testing.T, stream *StreamEvent, delta string) {
+	t.Helper()
+	if err := stream.AppendDelta(StreamDelta{Delta: delta}); err != nil {
+		t.Errorf("append %q: %v", delta, err)
+	}
+}
+
+func TestStreamEventSubscribers_TableDriven(t *testing.T) {
+	tests := []struct {
+		name        string
+		subscribers int
+		deltas      int
+		// readDelay slows down every subscriber's reads.
+		readDelay time.Duration
+		// joinAfter is how many deltas are streamed before the subscribers join.
+		joinAfter int
+		// resume subscribes from the offset reached when the subscribers join.
+		resume bool
+	}{
+		{name: "many fast subscribers", subscribers: 100, deltas: 500},
+		{name: "many slow subscribers", subscribers: 50, deltas: 300, readDelay: time.Millisecond},
+		{name: "subscribers joining mid-stream", subscribers: 50, deltas: 300, joinAfter: 150},
+		{name: "subscribers resuming mid-stream", subscribers: 50, deltas: 300, joinAfter: 150, resume: true},
+		{name: "subscribers joining after the end", subscribers: 20, deltas: 50, joinAfter: 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewStreamHub()
+			hub.SetMaxLag(0)
+			stream := hub.CreateStream(uuid.New(), nil)
+
+			var full strings.Builder
+			for i := 0; i < tt.deltas; i++ {
+				fmt.Fprintf(&full, "délta %d. ", i)
+			}
+			deltas := strings.SplitAfter(full.String(), ". ")[:tt.deltas]
+
+			for _, delta := range deltas[:tt.joinAfter] {
+				appendDelta(t, stream, delta)
+			}
+			if tt.joinAfter == tt.deltas {
+				stream.Complete()
+			}
+			offset := 0
+			if tt.resume {
+				offset = len(strings.Join(deltas[:tt.joinAfter], ""))
+			}
+			want := full.String()[offset:]
+
+			var wg sync.WaitGroup
+			for i := 0; i < tt.subscribers; i++ {
+				ch, _, cancel := stream.Subscribe(offset)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer cancel()
+					text, status := collect(t, ch, tt.readDelay)
+					if text != want {
+						t.Errorf("got %d bytes of text, want %d", len(text), len(want))
+					}
+					if status != MessageStatusDone {
+						t.Errorf("got status %q, want %q", status, MessageStatusDone)
+					}
+				}()
+			}
+
+			if tt.joinAfter < tt.deltas {
+				for _, delta := range deltas[tt.joinAfter:] {
+					appendDelta(t, stream, delta)
+				}
+				stream.Complete()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestStreamEventSubscribeOffset_TableDriven(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		want   string
+	}{
+		{name: "from the start", offset: 0, want: "héllo world"},
+		{name: "from a delta boundary", offset: 7, want: "world"},
+		{name: "from inside a character", offset: 2, want: "éllo world"},
+		{name: "past the end", offset: 100, want: ""},
+		{name: "negative", offset: -5, want: "héllo world"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := NewStreamHub().CreateStream(uuid.New(), nil)
+			appendDelta(t, stream, "héllo ")
+			appendDelta(t, stream, "world")
+			stream.Complete()
+
+			ch, _, cancel := stream.Subscribe(tt.offset)
+			defer cancel()
+			text, _ := collect(t, ch, 0)
+			if text != tt.want {
+				t.Errorf("got %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEventLaggingSubscriber(t *testing.T) {
+	hub := NewStreamHub()
+	hub.SetMaxLag(20 * time.Millisecond)
+	stream := hub.CreateStream(uuid.New(), nil)
+
+	stalled, stalledErrs, cancelStalled := stream.Subscribe(0)
+	defer cancelStalled()
+	reader, _, cancelReader := stream.Subscribe(0)
+	defer cancelReader()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		text, _ := collect(t, reader, 0)
+		if text != "abc" {
+			t.Errorf("reader got %q, want %q", text, "abc")
+		}
+	}()
+
+	appendDelta(t, stream, "a")
+	select {
+	case err := <-stalledErrs:
+		if !errors.Is(err, ErrSubscriberLagging) {
+			t.Fatalf("got error %v, want %v", err, ErrSubscriberLagging)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the stalled subscriber was not disconnected")
+	}
+	if _, ok := <-stalled; ok {
+		t.Error("the stalled subscriber's channel is still open")
+	}
+
+	appendDelta(t, stream, "b")
+	appendDelta(t, stream, "c")
+	stream.Complete()
+	wg.Wait()
+}
+
+func TestStreamEventFailure(t *testing.T) {
+	stream := NewStreamHub().CreateStream(uuid.New(), nil)
+	upstreamErr := &UpstreamError{StatusCode: 503, Detail: "overloaded"}
+
+	early, earlyErrs, cancelEarly := stream.Subscribe(0)
+	defer cancelEarly()
+	appendDelta(t, stream, "partial")
+	stream.Fail(upstreamErr)
+	late, lateErrs, cancelLate := stream.Subscribe(0)
+	defer cancelLate()
+
+	subscriptions := []struct {
+		name string
+		ch   <-chan StreamDelta
+		errs <-chan error
+	}{
+		{name: "subscribed before the failure", ch: early, errs: earlyErrs},
+		{name: "subscribed after the failure", ch: late, errs: lateErrs},
+	}
+	for _, sub := range subscriptions {
+		t.Run(sub.name, func(t *testing.T) {
+			var text strings.Builder
+			for delta := range sub.ch {
+				if delta.IsFinished {
+					t.Fatal("got a final delta instead of the failure")
+				}
+				text.WriteString(delta.Delta)
+			}
+			if text.String() != "partial" {
+				t.Errorf("got %q, want %q", text.String(), "partial")
+			}
+			select {
+			case err := <-sub.errs:
+				if !errors.Is(err, upstreamErr) {
+					t.Errorf("got error %v, want %v", err, upstreamErr)
+				}
+			default:
+				t.Error("the failure was not sent")
+			}
+		})
+	}
+}
+
+func TestStreamEventAppendAfterFinish_TableDriven(t *testing.T) {
+	tests := []struct {
+		name   string
+		finish func(stream *StreamEvent)
+		want   MessageStatus
+	}{
+		{name: "completed", finish: (*StreamEvent).Complete, want: MessageStatusDone},
+		{name: "failed", finish: func(stream *StreamEvent) { stream.Fail(errors.New("boom")) }, want: MessageStatusError},
+		{name: "cancelled", finish: func(stream *StreamEvent) { stream.Cancel() }, want: MessageStatusCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := NewStreamHub().CreateStream(uuid.New(), nil)
+			if err := stream.AppendDelta(StreamDelta{Delta: "kept"}); err != nil {
+				t.Fatalf("AppendDelta: %v", err)
+			}
+			tt.finish(stream)
+
+			if err := stream.AppendDelta(StreamDelta{Delta: " dropped"}); !errors.Is(err, ErrStreamFinished) {
+				t.Errorf("got error %v, want %v", err, ErrStreamFinished)
+			}
+			if status, content, _ := stream.Get(); status != tt.want || content != "kept" {
+				t.Errorf("got %q ending %s, want %q ending %s", content, status, "kept", tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamHubSubscribe(t *testing.T) {
+	hub := NewStreamHub()
+	if ok, _, _, _ := hub.Subscribe(context.Background(), uuid.New(), 0); ok {
+		t.Error("subscribed to a stream that does not exist")
+	}
+}
+
+func TestContentAssembler_TableDriven(t *testing.T) {
+	type piece struct {
+		offset int
+		text   string
+	}
+	tests := []struct {
+		name   string
+		start  int
+		pieces []piece
+		want   []string
+	}{
+		{
+			name:   "in order",
+			pieces: []piece{{0, "ab"}, {2, "cd"}},
+			want:   []string{"ab", "cd"},
+		},
+		{
+			name:   "snapshot after live deltas",
+			pieces: []piece{{4, "ef"}, {0, "abcd"}, {6, "g"}},
+			want:   []string{"", "abcdef", "g"},
+		},
+		{
+			name:   "overlapping and repeated pieces",
+			pieces: []piece{{0, "abc"}, {1, "bcd"}, {0, "abcd"}, {4, "e"}},
+			want:   []string{"abc", "d", "", "e"},
+		},
+		{
+			name:   "resuming from an offset",
+			start:  3,
+			pieces: []piece{{0, "abcde"}, {5, "f"}},
+			want:   []string{"de", "f"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler := contentAssembler{length: tt.start}
+			for i, p := range tt.pieces {
+				if got := assembler.add(p.offset, p.text); got != tt.want[i] {
+					t.Errorf("piece %d: got %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	problemutil "github.com/NYCU-SDC/summer/pkg/problem"
+)
+
+// maxUpstreamDetail bounds the part of an upstream error response kept as its detail.
+const maxUpstreamDetail = 500
+
+// UpstreamError is a failure of the LLM service: an error response with its status
+// code, or, with StatusCode 0, a connection that could not be made or broke off.
+type UpstreamError struct {
+	StatusCode int
+	Detail     string
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("upstream unreachable: %s", e.Detail)
+	}
+	return fmt.Sprintf("upstream status=%d detail=%q", e.StatusCode, e.Detail)
+}
+
+// Retryable tells whether the same request may succeed later: the service was
+// unreachable, overloaded or failed on its side.
+func (e *UpstreamError) Retryable() bool {
+	return e.StatusCode == 0 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// upstreamDetail reads the detail of an LLM service error response, which FastAPI
+// sends as {"detail": "..."}; other bodies are kept as they are, cut short.
+func upstreamDetail(body []byte) string {
+	var payload struct {
+		Detail json.RawMessage `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		var detail string
+		if err := json.Unmarshal(payload.Detail, &detail); err == nil {
+			return truncateBytes(detail, maxUpstreamDetail)
+		}
+	}
+	return truncateBytes(strings.TrimSpace(string(body)), maxUpstreamDetail)
+}
+
+func truncateBytes(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	return strings.ToValidUTF8(text[:limit], "") + "…"
+}
+
+// StreamProblem is the payload of an SSE error event: a problem detail like those of
+// the REST API, telling whether the LLM service failed and whether to try again.
+type StreamProblem struct {
+	problemutil.Problem
+	// UpstreamStatus is the status code the LLM service answered with, if it did.
+	UpstreamStatus int  `json:"upstreamStatus,omitempty"`
+	Retryable      bool `json:"retryable"`
+}
+
+// StreamError is a StreamProblem as an error, such as a failure relayed from another
+// replica.
+type StreamError struct {
+	Problem StreamProblem
+}
+
+func (e *StreamError) Error() string {
+	return e.Problem.Detail
+}
+
+// NewStreamProblem describes why a stream failed. Its detail is shown to users and
+// stored as the error reason, so internal errors and the error messages of the LLM
+// service are not spelled out; SSEError logs them.
+func NewStreamProblem(err error) StreamProblem {
+	var streamErr *StreamError
+	var upstreamErr *UpstreamError
+	switch {
+	case errors.As(err, &streamErr):
+		return streamErr.Problem
+	case errors.As(err, &upstreamErr):
+		detail := "The language model service could not be reached."
+		if upstreamErr.StatusCode != 0 {
+			detail = fmt.Sprintf("The language model service answered with status %d.", upstreamErr.StatusCode)
+		}
+		return StreamProblem{
+			Problem: problemutil.Problem{
+				Title:  "Bad Gateway",
+				Status: http.StatusBadGateway,
+				Type:   "https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/502",
+				Detail: detail,
+			},
+			UpstreamStatus: upstreamErr.StatusCode,
+			Retryable:      upstreamErr.Retryable(),
+		}
+	case errors.Is(err, context.DeadlineExceeded):
+		return StreamProblem{
+			Problem: problemutil.Problem{
+				Title:  "Gateway Timeout",
+				Status: http.StatusGatewayTimeout,
+				Type:   "https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/504",
+				Detail: "The language model service took too long to answer.",
+			},
+			Retryable: true,
+		}
+	case errors.Is(err, ErrSubscriberLagging):
+		// Only this subscriber is affected; it can resume with Last-Event-ID.
+		return StreamProblem{
+			Problem: problemutil.Problem{
+				Title:  "Request Timeout",
+				Status: http.StatusRequestTimeout,
+				Type:   "https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/408",
+				Detail: "The stream was closed because the client did not keep up with it.",
+			},
+			Retryable: true,
+		}
+	default:
+		return StreamProblem{
+			Problem: problemutil.NewInternalServerProblem("The reply could not be generated."),
+		}
+	}
+}
+
+// storedStreamError rebuilds the failure of a stream from the error reason stored
+// with its message.
+func storedStreamError(reason string) *StreamError {
+	if reason == "" {
+		reason = "The reply could not be generated."
+	}
+	return &StreamError{Problem: StreamProblem{Problem: problemutil.NewInternalServerProblem(reason)}}
+}
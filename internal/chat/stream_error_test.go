@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNewStreamProblem_TableDriven(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantUpstream   int
+		wantRetryable  bool
+		wantDetailPart string
+		// hiddenDetail must not show in the detail.
+		hiddenDetail string
+	}{
+		{
+			name:           "upstream server error",
+			err:            &UpstreamError{StatusCode: http.StatusBadGateway, Detail: "Connection timeout"},
+			wantStatus:     http.StatusBadGateway,
+			wantUpstream:   http.StatusBadGateway,
+			wantRetryable:  true,
+			wantDetailPart: "answered with status 502.",
+			hiddenDetail:   "Connection timeout",
+		},
+		{
+			name:          "upstream rate limit",
+			err:           fmt.Errorf("round 2: %w", &UpstreamError{StatusCode: http.StatusTooManyRequests}),
+			wantStatus:    http.StatusBadGateway,
+			wantUpstream:  http.StatusTooManyRequests,
+			wantRetryable: true,
+		},
+		{
+			name:          "upstream rejected the request",
+			err:           &UpstreamError{StatusCode: http.StatusUnprocessableEntity},
+			wantStatus:    http.StatusBadGateway,
+			wantUpstream:  http.StatusUnprocessableEntity,
+			wantRetryable: false,
+		},
+		{
+			name:           "upstream unreachable",
+			err:            &UpstreamError{Detail: "connection refused"},
+			wantStatus:     http.StatusBadGateway,
+			wantRetryable:  true,
+			wantDetailPart: "could not be reached",
+			hiddenDetail:   "connection refused",
+		},
+		{
+			name:          "timeout",
+			err:           context.DeadlineExceeded,
+			wantStatus:    http.StatusGatewayTimeout,
+			wantRetryable: true,
+		},
+		{
+			name:          "lagging subscriber",
+			err:           ErrSubscriberLagging,
+			wantStatus:    http.StatusRequestTimeout,
+			wantRetryable: true,
+		},
+		{
+			name:           "relayed problem",
+			err:            storedStreamError("stopped"),
+			wantStatus:     http.StatusInternalServerError,
+			wantDetailPart: "stopped",
+		},
+		{
+			name:           "internal error is not spelled out",
+			err:            errors.New("pq: connection reset"),
+			wantStatus:     http.StatusInternalServerError,
+			wantDetailPart: "could not be generated",
+			hiddenDetail:   "pq:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := NewStreamProblem(tt.err)
+			if problem.Status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", problem.Status, tt.wantStatus)
+			}
+			if problem.UpstreamStatus != tt.wantUpstream {
+				t.Errorf("got upstream status %d, want %d", problem.UpstreamStatus, tt.wantUpstream)
+			}
+			if problem.Retryable != tt.wantRetryable {
+				t.Errorf("got retryable %v, want %v", problem.Retryable, tt.wantRetryable)
+			}
+			if !strings.Contains(problem.Detail, tt.wantDetailPart) {
+				t.Errorf("got detail %q, want it to contain %q", problem.Detail, tt.wantDetailPart)
+			}
+			if tt.hiddenDetail != "" && strings.Contains(problem.Detail, tt.hiddenDetail) {
+				t.Errorf("got detail %q, which spells out %q", problem.Detail, tt.hiddenDetail)
+			}
+		})
+	}
+}
+
+func TestUpstreamDetail_TableDriven(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "FastAPI detail", body: `{"detail": "Error while communicating with the OpenAI API"}`, want: "Error while communicating with the OpenAI API"},
+		{name: "validation errors", body: `{"detail": [{"msg": "field required"}]}`, want: `{"detail": [{"msg": "field required"}]}`},
+		{name: "plain text", body: " Bad Gateway \n", want: "Bad Gateway"},
+		{name: "long body", body: strings.Repeat("x", maxUpstreamDetail+10), want: strings.Repeat("x", maxUpstreamDetail) + "…"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamDetail([]byte(tt.body)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamFailureDetailIsLoggedOnly(t *testing.T) {
+	user := uuid.New()
+	querier := newFakeChatQuerier()
+	chat := querier.addChat(user)
+	core, logs := observer.New(zap.WarnLevel)
+	service := newTestService(querier)
+	service.logger = zap.New(core)
+	service.provider = &fakeProvider{err: &UpstreamError{
+		StatusCode: http.StatusUnprocessableEntity,
+		Detail:     "Invalid API key sk-test-1234",
+	}}
+
+	created, err := service.CreateMessage(userContext(user), chat.ID, "hi", uuid.Nil, nil, GenerationOptions{})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	reply := querier.waitFinished(t, created.ReplyMessageID)
+
+	if MessageStatus(reply.Status) != MessageStatusError {
+		t.Fatalf("got status %s, want %s", reply.Status, MessageStatusError)
+	}
+	if want := "The language model service answered with status 422."; reply.ErrorReason.String != want {
+		t.Errorf("stored error reason %q, want %q", reply.ErrorReason.String, want)
+	}
+	logged := logs.FilterField(zap.String("upstream_detail", "Invalid API key sk-test-1234"))
+	if logged.Len() == 0 {
+		t.Error("the upstream detail was not logged")
+	}
+}
@@ -0,0 +1,354 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"sciedu-backend/internal/content"
+	"sciedu-backend/internal/question"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxToolRounds bounds how many times one reply may call tools before the model
+	// has to answer without them.
+	maxToolRounds = 5
+	// maxToolCalls bounds the calls the model may make in one round.
+	maxToolCalls = 8
+	// toolTimeout bounds one tool call.
+	toolTimeout = 10 * time.Second
+	// maxToolResultTokens bounds text returned by a tool.
+	maxToolResultTokens = 4000
+)
+
+var errInvalidToolArguments = errors.New("invalid tool arguments")
+
+// Tool is a backend function the tutor model may call.
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments.
+	Parameters json.RawMessage
+	// Call runs the tool with the model's arguments. The result is sent back to the
+	// model as JSON; an error is sent back as its message.
+	Call func(ctx context.Context, arguments json.RawMessage) (any, error)
+}
+
+// ToolRegistry is the set of tools offered to the model.
+type ToolRegistry struct {
+	tools []Tool
+}
+
+func NewToolRegistry(tools ...Tool) *ToolRegistry {
+	return &ToolRegistry{tools: tools}
+}
+
+// SetTools replaces the tools offered to the model; nil offers none.
+func (s *ChatService) SetTools(tools *ToolRegistry) {
+	s.tools = tools
+}
+
+func (r *ToolRegistry) definitions() []ToolDefinition {
+	if r == nil {
+		return nil
+	}
+	definitions := make([]ToolDefinition, 0, len(r.tools))
+	for _, tool := range r.tools {
+		definitions = append(definitions, ToolDefinition{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return definitions
+}
+
+func (r *ToolRegistry) lookup(name string) (Tool, bool) {
+	if r == nil {
+		return Tool{}, false
+	}
+	for _, tool := range r.tools {
+		if tool.Name == name {
+			return tool, true
+		}
+	}
+	return Tool{}, false
+}
+
+// QuestionLookup reads questions; question.QuestionService implements it.
+type QuestionLookup interface {
+	Get(ctx context.Context, id uuid.UUID) (question.Question, error)
+	ListOptionsByQuestion(ctx context.Context, questionID uuid.UUID) ([]question.Option, error)
+}
+
+// TextContentLookup reads text contents; content.Service implements it.
+type TextContentLookup interface {
+	GetTextContent(ctx context.Context, id uuid.UUID) (content.Content, error)
+}
+
+type questionToolResult struct {
+	ID      uuid.UUID                  `json:"id"`
+	Type    string                     `json:"type"`
+	Content string                     `json:"content"`
+	Options []questionToolResultOption `json:"options,omitempty"`
+}
+
+type questionToolResultOption struct {
+	Label   string `json:"label"`
+	Content string `json:"content"`
+}
+
+// NewQuestionTool lets the model read a question and its choices by ID.
+func NewQuestionTool(questions QuestionLookup) Tool {
+	return Tool{
+		Name:        "get_question",
+		Description: "Look up a question by its ID, with its answer choices when it is a choice question.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{"id":{"type":"string",` +
+			`"description":"The question ID, a UUID."}},"required":["id"]}`),
+		Call: func(ctx context.Context, arguments json.RawMessage) (any, error) {
+			id, err := parseIDArgument(arguments)
+			if err != nil {
+				return nil, err
+			}
+			q, err := questions.Get(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			result := questionToolResult{ID: q.ID, Type: q.Type, Content: q.Content}
+			options, err := questions.ListOptionsByQuestion(ctx, q.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, option := range options {
+				result.Options = append(result.Options, questionToolResultOption{Label: option.Label, Content: option.Content})
+			}
+			return result, nil
+		},
+	}
+}
+
+type textContentToolResult struct {
+	ID      uuid.UUID `json:"id"`
+	Title   string    `json:"title,omitempty"`
+	Content string    `json:"content"`
+}
+
+// NewTextContentTool lets the model read a text content by ID. Long texts are cut.
+func NewTextContentTool(contents TextContentLookup) Tool {
+	return Tool{
+		Name:        "get_text_content",
+		Description: "Fetch the text of a learning material by its content ID.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{"id":{"type":"string",` +
+			`"description":"The content ID, a UUID."}},"required":["id"]}`),
+		Call: func(ctx context.Context, arguments json.RawMessage) (any, error) {
+			id, err := parseIDArgument(arguments)
+			if err != nil {
+				return nil, err
+			}
+			item, err := contents.GetTextContent(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			return textContentToolResult{
+				ID:      item.ID,
+				Title:   item.Title.String,
+				Content: truncateTokens(item.Content, maxToolResultTokens),
+			}, nil
+		},
+	}
+}
+
+type calculatorToolResult struct {
+	Expression string  `json:"expression"`
+	Value      float64 `json:"value"`
+}
+
+// NewCalculatorTool lets the model evaluate arithmetic instead of doing it in text.
+func NewCalculatorTool() Tool {
+	return Tool{
+		Name: "evaluate_expression",
+		Description: "Evaluate a numeric expression exactly. Supports + - * / % ^, parentheses, " +
+			"pi, e and the functions abs, sqrt, cbrt, exp, ln, log (base 10), log2, sin, cos, tan, " +
+			"asin, acos, atan (radians), floor, ceil and round.",
+		Parameters: json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string",` +
+			`"description":"The expression, for example (3.2e-3 * 9.81) / sqrt(2)."}},"required":["expression"]}`),
+		Call: func(ctx context.Context, arguments json.RawMessage) (any, error) {
+			var args struct {
+				Expression string `json:"expression"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return nil, fmt.Errorf("%w: %v", errInvalidToolArguments, err)
+			}
+			value, err := evaluateExpression(args.Expression)
+			if err != nil {
+				return nil, err
+			}
+			return calculatorToolResult{Expression: args.Expression, Value: value}, nil
+		},
+	}
+}
+
+func parseIDArgument(arguments json.RawMessage) (uuid.UUID, error) {
+	var args struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", errInvalidToolArguments, err)
+	}
+	id, err := uuid.Parse(strings.TrimSpace(args.ID))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: id %q is not a UUID", errInvalidToolArguments, args.ID)
+	}
+	return id, nil
+}
+
+// toolCallBuilder assembles streamed tool call fragments into calls, by index.
+type toolCallBuilder struct {
+	calls []ToolCall
+}
+
+func (b *toolCallBuilder) add(deltas []ToolCallDelta) {
+	for _, delta := range deltas {
+		if delta.Index < 0 || delta.Index >= maxToolCalls {
+			continue
+		}
+		for len(b.calls) <= delta.Index {
+			b.calls = append(b.calls, ToolCall{Type: "function"})
+		}
+		call := &b.calls[delta.Index]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Type != "" {
+			call.Type = delta.Type
+		}
+		if delta.Function.Name != "" {
+			call.Function.Name = delta.Function.Name
+		}
+		call.Function.Arguments += delta.Function.Arguments
+	}
+}
+
+// build returns the complete calls, naming those the model left without an ID.
+func (b *toolCallBuilder) build() []ToolCall {
+	var calls []ToolCall
+	for i, call := range b.calls {
+		if call.Function.Name == "" {
+			continue
+		}
+		if call.ID == "" {
+			call.ID = fmt.Sprintf("call_%d", i)
+		}
+		if strings.TrimSpace(call.Function.Arguments) == "" {
+			call.Function.Arguments = "{}"
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// runTools stores an assistant message carrying the model's tool calls and the text
+// it wrote along with them under parentID, runs each call and stores its result as a
+// tool message, chained one after the other. The reply is moved under the last of
+// them, so that the branch reads prompt, calls, results, answer. It returns the
+// stored messages as LLM messages and the ID of the last one.
+func (s *ChatService) runTools(ctx context.Context, reply Message, parentID uuid.UUID, text string, calls []ToolCall) ([]ChatMessage, uuid.UUID, error) {
+	encoded, err := json.Marshal(calls)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+	request, err := s.querier.CreateMessage(ctx, CreateMessageParams{
+		ChatID:      reply.ChatID,
+		PreviousID:  pgtype.UUID{Bytes: parentID, Valid: true},
+		Content:     pgtype.Text{String: text, Valid: true},
+		Role:        string(MessageRoleAssistant),
+		Status:      string(MessageStatusDone),
+		Model:       reply.Model,
+		Temperature: reply.Temperature,
+		MaxTokens:   reply.MaxTokens,
+		ToolCalls:   encoded,
+	})
+	if err != nil {
+		return nil, uuid.Nil, databaseutil.WrapDBError(err, s.logger, "create tool call message")
+	}
+	messages := []ChatMessage{{Role: MessageRoleAssistant, Content: text, ToolCalls: calls}}
+	parentID = request.ID
+
+	for _, call := range calls {
+		result := s.callTool(ctx, call)
+		msg, err := s.querier.CreateMessage(ctx, CreateMessageParams{
+			ChatID:     reply.ChatID,
+			PreviousID: pgtype.UUID{Bytes: parentID, Valid: true},
+			Content:    pgtype.Text{String: result, Valid: true},
+			Role:       string(MessageRoleTool),
+			Status:     string(MessageStatusDone),
+			ToolCallID: pgtype.Text{String: call.ID, Valid: true},
+		})
+		if err != nil {
+			return nil, uuid.Nil, databaseutil.WrapDBError(err, s.logger, "create tool message")
+		}
+		messages = append(messages, ChatMessage{Role: MessageRoleTool, Content: result, ToolCallID: call.ID})
+		parentID = msg.ID
+	}
+
+	err = s.querier.UpdateMessageParent(ctx, UpdateMessageParentParams{
+		ID:         reply.ID,
+		PreviousID: pgtype.UUID{Bytes: parentID, Valid: true},
+	})
+	if err != nil {
+		return nil, uuid.Nil, databaseutil.WrapDBErrorWithKeyValue(err, "message", "message_id", reply.ID.String(),
+			s.logger, "move reply under tool results")
+	}
+	return messages, parentID, nil
+}
+
+// callTool runs a tool call and returns its JSON result. Failures are reported to the
+// model in the result, so that it can recover, rather than failing the reply.
+func (s *ChatService) callTool(ctx context.Context, call ToolCall) string {
+	tool, ok := s.tools.lookup(call.Function.Name)
+	if !ok {
+		return toolError(fmt.Errorf("unknown tool %q", call.Function.Name))
+	}
+	ctx, cancel := context.WithTimeout(ctx, toolTimeout)
+	defer cancel()
+
+	result, err := tool.Call(ctx, json.RawMessage(call.Function.Arguments))
+	if err != nil {
+		s.logger.Info("tool call failed", zap.String("tool", tool.Name), zap.Error(err))
+		return toolError(err)
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		s.logger.Warn("failed to encode tool result", zap.String("tool", tool.Name), zap.Error(err))
+		return toolError(errors.New("the tool returned an unreadable result"))
+	}
+	return string(encoded)
+}
+
+func toolError(err error) string {
+	encoded, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(encoded)
+}
+
+// decodeToolCalls reads the tool calls stored on a message; malformed ones are dropped.
+func decodeToolCalls(data []byte) []ToolCall {
+	if len(data) == 0 {
+		return nil
+	}
+	var calls []ToolCall
+	if err := json.Unmarshal(data, &calls); err != nil {
+		return nil
+	}
+	return calls
+}
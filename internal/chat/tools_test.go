@@ -0,0 +1,167 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestToolCallBuilder_TableDriven(t *testing.T) {
+	fn := func(name, arguments string) FunctionCall {
+		return FunctionCall{Name: name, Arguments: arguments}
+	}
+	tests := []struct {
+		name   string
+		chunks [][]ToolCallDelta
+		want   []ToolCall
+	}{
+		{name: "no fragments"},
+		{
+			name: "arguments split across chunks",
+			chunks: [][]ToolCallDelta{
+				{{Index: 0, ID: "call_a", Type: "function", Function: fn("evaluate_expression", "")}},
+				{{Index: 0, Function: fn("", `{"expres`)}},
+				{{Index: 0, Function: fn("", `sion":"1+1"}`)}},
+			},
+			want: []ToolCall{{ID: "call_a", Type: "function", Function: fn("evaluate_expression", `{"expression":"1+1"}`)}},
+		},
+		{
+			name: "parallel calls interleaved",
+			chunks: [][]ToolCallDelta{
+				{{Index: 0, ID: "call_a", Function: fn("get_question", `{"id":`)}, {Index: 1, ID: "call_b", Function: fn("get_text_content", "")}},
+				{{Index: 1, Function: fn("", `{"id":"2"}`)}},
+				{{Index: 0, Function: fn("", `"1"}`)}},
+			},
+			want: []ToolCall{
+				{ID: "call_a", Type: "function", Function: fn("get_question", `{"id":"1"}`)},
+				{ID: "call_b", Type: "function", Function: fn("get_text_content", `{"id":"2"}`)},
+			},
+		},
+		{
+			name:   "missing ID and arguments are filled in",
+			chunks: [][]ToolCallDelta{{{Index: 0, Function: fn("evaluate_expression", "")}}},
+			want:   []ToolCall{{ID: "call_0", Type: "function", Function: fn("evaluate_expression", "{}")}},
+		},
+		{
+			name: "calls without a name are dropped",
+			chunks: [][]ToolCallDelta{
+				{{Index: 0, Function: fn("", `{}`)}, {Index: 1, ID: "call_b", Function: fn("get_question", `{}`)}},
+			},
+			want: []ToolCall{{ID: "call_b", Type: "function", Function: fn("get_question", `{}`)}},
+		},
+		{
+			name: "out of range indexes are ignored",
+			chunks: [][]ToolCallDelta{
+				{{Index: -1, ID: "neg", Function: fn("get_question", `{}`)}, {Index: maxToolCalls, ID: "far", Function: fn("get_question", `{}`)}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var builder toolCallBuilder
+			for _, chunk := range tt.chunks {
+				builder.add(chunk)
+			}
+			if got := builder.build(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallTool_TableDriven(t *testing.T) {
+	tests := []struct {
+		name string
+		call ToolCall
+		want string
+	}{
+		{
+			name: "result",
+			call: ToolCall{Function: FunctionCall{Name: "evaluate_expression", Arguments: `{"expression":"6*7"}`}},
+			want: `{"expression":"6*7","value":42}`,
+		},
+		{
+			name: "tool error is sent to the model",
+			call: ToolCall{Function: FunctionCall{Name: "evaluate_expression", Arguments: `{"expression":"1/0"}`}},
+			want: `{"error":"invalid expression: division by zero"}`,
+		},
+		{
+			name: "malformed arguments",
+			call: ToolCall{Function: FunctionCall{Name: "evaluate_expression", Arguments: `{"expression":`}},
+			want: `{"error":"invalid tool arguments: unexpected end of JSON input"}`,
+		},
+		{
+			name: "unknown tool",
+			call: ToolCall{Function: FunctionCall{Name: "rm"}},
+			want: `{"error":"unknown tool \"rm\""}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newTestService(newFakeChatQuerier())
+			service.SetTools(NewToolRegistry(NewCalculatorTool()))
+			if got := service.callTool(context.Background(), tt.call); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolRoundText(t *testing.T) {
+	user := uuid.New()
+	querier := newFakeChatQuerier()
+	chat := querier.addChat(user)
+	call := ToolCallDelta{Index: 0, ID: "call_a", Type: "function",
+		Function: FunctionCall{Name: "evaluate_expression", Arguments: `{"expression":"6*7"}`}}
+	provider := &fakeProvider{rounds: [][]StreamDelta{
+		{{Delta: "Let me compute. "}, {ToolCalls: []ToolCallDelta{call}}},
+		{{Delta: "It is 42."}},
+	}}
+	service := newTestService(querier)
+	service.provider = provider
+	service.SetTools(NewToolRegistry(NewCalculatorTool()))
+
+	created, err := service.CreateMessage(userContext(user), chat.ID, "what is 6*7?", uuid.Nil, nil, GenerationOptions{})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	reply := querier.waitFinished(t, created.ReplyMessageID)
+	if reply.Content.String != "Let me compute. It is 42." {
+		t.Errorf("got reply %q, want the text of both rounds", reply.Content.String)
+	}
+
+	path, err := service.GetChatPath(userContext(user), chat.ID, uuid.Nil)
+	if err != nil {
+		t.Fatalf("GetChatPath: %v", err)
+	}
+	if len(path) != 4 {
+		t.Fatalf("got a branch of %d messages, want prompt, calls, result, reply", len(path))
+	}
+	if calls := path[1]; len(calls.ToolCalls) != 1 || calls.Content != "Let me compute. " {
+		t.Errorf("got tool call message %q with %d calls, want the first round's text", calls.Content, len(calls.ToolCalls))
+	}
+
+	if len(provider.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(provider.requests))
+	}
+	second := provider.requests[1].Messages
+	if len(second) != 3 || second[1].Content != "Let me compute. " || len(second[1].ToolCalls) != 1 {
+		body, _ := json.Marshal(second)
+		t.Errorf("the second round does not carry the first round's text with its calls: %s", body)
+	}
+
+	history := service.chatMessages(context.Background(), path)
+	var contents []string
+	for _, msg := range history {
+		contents = append(contents, msg.Content)
+	}
+	want := []string{"what is 6*7?", "Let me compute. ", `{"expression":"6*7","value":42}`, "It is 42."}
+	if !reflect.DeepEqual(contents, want) {
+		t.Errorf("got history %q, want %q", contents, want)
+	}
+}
@@ -0,0 +1,191 @@
+package chat
+
+import (
+	"context"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// TreeMessage is a message with its place in the conversation tree. Siblings are the
+// messages sharing its previous message (or the roots), ordered by creation time.
+type TreeMessage struct {
+	MessageReturn
+	ChildIDs     []uuid.UUID `json:"childIDs"`
+	SiblingIndex int         `json:"siblingIndex"`
+	SiblingCount int         `json:"siblingCount"`
+}
+
+type ChatTree struct {
+	Messages      []TreeMessage `json:"messages"`
+	RootIDs       []uuid.UUID   `json:"rootIDs"`
+	CurrentLeafID uuid.UUID     `json:"currentLeafID,omitempty"`
+	// ActivePath lists the message IDs from the root to the current leaf.
+	ActivePath []uuid.UUID `json:"activePath"`
+}
+
+// messageTree indexes a chat's messages by ID and by parent.
+type messageTree struct {
+	byID     map[uuid.UUID]MessageReturn
+	children map[uuid.UUID][]uuid.UUID // uuid.Nil holds the roots
+	order    []uuid.UUID
+}
+
+func newMessageTree(messages []MessageReturn) messageTree {
+	tree := messageTree{
+		byID:     make(map[uuid.UUID]MessageReturn, len(messages)),
+		children: make(map[uuid.UUID][]uuid.UUID),
+		order:    make([]uuid.UUID, 0, len(messages)),
+	}
+	// messages come in created_at order, so children lists are too.
+	for _, msg := range messages {
+		tree.byID[msg.ID] = msg
+		tree.children[msg.PreviousID] = append(tree.children[msg.PreviousID], msg.ID)
+		tree.order = append(tree.order, msg.ID)
+	}
+	return tree
+}
+
+// leafOf follows the newest child from a message down to a leaf.
+func (t messageTree) leafOf(id uuid.UUID) uuid.UUID {
+	for {
+		children := t.children[id]
+		if len(children) == 0 {
+			return id
+		}
+		id = children[len(children)-1]
+	}
+}
+
+// pathTo returns the messages from the root down to id.
+func (t messageTree) pathTo(id uuid.UUID) []MessageReturn {
+	var reversed []MessageReturn
+	for id != uuid.Nil {
+		msg, ok := t.byID[id]
+		if !ok {
+			break
+		}
+		reversed = append(reversed, msg)
+		id = msg.PreviousID
+	}
+	path := make([]MessageReturn, 0, len(reversed))
+	for i := len(reversed) - 1; i >= 0; i-- {
+		path = append(path, reversed[i])
+	}
+	return path
+}
+
+// currentLeaf is the chat's stored leaf when it still exists, otherwise the newest message.
+func (t messageTree) currentLeaf(chat Chat) uuid.UUID {
+	if chat.CurrentLeafID.Valid {
+		if _, ok := t.byID[chat.CurrentLeafID.Bytes]; ok {
+			return chat.CurrentLeafID.Bytes
+		}
+	}
+	if len(t.order) == 0 {
+		return uuid.Nil
+	}
+	return t.order[len(t.order)-1]
+}
+
+func (s *ChatService) getChatRow(ctx context.Context, chatID uuid.UUID) (Chat, error) {
+	chat, err := s.querier.GetChat(ctx, chatID)
+	if err != nil {
+		return Chat{}, databaseutil.WrapDBErrorWithKeyValue(err, "chat", "chat_id", chatID.String(), s.logger, "get chat")
+	}
+	if chat.ID == uuid.Nil {
+		return Chat{}, handlerutil.NewNotFoundError("chat", "chat_id", chatID.String(), "")
+	}
+	return chat, nil
+}
+
+// GetChatTree returns every message of a chat with its children and sibling position,
+// together with the branch the chat currently shows.
+func (s *ChatService) GetChatTree(ctx context.Context, chatID uuid.UUID) (ChatTree, error) {
+	chat, err := s.authorizeChat(ctx, chatID)
+	if err != nil {
+		return ChatTree{}, err
+	}
+	messages, err := s.fetchMessages(ctx, chatID)
+	if err != nil {
+		return ChatTree{}, err
+	}
+	tree := newMessageTree(messages)
+
+	result := ChatTree{
+		Messages:   make([]TreeMessage, 0, len(messages)),
+		RootIDs:    append([]uuid.UUID{}, tree.children[uuid.Nil]...),
+		ActivePath: []uuid.UUID{},
+	}
+	for _, msg := range messages {
+		siblings := tree.children[msg.PreviousID]
+		node := TreeMessage{
+			MessageReturn: msg,
+			ChildIDs:      append([]uuid.UUID{}, tree.children[msg.ID]...),
+			SiblingCount:  len(siblings),
+		}
+		for i, id := range siblings {
+			if id == msg.ID {
+				node.SiblingIndex = i
+				break
+			}
+		}
+		result.Messages = append(result.Messages, node)
+	}
+
+	result.CurrentLeafID = tree.currentLeaf(chat)
+	for _, msg := range tree.pathTo(result.CurrentLeafID) {
+		result.ActivePath = append(result.ActivePath, msg.ID)
+	}
+	return result, nil
+}
+
+// GetChatPath returns the branch ending at the leaf below messageID, following the
+// newest child at every fork. A nil messageID means the chat's current leaf.
+func (s *ChatService) GetChatPath(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID) ([]MessageReturn, error) {
+	chat, err := s.authorizeChat(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.fetchMessages(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	tree := newMessageTree(messages)
+
+	if messageID == uuid.Nil {
+		return tree.pathTo(tree.currentLeaf(chat)), nil
+	}
+	if _, ok := tree.byID[messageID]; !ok {
+		return nil, handlerutil.NewNotFoundError("message", "message_id", messageID.String(), "message does not belong to this chat")
+	}
+	return tree.pathTo(tree.leafOf(messageID)), nil
+}
+
+// SetCurrentLeaf switches the chat to the branch through messageID and returns it.
+func (s *ChatService) SetCurrentLeaf(ctx context.Context, chatID uuid.UUID, messageID uuid.UUID) ([]MessageReturn, error) {
+	path, err := s.GetChatPath(ctx, chatID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return path, nil
+	}
+	if err := s.updateCurrentLeaf(ctx, chatID, path[len(path)-1].ID); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+func (s *ChatService) updateCurrentLeaf(ctx context.Context, chatID uuid.UUID, leafID uuid.UUID) error {
+	err := s.querier.UpdateChatCurrentLeaf(ctx, UpdateChatCurrentLeafParams{
+		ID:            chatID,
+		CurrentLeafID: pgtype.UUID{Bytes: leafID, Valid: leafID != uuid.Nil},
+	})
+	if err != nil {
+		return databaseutil.WrapDBErrorWithKeyValue(err, "chat", "chat_id", chatID.String(), s.logger, "update current leaf")
+	}
+	return nil
+}
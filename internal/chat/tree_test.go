@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"sciedu-backend/internal/auth"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// branchedChat builds the tree
+//
+//	q1 ─ a1 ─ q2 ─ a2
+//	   └ a1' ─ q3
+//	q4
+//
+// and returns its messages by name.
+func branchedChat(f *fakeChatQuerier, owner uuid.UUID) (Chat, map[string]uuid.UUID) {
+	chat := f.addChat(owner)
+	ids := map[string]uuid.UUID{}
+	add := func(name, previous string, role MessageRole) {
+		ids[name] = f.addMessage(chat.ID, ids[previous], role, name).ID
+	}
+	add("q1", "", MessageRoleUser)
+	add("a1", "q1", MessageRoleAssistant)
+	add("q2", "a1", MessageRoleUser)
+	add("a1'", "q1", MessageRoleAssistant)
+	add("a2", "q2", MessageRoleAssistant)
+	add("q3", "a1'", MessageRoleUser)
+	add("q4", "", MessageRoleUser)
+	return chat, ids
+}
+
+func names(ids map[string]uuid.UUID, path []uuid.UUID) []string {
+	byID := map[uuid.UUID]string{}
+	for name, id := range ids {
+		byID[id] = name
+	}
+	result := make([]string, 0, len(path))
+	for _, id := range path {
+		result = append(result, byID[id])
+	}
+	return result
+}
+
+func TestGetChatTree_TableDriven(t *testing.T) {
+	tests := []struct {
+		name string
+		// leaf is the stored current leaf; "" leaves it unset and "gone" points it at
+		// a message that no longer exists.
+		leaf           string
+		wantLeaf       string
+		wantActivePath []string
+	}{
+		{name: "no stored leaf uses the newest message", wantLeaf: "q4", wantActivePath: []string{"q4"}},
+		{name: "stored leaf", leaf: "a2", wantLeaf: "a2", wantActivePath: []string{"q1", "a1", "q2", "a2"}},
+		{name: "stored leaf on another branch", leaf: "q3", wantLeaf: "q3", wantActivePath: []string{"q1", "a1'", "q3"}},
+		{name: "stored leaf that was deleted", leaf: "gone", wantLeaf: "q4", wantActivePath: []string{"q4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner := uuid.New()
+			querier := newFakeChatQuerier()
+			chat, ids := branchedChat(querier, owner)
+			switch tt.leaf {
+			case "":
+			case "gone":
+				chat.CurrentLeafID = pgtype.UUID{Bytes: uuid.New(), Valid: true}
+			default:
+				chat.CurrentLeafID = pgtype.UUID{Bytes: ids[tt.leaf], Valid: true}
+			}
+			querier.chats[chat.ID] = chat
+
+			tree, err := newTestService(querier).GetChatTree(userContext(owner), chat.ID)
+			if err != nil {
+				t.Fatalf("GetChatTree: %v", err)
+			}
+			if tree.CurrentLeafID != ids[tt.wantLeaf] {
+				t.Errorf("got current leaf %v, want %s", names(ids, []uuid.UUID{tree.CurrentLeafID}), tt.wantLeaf)
+			}
+			if got := names(ids, tree.ActivePath); !slices.Equal(got, tt.wantActivePath) {
+				t.Errorf("got active path %v, want %v", got, tt.wantActivePath)
+			}
+			if got := names(ids, tree.RootIDs); !slices.Equal(got, []string{"q1", "q4"}) {
+				t.Errorf("got roots %v, want [q1 q4]", got)
+			}
+
+			wantNodes := map[string]struct {
+				children     []string
+				index, count int
+			}{
+				"q1":  {children: []string{"a1", "a1'"}, index: 0, count: 2},
+				"a1":  {children: []string{"q2"}, index: 0, count: 2},
+				"a1'": {children: []string{"q3"}, index: 1, count: 2},
+				"q2":  {children: []string{"a2"}, index: 0, count: 1},
+				"a2":  {children: []string{}, index: 0, count: 1},
+				"q3":  {children: []string{}, index: 0, count: 1},
+				"q4":  {children: []string{}, index: 1, count: 2},
+			}
+			if len(tree.Messages) != len(wantNodes) {
+				t.Fatalf("got %d messages, want %d", len(tree.Messages), len(wantNodes))
+			}
+			for _, node := range tree.Messages {
+				name := node.Content
+				want := wantNodes[name]
+				if got := names(ids, node.ChildIDs); !slices.Equal(got, want.children) {
+					t.Errorf("%s: got children %v, want %v", name, got, want.children)
+				}
+				if node.SiblingIndex != want.index || node.SiblingCount != want.count {
+					t.Errorf("%s: got sibling %d of %d, want %d of %d", name, node.SiblingIndex, node.SiblingCount, want.index, want.count)
+				}
+			}
+		})
+	}
+}
+
+func TestGetChatPath_TableDriven(t *testing.T) {
+	tests := []struct {
+		name      string
+		messageID string
+		// unknown asks for a message of another chat.
+		unknown  bool
+		wantPath []string
+	}{
+		{name: "current leaf", wantPath: []string{"q4"}},
+		{name: "leaf message", messageID: "a2", wantPath: []string{"q1", "a1", "q2", "a2"}},
+		{name: "fork follows the newest child", messageID: "q1", wantPath: []string{"q1", "a1'", "q3"}},
+		{name: "older sibling", messageID: "a1", wantPath: []string{"q1", "a1", "q2", "a2"}},
+		{name: "message of another chat", unknown: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner := uuid.New()
+			querier := newFakeChatQuerier()
+			chat, ids := branchedChat(querier, owner)
+			messageID := ids[tt.messageID]
+			if tt.unknown {
+				messageID = uuid.New()
+			}
+
+			path, err := newTestService(querier).GetChatPath(userContext(owner), chat.ID, messageID)
+			if tt.unknown {
+				var notFound handlerutil.NotFoundError
+				if !errors.As(err, &notFound) {
+					t.Fatalf("got error %v, want a not found error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetChatPath: %v", err)
+			}
+			got := make([]string, 0, len(path))
+			for _, msg := range path {
+				got = append(got, msg.Content)
+			}
+			if !slices.Equal(got, tt.wantPath) {
+				t.Errorf("got path %v, want %v", got, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestSetCurrentLeaf(t *testing.T) {
+	owner := uuid.New()
+	querier := newFakeChatQuerier()
+	chat, ids := branchedChat(querier, owner)
+	service := newTestService(querier)
+
+	path, err := service.SetCurrentLeaf(userContext(owner), chat.ID, ids["a1"])
+	if err != nil {
+		t.Fatalf("SetCurrentLeaf: %v", err)
+	}
+	if len(path) == 0 || path[len(path)-1].ID != ids["a2"] {
+		t.Fatalf("got path ending at %v, want a2", path)
+	}
+	if len(querier.updateChatCurrentLeafArgs) != 1 || querier.updateChatCurrentLeafArgs[0].CurrentLeafID.Bytes != ids["a2"] {
+		t.Fatalf("got current leaf updates %+v, want one to a2", querier.updateChatCurrentLeafArgs)
+	}
+
+	tree, err := service.GetChatTree(userContext(owner), chat.ID)
+	if err != nil {
+		t.Fatalf("GetChatTree: %v", err)
+	}
+	if got := names(ids, tree.ActivePath); !slices.Equal(got, []string{"q1", "a1", "q2", "a2"}) {
+		t.Errorf("got active path %v after switching branches", got)
+	}
+}
+
+func TestGetChatTreeAuthorization_TableDriven(t *testing.T) {
+	owner := uuid.New()
+	tests := []struct {
+		name    string
+		userID  uuid.UUID
+		roles   []string
+		wantErr error
+	}{
+		{name: "owner", userID: owner},
+		{name: "admin", userID: uuid.New(), roles: []string{auth.RoleAdmin}},
+		{name: "another user", userID: uuid.New(), wantErr: handlerutil.ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			querier := newFakeChatQuerier()
+			chat, _ := branchedChat(querier, owner)
+			_, err := newTestService(querier).GetChatTree(userContext(tt.userID, tt.roles...), chat.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,8 +1,18 @@
 package chat
 
+import "encoding/json"
+
 type StreamDelta struct {
 	Delta      string `json:"delta"`
 	IsFinished bool   `json:"isFinished"`
+	// Status is set on the terminal delta to tell how the stream ended.
+	Status MessageStatus `json:"status,omitempty"`
+	// ToolCalls are fragments of the tool calls the model is making. They are consumed
+	// by the service and never forwarded to clients.
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+	// Offset is the byte length of the content streamed up to and including this
+	// delta. It serves as the SSE event ID.
+	Offset int `json:"-"`
 }
 
 type MessageRole string
@@ -10,6 +20,8 @@ type MessageRole string
 const (
 	MessageRoleUser      MessageRole = "user"
 	MessageRoleAssistant MessageRole = "assistant"
+	MessageRoleSystem    MessageRole = "system"
+	MessageRoleTool      MessageRole = "tool"
 )
 
 type MessageStatus string
@@ -18,14 +30,96 @@ const (
 	MessageStatusStreaming MessageStatus = "streaming"
 	MessageStatusDone      MessageStatus = "completed"
 	MessageStatusError     MessageStatus = "failed"
+	MessageStatusCancelled MessageStatus = "cancelled"
 )
 
 type ChatMessage struct {
 	Role    MessageRole `json:"role"`
 	Content string      `json:"content"`
+	// Parts are media sent along with Content, see MarshalJSON.
+	Parts []ContentPart `json:"-"`
+	// ToolCalls are the calls requested by an assistant message.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call a tool message answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// ContentPart is one element of multimodal message content.
+type ContentPart struct {
+	Type       string      `json:"type"`
+	Text       string      `json:"text,omitempty"`
+	ImageURL   *ImageURL   `json:"image_url,omitempty"`
+	InputAudio *InputAudio `json:"input_audio,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+type InputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+// MarshalJSON sends content as a plain string, or as an array of a text part followed
+// by the media parts when the message has any.
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Parts) == 0 {
+		type plain ChatMessage
+		return json.Marshal(plain(m))
+	}
+	parts := make([]ContentPart, 0, len(m.Parts)+1)
+	if m.Content != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: m.Content})
+	}
+	parts = append(parts, m.Parts...)
+	return json.Marshal(struct {
+		Role    MessageRole   `json:"role"`
+		Content []ContentPart `json:"content"`
+	}{m.Role, parts})
+}
+
+// ToolCall is a function call requested by the model.
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name string `json:"name"`
+	// Arguments is a JSON object, as generated by the model.
+	Arguments string `json:"arguments"`
+}
+
+// ToolCallDelta is a streamed fragment of a tool call. Fragments with the same Index
+// belong to the same call; the ID, type and name come first and the arguments are
+// spread over the following fragments.
+type ToolCallDelta struct {
+	Index    int          `json:"index"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+// ToolDefinition describes a tool the model may call.
+type ToolDefinition struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Parameters is the JSON schema of the arguments.
+	Parameters json.RawMessage `json:"parameters"`
 }
 
 type CreateChatCompletionRequest struct {
-	Messages []ChatMessage `json:"messages"`
-	Stream   bool          `json:"stream"`
+	Model       string           `json:"model,omitempty"`
+	Messages    []ChatMessage    `json:"messages"`
+	Stream      bool             `json:"stream"`
+	Temperature *float32         `json:"temperature,omitempty"`
+	MaxTokens   *int32           `json:"max_tokens,omitempty"`
+	Tools       []ToolDefinition `json:"tools,omitempty"`
 }
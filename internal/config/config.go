@@ -20,7 +20,12 @@ type Config struct {
 	DatabaseURL     string `yaml:"database_url"       envconfig:"DATABASE_URL"`
 	MigrationSource string `yaml:"migration_source"   envconfig:"MIGRATION_SOURCE"`
 	LLMURL          string `yaml:"llm_url"            envconfig:"LLM_URL"`
+	LLMModels       string `yaml:"llm_models"         envconfig:"LLM_MODELS"`
 	AllowOrigins    string `yaml:"allow_origins"      envconfig:"ALLOW_ORIGINS"`
+	StorageQuotas   string `yaml:"storage_quotas"     envconfig:"STORAGE_QUOTAS"`
+	ContextBudgets  string `yaml:"context_budgets"    envconfig:"CONTEXT_BUDGETS"`
+	StreamHub       string `yaml:"stream_hub"         envconfig:"STREAM_HUB"`
+	StreamMaxLag    string `yaml:"stream_max_lag"     envconfig:"STREAM_MAX_LAG"`
 }
 
 type LogBuffer struct {
@@ -66,7 +71,12 @@ func Load() (Config, *LogBuffer) {
 		DatabaseURL:     "",
 		MigrationSource: "file://internal/database/migrations",
 		LLMURL:          "https://llm.dev.sciedu.sdc.nycu.club",
+		LLMModels:       "gpt-4o,gpt-4o-mini",
 		AllowOrigins:    "",
+		StorageQuotas:   "default=1GiB,EXPERIMENTER=10GiB,ADMIN=unlimited",
+		ContextBudgets:  "default=16000",
+		StreamHub:       "memory",
+		StreamMaxLag:    "30s",
 	}
 
 	var err error
@@ -127,7 +137,12 @@ func FromEnv(config *Config, logger *LogBuffer) (*Config, error) {
 		DatabaseURL:     os.Getenv("DATABASE_URL"),
 		MigrationSource: os.Getenv("MIGRATION_SOURCE"),
 		LLMURL:          os.Getenv("LLM_URL"),
+		LLMModels:       os.Getenv("LLM_MODELS"),
 		AllowOrigins:    os.Getenv("ALLOW_ORIGINS"),
+		StorageQuotas:   os.Getenv("STORAGE_QUOTAS"),
+		ContextBudgets:  os.Getenv("CONTEXT_BUDGETS"),
+		StreamHub:       os.Getenv("STREAM_HUB"),
+		StreamMaxLag:    os.Getenv("STREAM_MAX_LAG"),
 	}
 
 	return configutil.Merge[Config](config, envConfig)
@@ -143,7 +158,12 @@ func FromFlags(config *Config) (*Config, error) {
 	flag.StringVar(&flagConfig.DatabaseURL, "database_url", "", "database url")
 	flag.StringVar(&flagConfig.MigrationSource, "migration_source", "", "migration source")
 	flag.StringVar(&flagConfig.LLMURL, "llm_url", "", "LLM url")
+	flag.StringVar(&flagConfig.LLMModels, "llm_models", "", "allowed LLM models (comma-separated, the first is the default)")
 	flag.StringVar(&flagConfig.AllowOrigins, "allow_origins", "", "allowed CORS origins (comma-separated)")
+	flag.StringVar(&flagConfig.StorageQuotas, "storage_quotas", "", "media storage quota per role (e.g. default=1GiB,ADMIN=unlimited)")
+	flag.StringVar(&flagConfig.ContextBudgets, "context_budgets", "", "LLM prompt token budget per model (e.g. default=16000,gpt-4o=120000)")
+	flag.StringVar(&flagConfig.StreamHub, "stream_hub", "", "where chat streams are tracked: memory (one replica) or postgres (several replicas)")
+	flag.StringVar(&flagConfig.StreamMaxLag, "stream_max_lag", "", "how long streamed text may wait for a slow client before it is disconnected (e.g. 30s, 0 to never)")
 
 	flag.Parse()
 
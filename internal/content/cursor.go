@@ -0,0 +1,45 @@
+package content
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errInvalidCursor = errors.New("invalid pagination cursor")
+
+// listCursor is the position after which the next page starts. Clients only ever
+// see it as an opaque string.
+type listCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        uuid.UUID `json:"id"`
+}
+
+func encodeCursor(item Content) string {
+	raw, _ := json.Marshal(listCursor{CreatedAt: item.CreatedAt.Time.UTC(), ID: item.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor parses a cursor returned by a previous page. An empty cursor means the
+// first page.
+func decodeCursor(raw string) (listCursor, bool, error) {
+	if raw == "" {
+		return listCursor{}, false, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return listCursor{}, false, fmt.Errorf("%w: %v", errInvalidCursor, err)
+	}
+	var c listCursor
+	if err := json.Unmarshal(decoded, &c); err != nil {
+		return listCursor{}, false, fmt.Errorf("%w: %v", errInvalidCursor, err)
+	}
+	if c.ID == uuid.Nil || c.CreatedAt.IsZero() {
+		return listCursor{}, false, errInvalidCursor
+	}
+	return c, true, nil
+}
@@ -5,10 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"sciedu-backend/internal/auth"
 
 	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
 	logutil "github.com/NYCU-SDC/summer/pkg/log"
@@ -22,6 +28,7 @@ import (
 const defaultUploadDir = "contents"
 const defaultMaxMediaUploadBytes = 200 << 20
 const maxMultipartFormOverheadBytes = 1 << 20
+const maxSearchQueryRunes = 200
 
 var maxMediaUploadBytes int64 = defaultMaxMediaUploadBytes
 
@@ -34,17 +41,44 @@ type Handler struct {
 
 type HandlerService interface {
 	CreateMediaContent(ctx context.Context, upload MediaUploadRequest) (Content, error)
-	GetMediaContent(ctx context.Context, id uuid.UUID) (Content, error)
-	ListTextContents(ctx context.Context, page, pageSize int32) (TextPage, error)
-	CreateTextContent(ctx context.Context, content string) (Content, error)
+	OpenMediaContent(ctx context.Context, id uuid.UUID, width int) (Content, *os.File, error)
+	ListTextContents(ctx context.Context, filter ContentListFilter) (ContentPage, error)
+	ListTextContentsByCursor(ctx context.Context, filter CursorListFilter) (CursorPage, error)
+	ListMediaContents(ctx context.Context, filter ContentListFilter) (ContentPage, error)
+	ListMediaContentsByCursor(ctx context.Context, filter CursorListFilter) (CursorPage, error)
+	CreateTextContent(ctx context.Context, req TextContentRequest) (Content, error)
 	BatchGetTextContents(ctx context.Context, ids []uuid.UUID) ([]Content, error)
 	GetTextContent(ctx context.Context, id uuid.UUID) (Content, error)
+	RenderTextHTML(item Content) string
+	ReconcileMedia(ctx context.Context, opts ReconcileOptions) (ReconcileReport, error)
 	GetContent(ctx context.Context, id uuid.UUID) (Content, error)
 	DeleteContent(ctx context.Context, id uuid.UUID) error
+	UpdateTextContent(ctx context.Context, id uuid.UUID, patch TextContentPatch) (Content, error)
+	ReplaceMediaContent(ctx context.Context, id uuid.UUID, upload MediaUploadRequest) (Content, error)
+	GetStorageUsage(ctx context.Context, userID uuid.UUID) (StorageUsage, error)
+	SearchTextContents(ctx context.Context, filter SearchFilter) (SearchPage, error)
 }
 
 type createTextRequest struct {
-	Content string `json:"content" validate:"required,min=1"`
+	Content     string   `json:"content" validate:"required,min=1,max=100000"`
+	Format      string   `json:"format" validate:"omitempty,oneof=plain markdown"`
+	Title       string   `json:"title" validate:"max=200"`
+	Description string   `json:"description" validate:"max=2000"`
+	AltText     string   `json:"altText" validate:"max=1000"`
+	Tags        []string `json:"tags" validate:"max=20,dive,min=1,max=50"`
+}
+
+type patchTextRequest struct {
+	Content     *string   `json:"content" validate:"omitempty,min=1,max=100000"`
+	Format      *string   `json:"format" validate:"omitempty,oneof=plain markdown"`
+	Title       *string   `json:"title" validate:"omitempty,max=200"`
+	Description *string   `json:"description" validate:"omitempty,max=2000"`
+	AltText     *string   `json:"altText" validate:"omitempty,max=1000"`
+	Tags        *[]string `json:"tags" validate:"omitempty,max=20,dive,min=1,max=50"`
+}
+
+type reconcileMediaRequest struct {
+	Action string `json:"action" validate:"omitempty,oneof=report quarantine delete"`
 }
 
 type batchTextRequest struct {
@@ -52,12 +86,46 @@ type batchTextRequest struct {
 }
 
 type contentResponse struct {
-	ID      uuid.UUID `json:"id"`
-	Type    string    `json:"type"`
-	Content string    `json:"content"`
+	ID            uuid.UUID  `json:"id"`
+	Type          string     `json:"type"`
+	Content       string     `json:"content"`
+	Format        string     `json:"format,omitempty"`
+	Revision      int32      `json:"revision"`
+	HTML          string     `json:"html,omitempty"`
+	SHA256        string     `json:"sha256,omitempty"`
+	VariantStatus string     `json:"variantStatus,omitempty"`
+	VariantWidths []int32    `json:"variantWidths,omitempty"`
+	Title         string     `json:"title,omitempty"`
+	Description   string     `json:"description,omitempty"`
+	AltText       string     `json:"altText,omitempty"`
+	Tags          []string   `json:"tags"`
+	CreatedBy     *uuid.UUID `json:"createdBy"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+// storageUsageResponse reports quotas in bytes; a null quota means unlimited.
+type storageUsageResponse struct {
+	UsedBytes      int64  `json:"usedBytes"`
+	QuotaBytes     *int64 `json:"quotaBytes"`
+	RemainingBytes *int64 `json:"remainingBytes"`
 }
 
-type paginatedTextResponse struct {
+// searchResultResponse is a content with its relevance; snippet is HTML.
+type searchResultResponse struct {
+	contentResponse
+	Rank    float32 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+type searchPageResponse struct {
+	Items       []searchResultResponse `json:"items"`
+	CurrentPage int32                  `json:"currentPage"`
+	PageSize    int32                  `json:"pageSize"`
+	HasNextPage bool                   `json:"hasNextPage"`
+}
+
+type paginatedContentResponse struct {
 	Items       []contentResponse `json:"items"`
 	TotalPages  int32             `json:"totalPages"`
 	TotalItems  int32             `json:"totalItems"`
@@ -66,6 +134,13 @@ type paginatedTextResponse struct {
 	HasNextPage bool              `json:"hasNextPage"`
 }
 
+type cursorPageResponse struct {
+	Items       []contentResponse `json:"items"`
+	PageSize    int32             `json:"pageSize"`
+	NextCursor  string            `json:"nextCursor,omitempty"`
+	HasNextPage bool              `json:"hasNextPage"`
+}
+
 func NewHandler(service HandlerService, logger *zap.Logger) *Handler {
 	if logger == nil {
 		logger = zap.NewNop()
@@ -83,7 +158,18 @@ func NewHandler(service HandlerService, logger *zap.Logger) *Handler {
 					Detail: err.Error(),
 				}
 			}
-			if errors.Is(err, errInvalidContentPayload) {
+			if errors.Is(err, errStorageQuotaExceeded) {
+				return problemutil.Problem{
+					Title:  "Insufficient Storage",
+					Status: http.StatusInsufficientStorage,
+					Type:   "https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/507",
+					Detail: err.Error(),
+				}
+			}
+			if errors.Is(err, errInvalidContentPayload) || errors.Is(err, errUnsupportedVariantWidth) ||
+				errors.Is(err, errEmptyTextContent) || errors.Is(err, errUnsupportedRender) ||
+				errors.Is(err, errInvalidCursor) || errors.Is(err, errInvalidReconcileAction) ||
+				errors.Is(err, errEmptySearchQuery) {
 				return problemutil.NewValidateProblem(err.Error())
 			}
 			return problemutil.Problem{}
@@ -100,12 +186,19 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux, middlewares *middlewareutil
 		mux.HandleFunc(pattern, fn)
 	}
 
+	handle("GET /api/content/media", h.ListMedia)
 	handle("POST /api/content/media", h.CreateMedia)
+	handle("POST /api/content/media/reconcile", h.ReconcileMedia)
 	handle("GET /api/content/media/{id}", h.StreamMedia)
+	handle("PUT /api/content/media/{id}", h.ReplaceMedia)
+	handle("GET /api/content/search", h.SearchText)
+	handle("GET /api/content/usage", h.GetUsage)
 	handle("GET /api/content/text", h.ListText)
 	handle("POST /api/content/text", h.CreateText)
 	handle("POST /api/content/text/batch", h.BatchGetText)
 	handle("GET /api/content/text/{id}", h.GetText)
+	handle("PUT /api/content/text/{id}", h.ReplaceText)
+	handle("PATCH /api/content/text/{id}", h.PatchText)
 	handle("DELETE /api/content/{id}", h.Delete)
 }
 
@@ -113,17 +206,9 @@ func (h *Handler) CreateMedia(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxMediaUploadBytes+maxMultipartFormOverheadBytes)
-	file, header, err := r.FormFile("content")
+	file, header, err := openMediaUpload(w, r)
 	if err != nil {
-		var maxBytesErr *http.MaxBytesError
-		if errors.As(err, &maxBytesErr) {
-			h.problemWriter.WriteError(ctx, w, fmt.Errorf("%w: maximum upload size is %d bytes",
-				errMediaContentTooLarge, maxMediaUploadBytes), logger)
-			return
-		}
-		h.problemWriter.WriteError(ctx, w, fmt.Errorf("%w: missing multipart field 'content'",
-			errInvalidContentPayload), logger)
+		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
 	}
 	defer func() {
@@ -132,13 +217,20 @@ func (h *Handler) CreateMedia(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	metadata, err := parseMediaMetadata(r)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
 	ext := sanitizeExt(filepath.Ext(header.Filename))
 	generatedFilename := uuid.NewString() + ext
 	item, err := h.service.CreateMediaContent(ctx, MediaUploadRequest{
-		Content:  file,
-		Filename: generatedFilename,
-		Dir:      defaultUploadDir,
-		MaxBytes: maxMediaUploadBytes,
+		Content:         file,
+		Filename:        generatedFilename,
+		Dir:             defaultUploadDir,
+		MaxBytes:        maxMediaUploadBytes,
+		ContentMetadata: metadata,
 	})
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
@@ -148,6 +240,79 @@ func (h *Handler) CreateMedia(w http.ResponseWriter, r *http.Request) {
 	handlerutil.WriteJSONResponse(w, http.StatusCreated, toContentResponse(item))
 }
 
+// ReplaceMedia swaps the file behind an existing media content, keeping its ID and metadata.
+func (h *Handler) ReplaceMedia(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	id, err := h.parseID(r.PathValue("id"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	file, header, err := openMediaUpload(w, r)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil {
+			logger.Warn("failed to close uploaded multipart file", zap.Error(cerr))
+		}
+	}()
+
+	callerID, _ := auth.UserIDFromContext(ctx)
+	ext := sanitizeExt(filepath.Ext(header.Filename))
+	item, err := h.service.ReplaceMediaContent(ctx, id, MediaUploadRequest{
+		Content:         file,
+		Filename:        uuid.NewString() + ext,
+		Dir:             defaultUploadDir,
+		MaxBytes:        maxMediaUploadBytes,
+		ContentMetadata: ContentMetadata{CreatedBy: callerID},
+	})
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, toContentResponse(item))
+}
+
+// ReconcileMedia reports (and optionally cleans up) drift between the media directory
+// and the contents table. Only admins may call it.
+func (h *Handler) ReconcileMedia(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	user, ok := auth.UserFromContext(ctx)
+	if !ok {
+		h.problemWriter.WriteError(ctx, w, handlerutil.ErrUnauthorized, logger)
+		return
+	}
+	if !user.HasRole(auth.RoleAdmin) {
+		h.problemWriter.WriteError(ctx, w, handlerutil.ErrForbidden, logger)
+		return
+	}
+
+	var req reconcileMediaRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	report, err := h.service.ReconcileMedia(ctx, ReconcileOptions{
+		Action: req.Action,
+		Dir:    defaultUploadDir,
+	})
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, report)
+}
+
 func (h *Handler) StreamMedia(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
@@ -158,21 +323,20 @@ func (h *Handler) StreamMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	item, err := h.service.GetMediaContent(ctx, id)
+	width, err := parseVariantWidth(r)
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
 	}
 
-	path := item.Content
-	f, err := os.Open(path)
+	_, f, err := h.service.OpenMediaContent(ctx, id, width)
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
 	}
 	defer func() {
 		if cerr := f.Close(); cerr != nil {
-			logger.Warn("failed to close media file", zap.String("path", path), zap.Error(cerr))
+			logger.Warn("failed to close media file", zap.String("path", f.Name()), zap.Error(cerr))
 		}
 	}()
 
@@ -182,7 +346,7 @@ func (h *Handler) StreamMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := filepath.Base(path)
+	filename := filepath.Base(f.Name())
 	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
 	w.WriteHeader(http.StatusOK)
@@ -192,6 +356,19 @@ func (h *Handler) StreamMedia(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) ListText(w http.ResponseWriter, r *http.Request) {
+	h.listContents(w, r, h.service.ListTextContents, h.service.ListTextContentsByCursor)
+}
+
+func (h *Handler) ListMedia(w http.ResponseWriter, r *http.Request) {
+	h.listContents(w, r, h.service.ListMediaContents, h.service.ListMediaContentsByCursor)
+}
+
+// listContents serves a listing in cursor mode when the "cursor" query parameter is
+// present (empty for the first page) and in offset mode otherwise.
+func (h *Handler) listContents(w http.ResponseWriter, r *http.Request,
+	listPage func(ctx context.Context, filter ContentListFilter) (ContentPage, error),
+	listByCursor func(ctx context.Context, filter CursorListFilter) (CursorPage, error),
+) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
 
@@ -201,13 +378,54 @@ func (h *Handler) ListText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := h.service.ListTextContents(ctx, page, pageSize)
+	var owner uuid.UUID
+	if raw := r.URL.Query().Get("owner"); raw != "" {
+		owner, err = h.parseID(raw)
+		if err != nil {
+			h.problemWriter.WriteError(ctx, w, err, logger)
+			return
+		}
+	}
+	tag := r.URL.Query().Get("tag")
+
+	if r.URL.Query().Has("cursor") {
+		result, err := listByCursor(ctx, CursorListFilter{
+			Cursor:   r.URL.Query().Get("cursor"),
+			PageSize: pageSize,
+			Tag:      tag,
+			Owner:    owner,
+		})
+		if err != nil {
+			h.problemWriter.WriteError(ctx, w, err, logger)
+			return
+		}
+
+		resp := cursorPageResponse{
+			Items:       make([]contentResponse, 0, len(result.Items)),
+			PageSize:    result.PageSize,
+			NextCursor:  result.NextCursor,
+			HasNextPage: result.HasNextPage,
+		}
+		for _, it := range result.Items {
+			resp.Items = append(resp.Items, toContentResponse(it))
+		}
+
+		handlerutil.WriteJSONResponse(w, http.StatusOK, resp)
+		return
+	}
+
+	result, err := listPage(ctx, ContentListFilter{
+		Page:     page,
+		PageSize: pageSize,
+		Tag:      tag,
+		Owner:    owner,
+	})
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
 	}
 
-	resp := paginatedTextResponse{
+	resp := paginatedContentResponse{
 		Items:       make([]contentResponse, 0, len(result.Items)),
 		TotalPages:  result.TotalPages,
 		TotalItems:  result.TotalItems,
@@ -223,6 +441,56 @@ func (h *Handler) ListText(w http.ResponseWriter, r *http.Request) {
 	handlerutil.WriteJSONResponse(w, http.StatusOK, resp)
 }
 
+// SearchText runs a full-text search over text contents.
+func (h *Handler) SearchText(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		h.problemWriter.WriteError(ctx, w, fmt.Errorf("%w: missing q query", errEmptySearchQuery), logger)
+		return
+	}
+	if utf8.RuneCountInString(query) > maxSearchQueryRunes {
+		h.problemWriter.WriteError(ctx, w,
+			fmt.Errorf("%w: q must be at most %d characters", errInvalidContentPayload, maxSearchQueryRunes), logger)
+		return
+	}
+
+	page, pageSize, err := parsePaginationParams(r)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	result, err := h.service.SearchTextContents(ctx, SearchFilter{
+		Query:    query,
+		Page:     page,
+		PageSize: pageSize,
+		Tag:      r.URL.Query().Get("tag"),
+	})
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	resp := searchPageResponse{
+		Items:       make([]searchResultResponse, 0, len(result.Items)),
+		CurrentPage: result.CurrentPage,
+		PageSize:    result.PageSize,
+		HasNextPage: result.HasNextPage,
+	}
+	for _, it := range result.Items {
+		resp.Items = append(resp.Items, searchResultResponse{
+			contentResponse: toContentResponse(it.Content),
+			Rank:            it.Rank,
+			Snippet:         it.Snippet,
+		})
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
 func (h *Handler) CreateText(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
@@ -233,7 +501,18 @@ func (h *Handler) CreateText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	item, err := h.service.CreateTextContent(ctx, req.Content)
+	createdBy, _ := auth.UserIDFromContext(ctx)
+	item, err := h.service.CreateTextContent(ctx, TextContentRequest{
+		Content: req.Content,
+		Format:  req.Format,
+		ContentMetadata: ContentMetadata{
+			Title:       req.Title,
+			Description: req.Description,
+			AltText:     req.AltText,
+			Tags:        req.Tags,
+			CreatedBy:   createdBy,
+		},
+	})
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
@@ -242,6 +521,77 @@ func (h *Handler) CreateText(w http.ResponseWriter, r *http.Request) {
 	handlerutil.WriteJSONResponse(w, http.StatusCreated, toContentResponse(item))
 }
 
+// ReplaceText overwrites the text and all metadata of a text content; omitted fields are cleared.
+func (h *Handler) ReplaceText(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	id, err := h.parseID(r.PathValue("id"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	var req createTextRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	tags := req.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	format := textFormatOrDefault(req.Format)
+	item, err := h.service.UpdateTextContent(ctx, id, TextContentPatch{
+		Content:     &req.Content,
+		Title:       &req.Title,
+		Description: &req.Description,
+		AltText:     &req.AltText,
+		Tags:        &tags,
+		Format:      &format,
+	})
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, toContentResponse(item))
+}
+
+// PatchText changes only the fields present in the request body.
+func (h *Handler) PatchText(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	id, err := h.parseID(r.PathValue("id"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	var req patchTextRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	item, err := h.service.UpdateTextContent(ctx, id, TextContentPatch{
+		Content:     req.Content,
+		Title:       req.Title,
+		Description: req.Description,
+		AltText:     req.AltText,
+		Tags:        req.Tags,
+		Format:      req.Format,
+	})
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, toContentResponse(item))
+}
+
 func (h *Handler) BatchGetText(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
@@ -276,26 +626,58 @@ func (h *Handler) GetText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	render := r.URL.Query().Get("render")
+	if render != "" && render != "html" {
+		h.problemWriter.WriteError(ctx, w, fmt.Errorf("%w: render must be 'html'", errUnsupportedRender), logger)
+		return
+	}
+
 	item, err := h.service.GetTextContent(ctx, id)
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
 	}
 
-	handlerutil.WriteJSONResponse(w, http.StatusOK, toContentResponse(item))
+	resp := toContentResponse(item)
+	if render == "html" {
+		resp.HTML = h.service.RenderTextHTML(item)
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, resp)
 }
 
-func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+// GetUsage reports the caller's media storage usage and quota.
+func (h *Handler) GetUsage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logutil.WithContext(ctx, h.logger)
 
-	id, err := h.parseID(r.PathValue("id"))
+	userID, ok := auth.UserIDFromContext(ctx)
+	if !ok {
+		h.problemWriter.WriteError(ctx, w, handlerutil.ErrUnauthorized, logger)
+		return
+	}
+
+	usage, err := h.service.GetStorageUsage(ctx, userID)
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
 	}
 
-	item, err := h.service.GetContent(ctx, id)
+	resp := storageUsageResponse{UsedBytes: usage.UsedBytes}
+	if usage.QuotaBytes != UnlimitedStorage {
+		quota := usage.QuotaBytes
+		remaining := max(quota-usage.UsedBytes, 0)
+		resp.QuotaBytes, resp.RemainingBytes = &quota, &remaining
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, resp)
+}
+
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	id, err := h.parseID(r.PathValue("id"))
 	if err != nil {
 		h.problemWriter.WriteError(ctx, w, err, logger)
 		return
@@ -306,12 +688,6 @@ func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if enumToString(item.Type) == "MEDIA" {
-		if rmErr := os.Remove(item.Content); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
-			logger.Warn("failed to remove media file after deleting content", zap.String("path", item.Content), zap.Error(rmErr))
-		}
-	}
-
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -352,12 +728,94 @@ func parsePaginationParams(r *http.Request) (int32, int32, error) {
 	return page, pageSize, nil
 }
 
-func toContentResponse(c Content) contentResponse {
-	return contentResponse{
-		ID:      c.ID,
-		Type:    enumToString(c.Type),
-		Content: c.Content,
+// openMediaUpload caps the request body and opens the multipart "content" file.
+func openMediaUpload(w http.ResponseWriter, r *http.Request) (multipart.File, *multipart.FileHeader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMediaUploadBytes+maxMultipartFormOverheadBytes)
+	file, header, err := r.FormFile("content")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, nil, fmt.Errorf("%w: maximum upload size is %d bytes", errMediaContentTooLarge, maxMediaUploadBytes)
+		}
+		return nil, nil, fmt.Errorf("%w: missing multipart field 'content'", errInvalidContentPayload)
+	}
+	return file, header, nil
+}
+
+// parseMediaMetadata reads the optional metadata fields sent alongside a multipart upload.
+// Tags may be repeated or comma-separated.
+func parseMediaMetadata(r *http.Request) (ContentMetadata, error) {
+	createdBy, _ := auth.UserIDFromContext(r.Context())
+	metadata := ContentMetadata{
+		Title:       r.FormValue("title"),
+		Description: r.FormValue("description"),
+		AltText:     r.FormValue("altText"),
+		CreatedBy:   createdBy,
+	}
+	if r.MultipartForm != nil {
+		for _, raw := range r.MultipartForm.Value["tags"] {
+			metadata.Tags = append(metadata.Tags, strings.Split(raw, ",")...)
+		}
+	}
+
+	switch {
+	case utf8.RuneCountInString(metadata.Title) > 200:
+		return ContentMetadata{}, fmt.Errorf("%w: title must be at most 200 characters", errInvalidContentPayload)
+	case utf8.RuneCountInString(metadata.Description) > 2000:
+		return ContentMetadata{}, fmt.Errorf("%w: description must be at most 2000 characters", errInvalidContentPayload)
+	case utf8.RuneCountInString(metadata.AltText) > 1000:
+		return ContentMetadata{}, fmt.Errorf("%w: altText must be at most 1000 characters", errInvalidContentPayload)
+	case len(metadata.Tags) > 20:
+		return ContentMetadata{}, fmt.Errorf("%w: at most 20 tags are allowed", errInvalidContentPayload)
+	}
+	for _, tag := range metadata.Tags {
+		if utf8.RuneCountInString(tag) > 50 {
+			return ContentMetadata{}, fmt.Errorf("%w: tags must be at most 50 characters", errInvalidContentPayload)
+		}
+	}
+
+	return metadata, nil
+}
+
+func parseVariantWidth(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("w")
+	if raw == "" {
+		return 0, nil
+	}
+	width, err := strconv.Atoi(raw)
+	if err != nil || width < 1 {
+		return 0, fmt.Errorf("%w: invalid w query", errInvalidContentPayload)
 	}
+	return width, nil
+}
+
+func toContentResponse(c Content) contentResponse {
+	resp := contentResponse{
+		ID:            c.ID,
+		Type:          enumToString(c.Type),
+		Content:       c.Content,
+		Revision:      c.Revision,
+		SHA256:        c.Sha256.String,
+		VariantStatus: c.VariantStatus.String,
+		VariantWidths: c.VariantWidths,
+		Title:         c.Title.String,
+		Description:   c.Description.String,
+		AltText:       c.AltText.String,
+		Tags:          c.Tags,
+		CreatedAt:     c.CreatedAt.Time,
+		UpdatedAt:     c.UpdatedAt.Time,
+	}
+	if resp.Type == "TEXT" {
+		resp.Format = textFormatOrDefault(c.Format)
+	}
+	if resp.Tags == nil {
+		resp.Tags = []string{}
+	}
+	if c.CreatedBy.Valid {
+		createdBy := uuid.UUID(c.CreatedBy.Bytes)
+		resp.CreatedBy = &createdBy
+	}
+	return resp
 }
 
 func enumToString(v interface{}) string {
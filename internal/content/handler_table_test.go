@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -14,19 +15,31 @@ import (
 	"strings"
 	"testing"
 
+	"sciedu-backend/internal/auth"
+
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
 	"go.uber.org/zap"
 )
 
 type fakeHandlerService struct {
 	createMediaContentFn func(ctx context.Context, upload MediaUploadRequest) (Content, error)
-	getMediaContentFn    func(ctx context.Context, id uuid.UUID) (Content, error)
-	listTextContentsFn   func(ctx context.Context, page, pageSize int32) (TextPage, error)
-	createTextContentFn  func(ctx context.Context, content string) (Content, error)
+	openMediaContentFn   func(ctx context.Context, id uuid.UUID, width int) (Content, *os.File, error)
+	listTextContentsFn   func(ctx context.Context, filter ContentListFilter) (ContentPage, error)
+	createTextContentFn  func(ctx context.Context, req TextContentRequest) (Content, error)
 	batchGetTextFn       func(ctx context.Context, ids []uuid.UUID) ([]Content, error)
 	getTextContentFn     func(ctx context.Context, id uuid.UUID) (Content, error)
 	getContentFn         func(ctx context.Context, id uuid.UUID) (Content, error)
 	deleteContentFn      func(ctx context.Context, id uuid.UUID) error
+	updateTextContentFn  func(ctx context.Context, id uuid.UUID, patch TextContentPatch) (Content, error)
+	replaceMediaFn       func(ctx context.Context, id uuid.UUID, upload MediaUploadRequest) (Content, error)
+	renderTextHTMLFn     func(item Content) string
+	listTextByCursorFn   func(ctx context.Context, filter CursorListFilter) (CursorPage, error)
+	listMediaFn          func(ctx context.Context, filter ContentListFilter) (ContentPage, error)
+	listMediaByCursorFn  func(ctx context.Context, filter CursorListFilter) (CursorPage, error)
+	reconcileMediaFn     func(ctx context.Context, opts ReconcileOptions) (ReconcileReport, error)
+	getStorageUsageFn    func(ctx context.Context, userID uuid.UUID) (StorageUsage, error)
+	searchTextFn         func(ctx context.Context, filter SearchFilter) (SearchPage, error)
 }
 
 func (f *fakeHandlerService) CreateMediaContent(ctx context.Context, upload MediaUploadRequest) (Content, error) {
@@ -36,23 +49,23 @@ func (f *fakeHandlerService) CreateMediaContent(ctx context.Context, upload Medi
 	return Content{}, nil
 }
 
-func (f *fakeHandlerService) GetMediaContent(ctx context.Context, id uuid.UUID) (Content, error) {
-	if f.getMediaContentFn != nil {
-		return f.getMediaContentFn(ctx, id)
+func (f *fakeHandlerService) OpenMediaContent(ctx context.Context, id uuid.UUID, width int) (Content, *os.File, error) {
+	if f.openMediaContentFn != nil {
+		return f.openMediaContentFn(ctx, id, width)
 	}
-	return Content{}, nil
+	return Content{}, nil, errors.New("not configured")
 }
 
-func (f *fakeHandlerService) ListTextContents(ctx context.Context, page, pageSize int32) (TextPage, error) {
+func (f *fakeHandlerService) ListTextContents(ctx context.Context, filter ContentListFilter) (ContentPage, error) {
 	if f.listTextContentsFn != nil {
-		return f.listTextContentsFn(ctx, page, pageSize)
+		return f.listTextContentsFn(ctx, filter)
 	}
-	return TextPage{}, nil
+	return ContentPage{}, nil
 }
 
-func (f *fakeHandlerService) CreateTextContent(ctx context.Context, content string) (Content, error) {
+func (f *fakeHandlerService) CreateTextContent(ctx context.Context, req TextContentRequest) (Content, error) {
 	if f.createTextContentFn != nil {
-		return f.createTextContentFn(ctx, content)
+		return f.createTextContentFn(ctx, req)
 	}
 	return Content{}, nil
 }
@@ -85,6 +98,69 @@ func (f *fakeHandlerService) DeleteContent(ctx context.Context, id uuid.UUID) er
 	return nil
 }
 
+func (f *fakeHandlerService) UpdateTextContent(ctx context.Context, id uuid.UUID, patch TextContentPatch) (Content, error) {
+	if f.updateTextContentFn != nil {
+		return f.updateTextContentFn(ctx, id, patch)
+	}
+	return Content{}, nil
+}
+
+func (f *fakeHandlerService) ReplaceMediaContent(ctx context.Context, id uuid.UUID, upload MediaUploadRequest) (Content, error) {
+	if f.replaceMediaFn != nil {
+		return f.replaceMediaFn(ctx, id, upload)
+	}
+	return Content{}, nil
+}
+
+func (f *fakeHandlerService) RenderTextHTML(item Content) string {
+	if f.renderTextHTMLFn != nil {
+		return f.renderTextHTMLFn(item)
+	}
+	return ""
+}
+
+func (f *fakeHandlerService) ListTextContentsByCursor(ctx context.Context, filter CursorListFilter) (CursorPage, error) {
+	if f.listTextByCursorFn != nil {
+		return f.listTextByCursorFn(ctx, filter)
+	}
+	return CursorPage{}, nil
+}
+
+func (f *fakeHandlerService) ListMediaContents(ctx context.Context, filter ContentListFilter) (ContentPage, error) {
+	if f.listMediaFn != nil {
+		return f.listMediaFn(ctx, filter)
+	}
+	return ContentPage{}, nil
+}
+
+func (f *fakeHandlerService) ListMediaContentsByCursor(ctx context.Context, filter CursorListFilter) (CursorPage, error) {
+	if f.listMediaByCursorFn != nil {
+		return f.listMediaByCursorFn(ctx, filter)
+	}
+	return CursorPage{}, nil
+}
+
+func (f *fakeHandlerService) ReconcileMedia(ctx context.Context, opts ReconcileOptions) (ReconcileReport, error) {
+	if f.reconcileMediaFn != nil {
+		return f.reconcileMediaFn(ctx, opts)
+	}
+	return ReconcileReport{}, nil
+}
+
+func (f *fakeHandlerService) GetStorageUsage(ctx context.Context, userID uuid.UUID) (StorageUsage, error) {
+	if f.getStorageUsageFn != nil {
+		return f.getStorageUsageFn(ctx, userID)
+	}
+	return StorageUsage{QuotaBytes: UnlimitedStorage}, nil
+}
+
+func (f *fakeHandlerService) SearchTextContents(ctx context.Context, filter SearchFilter) (SearchPage, error) {
+	if f.searchTextFn != nil {
+		return f.searchTextFn(ctx, filter)
+	}
+	return SearchPage{}, nil
+}
+
 func newContentTestMux(svc *fakeHandlerService) *http.ServeMux {
 	h := NewHandler(svc, zap.NewNop())
 	mux := http.NewServeMux()
@@ -111,7 +187,7 @@ func TestCreateText(t *testing.T) {
 			name: "success",
 			body: `{"content":"hello"}`,
 			service: &fakeHandlerService{
-				createTextContentFn: func(context.Context, string) (Content, error) {
+				createTextContentFn: func(context.Context, TextContentRequest) (Content, error) {
 					return Content{ID: id, Type: "TEXT", Content: "hello"}, nil
 				},
 			},
@@ -127,6 +203,44 @@ func TestCreateText(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "passes metadata",
+			body: `{"content":"hello","title":"Intro","altText":"diagram","tags":["physics"]}`,
+			service: &fakeHandlerService{
+				createTextContentFn: func(_ context.Context, req TextContentRequest) (Content, error) {
+					if req.Title != "Intro" || req.AltText != "diagram" || len(req.Tags) != 1 || req.Tags[0] != "physics" {
+						t.Fatalf("unexpected metadata: %+v", req.ContentMetadata)
+					}
+					return Content{
+						ID:      id,
+						Type:    "TEXT",
+						Content: "hello",
+						Title:   pgtype.Text{String: "Intro", Valid: true},
+						Tags:    []string{"physics"},
+					}, nil
+				},
+			},
+			wantStatus: http.StatusCreated,
+			assertBody: func(t *testing.T, body string) {
+				t.Helper()
+				var got map[string]any
+				if err := json.Unmarshal([]byte(body), &got); err != nil {
+					t.Fatalf("decode body: %v", err)
+				}
+				if got["title"] != "Intro" {
+					t.Fatalf("unexpected title: %v", got["title"])
+				}
+				if tags, ok := got["tags"].([]any); !ok || len(tags) != 1 || tags[0] != "physics" {
+					t.Fatalf("unexpected tags: %v", got["tags"])
+				}
+			},
+		},
+		{
+			name:       "too many tags",
+			body:       `{"content":"hello","tags":["a","b","c","d","e","f","g","h","i","j","k","l","m","n","o","p","q","r","s","t","u"]}`,
+			service:    &fakeHandlerService{},
+			wantStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
@@ -168,12 +282,76 @@ func TestListText(t *testing.T) {
 			service:    &fakeHandlerService{},
 			wantStatus: http.StatusBadRequest,
 		},
+		{
+			name:       "invalid owner",
+			path:       "/api/content/text?owner=not-a-uuid",
+			service:    &fakeHandlerService{},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "passes filters",
+			path: "/api/content/text?tag=physics&owner=" + id.String(),
+			service: &fakeHandlerService{
+				listTextContentsFn: func(_ context.Context, filter ContentListFilter) (ContentPage, error) {
+					if filter.Tag != "physics" || filter.Owner != id {
+						t.Fatalf("unexpected filter: %+v", filter)
+					}
+					return ContentPage{Items: []Content{}, CurrentPage: 1, PageSize: 20}, nil
+				},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "cursor mode",
+			path: "/api/content/text?cursor=&pageSize=5",
+			service: &fakeHandlerService{
+				listTextContentsFn: func(context.Context, ContentListFilter) (ContentPage, error) {
+					t.Fatalf("expected cursor listing, not offset listing")
+					return ContentPage{}, nil
+				},
+				listTextByCursorFn: func(_ context.Context, filter CursorListFilter) (CursorPage, error) {
+					if filter.Cursor != "" || filter.PageSize != 5 {
+						t.Fatalf("unexpected filter: %+v", filter)
+					}
+					return CursorPage{
+						Items:       []Content{{ID: id, Type: "TEXT", Content: "data"}},
+						PageSize:    5,
+						NextCursor:  "next",
+						HasNextPage: true,
+					}, nil
+				},
+			},
+			wantStatus: http.StatusOK,
+			assertBody: func(t *testing.T, body string) {
+				t.Helper()
+				var got map[string]any
+				if err := json.Unmarshal([]byte(body), &got); err != nil {
+					t.Fatalf("decode body: %v", err)
+				}
+				if got["nextCursor"] != "next" || got["hasNextPage"] != true {
+					t.Fatalf("unexpected cursor page: %v", got)
+				}
+				if _, ok := got["totalItems"]; ok {
+					t.Fatalf("cursor pages should not report totals: %v", got)
+				}
+			},
+		},
+		{
+			name: "invalid cursor",
+			path: "/api/content/text?cursor=garbage",
+			service: &fakeHandlerService{
+				listTextByCursorFn: func(context.Context, CursorListFilter) (CursorPage, error) {
+					return CursorPage{}, errInvalidCursor
+				},
+			},
+			wantStatus: http.StatusBadRequest,
+		},
 		{
 			name: "success",
 			path: "/api/content/text?page=1&pageSize=20",
 			service: &fakeHandlerService{
-				listTextContentsFn: func(context.Context, int32, int32) (TextPage, error) {
-					return TextPage{
+				listTextContentsFn: func(context.Context, ContentListFilter) (ContentPage, error) {
+					return ContentPage{
 						Items:       []Content{{ID: id, Type: "TEXT", Content: "data"}},
 						TotalPages:  1,
 						TotalItems:  1,
@@ -215,86 +393,238 @@ func TestListText(t *testing.T) {
 	}
 }
 
-func TestDelete(t *testing.T) {
+func TestListMedia(t *testing.T) {
 	id := uuid.New()
-	mediaFile := filepath.Join(t.TempDir(), "to-delete.bin")
-	if err := os.WriteFile(mediaFile, []byte("x"), 0o644); err != nil {
-		t.Fatalf("write media file: %v", err)
-	}
-	mediaFileKeep := filepath.Join(t.TempDir(), "to-keep.bin")
-	if err := os.WriteFile(mediaFileKeep, []byte("x"), 0o644); err != nil {
-		t.Fatalf("write media file: %v", err)
-	}
 	tests := []struct {
 		name       string
 		path       string
 		service    *fakeHandlerService
 		wantStatus int
-		assert     func(t *testing.T)
 	}{
 		{
-			name:       "invalid uuid",
-			path:       "/api/content/not-a-uuid",
-			service:    &fakeHandlerService{},
-			wantStatus: http.StatusBadRequest,
+			name: "offset mode",
+			path: "/api/content/media?page=2",
+			service: &fakeHandlerService{
+				listMediaFn: func(_ context.Context, filter ContentListFilter) (ContentPage, error) {
+					if filter.Page != 2 {
+						t.Fatalf("expected page 2, got %d", filter.Page)
+					}
+					return ContentPage{Items: []Content{{ID: id, Type: "MEDIA"}}, CurrentPage: 2, PageSize: 20}, nil
+				},
+			},
+			wantStatus: http.StatusOK,
 		},
 		{
-			name: "success",
-			path: "/api/content/" + id.String(),
+			name: "cursor mode",
+			path: "/api/content/media?cursor=abc",
 			service: &fakeHandlerService{
-				getContentFn: func(context.Context, uuid.UUID) (Content, error) {
-					return Content{ID: id, Type: "TEXT", Content: "x"}, nil
+				listMediaByCursorFn: func(_ context.Context, filter CursorListFilter) (CursorPage, error) {
+					if filter.Cursor != "abc" {
+						t.Fatalf("expected cursor abc, got %q", filter.Cursor)
+					}
+					return CursorPage{Items: []Content{}, PageSize: 20}, nil
 				},
 			},
-			wantStatus: http.StatusNoContent,
+			wantStatus: http.StatusOK,
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+
+			newContentTestMux(tt.service).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetText(t *testing.T) {
+	id := uuid.New()
+	markdownItem := Content{ID: id, Type: "TEXT", Content: "**bold**", Format: formatMarkdown, Revision: 2}
+	tests := []struct {
+		name       string
+		query      string
+		service    *fakeHandlerService
+		wantStatus int
+		wantHTML   string
+	}{
 		{
-			name: "delete error",
-			path: "/api/content/" + id.String(),
+			name: "raw by default",
 			service: &fakeHandlerService{
-				getContentFn: func(context.Context, uuid.UUID) (Content, error) {
-					return Content{ID: id, Type: "TEXT", Content: "x"}, nil
+				getTextContentFn: func(context.Context, uuid.UUID) (Content, error) {
+					return markdownItem, nil
 				},
-				deleteContentFn: func(context.Context, uuid.UUID) error {
-					return errors.New("boom")
+				renderTextHTMLFn: func(Content) string {
+					t.Fatalf("expected no rendering without render query")
+					return ""
 				},
 			},
-			wantStatus: http.StatusInternalServerError,
+			wantStatus: http.StatusOK,
 		},
 		{
-			name: "delete error keeps media file",
-			path: "/api/content/" + id.String(),
+			name:  "render html",
+			query: "?render=html",
 			service: &fakeHandlerService{
-				getContentFn: func(context.Context, uuid.UUID) (Content, error) {
-					return Content{ID: id, Type: "MEDIA", Content: mediaFileKeep}, nil
+				getTextContentFn: func(context.Context, uuid.UUID) (Content, error) {
+					return markdownItem, nil
 				},
-				deleteContentFn: func(context.Context, uuid.UUID) error {
-					return errors.New("boom")
+				renderTextHTMLFn: func(item Content) string {
+					if item.Revision != 2 {
+						t.Fatalf("expected revision 2, got %d", item.Revision)
+					}
+					return "<p><strong>bold</strong></p>\n"
 				},
 			},
-			wantStatus: http.StatusInternalServerError,
-			assert: func(t *testing.T) {
-				t.Helper()
-				if _, err := os.Stat(mediaFileKeep); err != nil {
-					t.Fatalf("expected media file kept, stat err=%v", err)
-				}
+			wantStatus: http.StatusOK,
+			wantHTML:   "<p><strong>bold</strong></p>\n",
+		},
+		{
+			name:       "unsupported render mode",
+			query:      "?render=pdf",
+			service:    &fakeHandlerService{},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/content/text/"+id.String()+tt.query, nil)
+
+			newContentTestMux(tt.service).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got contentResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode body: %v", err)
+			}
+			if got.Format != formatMarkdown || got.HTML != tt.wantHTML {
+				t.Fatalf("unexpected response: format=%q html=%q", got.Format, got.HTML)
+			}
+		})
+	}
+}
+
+func TestUpdateText(t *testing.T) {
+	id := uuid.New()
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		service    *fakeHandlerService
+		wantStatus int
+	}{
+		{
+			name:       "put requires content",
+			method:     http.MethodPut,
+			body:       `{"title":"Intro"}`,
+			service:    &fakeHandlerService{},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "put replaces every field",
+			method: http.MethodPut,
+			body:   `{"content":"fixed typo"}`,
+			service: &fakeHandlerService{
+				updateTextContentFn: func(_ context.Context, gotID uuid.UUID, patch TextContentPatch) (Content, error) {
+					if gotID != id {
+						t.Fatalf("expected id %s, got %s", id, gotID)
+					}
+					if patch.Content == nil || *patch.Content != "fixed typo" {
+						t.Fatalf("unexpected content: %v", patch.Content)
+					}
+					if patch.Title == nil || *patch.Title != "" || patch.Tags == nil || len(*patch.Tags) != 0 {
+						t.Fatalf("expected omitted fields to be cleared, got %+v", patch)
+					}
+					return Content{ID: id, Type: "TEXT", Content: "fixed typo"}, nil
+				},
 			},
+			wantStatus: http.StatusOK,
 		},
 		{
-			name: "success media deletes file",
-			path: "/api/content/" + id.String(),
+			name:   "patch keeps omitted fields",
+			method: http.MethodPatch,
+			body:   `{"title":"Intro"}`,
+			service: &fakeHandlerService{
+				updateTextContentFn: func(_ context.Context, _ uuid.UUID, patch TextContentPatch) (Content, error) {
+					if patch.Content != nil || patch.Tags != nil || patch.AltText != nil {
+						t.Fatalf("expected only title to be set, got %+v", patch)
+					}
+					if patch.Title == nil || *patch.Title != "Intro" {
+						t.Fatalf("unexpected title: %v", patch.Title)
+					}
+					return Content{ID: id, Type: "TEXT", Content: "data"}, nil
+				},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "patch blank content",
+			method: http.MethodPatch,
+			body:   `{"content":"   "}`,
 			service: &fakeHandlerService{
-				getContentFn: func(context.Context, uuid.UUID) (Content, error) {
-					return Content{ID: id, Type: "MEDIA", Content: mediaFile}, nil
+				updateTextContentFn: func(context.Context, uuid.UUID, TextContentPatch) (Content, error) {
+					return Content{}, errEmptyTextContent
 				},
 			},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/api/content/text/"+id.String(), strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			newContentTestMux(tt.service).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	id := uuid.New()
+	tests := []struct {
+		name       string
+		path       string
+		service    *fakeHandlerService
+		wantStatus int
+	}{
+		{
+			name:       "invalid uuid",
+			path:       "/api/content/not-a-uuid",
+			service:    &fakeHandlerService{},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "success",
+			path:       "/api/content/" + id.String(),
+			service:    &fakeHandlerService{},
 			wantStatus: http.StatusNoContent,
-			assert: func(t *testing.T) {
-				t.Helper()
-				if _, err := os.Stat(mediaFile); !errors.Is(err, os.ErrNotExist) {
-					t.Fatalf("expected media file deleted, stat err=%v", err)
-				}
+		},
+		{
+			name: "delete error",
+			path: "/api/content/" + id.String(),
+			service: &fakeHandlerService{
+				deleteContentFn: func(context.Context, uuid.UUID) error {
+					return errors.New("boom")
+				},
 			},
+			wantStatus: http.StatusInternalServerError,
 		},
 	}
 
@@ -306,9 +636,6 @@ func TestDelete(t *testing.T) {
 			if rec.Code != tt.wantStatus {
 				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
 			}
-			if tt.assert != nil {
-				tt.assert(t)
-			}
 		})
 	}
 }
@@ -414,6 +741,33 @@ func TestCreateMedia(t *testing.T) {
 			},
 			wantStatus: http.StatusRequestEntityTooLarge,
 		},
+		{
+			name: "over storage quota",
+			buildReq: func(t *testing.T) *http.Request {
+				t.Helper()
+				var body bytes.Buffer
+				writer := multipart.NewWriter(&body)
+				part, err := writer.CreateFormFile("content", "a.txt")
+				if err != nil {
+					t.Fatalf("create form file: %v", err)
+				}
+				if _, err := part.Write([]byte("hello")); err != nil {
+					t.Fatalf("write part: %v", err)
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatalf("close writer: %v", err)
+				}
+				req := httptest.NewRequest(http.MethodPost, "/api/content/media", &body)
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+				return req
+			},
+			service: &fakeHandlerService{
+				createMediaContentFn: func(context.Context, MediaUploadRequest) (Content, error) {
+					return Content{}, errStorageQuotaExceeded
+				},
+			},
+			wantStatus: http.StatusInsufficientStorage,
+		},
 	}
 
 	for _, tt := range tests {
@@ -427,13 +781,284 @@ func TestCreateMedia(t *testing.T) {
 	}
 }
 
+func TestReplaceMedia(t *testing.T) {
+	id := uuid.New()
+	tests := []struct {
+		name       string
+		withFile   bool
+		service    *fakeHandlerService
+		wantStatus int
+	}{
+		{
+			name:       "missing multipart field",
+			service:    &fakeHandlerService{},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:     "success",
+			withFile: true,
+			service: &fakeHandlerService{
+				replaceMediaFn: func(_ context.Context, gotID uuid.UUID, upload MediaUploadRequest) (Content, error) {
+					if gotID != id {
+						t.Fatalf("expected id %s, got %s", id, gotID)
+					}
+					raw, err := io.ReadAll(upload.Content)
+					if err != nil {
+						t.Fatalf("read upload content: %v", err)
+					}
+					if string(raw) != "new image" || filepath.Ext(upload.Filename) != ".png" {
+						t.Fatalf("unexpected media input raw=%q filename=%s", string(raw), upload.Filename)
+					}
+					return Content{ID: id, Type: "MEDIA", Content: "./contents/new.png"}, nil
+				},
+			},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			if tt.withFile {
+				part, err := writer.CreateFormFile("content", "new.png")
+				if err != nil {
+					t.Fatalf("create form file: %v", err)
+				}
+				if _, err := part.Write([]byte("new image")); err != nil {
+					t.Fatalf("write part: %v", err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("close writer: %v", err)
+			}
+			req := httptest.NewRequest(http.MethodPut, "/api/content/media/"+id.String(), &body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+
+			rec := httptest.NewRecorder()
+			newContentTestMux(tt.service).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReconcileMediaEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       *auth.User
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "anonymous",
+			body:       `{}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "not an admin",
+			user:       &auth.User{ID: uuid.New(), Roles: []string{auth.RoleStudent}},
+			body:       `{}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "unknown action",
+			user:       &auth.User{ID: uuid.New(), Roles: []string{auth.RoleAdmin}},
+			body:       `{"action":"shred"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "admin",
+			user:       &auth.User{ID: uuid.New(), Roles: []string{auth.RoleAdmin}},
+			body:       `{"action":"quarantine"}`,
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeHandlerService{
+				reconcileMediaFn: func(_ context.Context, opts ReconcileOptions) (ReconcileReport, error) {
+					if opts.Action != ReconcileActionQuarantine || opts.Dir != defaultUploadDir {
+						t.Fatalf("unexpected options: %+v", opts)
+					}
+					return ReconcileReport{Action: opts.Action}, nil
+				},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/content/media/reconcile", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.user != nil {
+				req = req.WithContext(auth.WithUser(req.Context(), *tt.user))
+			}
+
+			rec := httptest.NewRecorder()
+			newContentTestMux(svc).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSearchText(t *testing.T) {
+	id := uuid.New()
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantFilter SearchFilter
+	}{
+		{
+			name:       "missing query",
+			url:        "/api/content/search",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "query too long",
+			url:        "/api/content/search?q=" + strings.Repeat("a", maxSearchQueryRunes+1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "success",
+			url:        "/api/content/search?q=%E5%85%89%E5%90%88&tag=biology&page=2&pageSize=5",
+			wantStatus: http.StatusOK,
+			wantFilter: SearchFilter{Query: "光合", Page: 2, PageSize: 5, Tag: "biology"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeHandlerService{
+				searchTextFn: func(_ context.Context, filter SearchFilter) (SearchPage, error) {
+					if filter != tt.wantFilter {
+						t.Fatalf("filter mismatch: want %+v got %+v", tt.wantFilter, filter)
+					}
+					return SearchPage{
+						Items: []SearchResult{{
+							Content: Content{ID: id, Type: "TEXT", Content: "光合作用"},
+							Rank:    0.5,
+							Snippet: "<mark>光合</mark>作用",
+						}},
+						CurrentPage: filter.Page,
+						PageSize:    filter.PageSize,
+					}, nil
+				},
+			}
+
+			rec := httptest.NewRecorder()
+			newContentTestMux(svc).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got struct {
+				Items []struct {
+					ID      uuid.UUID `json:"id"`
+					Rank    float32   `json:"rank"`
+					Snippet string    `json:"snippet"`
+				} `json:"items"`
+				CurrentPage int32 `json:"currentPage"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if len(got.Items) != 1 || got.Items[0].ID != id || got.Items[0].Snippet != "<mark>光合</mark>作用" || got.CurrentPage != 2 {
+				t.Fatalf("unexpected response: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	userID := uuid.New()
+	tests := []struct {
+		name       string
+		user       *auth.User
+		usage      StorageUsage
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "anonymous",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "limited",
+			user:       &auth.User{ID: userID, Roles: []string{auth.RoleStudent}},
+			usage:      StorageUsage{UsedBytes: 30, QuotaBytes: 100},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"usedBytes":30,"quotaBytes":100,"remainingBytes":70}`,
+		},
+		{
+			name:       "lowered below usage",
+			user:       &auth.User{ID: userID, Roles: []string{auth.RoleStudent}},
+			usage:      StorageUsage{UsedBytes: 130, QuotaBytes: 100},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"usedBytes":130,"quotaBytes":100,"remainingBytes":0}`,
+		},
+		{
+			name:       "unlimited",
+			user:       &auth.User{ID: userID, Roles: []string{auth.RoleAdmin}},
+			usage:      StorageUsage{UsedBytes: 30, QuotaBytes: UnlimitedStorage},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"usedBytes":30,"quotaBytes":null,"remainingBytes":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeHandlerService{
+				getStorageUsageFn: func(_ context.Context, id uuid.UUID) (StorageUsage, error) {
+					if id != userID {
+						t.Fatalf("expected usage of %s, got %s", userID, id)
+					}
+					return tt.usage, nil
+				},
+			}
+			req := httptest.NewRequest(http.MethodGet, "/api/content/usage", nil)
+			if tt.user != nil {
+				req = req.WithContext(auth.WithUser(req.Context(), *tt.user))
+			}
+
+			rec := httptest.NewRecorder()
+			newContentTestMux(svc).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d body=%s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Fatalf("body mismatch: want %s got %s", tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
 func TestStreamMedia(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "x.bin")
 	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
 		t.Fatalf("write temp file: %v", err)
 	}
+	if err := os.WriteFile(variantPath(path, 320), []byte("small"), 0o644); err != nil {
+		t.Fatalf("write variant file: %v", err)
+	}
 	id := uuid.New()
+	// open serves the file at path when the service is asked for the given width.
+	open := func(path string, wantWidth int) func(context.Context, uuid.UUID, int) (Content, *os.File, error) {
+		return func(_ context.Context, gotID uuid.UUID, width int) (Content, *os.File, error) {
+			if gotID != id || width != wantWidth {
+				return Content{}, nil, fmt.Errorf("opened %s at width %d, want %s at width %d", gotID, width, id, wantWidth)
+			}
+			f, err := os.Open(path)
+			return Content{ID: id, Type: "MEDIA", Content: path}, f, err
+		}
+	}
 
 	tests := []struct {
 		name       string
@@ -442,6 +1067,37 @@ func TestStreamMedia(t *testing.T) {
 		wantStatus int
 		assertBody func(t *testing.T, rec *httptest.ResponseRecorder)
 	}{
+		{
+			name:       "variant",
+			path:       "/api/content/media/" + id.String() + "?w=320",
+			service:    &fakeHandlerService{openMediaContentFn: open(variantPath(path, 320), 320)},
+			wantStatus: http.StatusOK,
+			assertBody: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				t.Helper()
+				if rec.Body.String() != "small" {
+					t.Fatalf("expected variant body, got %q", rec.Body.String())
+				}
+				if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, `filename="x_w320.bin"`) {
+					t.Fatalf("unexpected content-disposition: %s", got)
+				}
+			},
+		},
+		{
+			name: "non standard width",
+			path: "/api/content/media/" + id.String() + "?w=300",
+			service: &fakeHandlerService{
+				openMediaContentFn: func(context.Context, uuid.UUID, int) (Content, *os.File, error) {
+					return Content{}, nil, fmt.Errorf("%w: width must be one of %v", errUnsupportedVariantWidth, standardVariantWidths)
+				},
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid width",
+			path:       "/api/content/media/" + id.String() + "?w=abc",
+			service:    &fakeHandlerService{},
+			wantStatus: http.StatusBadRequest,
+		},
 		{
 			name:       "invalid uuid",
 			path:       "/api/content/media/not-a-uuid",
@@ -449,13 +1105,9 @@ func TestStreamMedia(t *testing.T) {
 			wantStatus: http.StatusBadRequest,
 		},
 		{
-			name: "success",
-			path: "/api/content/media/" + id.String(),
-			service: &fakeHandlerService{
-				getMediaContentFn: func(context.Context, uuid.UUID) (Content, error) {
-					return Content{ID: id, Type: "MEDIA", Content: path}, nil
-				},
-			},
+			name:       "success",
+			path:       "/api/content/media/" + id.String(),
+			service:    &fakeHandlerService{openMediaContentFn: open(path, 0)},
 			wantStatus: http.StatusOK,
 			assertBody: func(t *testing.T, rec *httptest.ResponseRecorder) {
 				t.Helper()
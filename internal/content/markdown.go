@@ -0,0 +1,775 @@
+package content
+
+import (
+	"html"
+	"strconv"
+	"strings"
+)
+
+// maxMarkdownNesting bounds how deep blockquotes, lists and inline links may nest, so
+// crafted input cannot drive the renderer into deep recursion.
+const maxMarkdownNesting = 16
+
+// renderMarkdown converts a Markdown subset to HTML. Every piece of source text is
+// escaped and only a fixed set of tags and attributes is emitted, so raw HTML in the
+// source never reaches the output. LaTeX math ($...$ and $$...$$) is escaped but
+// otherwise passed through in math-marked elements for the client to typeset.
+//
+// Supported: ATX headings, paragraphs, emphasis, inline code, fenced code blocks,
+// blockquotes, bullet and ordered lists, thematic breaks, links, images and autolinks.
+func renderMarkdown(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\r", "\n")
+
+	var b strings.Builder
+	renderMarkdownBlocks(&b, strings.Split(src, "\n"), 0, false)
+	return b.String()
+}
+
+// renderPlainText escapes plain text, keeping paragraphs and line breaks.
+func renderPlainText(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\r", "\n")
+
+	var b strings.Builder
+	for _, paragraph := range strings.Split(src, "\n\n") {
+		paragraph = strings.Trim(paragraph, "\n")
+		if strings.TrimSpace(paragraph) == "" {
+			continue
+		}
+		b.WriteString("<p>")
+		for i, line := range strings.Split(paragraph, "\n") {
+			if i > 0 {
+				b.WriteString("<br>\n")
+			}
+			b.WriteString(html.EscapeString(line))
+		}
+		b.WriteString("</p>\n")
+	}
+	return b.String()
+}
+
+// renderMarkdownBlocks renders block-level constructs. In tight mode (list items
+// without blank lines) paragraphs are emitted without <p> wrappers.
+func renderMarkdownBlocks(b *strings.Builder, lines []string, depth int, tight bool) {
+	for i := 0; i < len(lines); {
+		trimmed := strings.TrimSpace(lines[i])
+		switch {
+		case trimmed == "":
+			i++
+		case fenceMarker(trimmed) != "":
+			i = renderFencedCode(b, lines, i)
+		case strings.HasPrefix(trimmed, "$$"):
+			i = renderMathBlock(b, lines, i)
+		case headingLevel(trimmed) > 0:
+			level := headingLevel(trimmed)
+			text := strings.TrimSpace(trimmed[level:])
+			text = strings.TrimSpace(strings.TrimRight(text, "#"))
+			tag := "h" + strconv.Itoa(level)
+			b.WriteString("<" + tag + ">")
+			renderMarkdownInline(b, text, 0)
+			b.WriteString("</" + tag + ">\n")
+			i++
+		case isThematicBreak(trimmed):
+			b.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">") && depth < maxMarkdownNesting:
+			i = renderBlockquote(b, lines, i, depth)
+		case depth < maxMarkdownNesting && parseListMarker(lines[i]).width > 0:
+			i = renderList(b, lines, i, depth)
+		default:
+			i = renderParagraph(b, lines, i, tight)
+		}
+	}
+}
+
+func renderParagraph(b *strings.Builder, lines []string, start int, tight bool) int {
+	end := start + 1
+	for end < len(lines) && !startsBlock(lines[end]) {
+		end++
+	}
+
+	text := make([]string, 0, end-start)
+	for _, line := range lines[start:end] {
+		text = append(text, strings.TrimLeft(line, " \t"))
+	}
+
+	if !tight {
+		b.WriteString("<p>")
+	}
+	renderMarkdownInline(b, strings.TrimRight(strings.Join(text, "\n"), " \t"), 0)
+	if !tight {
+		b.WriteString("</p>")
+	}
+	b.WriteString("\n")
+	return end
+}
+
+// startsBlock reports whether the line ends a paragraph and starts another block.
+func startsBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || fenceMarker(trimmed) != "" || strings.HasPrefix(trimmed, "$$") ||
+		headingLevel(trimmed) > 0 || isThematicBreak(trimmed) || strings.HasPrefix(trimmed, ">") {
+		return true
+	}
+	marker := parseListMarker(line)
+	// Only bullets and lists starting at 1 may interrupt a paragraph, so "2024. was a
+	// year" inside a sentence is not mistaken for a list.
+	return marker.width > 0 && (!marker.ordered || marker.start == 1)
+}
+
+func headingLevel(trimmed string) int {
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return 0
+	}
+	if level < len(trimmed) && trimmed[level] != ' ' && trimmed[level] != '\t' {
+		return 0
+	}
+	return level
+}
+
+func isThematicBreak(trimmed string) bool {
+	if len(trimmed) < 3 || !strings.ContainsRune("-*_", rune(trimmed[0])) {
+		return false
+	}
+	count := 0
+	for i := 0; i < len(trimmed); i++ {
+		switch trimmed[i] {
+		case trimmed[0]:
+			count++
+		case ' ', '\t':
+		default:
+			return false
+		}
+	}
+	return count >= 3
+}
+
+// fenceMarker returns the opening fence (``` or ~~~, possibly longer) of a code block.
+func fenceMarker(trimmed string) string {
+	if len(trimmed) < 3 || (trimmed[0] != '`' && trimmed[0] != '~') {
+		return ""
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == trimmed[0] {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+	// A backtick fence's info string may not contain backticks (it would be inline code).
+	if trimmed[0] == '`' && strings.Contains(trimmed[n:], "`") {
+		return ""
+	}
+	return trimmed[:n]
+}
+
+func renderFencedCode(b *strings.Builder, lines []string, start int) int {
+	opening := strings.TrimSpace(lines[start])
+	fence := fenceMarker(opening)
+	lang := codeLanguage(strings.TrimSpace(opening[len(fence):]))
+
+	end := start + 1
+	var code strings.Builder
+	for ; end < len(lines); end++ {
+		trimmed := strings.TrimSpace(lines[end])
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			end++
+			break
+		}
+		code.WriteString(lines[end])
+		code.WriteString("\n")
+	}
+
+	b.WriteString("<pre><code")
+	if lang != "" {
+		b.WriteString(` class="language-` + lang + `"`)
+	}
+	b.WriteString(">")
+	b.WriteString(html.EscapeString(code.String()))
+	b.WriteString("</code></pre>\n")
+	return end
+}
+
+// codeLanguage keeps only the characters a language name needs, since it ends up in
+// a class attribute.
+func codeLanguage(info string) string {
+	if fields := strings.Fields(info); len(fields) > 0 {
+		info = fields[0]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '+', r == '#', r == '.':
+			return r
+		default:
+			return -1
+		}
+	}, info)
+}
+
+// renderMathBlock passes a $$ ... $$ display math block through for the client.
+func renderMathBlock(b *strings.Builder, lines []string, start int) int {
+	first := strings.TrimSpace(lines[start])[2:]
+	end := start + 1
+
+	var tex string
+	if idx := strings.Index(first, "$$"); idx >= 0 {
+		tex = first[:idx]
+	} else {
+		parts := []string{first}
+		for ; end < len(lines); end++ {
+			line := lines[end]
+			if idx := strings.Index(line, "$$"); idx >= 0 {
+				parts = append(parts, line[:idx])
+				end++
+				break
+			}
+			parts = append(parts, line)
+		}
+		tex = strings.Join(parts, "\n")
+	}
+
+	b.WriteString(`<div class="math math-display">`)
+	b.WriteString(html.EscapeString(strings.TrimSpace(tex)))
+	b.WriteString("</div>\n")
+	return end
+}
+
+func renderBlockquote(b *strings.Builder, lines []string, start, depth int) int {
+	end := start
+	inner := make([]string, 0)
+	for ; end < len(lines); end++ {
+		trimmed := strings.TrimLeft(lines[end], " \t")
+		if !strings.HasPrefix(trimmed, ">") {
+			break
+		}
+		trimmed = strings.TrimPrefix(trimmed, ">")
+		inner = append(inner, strings.TrimPrefix(trimmed, " "))
+	}
+
+	b.WriteString("<blockquote>\n")
+	renderMarkdownBlocks(b, inner, depth+1, false)
+	b.WriteString("</blockquote>\n")
+	return end
+}
+
+type listMarker struct {
+	ordered bool
+	start   int
+	delim   byte
+	// indent is the column where the marker starts; width is the column where the
+	// item content starts. A zero width means the line is not a list item.
+	indent int
+	width  int
+}
+
+func parseListMarker(line string) listMarker {
+	indent := 0
+	for indent < len(line) && line[indent] == ' ' {
+		indent++
+	}
+	if indent > 3 || indent >= len(line) {
+		return listMarker{}
+	}
+	rest := line[indent:]
+
+	if rest[0] == '-' || rest[0] == '*' || rest[0] == '+' {
+		if len(rest) == 1 || rest[1] == ' ' || rest[1] == '\t' {
+			return listMarker{delim: rest[0], indent: indent, width: indent + 2}
+		}
+		return listMarker{}
+	}
+
+	digits := 0
+	for digits < len(rest) && digits < 9 && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 || digits >= len(rest) || (rest[digits] != '.' && rest[digits] != ')') {
+		return listMarker{}
+	}
+	if digits+1 < len(rest) && rest[digits+1] != ' ' && rest[digits+1] != '\t' {
+		return listMarker{}
+	}
+	start, _ := strconv.Atoi(rest[:digits])
+	return listMarker{ordered: true, start: start, delim: rest[digits], indent: indent, width: indent + digits + 2}
+}
+
+func renderList(b *strings.Builder, lines []string, start, depth int) int {
+	first := parseListMarker(lines[start])
+
+	var items [][]string
+	tight := true
+	end := start
+	for end < len(lines) {
+		marker := parseListMarker(lines[end])
+		if marker.width == 0 || marker.ordered != first.ordered || marker.delim != first.delim {
+			break
+		}
+
+		item := []string{contentAfter(lines[end], marker.width)}
+		end++
+		for end < len(lines) {
+			line := lines[end]
+			if strings.TrimSpace(line) == "" {
+				// A blank line continues the item only if indented content follows.
+				next := end + 1
+				for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+					next++
+				}
+				if next < len(lines) && leadingSpaces(lines[next]) >= marker.width {
+					item = append(item, "")
+					tight = false
+					end++
+					continue
+				}
+				break
+			}
+			if leadingSpaces(line) >= marker.width {
+				item = append(item, contentAfter(line, marker.width))
+				end++
+				continue
+			}
+			if startsBlock(line) || parseListMarker(line).width > 0 {
+				break
+			}
+			// Lazy continuation of the item's paragraph.
+			item = append(item, strings.TrimLeft(line, " \t"))
+			end++
+		}
+		items = append(items, item)
+
+		// Blank lines between items make the list loose but do not end it.
+		next := end
+		for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+			next++
+		}
+		if next > end && next < len(lines) {
+			if m := parseListMarker(lines[next]); m.width > 0 && m.ordered == first.ordered && m.delim == first.delim {
+				tight = false
+				end = next
+			}
+		}
+	}
+
+	tag := "ul"
+	if first.ordered {
+		tag = "ol"
+	}
+	b.WriteString("<" + tag)
+	if first.ordered && first.start != 1 {
+		b.WriteString(` start="` + strconv.Itoa(first.start) + `"`)
+	}
+	b.WriteString(">\n")
+	for _, item := range items {
+		b.WriteString("<li>")
+		renderMarkdownBlocks(b, item, depth+1, tight)
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return end
+}
+
+func leadingSpaces(line string) int {
+	n := 0
+	for n < len(line) && line[n] == ' ' {
+		n++
+	}
+	return n
+}
+
+// contentAfter drops the first width columns of a list line (marker or indentation).
+func contentAfter(line string, width int) string {
+	if len(line) <= width {
+		return ""
+	}
+	return line[width:]
+}
+
+// renderMarkdownInline renders inline constructs of a block's text.
+func renderMarkdownInline(b *strings.Builder, text string, depth int) {
+	x := &inlineIndex{text: text, noCloserFrom: map[string]int{}}
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch c {
+		case '\\':
+			if i+1 < len(text) && text[i+1] == '\n' {
+				b.WriteString("<br>\n")
+				i += 2
+				continue
+			}
+			if i+1 < len(text) && isASCIIPunct(text[i+1]) {
+				b.WriteString(html.EscapeString(text[i+1 : i+2]))
+				i += 2
+				continue
+			}
+		case ' ':
+			if j := strings.IndexFunc(text[i:], func(r rune) bool { return r != ' ' }); j >= 2 && text[i+j] == '\n' {
+				b.WriteString("<br>\n")
+				i += j + 1
+				continue
+			}
+		case '`':
+			if n := renderCodeSpan(b, x, i); n > 0 {
+				i += n
+				continue
+			}
+		case '$':
+			if n := renderInlineMath(b, x, i); n > 0 {
+				i += n
+				continue
+			}
+		case '*', '_':
+			if n := renderEmphasis(b, x, i, depth); n > 0 {
+				i += n
+				continue
+			}
+		case '!':
+			if i+1 < len(text) && text[i+1] == '[' {
+				if n := renderLink(b, x, i+1, true, depth); n > 0 {
+					i += n + 1
+					continue
+				}
+			}
+		case '[':
+			if n := renderLink(b, x, i, false, depth); n > 0 {
+				i += n
+				continue
+			}
+		case '<':
+			if n := renderAutolink(b, text[i:]); n > 0 {
+				i += n
+				continue
+			}
+		}
+
+		// Copy a run of ordinary characters in one go.
+		j := i + 1
+		for j < len(text) && !strings.ContainsRune("\\ `$*_![<", rune(text[j])) {
+			j++
+		}
+		b.WriteString(html.EscapeString(text[i:j]))
+		i = j
+	}
+}
+
+// inlineIndex remembers what scans of one text have found, so that text full of
+// unclosed delimiters renders in linear time instead of being scanned to its end
+// again at every opener.
+type inlineIndex struct {
+	text string
+	// noCloserFrom maps a closing delimiter to the position from which the text is
+	// known not to contain a closer for it.
+	noCloserFrom map[string]int
+	// brackets and parens map each opening bracket or parenthesis to its match; they
+	// are filled on first use.
+	brackets map[int]int
+	parens   map[int]int
+}
+
+// mayClose reports whether a closer for delim may still follow from.
+func (x *inlineIndex) mayClose(delim string, from int) bool {
+	end, ok := x.noCloserFrom[delim]
+	return !ok || from < end
+}
+
+// unclosed records that no closer for delim follows from.
+func (x *inlineIndex) unclosed(delim string, from int) {
+	if end, ok := x.noCloserFrom[delim]; !ok || from < end {
+		x.noCloserFrom[delim] = from
+	}
+}
+
+// match returns the position of the bracket closing the one at pos, or -1.
+func (x *inlineIndex) match(pos int) int {
+	matches := &x.parens
+	if x.text[pos] == '[' {
+		matches = &x.brackets
+	}
+	if *matches == nil {
+		*matches = matchPairs(x.text, x.text[pos], closingPair(x.text[pos]))
+	}
+	if end, ok := (*matches)[pos]; ok {
+		return end
+	}
+	return -1
+}
+
+func closingPair(c byte) byte {
+	if c == '[' {
+		return ']'
+	}
+	return ')'
+}
+
+// matchPairs pairs every unescaped open byte with its closing byte in one pass.
+func matchPairs(text string, open, close byte) map[int]int {
+	matches := map[int]int{}
+	var stack []int
+	for j := 0; j < len(text); j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case open:
+			stack = append(stack, j)
+		case close:
+			if len(stack) > 0 {
+				matches[stack[len(stack)-1]] = j
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return matches
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// renderCodeSpan renders `code` starting at x.text[i] and returns the number of bytes
+// consumed, or 0.
+func renderCodeSpan(b *strings.Builder, x *inlineIndex, i int) int {
+	text := x.text[i:]
+	n := 0
+	for n < len(text) && text[n] == '`' {
+		n++
+	}
+	fence := text[:n]
+	if !x.mayClose(fence, i+n) {
+		return 0
+	}
+	for j := n; j < len(text); {
+		idx := strings.Index(text[j:], fence)
+		if idx < 0 {
+			x.unclosed(fence, i+n)
+			return 0
+		}
+		closeAt := j + idx
+		closeEnd := closeAt + n
+		if closeEnd < len(text) && text[closeEnd] == '`' {
+			// Longer run of backticks; keep looking for an exact match.
+			for closeEnd < len(text) && text[closeEnd] == '`' {
+				closeEnd++
+			}
+			j = closeEnd
+			continue
+		}
+
+		code := strings.ReplaceAll(text[n:closeAt], "\n", " ")
+		if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+			code = code[1 : len(code)-1]
+		}
+		b.WriteString("<code>")
+		b.WriteString(html.EscapeString(code))
+		b.WriteString("</code>")
+		return closeEnd
+	}
+	x.unclosed(fence, i+n)
+	return 0
+}
+
+// renderInlineMath passes $...$ (or $$...$$) through for the client. To avoid eating
+// prices such as "$5 and $10", the opening $ may not be followed by a space and the
+// closing $ may not be preceded by a space or followed by a digit.
+func renderInlineMath(b *strings.Builder, x *inlineIndex, i int) int {
+	text := x.text[i:]
+	delim := "$"
+	class := "math math-inline"
+	if strings.HasPrefix(text, "$$") {
+		delim = "$$"
+		class = "math math-display"
+	}
+	body := text[len(delim):]
+	if body == "" || body[0] == ' ' || body[0] == '\n' || !x.mayClose(delim, i+len(delim)) {
+		return 0
+	}
+
+	for j := 0; j < len(body); j++ {
+		if body[j] == '\\' {
+			j++
+			continue
+		}
+		if !strings.HasPrefix(body[j:], delim) {
+			continue
+		}
+		if j == 0 || body[j-1] == ' ' || body[j-1] == '\n' {
+			return 0
+		}
+		after := j + len(delim)
+		if delim == "$" && after < len(body) && body[after] >= '0' && body[after] <= '9' {
+			return 0
+		}
+		b.WriteString(`<span class="` + class + `">`)
+		b.WriteString(html.EscapeString(body[:j]))
+		b.WriteString("</span>")
+		return len(delim) + after
+	}
+	x.unclosed(delim, i+len(delim))
+	return 0
+}
+
+// renderEmphasis renders *em*, _em_, **strong** and __strong__ starting at x.text[i].
+func renderEmphasis(b *strings.Builder, x *inlineIndex, i, depth int) int {
+	if depth >= maxMarkdownNesting {
+		return 0
+	}
+	text := x.text
+	c := text[i]
+	// Underscores inside words (snake_case) are literal.
+	if c == '_' && i > 0 && isWordByte(text[i-1]) {
+		return 0
+	}
+
+	delim := string(c)
+	tag := "em"
+	if strings.HasPrefix(text[i:], delim+delim) {
+		delim += delim
+		tag = "strong"
+	}
+	open := i + len(delim)
+	if open >= len(text) || text[open] == ' ' || text[open] == '\n' || !x.mayClose(delim, open+1) {
+		return 0
+	}
+
+	for j := open + 1; j < len(text); j++ {
+		switch {
+		case text[j] == '\\':
+			j++
+			continue
+		case text[j] == '`':
+			// Skip code spans so delimiters inside them don't close the emphasis.
+			if n := renderCodeSpan(&strings.Builder{}, x, j); n > 0 {
+				j += n - 1
+			}
+			continue
+		case !strings.HasPrefix(text[j:], delim):
+			continue
+		}
+		closeEnd := j + len(delim)
+		if len(delim) == 1 && closeEnd < len(text) && text[closeEnd] == c {
+			// Part of a double delimiter; skip it as a whole.
+			j++
+			continue
+		}
+		if text[j-1] == ' ' || text[j-1] == '\n' {
+			continue
+		}
+		if c == '_' && closeEnd < len(text) && isWordByte(text[closeEnd]) {
+			continue
+		}
+
+		b.WriteString("<" + tag + ">")
+		renderMarkdownInline(b, text[open:j], depth+1)
+		b.WriteString("</" + tag + ">")
+		return closeEnd - i
+	}
+	x.unclosed(delim, open+1)
+	return 0
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// renderLink renders [text](url) starting at x.text[i] or, for images, the part after
+// "!". Links whose URL is not safe are rendered as their text only.
+func renderLink(b *strings.Builder, x *inlineIndex, i int, image bool, depth int) int {
+	if depth >= maxMarkdownNesting {
+		return 0
+	}
+
+	text := x.text[i:]
+	closeBracket := x.match(i) - i
+	if closeBracket < 0 || closeBracket+1 >= len(text) || text[closeBracket+1] != '(' {
+		return 0
+	}
+	// The destination may contain balanced parentheses, e.g. wiki URLs.
+	closeParen := x.match(i+closeBracket+1) - i
+	if closeParen < 0 {
+		return 0
+	}
+
+	label := text[1:closeBracket]
+	target := strings.TrimSpace(text[closeBracket+2 : closeParen])
+	// An optional quoted title after the URL is accepted but not rendered. Anything
+	// else after whitespace means this is not a link.
+	if idx := strings.IndexAny(target, " \t\n"); idx >= 0 {
+		title := strings.TrimSpace(target[idx:])
+		if title[0] != '"' && title[0] != '\'' {
+			return 0
+		}
+		target = target[:idx]
+	}
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+
+	href, ok := safeURL(target)
+	switch {
+	case image && ok:
+		b.WriteString(`<img src="` + html.EscapeString(href) + `" alt="` + html.EscapeString(plainLabel(label)) + `">`)
+	case image:
+		b.WriteString(html.EscapeString(plainLabel(label)))
+	case ok:
+		b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer">`)
+		renderMarkdownInline(b, label, depth+1)
+		b.WriteString("</a>")
+	default:
+		renderMarkdownInline(b, label, depth+1)
+	}
+	return closeParen + 1
+}
+
+// plainLabel strips the most common inline markup from an image description.
+func plainLabel(label string) string {
+	return strings.NewReplacer("*", "", "_", "", "`", "").Replace(label)
+}
+
+// renderAutolink renders <https://example.com> and <mailto:...> style links.
+func renderAutolink(b *strings.Builder, text string) int {
+	// The scan stops where the target would have to end, so it never passes the next
+	// "<" and repeated openers are not rescanned.
+	end := strings.IndexAny(text[1:], " \t\n<>") + 1
+	if end <= 0 || text[end] != '>' {
+		return 0
+	}
+	target := text[1:end]
+	if !strings.Contains(target, ":") {
+		return 0
+	}
+	href, ok := safeURL(target)
+	if !ok {
+		return 0
+	}
+	b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer">`)
+	b.WriteString(html.EscapeString(target))
+	b.WriteString("</a>")
+	return end + 1
+}
+
+// safeURL accepts relative URLs and absolute http, https and mailto URLs. Browsers
+// ignore control characters and whitespace inside a scheme, so those are stripped
+// before the scheme is checked.
+func safeURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", false
+	}
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, raw)
+	if idx := strings.IndexAny(cleaned, ":/?#"); idx >= 0 && cleaned[idx] == ':' {
+		switch strings.ToLower(cleaned[:idx]) {
+		case "http", "https", "mailto":
+		default:
+			return "", false
+		}
+	}
+	return raw, true
+}
@@ -0,0 +1,174 @@
+package content
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "paragraph and emphasis",
+			src:  "Some *em*, **strong** and `a < b`.",
+			want: "<p>Some <em>em</em>, <strong>strong</strong> and <code>a &lt; b</code>.</p>\n",
+		},
+		{
+			name: "nested emphasis",
+			src:  "*a **b** c*",
+			want: "<p><em>a <strong>b</strong> c</em></p>\n",
+		},
+		{
+			name: "snake case is literal",
+			src:  "use snake_case_names",
+			want: "<p>use snake_case_names</p>\n",
+		},
+		{
+			name: "headings",
+			src:  "# Title #\n### Sub",
+			want: "<h1>Title</h1>\n<h3>Sub</h3>\n",
+		},
+		{
+			name: "fenced code keeps markup escaped",
+			src:  "```go\nfmt.Println(\"<b>\")\n```",
+			want: "<pre><code class=\"language-go\">fmt.Println(&#34;&lt;b&gt;&#34;)\n</code></pre>\n",
+		},
+		{
+			name: "tight bullet list",
+			src:  "- one\n- two\n  - nested",
+			want: "<ul>\n<li>one\n</li>\n<li>two\n<ul>\n<li>nested\n</li>\n</ul>\n</li>\n</ul>\n",
+		},
+		{
+			name: "ordered list with start",
+			src:  "3. three\n4. four",
+			want: "<ol start=\"3\">\n<li>three\n</li>\n<li>four\n</li>\n</ol>\n",
+		},
+		{
+			name: "blockquote",
+			src:  "> quoted\n> text",
+			want: "<blockquote>\n<p>quoted\ntext</p>\n</blockquote>\n",
+		},
+		{
+			name: "thematic break",
+			src:  "a\n\n---\n\nb",
+			want: "<p>a</p>\n<hr>\n<p>b</p>\n",
+		},
+		{
+			name: "hard line break",
+			src:  "first  \nsecond",
+			want: "<p>first<br>\nsecond</p>\n",
+		},
+		{
+			name: "link and image",
+			src:  "[docs](https://example.com/a?b=1&c=2) ![a *plot*](/img/plot.png)",
+			want: "<p><a href=\"https://example.com/a?b=1&amp;c=2\" rel=\"nofollow noopener noreferrer\">docs</a> <img src=\"/img/plot.png\" alt=\"a plot\"></p>\n",
+		},
+		{
+			name: "inline math passes through escaped",
+			src:  "Euler: $e^{i\\pi} < 0$",
+			want: "<p>Euler: <span class=\"math math-inline\">e^{i\\pi} &lt; 0</span></p>\n",
+		},
+		{
+			name: "prices are not math",
+			src:  "costs $5 and $10",
+			want: "<p>costs $5 and $10</p>\n",
+		},
+		{
+			name: "display math block",
+			src:  "$$\n\\int_0^1 x\\,dx\n$$",
+			want: "<div class=\"math math-display\">\\int_0^1 x\\,dx</div>\n",
+		},
+		{
+			name: "link with parentheses and title",
+			src:  "[wiki](https://en.wikipedia.org/wiki/Force_(physics) \"Force\")",
+			want: "<p><a href=\"https://en.wikipedia.org/wiki/Force_(physics)\" rel=\"nofollow noopener noreferrer\">wiki</a></p>\n",
+		},
+		{
+			name: "raw html is escaped",
+			src:  "<script>alert(1)</script><img src=x onerror=alert(1)>",
+			want: "<p>&lt;script&gt;alert(1)&lt;/script&gt;&lt;img src=x onerror=alert(1)&gt;</p>\n",
+		},
+		{
+			name: "javascript link is dropped",
+			src:  "[click](javascript:alert(1))",
+			want: "<p>click</p>\n",
+		},
+		{
+			name: "obfuscated scheme is dropped",
+			src:  "[a](JaVaScRiPt:alert(1)) [b](java\tscript:alert(1)) ![c](data:text/html;base64,PHNjcmlwdD4=)",
+			want: "<p>a [b](java\tscript:alert(1)) c</p>\n",
+		},
+		{
+			name: "attribute breakout is escaped",
+			src:  "[x](/a\"onmouseover=\"alert(1))",
+			want: "<p><a href=\"/a&#34;onmouseover=&#34;alert(1)\" rel=\"nofollow noopener noreferrer\">x</a></p>\n",
+		},
+		{
+			name: "code language is sanitized",
+			src:  "```\"><script>\nx\n```",
+			want: "<pre><code class=\"language-script\">x\n</code></pre>\n",
+		},
+		{
+			name: "autolinks",
+			src:  "<https://example.com> <javascript:alert(1)>",
+			want: "<p><a href=\"https://example.com\" rel=\"nofollow noopener noreferrer\">https://example.com</a> &lt;javascript:alert(1)&gt;</p>\n",
+		},
+		{
+			name: "backslash escapes",
+			src:  "\\*not em\\* and \\<b>",
+			want: "<p>*not em* and &lt;b&gt;</p>\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderMarkdown(tt.src)
+			if got != tt.want {
+				t.Fatalf("renderMarkdown(%q)\n got: %q\nwant: %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderPlainText(t *testing.T) {
+	got := renderPlainText("line <1>\nline 2\n\n\nnext *para*")
+	want := "<p>line &lt;1&gt;<br>\nline 2</p>\n<p>next *para*</p>\n"
+	if got != want {
+		t.Fatalf("renderPlainText\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestRenderMarkdownPathological(t *testing.T) {
+	tests := []struct {
+		name   string
+		repeat string
+	}{
+		{name: "unclosed emphasis", repeat: "*a "},
+		{name: "unclosed strong", repeat: "**a "},
+		{name: "unclosed underscore", repeat: "_a "},
+		{name: "unclosed brackets", repeat: "["},
+		{name: "unclosed link labels", repeat: "[a"},
+		{name: "labels without destination", repeat: "[a]("},
+		{name: "unclosed math", repeat: "$a "},
+		{name: "code spans", repeat: "`a"},
+		{name: "unclosed autolinks", repeat: "<a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := strings.Repeat(tt.repeat, 100000/len(tt.repeat))
+			start := time.Now()
+			got := renderMarkdown(src)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("rendering %d bytes took %v", len(src), elapsed)
+			}
+			if strings.Contains(got, "<a ") || strings.Contains(got, "<em>") {
+				t.Errorf("unclosed delimiters were rendered as markup: %.80q", got)
+			}
+		})
+	}
+}
@@ -1,50 +1,235 @@
 -- name: CreateTextContent :one
-INSERT INTO contents (type, content)
-VALUES ('TEXT', $1)
-RETURNING id, type, content;
+INSERT INTO contents (type, content, title, description, alt_text, tags, created_by, format)
+VALUES ('TEXT', $1, $2, $3, $4, $5, $6, $7)
+RETURNING id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes;
 
 -- name: CreateMediaContent :one
-INSERT INTO contents (type, content)
-VALUES ('MEDIA', $1)
-RETURNING id, type, content;
+INSERT INTO contents (type, content, sha256, variant_status, title, description, alt_text, tags, created_by, size_bytes)
+VALUES ('MEDIA', $1, $2, $3, $4, $5, $6, $7, $8, $9)
+RETURNING id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes;
 
 -- name: GetTextContent :one
-SELECT id, type, content
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
 FROM contents
 WHERE id = $1
   AND type = 'TEXT';
 
 -- name: GetMediaContent :one
-SELECT id, type, content
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
 FROM contents
 WHERE id = $1
   AND type = 'MEDIA';
 
+-- name: GetMediaContentForUpdate :one
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
+FROM contents
+WHERE id = $1
+  AND type = 'MEDIA'
+FOR UPDATE;
+
+-- name: GetMediaContentBySHA256 :one
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
+FROM contents
+WHERE type = 'MEDIA'
+  AND sha256 = $1
+ORDER BY id
+LIMIT 1;
+
+-- name: CountMediaContentsByPath :one
+SELECT COUNT(*)
+FROM contents
+WHERE type = 'MEDIA'
+  AND content = $1;
+
+-- name: LockMediaBlob :exec
+SELECT pg_advisory_xact_lock(hashtextextended(sqlc.arg('key')::text, 0));
+
 -- name: GetContent :one
-SELECT id, type, content
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
 FROM contents
 WHERE id = $1;
 
 -- name: ListTextContents :many
-SELECT id, type, content
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
 FROM contents
 WHERE type = 'TEXT'
-ORDER BY id
-LIMIT $1
-OFFSET $2;
+  AND (sqlc.narg('tag')::text IS NULL OR sqlc.narg('tag')::text = ANY(tags))
+  AND (sqlc.narg('created_by')::uuid IS NULL OR created_by = sqlc.narg('created_by')::uuid)
+ORDER BY created_at, id
+LIMIT sqlc.arg('limit')
+OFFSET sqlc.arg('offset');
 
 -- name: CountTextContents :one
 SELECT COUNT(*)
 FROM contents
-WHERE type = 'TEXT';
+WHERE type = 'TEXT'
+  AND (sqlc.narg('tag')::text IS NULL OR sqlc.narg('tag')::text = ANY(tags))
+  AND (sqlc.narg('created_by')::uuid IS NULL OR created_by = sqlc.narg('created_by')::uuid);
+
+-- name: ListTextContentsByCursor :many
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
+FROM contents
+WHERE type = 'TEXT'
+  AND (sqlc.narg('tag')::text IS NULL OR sqlc.narg('tag')::text = ANY(tags))
+  AND (sqlc.narg('created_by')::uuid IS NULL OR created_by = sqlc.narg('created_by')::uuid)
+  AND (sqlc.narg('after_created_at')::timestamptz IS NULL
+       OR (created_at, id) > (sqlc.narg('after_created_at')::timestamptz, sqlc.narg('after_id')::uuid))
+ORDER BY created_at, id
+LIMIT sqlc.arg('limit');
+
+-- name: ListMediaContents :many
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
+FROM contents
+WHERE type = 'MEDIA'
+  AND (sqlc.narg('tag')::text IS NULL OR sqlc.narg('tag')::text = ANY(tags))
+  AND (sqlc.narg('created_by')::uuid IS NULL OR created_by = sqlc.narg('created_by')::uuid)
+ORDER BY created_at, id
+LIMIT sqlc.arg('limit')
+OFFSET sqlc.arg('offset');
+
+-- name: CountMediaContents :one
+SELECT COUNT(*)
+FROM contents
+WHERE type = 'MEDIA'
+  AND (sqlc.narg('tag')::text IS NULL OR sqlc.narg('tag')::text = ANY(tags))
+  AND (sqlc.narg('created_by')::uuid IS NULL OR created_by = sqlc.narg('created_by')::uuid);
+
+-- name: ListMediaContentsByCursor :many
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
+FROM contents
+WHERE type = 'MEDIA'
+  AND (sqlc.narg('tag')::text IS NULL OR sqlc.narg('tag')::text = ANY(tags))
+  AND (sqlc.narg('created_by')::uuid IS NULL OR created_by = sqlc.narg('created_by')::uuid)
+  AND (sqlc.narg('after_created_at')::timestamptz IS NULL
+       OR (created_at, id) > (sqlc.narg('after_created_at')::timestamptz, sqlc.narg('after_id')::uuid))
+ORDER BY created_at, id
+LIMIT sqlc.arg('limit');
 
 -- name: BatchGetTextContents :many
-SELECT id, type, content
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
 FROM contents
 WHERE type = 'TEXT'
   AND id = ANY($1::uuid[])
 ORDER BY array_position($1::uuid[], id);
 
--- name: DeleteContent :exec
+-- name: UpdateMediaVariants :exec
+UPDATE contents
+SET variant_status = sqlc.arg('variant_status'),
+    variant_widths = sqlc.arg('variant_widths')
+WHERE id = sqlc.arg('id')
+  AND type = 'MEDIA'
+  AND content = sqlc.arg('blob_path');
+
+-- name: ListUnfinishedMediaVariants :many
+SELECT id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes
+FROM contents
+WHERE type = 'MEDIA'
+  AND variant_status IN ('pending', 'processing')
+ORDER BY created_at, id;
+
+-- name: UpdateTextContent :one
+UPDATE contents
+SET content = COALESCE(sqlc.narg('content')::text, content),
+    title = NULLIF(COALESCE(sqlc.narg('title')::text, title), ''),
+    description = NULLIF(COALESCE(sqlc.narg('description')::text, description), ''),
+    alt_text = NULLIF(COALESCE(sqlc.narg('alt_text')::text, alt_text), ''),
+    tags = COALESCE(sqlc.narg('tags')::text[], tags),
+    format = COALESCE(sqlc.narg('format')::text, format),
+    revision = revision + 1,
+    updated_at = now()
+WHERE id = sqlc.arg('id')
+  AND type = 'TEXT'
+RETURNING id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes;
+
+-- name: ReplaceMediaContent :one
+-- A row without an owner is adopted by the caller who replaces its file, since they
+-- are charged for it.
+UPDATE contents
+SET content = sqlc.arg('content'),
+    sha256 = sqlc.arg('sha256'),
+    variant_status = sqlc.arg('variant_status'),
+    variant_widths = '{}',
+    size_bytes = sqlc.arg('size_bytes'),
+    created_by = COALESCE(created_by, sqlc.arg('created_by')),
+    revision = revision + 1,
+    updated_at = now()
+WHERE id = sqlc.arg('id')
+  AND type = 'MEDIA'
+RETURNING id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes;
+
+-- name: ListMediaPaths :many
+SELECT id, content
+FROM contents
+WHERE type = 'MEDIA'
+ORDER BY id;
+
+-- name: DeleteMissingMediaContent :one
 DELETE FROM contents
-WHERE id = $1;
+WHERE id = $1
+  AND type = 'MEDIA'
+  AND content = $2
+RETURNING created_by, size_bytes;
+
+-- name: DeleteContent :one
+DELETE FROM contents
+WHERE id = $1
+RETURNING id, type, content, sha256, variant_status, variant_widths, title, description, alt_text, tags, created_by, created_at, updated_at, format, revision, size_bytes;
+
+-- name: EnsureUserStorage :exec
+INSERT INTO user_storage (user_id)
+VALUES ($1)
+ON CONFLICT (user_id) DO NOTHING;
+
+-- name: ReserveUserStorage :one
+-- Charges bytes to a user only if the result stays within their quota. The user's
+-- own quota_bytes wins over the role quota; both NULL means unlimited.
+UPDATE user_storage
+SET used_bytes = used_bytes + sqlc.arg('bytes')::bigint,
+    updated_at = now()
+WHERE user_id = sqlc.arg('user_id')
+  AND (
+      COALESCE(quota_bytes, sqlc.narg('role_quota')::bigint) IS NULL
+      OR used_bytes + sqlc.arg('bytes')::bigint <= COALESCE(quota_bytes, sqlc.narg('role_quota')::bigint)
+  )
+RETURNING used_bytes;
+
+-- name: ReleaseUserStorage :exec
+UPDATE user_storage
+SET used_bytes = GREATEST(used_bytes - sqlc.arg('bytes')::bigint, 0),
+    updated_at = now()
+WHERE user_id = sqlc.arg('user_id');
+
+-- name: GetUserStorage :one
+SELECT user_id, used_bytes, quota_bytes, updated_at
+FROM user_storage
+WHERE user_id = $1;
+
+-- name: SearchTextContents :many
+-- Matches words through the tsvector and substrings (for CJK text) through the
+-- trigram index; pattern is an escaped ILIKE pattern built from the query.
+SELECT sqlc.embed(contents),
+       (ts_rank_cd(content_search.document, websearch_to_tsquery('simple', sqlc.arg('query')::text))
+           + similarity(content_search.body, sqlc.arg('query')::text))::real AS rank
+FROM content_search
+JOIN contents ON contents.id = content_search.content_id
+WHERE (
+      content_search.document @@ websearch_to_tsquery('simple', sqlc.arg('query')::text)
+      OR content_search.body ILIKE sqlc.arg('pattern')::text
+  )
+  AND (sqlc.narg('tag')::text IS NULL OR sqlc.narg('tag')::text = ANY(contents.tags))
+ORDER BY rank DESC, contents.created_at DESC, contents.id
+LIMIT sqlc.arg('limit')
+OFFSET sqlc.arg('offset');
+
+-- name: RetrieveTextContents :many
+-- Ranks text contents against free text such as a chat prompt: terms is a tsquery
+-- OR-ing its words, and trigram word similarity covers text without word boundaries.
+SELECT sqlc.embed(contents),
+       (ts_rank_cd(content_search.document, to_tsquery('simple', sqlc.arg('terms')::text))
+           + word_similarity(sqlc.arg('query')::text, content_search.body))::real AS rank
+FROM content_search
+JOIN contents ON contents.id = content_search.content_id
+WHERE content_search.document @@ to_tsquery('simple', sqlc.arg('terms')::text)
+   OR sqlc.arg('query')::text <% content_search.body
+ORDER BY rank DESC, contents.id
+LIMIT sqlc.arg('limit');
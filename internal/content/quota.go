@@ -0,0 +1,199 @@
+package content
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"sciedu-backend/internal/auth"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+// UnlimitedStorage is the quota of a role without a storage limit.
+const UnlimitedStorage int64 = -1
+
+// defaultQuotaKey names the quota of users whose roles have none of their own.
+const defaultQuotaKey = "default"
+
+var errStorageQuotaExceeded = errors.New("storage quota exceeded")
+var errInvalidStorageQuota = errors.New("invalid storage quota")
+
+// StorageQuotas holds the byte quota of each role. A user with several roles gets the
+// largest of them; a user with none of the listed roles gets Default.
+type StorageQuotas struct {
+	Default int64
+	Roles   map[string]int64
+}
+
+// StorageUsage is how much of their quota a user has used. QuotaBytes is
+// UnlimitedStorage when the user has no limit.
+type StorageUsage struct {
+	UsedBytes  int64
+	QuotaBytes int64
+}
+
+// ParseStorageQuotas parses a comma-separated list of role=size pairs such as
+// "default=1GiB,EXPERIMENTER=10GiB,ADMIN=unlimited". Sizes are bytes with an optional
+// KiB, MiB, GiB or TiB suffix. Roles that are not listed fall back to default, which
+// itself is unlimited when omitted.
+func ParseStorageQuotas(spec string) (StorageQuotas, error) {
+	quotas := StorageQuotas{Default: UnlimitedStorage, Roles: map[string]int64{}}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return StorageQuotas{}, fmt.Errorf("%w: %q is not role=size", errInvalidStorageQuota, part)
+		}
+		size, err := parseStorageSize(strings.TrimSpace(value))
+		if err != nil {
+			return StorageQuotas{}, fmt.Errorf("%w: %s: %v", errInvalidStorageQuota, key, err)
+		}
+		if strings.EqualFold(key, defaultQuotaKey) {
+			quotas.Default = size
+		} else {
+			quotas.Roles[strings.ToUpper(key)] = size
+		}
+	}
+	return quotas, nil
+}
+
+func parseStorageSize(value string) (int64, error) {
+	if strings.EqualFold(value, "unlimited") {
+		return UnlimitedStorage, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		shift  uint
+	}{{"KiB", 10}, {"MiB", 20}, {"GiB", 30}, {"TiB", 40}} {
+		if trimmed, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, multiplier = strings.TrimSpace(trimmed), int64(1)<<unit.shift
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", value)
+	}
+	if n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("%q is too large", value)
+	}
+	return n * multiplier, nil
+}
+
+// forRoles returns the quota of a user holding the given roles.
+func (q StorageQuotas) forRoles(roles []string) int64 {
+	quota, matched := int64(0), false
+	for _, role := range roles {
+		roleQuota, ok := q.Roles[role]
+		if !ok {
+			continue
+		}
+		if roleQuota == UnlimitedStorage {
+			return UnlimitedStorage
+		}
+		quota, matched = max(quota, roleQuota), true
+	}
+	if !matched {
+		return q.Default
+	}
+	return quota
+}
+
+// SetStorageQuotas replaces the role quotas enforced on media uploads.
+func (s *Service) SetStorageQuotas(quotas StorageQuotas) {
+	s.storageQuotas = quotas
+}
+
+// roleQuota resolves the role quota of the owner of an upload. Roles are only known
+// for the caller, so uploads charged to someone else use the default quota.
+func (s *Service) roleQuota(ctx context.Context, owner uuid.UUID) int64 {
+	if user, ok := auth.UserFromContext(ctx); ok && user.ID == owner {
+		return s.storageQuotas.forRoles(user.Roles)
+	}
+	return s.storageQuotas.Default
+}
+
+// reserveStorage charges bytes to a user, failing with errStorageQuotaExceeded when
+// that would take them over their quota. The check and the charge are one statement,
+// so concurrent uploads cannot overshoot the quota together. Bytes cannot be charged
+// to no one.
+func (s *Service) reserveStorage(ctx context.Context, owner uuid.UUID, bytes int64) error {
+	if bytes <= 0 {
+		return nil
+	}
+	if owner == uuid.Nil {
+		return handlerutil.ErrUnauthorized
+	}
+	if err := s.querier.EnsureUserStorage(ctx, owner); err != nil {
+		return databaseutil.WrapDBErrorWithKeyValue(err, "user_storage", "user_id", owner.String(),
+			s.logger, "ensure user storage")
+	}
+
+	var roleQuota pgtype.Int8
+	if quota := s.roleQuota(ctx, owner); quota != UnlimitedStorage {
+		roleQuota = pgtype.Int8{Int64: quota, Valid: true}
+	}
+	_, err := s.querier.ReserveUserStorage(ctx, ReserveUserStorageParams{
+		Bytes:     bytes,
+		UserID:    owner,
+		RoleQuota: roleQuota,
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		usage, usageErr := s.GetStorageUsage(ctx, owner)
+		if usageErr != nil {
+			return errStorageQuotaExceeded
+		}
+		return fmt.Errorf("%w: %d of %d bytes used, upload needs %d more",
+			errStorageQuotaExceeded, usage.UsedBytes, usage.QuotaBytes, bytes)
+	}
+	if err != nil {
+		return databaseutil.WrapDBErrorWithKeyValue(err, "user_storage", "user_id", owner.String(),
+			s.logger, "reserve user storage")
+	}
+	return nil
+}
+
+// releaseStorage gives bytes back to a user. Failures are only logged: usage then
+// overstates what is stored, which errs on the side of the quota.
+func (s *Service) releaseStorage(ctx context.Context, owner uuid.UUID, bytes int64) {
+	if owner == uuid.Nil || bytes <= 0 {
+		return
+	}
+	if err := s.querier.ReleaseUserStorage(ctx, ReleaseUserStorageParams{Bytes: bytes, UserID: owner}); err != nil {
+		s.logger.Warn("failed to release user storage",
+			zap.String("user_id", owner.String()), zap.Int64("bytes", bytes), zap.Error(err))
+	}
+}
+
+// GetStorageUsage reports the bytes charged to a user and their quota.
+func (s *Service) GetStorageUsage(ctx context.Context, userID uuid.UUID) (StorageUsage, error) {
+	usage := StorageUsage{QuotaBytes: s.roleQuota(ctx, userID)}
+
+	row, err := s.querier.GetUserStorage(ctx, userID)
+	switch {
+	case err == nil:
+		usage.UsedBytes = row.UsedBytes
+		if row.QuotaBytes.Valid {
+			usage.QuotaBytes = row.QuotaBytes.Int64
+		}
+	case errors.Is(err, pgx.ErrNoRows):
+		// Nothing uploaded yet.
+	default:
+		return StorageUsage{}, databaseutil.WrapDBErrorWithKeyValue(err, "user_storage", "user_id", userID.String(),
+			s.logger, "get user storage")
+	}
+	return usage, nil
+}
@@ -0,0 +1,237 @@
+package content
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	ReconcileActionReport     = "report"
+	ReconcileActionQuarantine = "quarantine"
+	ReconcileActionDelete     = "delete"
+)
+
+const (
+	reconcileOutcomeQuarantined = "quarantined"
+	reconcileOutcomeDeleted     = "deleted"
+	reconcileOutcomeSkipped     = "skipped"
+	reconcileOutcomeFailed      = "failed"
+)
+
+// DefaultReconcileGracePeriod keeps files written recently out of the orphan list: an
+// upload's blob exists on disk for a moment before its row is inserted.
+const DefaultReconcileGracePeriod = time.Hour
+
+// quarantineDirName is created inside the media directory; the scan skips directories,
+// so quarantined files are never reported again.
+const quarantineDirName = ".quarantine"
+
+var errInvalidReconcileAction = errors.New("invalid reconcile action")
+
+type ReconcileOptions struct {
+	// Action is report, quarantine or delete. Quarantine moves orphan files aside and
+	// only reports missing files; delete removes orphan files and the rows whose file
+	// is missing.
+	Action string
+	// Dir is the media directory to scan; empty means the default upload directory.
+	Dir         string
+	GracePeriod time.Duration
+}
+
+type ReconcileReport struct {
+	Action       string              `json:"action"`
+	Dir          string              `json:"dir"`
+	ScannedFiles int                 `json:"scannedFiles"`
+	ScannedRows  int                 `json:"scannedRows"`
+	OrphanFiles  []OrphanMediaFile   `json:"orphanFiles"`
+	MissingFiles []MissingMediaEntry `json:"missingFiles"`
+}
+
+// OrphanMediaFile is a file in the media directory that no content row references.
+type OrphanMediaFile struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	Outcome    string    `json:"outcome,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// MissingMediaEntry is a media content row whose file is gone.
+type MissingMediaEntry struct {
+	ContentID uuid.UUID `json:"contentId"`
+	Path      string    `json:"path"`
+	Outcome   string    `json:"outcome,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ReconcileMedia compares the media directory with the contents table. Files no row
+// references (including variants of such files and stale temp files) are orphans;
+// rows whose file does not exist are missing. Both are reported and, depending on
+// the action, cleaned up.
+func (s *Service) ReconcileMedia(ctx context.Context, opts ReconcileOptions) (ReconcileReport, error) {
+	switch opts.Action {
+	case "":
+		opts.Action = ReconcileActionReport
+	case ReconcileActionReport, ReconcileActionQuarantine, ReconcileActionDelete:
+	default:
+		return ReconcileReport{}, fmt.Errorf("%w: action must be one of report, quarantine, delete", errInvalidReconcileAction)
+	}
+	if opts.Dir == "" {
+		opts.Dir = defaultMediaDir
+	}
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = DefaultReconcileGracePeriod
+	}
+	logger := s.logger.With(zap.String("action", opts.Action), zap.String("dir", opts.Dir))
+
+	rows, err := s.querier.ListMediaPaths(ctx)
+	if err != nil {
+		return ReconcileReport{}, databaseutil.WrapDBError(err, s.logger, "list media paths")
+	}
+
+	report := ReconcileReport{
+		Action:       opts.Action,
+		Dir:          opts.Dir,
+		ScannedRows:  len(rows),
+		OrphanFiles:  []OrphanMediaFile{},
+		MissingFiles: []MissingMediaEntry{},
+	}
+
+	// Every row keeps its blob and all possible variants alive.
+	referenced := make(map[string]struct{}, len(rows)*(len(standardVariantWidths)+1))
+	for _, row := range rows {
+		referenced[comparablePath(row.Content)] = struct{}{}
+		for _, width := range standardVariantWidths {
+			referenced[comparablePath(variantPath(row.Content, width))] = struct{}{}
+		}
+	}
+
+	entries, err := os.ReadDir(opts.Dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ReconcileReport{}, fmt.Errorf("read media directory: %w", err)
+	}
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		report.ScannedFiles++
+
+		path := filepath.Join(opts.Dir, entry.Name())
+		if _, ok := referenced[comparablePath(path)]; ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		orphan := OrphanMediaFile{Path: path, Size: info.Size(), ModifiedAt: info.ModTime().UTC()}
+		if opts.Action != ReconcileActionReport {
+			s.cleanUpOrphan(ctx, &orphan, opts, logger)
+		}
+		report.OrphanFiles = append(report.OrphanFiles, orphan)
+	}
+
+	for _, row := range rows {
+		if _, err := os.Stat(row.Content); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		missing := MissingMediaEntry{ContentID: row.ID, Path: row.Content}
+		if opts.Action == ReconcileActionDelete {
+			s.cleanUpMissing(ctx, &missing, logger)
+		}
+		report.MissingFiles = append(report.MissingFiles, missing)
+	}
+
+	logger.Info("reconciled media directory",
+		zap.Int("scanned_files", report.ScannedFiles),
+		zap.Int("scanned_rows", report.ScannedRows),
+		zap.Int("orphan_files", len(report.OrphanFiles)),
+		zap.Int("missing_files", len(report.MissingFiles)))
+
+	return report, nil
+}
+
+func (s *Service) cleanUpOrphan(ctx context.Context, orphan *OrphanMediaFile, opts ReconcileOptions, logger *zap.Logger) {
+	// A new row may have started pointing at the file since the scan. The blob's lock
+	// keeps uploads from reusing it while it is moved away.
+	err := s.withinTx(ctx, func(q Querier) error {
+		storedPath := toStoredPath(orphan.Path)
+		if err := q.LockMediaBlob(ctx, mediaBlobKey(storedPath)); err != nil {
+			return err
+		}
+		count, err := q.CountMediaContentsByPath(ctx, storedPath)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			orphan.Outcome = reconcileOutcomeSkipped
+			return nil
+		}
+
+		switch opts.Action {
+		case ReconcileActionQuarantine:
+			dir := filepath.Join(opts.Dir, quarantineDirName)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+			if err := os.Rename(orphan.Path, filepath.Join(dir, filepath.Base(orphan.Path))); err != nil {
+				return err
+			}
+			orphan.Outcome = reconcileOutcomeQuarantined
+		case ReconcileActionDelete:
+			if err := os.Remove(orphan.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			orphan.Outcome = reconcileOutcomeDeleted
+		}
+		return nil
+	})
+	if err != nil {
+		orphan.Outcome, orphan.Error = reconcileOutcomeFailed, err.Error()
+		logger.Warn("failed to clean up orphan media file", zap.String("path", orphan.Path), zap.String("error", orphan.Error))
+	}
+}
+
+func (s *Service) cleanUpMissing(ctx context.Context, missing *MissingMediaEntry, logger *zap.Logger) {
+	// The row only goes if it still points at the same missing file.
+	deleted, err := s.querier.DeleteMissingMediaContent(ctx, DeleteMissingMediaContentParams{
+		ID:      missing.ContentID,
+		Content: missing.Path,
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		missing.Outcome = reconcileOutcomeSkipped
+		return
+	}
+	if err != nil {
+		missing.Outcome, missing.Error = reconcileOutcomeFailed, err.Error()
+		logger.Warn("failed to delete media content with missing file",
+			zap.String("content_id", missing.ContentID.String()), zap.Error(err))
+		return
+	}
+	missing.Outcome = reconcileOutcomeDeleted
+	s.releaseStorage(ctx, deleted.CreatedBy.Bytes, deleted.SizeBytes)
+	s.renderCache.remove(missing.ContentID)
+}
+
+// comparablePath normalizes a stored or scanned path so both sides compare equal.
+func comparablePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
@@ -0,0 +1,99 @@
+package content
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	formatPlain    = "plain"
+	formatMarkdown = "markdown"
+)
+
+// renderCacheSize bounds how many rendered text contents are kept in memory.
+const renderCacheSize = 1024
+
+var errUnsupportedRender = errors.New("unsupported render mode")
+
+// renderHTML renders text content in the given format to sanitized HTML.
+func renderHTML(format, text string) string {
+	if format == formatMarkdown {
+		return renderMarkdown(text)
+	}
+	return renderPlainText(text)
+}
+
+// renderCache is an LRU of rendered HTML keyed by content ID. Each entry remembers
+// the revision it was rendered from, so an update simply causes a miss.
+type renderCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[uuid.UUID]*list.Element
+	order    *list.List // front is most recently used
+}
+
+type renderCacheEntry struct {
+	id       uuid.UUID
+	revision int32
+	html     string
+}
+
+func newRenderCache(capacity int) *renderCache {
+	return &renderCache{
+		capacity: capacity,
+		entries:  make(map[uuid.UUID]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *renderCache) get(id uuid.UUID, revision int32) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*renderCacheEntry)
+	if entry.revision != revision {
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.html, true
+}
+
+func (c *renderCache) put(id uuid.UUID, revision int32, html string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		entry := elem.Value.(*renderCacheEntry)
+		// Never let a slow render of an old revision replace a newer one.
+		if revision >= entry.revision {
+			entry.revision = revision
+			entry.html = html
+		}
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[id] = c.order.PushFront(&renderCacheEntry{id: id, revision: revision, html: html})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderCacheEntry).id)
+	}
+}
+
+func (c *renderCache) remove(id uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+	}
+}
@@ -3,5 +3,62 @@ CREATE TYPE content_type AS ENUM ('TEXT', 'MEDIA');
 CREATE TABLE IF NOT EXISTS contents (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     type content_type NOT NULL,
-    content TEXT NOT NULL        /* string if text, filepath if media */
+    content TEXT NOT NULL,       /* string if text, filepath if media */
+    sha256 TEXT,                 /* hex digest of the media blob, NULL for text */
+    variant_status TEXT,         /* resized image variants, NULL when not applicable */
+    variant_widths INT[] NOT NULL DEFAULT '{}',
+    title TEXT,
+    description TEXT,
+    alt_text TEXT,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    format TEXT NOT NULL DEFAULT 'plain', /* how text content is rendered */
+    revision INT NOT NULL DEFAULT 1,      /* bumped on every update */
+    size_bytes BIGINT NOT NULL DEFAULT 0, /* bytes charged to created_by, 0 for text */
+    CONSTRAINT contents_variant_status_known CHECK (
+        variant_status IS NULL
+        OR variant_status IN ('pending', 'processing', 'ready', 'failed')
+    ),
+    CONSTRAINT contents_format_known CHECK (format IN ('plain', 'markdown'))
 );
+
+CREATE INDEX IF NOT EXISTS idx_contents_media_sha256
+ON contents(sha256)
+WHERE type = 'MEDIA';
+
+CREATE INDEX IF NOT EXISTS idx_contents_media_path
+ON contents(content)
+WHERE type = 'MEDIA';
+
+CREATE INDEX IF NOT EXISTS idx_contents_tags
+ON contents USING GIN (tags);
+
+CREATE INDEX IF NOT EXISTS idx_contents_created_by
+ON contents(created_by);
+
+CREATE INDEX IF NOT EXISTS idx_contents_type_created_at_id
+ON contents(type, created_at, id);
+
+CREATE TABLE IF NOT EXISTS user_storage (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    used_bytes BIGINT NOT NULL DEFAULT 0,
+    quota_bytes BIGINT,                   /* per-user override, NULL uses the role quota */
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT user_storage_used_bytes_not_negative CHECK (used_bytes >= 0),
+    CONSTRAINT user_storage_quota_bytes_not_negative CHECK (quota_bytes IS NULL OR quota_bytes >= 0)
+);
+
+/* Filled by the contents_search_refresh trigger for TEXT rows. */
+CREATE TABLE IF NOT EXISTS content_search (
+    content_id UUID PRIMARY KEY REFERENCES contents(id) ON DELETE CASCADE,
+    document TSVECTOR NOT NULL,  /* weighted title, tags, description, content */
+    body TEXT NOT NULL           /* the same text, for trigram substring matches */
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_search_document
+ON content_search USING GIN (document);
+
+CREATE INDEX IF NOT EXISTS idx_content_search_body_trgm
+ON content_search USING GIN (body gin_trgm_ops);
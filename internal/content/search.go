@@ -0,0 +1,257 @@
+package content
+
+import (
+	"context"
+	"errors"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+)
+
+const (
+	// snippetRunes is the length of a search snippet, before ellipses.
+	snippetRunes = 160
+	// snippetLeadRunes is how much text is kept before the first match.
+	snippetLeadRunes = 40
+	// maxRetrievalQueryRunes bounds the free text RetrieveTextContents matches on.
+	maxRetrievalQueryRunes = 1000
+	// maxRetrievalTerms bounds the words of a retrieval query.
+	maxRetrievalTerms = 32
+)
+
+var retrievalStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true,
+	"you": true, "was": true, "were": true, "has": true, "have": true, "had": true,
+	"how": true, "what": true, "why": true, "when": true, "where": true, "which": true,
+	"who": true, "does": true, "did": true, "this": true, "that": true, "with": true,
+	"from": true, "they": true, "them": true, "there": true, "their": true, "then": true,
+	"than": true, "into": true, "about": true, "would": true, "could": true, "should": true,
+	"will": true, "your": true, "its": true, "been": true, "can": true, "some": true,
+}
+
+var errEmptySearchQuery = errors.New("search query is empty")
+
+type SearchFilter struct {
+	Query    string
+	Page     int32
+	PageSize int32
+	Tag      string
+}
+
+// SearchResult is a matching text content with its relevance and an HTML snippet
+// in which the matched terms are wrapped in <mark>.
+type SearchResult struct {
+	Content Content
+	Rank    float32
+	Snippet string
+}
+
+type SearchPage struct {
+	Items       []SearchResult
+	CurrentPage int32
+	PageSize    int32
+	HasNextPage bool
+}
+
+// SearchTextContents returns text contents matching the query, most relevant first.
+// The query uses web search syntax ("quoted phrases", -excluded, or); text without
+// spaces between words, such as Chinese, is matched as a substring.
+func (s *Service) SearchTextContents(ctx context.Context, filter SearchFilter) (SearchPage, error) {
+	query := strings.TrimSpace(filter.Query)
+	if query == "" {
+		return SearchPage{}, errEmptySearchQuery
+	}
+	page, pageSize := normalizePagination(filter.Page, filter.PageSize)
+
+	rows, err := s.querier.SearchTextContents(ctx, SearchTextContentsParams{
+		Query:   query,
+		Pattern: "%" + escapeLikePattern(query) + "%",
+		Tag:     optionalText(normalizeTag(filter.Tag)),
+		// One extra row tells whether another page follows.
+		Limit:  pageSize + 1,
+		Offset: (page - 1) * pageSize,
+	})
+	if err != nil {
+		return SearchPage{}, databaseutil.WrapDBError(err, s.logger, "search text contents")
+	}
+
+	result := SearchPage{
+		Items:       make([]SearchResult, 0, min(len(rows), int(pageSize))),
+		CurrentPage: page,
+		PageSize:    pageSize,
+	}
+	if len(rows) > int(pageSize) {
+		rows = rows[:pageSize]
+		result.HasNextPage = true
+	}
+	terms := searchTerms(query)
+	for _, row := range rows {
+		result.Items = append(result.Items, SearchResult{
+			Content: row.Content,
+			Rank:    row.Rank,
+			Snippet: highlightSnippet(row.Content.Content, terms),
+		})
+	}
+	return result, nil
+}
+
+// RetrieveTextContents returns the text contents most related to free text, such as
+// a student's chat prompt, best first. Unlike SearchTextContents any of its words may
+// match, so long questions still find the lessons they touch on.
+func (s *Service) RetrieveTextContents(ctx context.Context, text string, limit int32) ([]SearchResult, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || limit < 1 {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(text) > maxRetrievalQueryRunes {
+		text = string([]rune(text)[:maxRetrievalQueryRunes])
+	}
+
+	rows, err := s.querier.RetrieveTextContents(ctx, RetrieveTextContentsParams{
+		Terms: retrievalTerms(text),
+		Query: text,
+		Limit: limit,
+	})
+	if err != nil {
+		return nil, databaseutil.WrapDBError(err, s.logger, "retrieve text contents")
+	}
+
+	terms := searchTerms(text)
+	results := make([]SearchResult, 0, len(rows))
+	for _, row := range rows {
+		results = append(results, SearchResult{
+			Content: row.Content,
+			Rank:    row.Rank,
+			Snippet: highlightSnippet(row.Content.Content, terms),
+		})
+	}
+	return results, nil
+}
+
+// retrievalTerms turns free text into a tsquery matching any of its words. Short
+// words and common English function words are left out, as they match everything.
+func retrievalTerms(text string) string {
+	var terms []string
+	seen := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if seen[word] || retrievalStopWords[word] || (isASCII(word) && len(word) < 3) {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, "'"+word+"'")
+		if len(terms) == maxRetrievalTerms {
+			break
+		}
+	}
+	return strings.Join(terms, " | ")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeLikePattern escapes the ILIKE wildcards so the query matches literally.
+func escapeLikePattern(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// searchTerms extracts the words worth highlighting from a web search query:
+// excluded terms and the "or" operator are dropped, quotes are ignored.
+func searchTerms(query string) [][]rune {
+	var terms [][]rune
+	seen := map[string]bool{}
+	for _, field := range strings.Fields(query) {
+		if strings.HasPrefix(field, "-") || strings.EqualFold(field, "or") {
+			continue
+		}
+		field = strings.Map(unicode.ToLower, strings.Trim(field, `"`))
+		if field == "" || seen[field] {
+			continue
+		}
+		seen[field] = true
+		terms = append(terms, []rune(field))
+	}
+	return terms
+}
+
+// highlightSnippet cuts a window of text around the first matched term and returns
+// it as escaped HTML with every match wrapped in <mark>.
+func highlightSnippet(text string, terms [][]rune) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// Non-overlapping matches, longest term first at each position.
+	type span struct{ start, end int }
+	var matches []span
+	for i := 0; i < len(lower); {
+		best := 0
+		for _, term := range terms {
+			if len(term) > best && hasRunePrefix(lower[i:], term) {
+				best = len(term)
+			}
+		}
+		if best == 0 {
+			i++
+			continue
+		}
+		matches = append(matches, span{i, i + best})
+		i += best
+	}
+
+	start := 0
+	if len(matches) > 0 {
+		start = max(matches[0].start-snippetLeadRunes, 0)
+	}
+	end := min(start+snippetRunes, len(runes))
+	// Keep the first match whole even when it runs past the window.
+	if len(matches) > 0 && matches[0].end > end {
+		end = matches[0].end
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.start < start || m.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:m.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[m.start:m.end])))
+		b.WriteString("</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+func hasRunePrefix(s, prefix []rune) bool {
+	if len(prefix) > len(s) {
+		return false
+	}
+	for i, r := range prefix {
+		if s[i] != r {
+			return false
+		}
+	}
+	return true
+}
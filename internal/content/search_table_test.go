@@ -0,0 +1,182 @@
+package content
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+func TestHighlightSnippet(t *testing.T) {
+	long := "Plants convert light into chemical energy through a process that takes place in the chloroplasts of leaf cells, " +
+		"which is known as photosynthesis. The process also releases oxygen into the atmosphere."
+
+	tests := []struct {
+		name  string
+		text  string
+		query string
+		want  string
+	}{
+		{
+			name:  "case insensitive word",
+			text:  "Light is needed for Photosynthesis.",
+			query: "photosynthesis",
+			want:  "Light is needed for <mark>Photosynthesis</mark>.",
+		},
+		{
+			name:  "cjk substring",
+			text:  "植物透過光合作用產生氧氣",
+			query: "光合作用",
+			want:  "植物透過<mark>光合作用</mark>產生氧氣",
+		},
+		{
+			name:  "several terms, excluded and or ignored",
+			text:  "light and water or soil",
+			query: `"light" or water -soil`,
+			want:  "<mark>light</mark> and <mark>water</mark> or soil",
+		},
+		{
+			name:  "longest term wins",
+			text:  "photosynthesis",
+			query: "photo photosynthesis",
+			want:  "<mark>photosynthesis</mark>",
+		},
+		{
+			name:  "escapes html",
+			text:  "<b>x</b> & y",
+			query: "y",
+			want:  "&lt;b&gt;x&lt;/b&gt; &amp; <mark>y</mark>",
+		},
+		{
+			name:  "window around a late match",
+			text:  long,
+			query: "oxygen",
+			want:  "…otosynthesis. The process also releases <mark>oxygen</mark> into the atmosphere.",
+		},
+		{
+			name:  "no match falls back to the start",
+			text:  long,
+			query: "mitochondria",
+			want:  "Plants convert light into chemical energy through a process that takes place in the chloroplasts of leaf cells, which is known as photosynthesis. The process al…",
+		},
+		{
+			name:  "collapses whitespace",
+			text:  "line one\n\n  line two",
+			query: "two",
+			want:  "line one line <mark>two</mark>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightSnippet(tt.text, searchTerms(tt.query)); got != tt.want {
+				t.Fatalf("snippet mismatch:\nwant %q\ngot  %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestContentSearchTrigger checks that the content_search row of a text content
+// follows it. It needs a PostgreSQL database to migrate, given by TEST_DATABASE_URL.
+func TestContentSearchTrigger(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	if err := databaseutil.MigrationUp("file://../database/migrations", databaseURL, zap.NewNop()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, databaseURL)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer pool.Close()
+
+	tests := []struct {
+		name   string
+		change string
+		// wantIndexed and wantDropped are words the row is expected to match, and no
+		// longer to match, after the change.
+		wantIndexed []string
+		wantDropped []string
+		wantDeleted bool
+	}{
+		{
+			name:        "content updated",
+			change:      `UPDATE contents SET content = 'respiration releases energy' WHERE id = $1`,
+			wantIndexed: []string{"respiration", "plants"},
+			wantDropped: []string{"photosynthesis"},
+		},
+		{
+			name:        "title updated",
+			change:      `UPDATE contents SET title = 'Chloroplasts' WHERE id = $1`,
+			wantIndexed: []string{"chloroplasts", "photosynthesis"},
+			wantDropped: []string{"plants"},
+		},
+		{
+			name:        "tags updated",
+			change:      `UPDATE contents SET tags = '{chemistry}' WHERE id = $1`,
+			wantIndexed: []string{"chemistry"},
+			wantDropped: []string{"biology"},
+		},
+		{
+			name:        "content deleted",
+			change:      `DELETE FROM contents WHERE id = $1`,
+			wantDeleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var id uuid.UUID
+			err := pool.QueryRow(ctx, `INSERT INTO contents (type, content, title, tags)
+				VALUES ('TEXT', 'photosynthesis makes sugar', 'Plants', '{biology}') RETURNING id`).Scan(&id)
+			if err != nil {
+				t.Fatalf("insert content: %v", err)
+			}
+			defer func() {
+				_, _ = pool.Exec(ctx, `DELETE FROM contents WHERE id = $1`, id)
+			}()
+
+			if _, err := pool.Exec(ctx, tt.change, id); err != nil {
+				t.Fatalf("change content: %v", err)
+			}
+
+			matches := func(word string) bool {
+				t.Helper()
+				var matched bool
+				err := pool.QueryRow(ctx, `SELECT document @@ to_tsquery('simple', $2) AND body ILIKE '%' || $2 || '%'
+					FROM content_search WHERE content_id = $1`, id, word).Scan(&matched)
+				if err != nil {
+					t.Fatalf("match %q: %v", word, err)
+				}
+				return matched
+			}
+			if tt.wantDeleted {
+				var count int
+				if err := pool.QueryRow(ctx, `SELECT count(*) FROM content_search WHERE content_id = $1`, id).Scan(&count); err != nil {
+					t.Fatalf("count search rows: %v", err)
+				}
+				if count != 0 {
+					t.Errorf("the search row outlived its content")
+				}
+				return
+			}
+			for _, word := range tt.wantIndexed {
+				if !matches(word) {
+					t.Errorf("the search row does not match %q", word)
+				}
+			}
+			for _, word := range tt.wantDropped {
+				if matches(word) {
+					t.Errorf("the search row still matches %q", word)
+				}
+			}
+		})
+	}
+}
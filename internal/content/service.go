@@ -2,6 +2,8 @@ package content
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,7 +13,10 @@ import (
 	"strings"
 
 	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"go.uber.org/zap"
 )
 
@@ -24,25 +29,59 @@ const (
 
 var errEmptyMediaContent = errors.New("media content is empty")
 var errEmptyTextContent = errors.New("text content is empty")
+var errMediaTransactionUnsupported = errors.New("media transaction unsupported")
 
 type Querier interface {
-	CreateMediaContent(ctx context.Context, content string) (Content, error)
-	CreateTextContent(ctx context.Context, content string) (Content, error)
+	CreateMediaContent(ctx context.Context, arg CreateMediaContentParams) (Content, error)
+	CreateTextContent(ctx context.Context, arg CreateTextContentParams) (Content, error)
 	GetMediaContent(ctx context.Context, id uuid.UUID) (Content, error)
 	GetTextContent(ctx context.Context, id uuid.UUID) (Content, error)
+	GetMediaContentForUpdate(ctx context.Context, id uuid.UUID) (Content, error)
+	GetMediaContentBySHA256(ctx context.Context, sha256 pgtype.Text) (Content, error)
+	CountMediaContentsByPath(ctx context.Context, content string) (int64, error)
 	GetContent(ctx context.Context, id uuid.UUID) (Content, error)
 	ListTextContents(ctx context.Context, arg ListTextContentsParams) ([]Content, error)
-	CountTextContents(ctx context.Context) (int64, error)
+	CountTextContents(ctx context.Context, arg CountTextContentsParams) (int64, error)
+	ListTextContentsByCursor(ctx context.Context, arg ListTextContentsByCursorParams) ([]Content, error)
+	ListMediaContents(ctx context.Context, arg ListMediaContentsParams) ([]Content, error)
+	CountMediaContents(ctx context.Context, arg CountMediaContentsParams) (int64, error)
+	ListMediaContentsByCursor(ctx context.Context, arg ListMediaContentsByCursorParams) ([]Content, error)
 	BatchGetTextContents(ctx context.Context, ids []uuid.UUID) ([]Content, error)
-	DeleteContent(ctx context.Context, id uuid.UUID) error
+	UpdateMediaVariants(ctx context.Context, arg UpdateMediaVariantsParams) error
+	ListUnfinishedMediaVariants(ctx context.Context) ([]Content, error)
+	UpdateTextContent(ctx context.Context, arg UpdateTextContentParams) (Content, error)
+	ReplaceMediaContent(ctx context.Context, arg ReplaceMediaContentParams) (Content, error)
+	DeleteContent(ctx context.Context, id uuid.UUID) (Content, error)
+	ListMediaPaths(ctx context.Context) ([]ListMediaPathsRow, error)
+	DeleteMissingMediaContent(ctx context.Context, arg DeleteMissingMediaContentParams) (DeleteMissingMediaContentRow, error)
+	EnsureUserStorage(ctx context.Context, userID uuid.UUID) error
+	ReserveUserStorage(ctx context.Context, arg ReserveUserStorageParams) (int64, error)
+	ReleaseUserStorage(ctx context.Context, arg ReleaseUserStorageParams) error
+	GetUserStorage(ctx context.Context, userID uuid.UUID) (UserStorage, error)
+	SearchTextContents(ctx context.Context, arg SearchTextContentsParams) ([]SearchTextContentsRow, error)
+	RetrieveTextContents(ctx context.Context, arg RetrieveTextContentsParams) ([]RetrieveTextContentsRow, error)
+	LockMediaBlob(ctx context.Context, key string) error
+}
+
+type MediaTransactor interface {
+	WithinTx(ctx context.Context, fn func(Querier) error) error
 }
 
 type Service struct {
-	logger  *zap.Logger
-	querier Querier
+	logger     *zap.Logger
+	querier    Querier
+	transactor MediaTransactor
+
+	// runAsync queues background work such as variant generation and reports
+	// whether it was accepted.
+	runAsync func(fn func()) bool
+
+	renderCache *renderCache
+
+	storageQuotas StorageQuotas
 }
 
-type TextPage struct {
+type ContentPage struct {
 	Items       []Content
 	TotalPages  int32
 	TotalItems  int32
@@ -51,11 +90,83 @@ type TextPage struct {
 	HasNextPage bool
 }
 
+// ContentMetadata describes a content item beyond its payload.
+type ContentMetadata struct {
+	Title       string
+	Description string
+	AltText     string
+	Tags        []string
+	CreatedBy   uuid.UUID
+}
+
+type TextContentRequest struct {
+	Content string
+	// Format is "plain" or "markdown"; empty means plain.
+	Format string
+	ContentMetadata
+}
+
+// TextContentPatch lists the fields of a text content to change. Nil fields are left
+// untouched; an empty title, description or alt text clears it.
+type TextContentPatch struct {
+	Content     *string
+	Title       *string
+	Description *string
+	AltText     *string
+	Tags        *[]string
+	Format      *string
+}
+
 type MediaUploadRequest struct {
 	Content  io.Reader
 	Filename string
 	Dir      string
 	MaxBytes int64
+	ContentMetadata
+}
+
+type ContentListFilter struct {
+	Page     int32
+	PageSize int32
+	Tag      string
+	Owner    uuid.UUID
+}
+
+// CursorListFilter selects a keyset page. An empty Cursor starts from the beginning.
+type CursorListFilter struct {
+	Cursor   string
+	PageSize int32
+	Tag      string
+	Owner    uuid.UUID
+}
+
+// CursorPage is one page of a keyset listing. NextCursor is empty on the last page.
+type CursorPage struct {
+	Items       []Content
+	PageSize    int32
+	NextCursor  string
+	HasNextPage bool
+}
+
+// writtenMedia is an upload written to a temp file and hashed, before it is stored
+// under its content-addressed name.
+type writtenMedia struct {
+	TmpPath   string
+	FinalPath string
+	SHA256    string
+	Size      int64
+}
+
+// cleanUp removes the temp file if it was not moved into place.
+func (w writtenMedia) cleanUp() {
+	_ = os.Remove(w.TmpPath)
+}
+
+type mediaBlob struct {
+	StoredPath string
+	SHA256     string
+	Size       int64
+	Reused     bool
 }
 
 func NewService(querier Querier, logger *zap.Logger) *Service {
@@ -64,18 +175,30 @@ func NewService(querier Querier, logger *zap.Logger) *Service {
 	}
 
 	return &Service{
-		logger:  logger,
-		querier: querier,
+		logger:        logger,
+		querier:       querier,
+		transactor:    transactorFromQuerier(querier),
+		runAsync:      newVariantPool().submit,
+		renderCache:   newRenderCache(renderCacheSize),
+		storageQuotas: StorageQuotas{Default: UnlimitedStorage},
 	}
 }
 
-func (s *Service) CreateTextContent(ctx context.Context, content string) (Content, error) {
-	content = strings.TrimSpace(content)
+func (s *Service) CreateTextContent(ctx context.Context, req TextContentRequest) (Content, error) {
+	content := strings.TrimSpace(req.Content)
 	if content == "" {
 		return Content{}, errEmptyTextContent
 	}
 
-	item, err := s.querier.CreateTextContent(ctx, content)
+	item, err := s.querier.CreateTextContent(ctx, CreateTextContentParams{
+		Content:     content,
+		Title:       optionalText(req.Title),
+		Description: optionalText(req.Description),
+		AltText:     optionalText(req.AltText),
+		Tags:        normalizeTags(req.Tags),
+		CreatedBy:   optionalUUID(req.CreatedBy),
+		Format:      textFormatOrDefault(req.Format),
+	})
 	if err != nil {
 		return Content{}, databaseutil.WrapDBError(err, s.logger, "create text content")
 	}
@@ -84,8 +207,165 @@ func (s *Service) CreateTextContent(ctx context.Context, content string) (Conten
 }
 
 func (s *Service) CreateMediaContent(ctx context.Context, upload MediaUploadRequest) (Content, error) {
+	// Uploads are charged to their owner, so one without an owner would escape the quota.
+	if upload.CreatedBy == uuid.Nil {
+		return Content{}, handlerutil.ErrUnauthorized
+	}
+
+	written, err := s.writeMediaUpload(upload)
+	if err != nil {
+		return Content{}, err
+	}
+	defer written.cleanUp()
+
+	// Uploads count against the owner's quota even when their blob is deduplicated.
+	if err := s.reserveStorage(ctx, upload.CreatedBy, written.Size); err != nil {
+		return Content{}, err
+	}
+
+	var item Content
+	err = s.withinTx(ctx, func(q Querier) error {
+		blob, err := s.storeMediaBlob(ctx, q, written)
+		if err != nil {
+			return err
+		}
+
+		// Persist only the stored path in DB; rollback file if DB insert fails.
+		item, err = q.CreateMediaContent(ctx, CreateMediaContentParams{
+			Content:       blob.StoredPath,
+			Sha256:        pgtype.Text{String: blob.SHA256, Valid: true},
+			VariantStatus: initialVariantStatus(blob.StoredPath),
+			Title:         optionalText(upload.Title),
+			Description:   optionalText(upload.Description),
+			AltText:       optionalText(upload.AltText),
+			Tags:          normalizeTags(upload.Tags),
+			CreatedBy:     optionalUUID(upload.CreatedBy),
+			SizeBytes:     blob.Size,
+		})
+		if err != nil {
+			s.discardMediaBlob(blob)
+			return databaseutil.WrapDBError(err, s.logger, "create media content")
+		}
+		return nil
+	})
+	if err != nil {
+		s.releaseStorage(ctx, upload.CreatedBy, written.Size)
+		return Content{}, err
+	}
+
+	s.scheduleVariants(item)
+
+	return item, nil
+}
+
+func (s *Service) UpdateTextContent(ctx context.Context, id uuid.UUID, patch TextContentPatch) (Content, error) {
+	arg := UpdateTextContentParams{
+		ID:          id,
+		Title:       patchText(patch.Title),
+		Description: patchText(patch.Description),
+		AltText:     patchText(patch.AltText),
+	}
+	if patch.Content != nil {
+		content := strings.TrimSpace(*patch.Content)
+		if content == "" {
+			return Content{}, errEmptyTextContent
+		}
+		arg.Content = pgtype.Text{String: content, Valid: true}
+	}
+	if patch.Tags != nil {
+		arg.Tags = normalizeTags(*patch.Tags)
+	}
+	if patch.Format != nil {
+		arg.Format = pgtype.Text{String: textFormatOrDefault(*patch.Format), Valid: true}
+	}
+
+	item, err := s.querier.UpdateTextContent(ctx, arg)
+	if err != nil {
+		return Content{}, databaseutil.WrapDBErrorWithKeyValue(err, "contents", "id", id.String(),
+			s.logger, "update text content")
+	}
+	return item, nil
+}
+
+// ReplaceMediaContent stores the upload as a new blob and points the row at it. The
+// row is locked from the read of its previous blob to the update, so concurrent
+// replacements cannot both release the same blob. The previous blob is removed only
+// once the update is committed, and only if no other row still references it, so
+// readers never see a missing file. upload.CreatedBy is the caller, who is charged
+// for, and takes over, a row without an owner.
+func (s *Service) ReplaceMediaContent(ctx context.Context, id uuid.UUID, upload MediaUploadRequest) (Content, error) {
+	if upload.CreatedBy == uuid.Nil {
+		return Content{}, handlerutil.ErrUnauthorized
+	}
+
+	written, err := s.writeMediaUpload(upload)
+	if err != nil {
+		return Content{}, err
+	}
+	defer written.cleanUp()
+
+	var previous, item Content
+	var owner uuid.UUID
+	var reserved int64
+	err = s.withinTx(ctx, func(q Querier) error {
+		var err error
+		previous, err = q.GetMediaContentForUpdate(ctx, id)
+		if err != nil {
+			return databaseutil.WrapDBErrorWithKeyValue(err, "contents", "id", id.String(),
+				s.logger, "get media content for update")
+		}
+
+		// The owner is charged the difference in size; a smaller file is refunded only
+		// once the row points at it.
+		owner = upload.CreatedBy
+		if previous.CreatedBy.Valid {
+			owner = previous.CreatedBy.Bytes
+		}
+		size := written.Size
+		growth := size - previous.SizeBytes
+		if err := s.reserveStorage(ctx, owner, growth); err != nil {
+			return err
+		}
+		reserved = growth
+
+		blob, err := s.storeMediaBlob(ctx, q, written)
+		if err != nil {
+			return err
+		}
+
+		item, err = q.ReplaceMediaContent(ctx, ReplaceMediaContentParams{
+			ID:            id,
+			Content:       blob.StoredPath,
+			Sha256:        pgtype.Text{String: blob.SHA256, Valid: true},
+			VariantStatus: initialVariantStatus(blob.StoredPath),
+			SizeBytes:     size,
+			CreatedBy:     optionalUUID(owner),
+		})
+		if err != nil {
+			s.discardMediaBlob(blob)
+			return databaseutil.WrapDBErrorWithKeyValue(err, "contents", "id", id.String(),
+				s.logger, "replace media content")
+		}
+		return nil
+	})
+	if err != nil {
+		s.releaseStorage(ctx, owner, reserved)
+		return Content{}, err
+	}
+
+	s.releaseStorage(ctx, owner, -reserved)
+	if previous.Content != item.Content {
+		s.releaseMediaBlob(ctx, previous.Content)
+	}
+	s.scheduleVariants(item)
+
+	return item, nil
+}
+
+// writeMediaUpload streams the upload into a temp file while hashing it.
+func (s *Service) writeMediaUpload(upload MediaUploadRequest) (writtenMedia, error) {
 	if upload.Content == nil {
-		return Content{}, errEmptyMediaContent
+		return writtenMedia{}, errEmptyMediaContent
 	}
 	dir := upload.Dir
 	if dir == "" {
@@ -103,68 +383,134 @@ func (s *Service) CreateMediaContent(ctx context.Context, upload MediaUploadRequ
 	}
 	// Ensure the storage directory exists before creating a temp file.
 	if err := os.MkdirAll(mediaRoot, 0o755); err != nil {
-		return Content{}, fmt.Errorf("create media directory: %w", err)
+		return writtenMedia{}, fmt.Errorf("create media directory: %w", err)
 	}
 
 	// Write to a temp file first to avoid exposing partial writes.
 	tmpFile, err := os.CreateTemp(mediaRoot, "upload-*"+ext)
 	if err != nil {
-		return Content{}, fmt.Errorf("create temp media file: %w", err)
+		return writtenMedia{}, fmt.Errorf("create temp media file: %w", err)
 	}
 
 	tmpPath := tmpFile.Name()
 
-	written, err := io.Copy(tmpFile, io.LimitReader(upload.Content, maxBytes+1))
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hasher), io.LimitReader(upload.Content, maxBytes+1))
 	if err != nil {
 		if cerr := tmpFile.Close(); cerr != nil {
 			s.logger.Warn("failed to close temp media file after write error", zap.String("path", tmpPath), zap.Error(cerr))
 		}
 		_ = os.Remove(tmpPath)
-		return Content{}, fmt.Errorf("write media file: %w", err)
+		return writtenMedia{}, fmt.Errorf("write media file: %w", err)
 	}
 	if written == 0 {
 		if cerr := tmpFile.Close(); cerr != nil {
 			s.logger.Warn("failed to close temp media file after empty upload", zap.String("path", tmpPath), zap.Error(cerr))
 		}
 		_ = os.Remove(tmpPath)
-		return Content{}, errEmptyMediaContent
+		return writtenMedia{}, errEmptyMediaContent
 	}
 	if written > maxBytes {
 		if cerr := tmpFile.Close(); cerr != nil {
 			s.logger.Warn("failed to close temp media file after oversized upload", zap.String("path", tmpPath), zap.Error(cerr))
 		}
 		_ = os.Remove(tmpPath)
-		return Content{}, fmt.Errorf("%w: maximum upload size is %d bytes", errMediaContentTooLarge, maxBytes)
+		return writtenMedia{}, fmt.Errorf("%w: maximum upload size is %d bytes", errMediaContentTooLarge, maxBytes)
 	}
 	if err := tmpFile.Sync(); err != nil {
 		if cerr := tmpFile.Close(); cerr != nil {
 			s.logger.Warn("failed to close temp media file after sync error", zap.String("path", tmpPath), zap.Error(cerr))
 		}
 		_ = os.Remove(tmpPath)
-		return Content{}, fmt.Errorf("sync media file: %w", err)
+		return writtenMedia{}, fmt.Errorf("sync media file: %w", err)
 	}
 	if err := tmpFile.Close(); err != nil {
 		_ = os.Remove(tmpPath)
-		return Content{}, fmt.Errorf("close media file: %w", err)
+		return writtenMedia{}, fmt.Errorf("close media file: %w", err)
 	}
 
-	// Atomically move the temp file into its final name.
-	finalName := uuid.NewString() + ext
-	finalPath := filepath.Join(mediaRoot, finalName)
-	if err := os.Rename(tmpPath, finalPath); err != nil {
-		_ = os.Remove(tmpPath)
-		return Content{}, fmt.Errorf("persist media file: %w", err)
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	return writtenMedia{
+		TmpPath:   tmpPath,
+		FinalPath: filepath.Join(mediaRoot, digest+ext),
+		SHA256:    digest,
+		Size:      written,
+	}, nil
+}
+
+// storeMediaBlob either reuses an existing blob with the same SHA-256 digest or moves
+// the temp file into its content-addressed final name. It holds the blob's lock for
+// the rest of the transaction, so the blob cannot be removed before the row that
+// points at it is committed.
+func (s *Service) storeMediaBlob(ctx context.Context, q Querier, written writtenMedia) (mediaBlob, error) {
+	if err := q.LockMediaBlob(ctx, written.SHA256); err != nil {
+		return mediaBlob{}, databaseutil.WrapDBError(err, s.logger, "lock media blob")
 	}
 
-	storedPath := toStoredPath(finalPath)
-	// Persist only the stored path in DB; rollback file if DB insert fails.
-	item, err := s.querier.CreateMediaContent(ctx, storedPath)
-	if err != nil {
-		_ = os.Remove(finalPath)
-		return Content{}, databaseutil.WrapDBError(err, s.logger, "create media content")
+	storedPath := toStoredPath(written.FinalPath)
+	shared := false
+
+	// Reuse the blob of an existing row with the same digest when it is still on disk.
+	existing, err := q.GetMediaContentBySHA256(ctx, pgtype.Text{String: written.SHA256, Valid: true})
+	switch {
+	case err == nil:
+		if _, statErr := os.Stat(existing.Content); statErr == nil {
+			return mediaBlob{StoredPath: existing.Content, SHA256: written.SHA256, Size: written.Size, Reused: true}, nil
+		}
+		s.logger.Warn("existing media blob is missing, storing upload again",
+			zap.String("path", existing.Content), zap.String("sha256", written.SHA256))
+		// Other rows may point at the name the upload is about to restore.
+		count, err := q.CountMediaContentsByPath(ctx, storedPath)
+		if err != nil {
+			return mediaBlob{}, databaseutil.WrapDBError(err, s.logger, "count media contents by path")
+		}
+		shared = count > 0
+	case errors.Is(err, pgx.ErrNoRows):
+	default:
+		return mediaBlob{}, databaseutil.WrapDBError(err, s.logger, "get media content by sha256")
 	}
 
-	return item, nil
+	// Atomically move the temp file into its content-addressed name.
+	if err := os.Rename(written.TmpPath, written.FinalPath); err != nil {
+		return mediaBlob{}, fmt.Errorf("persist media file: %w", err)
+	}
+
+	return mediaBlob{StoredPath: storedPath, SHA256: written.SHA256, Size: written.Size, Reused: shared}, nil
+}
+
+// discardMediaBlob removes a blob written by storeMediaBlob when its row could not be
+// persisted. It runs while the blob's lock is held; blobs that another row
+// references are left on disk.
+func (s *Service) discardMediaBlob(blob mediaBlob) {
+	if blob.Reused {
+		return
+	}
+	if err := os.Remove(blob.StoredPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Warn("failed to remove media file after failed insert", zap.String("path", blob.StoredPath), zap.Error(err))
+	}
+}
+
+// releaseMediaBlob removes a blob and its variants once no row references it anymore.
+// The check and the removal hold the blob's lock, so an upload reusing the blob either
+// commits its row first and keeps the blob, or stores the blob again afterwards.
+func (s *Service) releaseMediaBlob(ctx context.Context, path string) {
+	err := s.withinTx(ctx, func(q Querier) error {
+		if err := q.LockMediaBlob(ctx, mediaBlobKey(path)); err != nil {
+			return err
+		}
+		count, err := q.CountMediaContentsByPath(ctx, path)
+		if err != nil || count > 0 {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("failed to remove released media file", zap.String("path", path), zap.Error(err))
+		}
+		removeMediaVariants(path, s.logger)
+		return nil
+	})
+	if err != nil {
+		s.logger.Warn("failed to check media references before removing media file", zap.String("path", path), zap.Error(err))
+	}
 }
 
 func (s *Service) GetTextContent(ctx context.Context, id uuid.UUID) (Content, error) {
@@ -185,6 +531,24 @@ func (s *Service) GetMediaContent(ctx context.Context, id uuid.UUID) (Content, e
 	return item, nil
 }
 
+// OpenMediaContent opens a media blob for reading, preferring the variant of the
+// given width when it is ready. The caller closes the file.
+func (s *Service) OpenMediaContent(ctx context.Context, id uuid.UUID, width int) (Content, *os.File, error) {
+	item, err := s.GetMediaContent(ctx, id)
+	if err != nil {
+		return Content{}, nil, err
+	}
+	path, err := resolveMediaPath(item, width)
+	if err != nil {
+		return Content{}, nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Content{}, nil, fmt.Errorf("open media file: %w", err)
+	}
+	return item, f, nil
+}
+
 func (s *Service) GetContent(ctx context.Context, id uuid.UUID) (Content, error) {
 	item, err := s.querier.GetContent(ctx, id)
 	if err != nil {
@@ -206,21 +570,70 @@ func (s *Service) BatchGetTextContents(ctx context.Context, ids []uuid.UUID) ([]
 	return items, nil
 }
 
-func (s *Service) ListTextContents(ctx context.Context, page, pageSize int32) (TextPage, error) {
-	page, pageSize = normalizePagination(page, pageSize)
+func (s *Service) ListTextContents(ctx context.Context, filter ContentListFilter) (ContentPage, error) {
+	return s.listContentPage(ctx, filter, "text",
+		func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID) (int64, error) {
+			return s.querier.CountTextContents(ctx, CountTextContentsParams{Tag: tag, CreatedBy: owner})
+		},
+		func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID, limit, offset int32) ([]Content, error) {
+			return s.querier.ListTextContents(ctx, ListTextContentsParams{Tag: tag, CreatedBy: owner, Limit: limit, Offset: offset})
+		})
+}
+
+func (s *Service) ListMediaContents(ctx context.Context, filter ContentListFilter) (ContentPage, error) {
+	return s.listContentPage(ctx, filter, "media",
+		func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID) (int64, error) {
+			return s.querier.CountMediaContents(ctx, CountMediaContentsParams{Tag: tag, CreatedBy: owner})
+		},
+		func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID, limit, offset int32) ([]Content, error) {
+			return s.querier.ListMediaContents(ctx, ListMediaContentsParams{Tag: tag, CreatedBy: owner, Limit: limit, Offset: offset})
+		})
+}
+
+func (s *Service) ListTextContentsByCursor(ctx context.Context, filter CursorListFilter) (CursorPage, error) {
+	return s.listContentCursorPage(ctx, filter, "text",
+		func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID, after pgtype.Timestamptz, afterID pgtype.UUID, limit int32) ([]Content, error) {
+			return s.querier.ListTextContentsByCursor(ctx, ListTextContentsByCursorParams{
+				Tag:            tag,
+				CreatedBy:      owner,
+				AfterCreatedAt: after,
+				AfterID:        afterID,
+				Limit:          limit,
+			})
+		})
+}
+
+func (s *Service) ListMediaContentsByCursor(ctx context.Context, filter CursorListFilter) (CursorPage, error) {
+	return s.listContentCursorPage(ctx, filter, "media",
+		func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID, after pgtype.Timestamptz, afterID pgtype.UUID, limit int32) ([]Content, error) {
+			return s.querier.ListMediaContentsByCursor(ctx, ListMediaContentsByCursorParams{
+				Tag:            tag,
+				CreatedBy:      owner,
+				AfterCreatedAt: after,
+				AfterID:        afterID,
+				Limit:          limit,
+			})
+		})
+}
+
+// listContentPage implements offset pagination, kept for clients that still send page numbers.
+func (s *Service) listContentPage(ctx context.Context, filter ContentListFilter, kind string,
+	count func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID) (int64, error),
+	list func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID, limit, offset int32) ([]Content, error),
+) (ContentPage, error) {
+	page, pageSize := normalizePagination(filter.Page, filter.PageSize)
+	tag := optionalText(normalizeTag(filter.Tag))
+	owner := optionalUUID(filter.Owner)
 
-	totalItems, err := s.querier.CountTextContents(ctx)
+	totalItems, err := count(ctx, tag, owner)
 	if err != nil {
-		return TextPage{}, databaseutil.WrapDBError(err, s.logger, "count text contents")
+		return ContentPage{}, databaseutil.WrapDBError(err, s.logger, "count "+kind+" contents")
 	}
 
 	offset := (page - 1) * pageSize
-	items, err := s.querier.ListTextContents(ctx, ListTextContentsParams{
-		Limit:  pageSize,
-		Offset: offset,
-	})
+	items, err := list(ctx, tag, owner, pageSize, offset)
 	if err != nil {
-		return TextPage{}, databaseutil.WrapDBError(err, s.logger, "list text contents")
+		return ContentPage{}, databaseutil.WrapDBError(err, s.logger, "list "+kind+" contents")
 	}
 
 	totalPages := int32(0)
@@ -228,7 +641,7 @@ func (s *Service) ListTextContents(ctx context.Context, page, pageSize int32) (T
 		totalPages = int32(math.Ceil(float64(totalItems) / float64(pageSize)))
 	}
 
-	return TextPage{
+	return ContentPage{
 		Items:       items,
 		TotalPages:  totalPages,
 		TotalItems:  int32(totalItems),
@@ -238,9 +651,86 @@ func (s *Service) ListTextContents(ctx context.Context, page, pageSize int32) (T
 	}, nil
 }
 
+// listContentCursorPage implements keyset pagination over (created_at, id). One extra
+// row is fetched to tell whether another page follows, so no COUNT(*) is needed.
+func (s *Service) listContentCursorPage(ctx context.Context, filter CursorListFilter, kind string,
+	list func(ctx context.Context, tag pgtype.Text, owner pgtype.UUID, after pgtype.Timestamptz, afterID pgtype.UUID, limit int32) ([]Content, error),
+) (CursorPage, error) {
+	_, pageSize := normalizePagination(defaultPage, filter.PageSize)
+	cursor, ok, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return CursorPage{}, err
+	}
+
+	var after pgtype.Timestamptz
+	var afterID pgtype.UUID
+	if ok {
+		after = pgtype.Timestamptz{Time: cursor.CreatedAt, Valid: true}
+		afterID = pgtype.UUID{Bytes: cursor.ID, Valid: true}
+	}
+
+	items, err := list(ctx, optionalText(normalizeTag(filter.Tag)), optionalUUID(filter.Owner), after, afterID, pageSize+1)
+	if err != nil {
+		return CursorPage{}, databaseutil.WrapDBError(err, s.logger, "list "+kind+" contents by cursor")
+	}
+
+	page := CursorPage{Items: items, PageSize: pageSize}
+	if len(items) > int(pageSize) {
+		page.Items = items[:pageSize]
+		page.HasNextPage = true
+		page.NextCursor = encodeCursor(page.Items[len(page.Items)-1])
+	}
+	return page, nil
+}
+
+// DeleteContent deletes a content row. The blob of a media content is removed with it
+// unless another row shares it.
 func (s *Service) DeleteContent(ctx context.Context, id uuid.UUID) error {
-	return databaseutil.WrapDBErrorWithKeyValue(s.querier.DeleteContent(ctx, id), "contents", "id", id.String(),
-		s.logger, "delete content")
+	item, err := s.querier.DeleteContent(ctx, id)
+	if err != nil {
+		return databaseutil.WrapDBErrorWithKeyValue(err, "contents", "id", id.String(), s.logger, "delete content")
+	}
+	s.renderCache.remove(id)
+	if item.CreatedBy.Valid {
+		s.releaseStorage(ctx, item.CreatedBy.Bytes, item.SizeBytes)
+	}
+	if enumToString(item.Type) == "MEDIA" {
+		s.releaseMediaBlob(ctx, item.Content)
+	}
+	return nil
+}
+
+// RenderTextHTML returns the sanitized HTML for a text content, rendering it at most
+// once per revision.
+func (s *Service) RenderTextHTML(item Content) string {
+	if html, ok := s.renderCache.get(item.ID, item.Revision); ok {
+		return html
+	}
+	html := renderHTML(item.Format, item.Content)
+	s.renderCache.put(item.ID, item.Revision, html)
+	return html
+}
+
+func (s *Service) withinTx(ctx context.Context, fn func(Querier) error) error {
+	if s.transactor == nil {
+		return errMediaTransactionUnsupported
+	}
+	return s.transactor.WithinTx(ctx, fn)
+}
+
+func transactorFromQuerier(querier Querier) MediaTransactor {
+	transactor, ok := querier.(MediaTransactor)
+	if !ok {
+		return nil
+	}
+	return transactor
+}
+
+// mediaBlobKey names the lock of a blob: its digest, which content-addressed blob
+// names start with.
+func mediaBlobKey(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
 }
 
 func normalizePagination(page, pageSize int32) (int32, int32) {
@@ -256,6 +746,53 @@ func normalizePagination(page, pageSize int32) (int32, int32) {
 	return page, pageSize
 }
 
+// normalizeTags lowercases and trims tags, dropping blanks and duplicates while keeping order.
+func normalizeTags(tags []string) []string {
+	result := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" {
+			continue
+		}
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		result = append(result, tag)
+	}
+	return result
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func optionalText(value string) pgtype.Text {
+	value = strings.TrimSpace(value)
+	return pgtype.Text{String: value, Valid: value != ""}
+}
+
+func textFormatOrDefault(format string) string {
+	if format == "" {
+		return formatPlain
+	}
+	return format
+}
+
+// patchText maps an optional patch field to a nullable query argument. A set field is
+// always valid so that an empty string reaches the query and clears the column.
+func patchText(value *string) pgtype.Text {
+	if value == nil {
+		return pgtype.Text{}
+	}
+	return pgtype.Text{String: strings.TrimSpace(*value), Valid: true}
+}
+
+func optionalUUID(id uuid.UUID) pgtype.UUID {
+	return pgtype.UUID{Bytes: id, Valid: id != uuid.Nil}
+}
+
 func sanitizeExt(ext string) string {
 	ext = strings.TrimSpace(strings.ToLower(ext))
 	if ext == "" {
@@ -270,6 +807,13 @@ func sanitizeExt(ext string) string {
 	return ext
 }
 
+func initialVariantStatus(blobPath string) pgtype.Text {
+	if !isVariantSourceExt(filepath.Ext(blobPath)) {
+		return pgtype.Text{}
+	}
+	return pgtype.Text{String: variantStatusPending, Valid: true}
+}
+
 func toStoredPath(path string) string {
 	slashPath := filepath.ToSlash(path)
 	if filepath.IsAbs(path) {
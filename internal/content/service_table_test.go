@@ -4,40 +4,112 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"image"
+	"image/png"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
+	"sciedu-backend/internal/auth"
+
+	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"go.uber.org/zap"
 )
 
+// helloWorldSHA256 is the hex SHA-256 digest of "hello world".
+const helloWorldSHA256 = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
 type fakeMediaQuerier struct {
-	createMediaContentFn   func(ctx context.Context, content string) (Content, error)
-	createMediaContentArgs []string
-	createTextContentFn    func(ctx context.Context, content string) (Content, error)
-	createTextContentArgs  []string
-	getMediaContentFn      func(ctx context.Context, id uuid.UUID) (Content, error)
-	getTextContentFn       func(ctx context.Context, id uuid.UUID) (Content, error)
-	getContentFn           func(ctx context.Context, id uuid.UUID) (Content, error)
-	listTextContentsFn     func(ctx context.Context, arg ListTextContentsParams) ([]Content, error)
-	countTextContentsFn    func(ctx context.Context) (int64, error)
-	batchGetTextContentsFn func(ctx context.Context, ids []uuid.UUID) ([]Content, error)
-	deleteContentFn        func(ctx context.Context, id uuid.UUID) error
-}
-
-func (f *fakeMediaQuerier) CreateMediaContent(ctx context.Context, content string) (Content, error) {
-	f.createMediaContentArgs = append(f.createMediaContentArgs, content)
+	createMediaContentFn       func(ctx context.Context, arg CreateMediaContentParams) (Content, error)
+	createMediaContentArgs     []CreateMediaContentParams
+	createTextContentFn        func(ctx context.Context, arg CreateTextContentParams) (Content, error)
+	createTextContentArgs      []CreateTextContentParams
+	getMediaContentFn          func(ctx context.Context, id uuid.UUID) (Content, error)
+	getMediaForUpdateFn        func(ctx context.Context, id uuid.UUID) (Content, error)
+	getMediaContentBySHA256Fn  func(ctx context.Context, sha256 pgtype.Text) (Content, error)
+	countMediaContentsByPathFn func(ctx context.Context, content string) (int64, error)
+	getTextContentFn           func(ctx context.Context, id uuid.UUID) (Content, error)
+	getContentFn               func(ctx context.Context, id uuid.UUID) (Content, error)
+	listTextContentsFn         func(ctx context.Context, arg ListTextContentsParams) ([]Content, error)
+	countTextContentsFn        func(ctx context.Context, arg CountTextContentsParams) (int64, error)
+	batchGetTextContentsFn     func(ctx context.Context, ids []uuid.UUID) ([]Content, error)
+	listTextByCursorFn         func(ctx context.Context, arg ListTextContentsByCursorParams) ([]Content, error)
+	listMediaContentsFn        func(ctx context.Context, arg ListMediaContentsParams) ([]Content, error)
+	countMediaContentsFn       func(ctx context.Context, arg CountMediaContentsParams) (int64, error)
+	listMediaByCursorFn        func(ctx context.Context, arg ListMediaContentsByCursorParams) ([]Content, error)
+	listMediaPathsFn           func(ctx context.Context) ([]ListMediaPathsRow, error)
+	deleteMissingMediaFn       func(ctx context.Context, arg DeleteMissingMediaContentParams) (DeleteMissingMediaContentRow, error)
+	deleteMissingMediaArgs     []DeleteMissingMediaContentParams
+	updateMediaVariantsArgs    []UpdateMediaVariantsParams
+	listUnfinishedVariantsFn   func(ctx context.Context) ([]Content, error)
+	updateTextContentFn        func(ctx context.Context, arg UpdateTextContentParams) (Content, error)
+	updateTextContentArgs      []UpdateTextContentParams
+	replaceMediaContentFn      func(ctx context.Context, arg ReplaceMediaContentParams) (Content, error)
+	replaceMediaContentArgs    []ReplaceMediaContentParams
+	deleteContentFn            func(ctx context.Context, id uuid.UUID) (Content, error)
+	reserveUserStorageFn       func(ctx context.Context, arg ReserveUserStorageParams) (int64, error)
+	reserveUserStorageArgs     []ReserveUserStorageParams
+	releaseUserStorageArgs     []ReleaseUserStorageParams
+	getUserStorageFn           func(ctx context.Context, userID uuid.UUID) (UserStorage, error)
+	searchTextContentsFn       func(ctx context.Context, arg SearchTextContentsParams) ([]SearchTextContentsRow, error)
+	searchTextContentsArgs     []SearchTextContentsParams
+	retrieveTextContentsFn     func(ctx context.Context, arg RetrieveTextContentsParams) ([]RetrieveTextContentsRow, error)
+	retrieveTextContentsArgs   []RetrieveTextContentsParams
+	lockMediaBlobArgs          []string
+	transactions               int
+}
+
+func (f *fakeMediaQuerier) WithinTx(_ context.Context, fn func(Querier) error) error {
+	f.transactions++
+	return fn(f)
+}
+
+func (f *fakeMediaQuerier) GetMediaContentForUpdate(ctx context.Context, id uuid.UUID) (Content, error) {
+	if f.getMediaForUpdateFn != nil {
+		return f.getMediaForUpdateFn(ctx, id)
+	}
+	return Content{}, pgx.ErrNoRows
+}
+
+func (f *fakeMediaQuerier) LockMediaBlob(_ context.Context, key string) error {
+	f.lockMediaBlobArgs = append(f.lockMediaBlobArgs, key)
+	return nil
+}
+
+func (f *fakeMediaQuerier) CreateMediaContent(ctx context.Context, arg CreateMediaContentParams) (Content, error) {
+	f.createMediaContentArgs = append(f.createMediaContentArgs, arg)
 	if f.createMediaContentFn != nil {
-		return f.createMediaContentFn(ctx, content)
+		return f.createMediaContentFn(ctx, arg)
 	}
 	return Content{}, nil
 }
 
-func (f *fakeMediaQuerier) CreateTextContent(ctx context.Context, content string) (Content, error) {
-	f.createTextContentArgs = append(f.createTextContentArgs, content)
+func (f *fakeMediaQuerier) GetMediaContentBySHA256(ctx context.Context, sha256 pgtype.Text) (Content, error) {
+	if f.getMediaContentBySHA256Fn != nil {
+		return f.getMediaContentBySHA256Fn(ctx, sha256)
+	}
+	return Content{}, pgx.ErrNoRows
+}
+
+func (f *fakeMediaQuerier) CountMediaContentsByPath(ctx context.Context, content string) (int64, error) {
+	if f.countMediaContentsByPathFn != nil {
+		return f.countMediaContentsByPathFn(ctx, content)
+	}
+	return 0, nil
+}
+
+func (f *fakeMediaQuerier) CreateTextContent(ctx context.Context, arg CreateTextContentParams) (Content, error) {
+	f.createTextContentArgs = append(f.createTextContentArgs, arg)
 	if f.createTextContentFn != nil {
-		return f.createTextContentFn(ctx, content)
+		return f.createTextContentFn(ctx, arg)
 	}
 	return Content{}, nil
 }
@@ -70,13 +142,56 @@ func (f *fakeMediaQuerier) ListTextContents(ctx context.Context, arg ListTextCon
 	return nil, nil
 }
 
-func (f *fakeMediaQuerier) CountTextContents(ctx context.Context) (int64, error) {
+func (f *fakeMediaQuerier) CountTextContents(ctx context.Context, arg CountTextContentsParams) (int64, error) {
 	if f.countTextContentsFn != nil {
-		return f.countTextContentsFn(ctx)
+		return f.countTextContentsFn(ctx, arg)
+	}
+	return 0, nil
+}
+
+func (f *fakeMediaQuerier) ListTextContentsByCursor(ctx context.Context, arg ListTextContentsByCursorParams) ([]Content, error) {
+	if f.listTextByCursorFn != nil {
+		return f.listTextByCursorFn(ctx, arg)
+	}
+	return nil, nil
+}
+
+func (f *fakeMediaQuerier) ListMediaContents(ctx context.Context, arg ListMediaContentsParams) ([]Content, error) {
+	if f.listMediaContentsFn != nil {
+		return f.listMediaContentsFn(ctx, arg)
+	}
+	return nil, nil
+}
+
+func (f *fakeMediaQuerier) CountMediaContents(ctx context.Context, arg CountMediaContentsParams) (int64, error) {
+	if f.countMediaContentsFn != nil {
+		return f.countMediaContentsFn(ctx, arg)
 	}
 	return 0, nil
 }
 
+func (f *fakeMediaQuerier) ListMediaContentsByCursor(ctx context.Context, arg ListMediaContentsByCursorParams) ([]Content, error) {
+	if f.listMediaByCursorFn != nil {
+		return f.listMediaByCursorFn(ctx, arg)
+	}
+	return nil, nil
+}
+
+func (f *fakeMediaQuerier) ListMediaPaths(ctx context.Context) ([]ListMediaPathsRow, error) {
+	if f.listMediaPathsFn != nil {
+		return f.listMediaPathsFn(ctx)
+	}
+	return nil, nil
+}
+
+func (f *fakeMediaQuerier) DeleteMissingMediaContent(ctx context.Context, arg DeleteMissingMediaContentParams) (DeleteMissingMediaContentRow, error) {
+	f.deleteMissingMediaArgs = append(f.deleteMissingMediaArgs, arg)
+	if f.deleteMissingMediaFn != nil {
+		return f.deleteMissingMediaFn(ctx, arg)
+	}
+	return DeleteMissingMediaContentRow{}, nil
+}
+
 func (f *fakeMediaQuerier) BatchGetTextContents(ctx context.Context, ids []uuid.UUID) ([]Content, error) {
 	if f.batchGetTextContentsFn != nil {
 		return f.batchGetTextContentsFn(ctx, ids)
@@ -84,14 +199,87 @@ func (f *fakeMediaQuerier) BatchGetTextContents(ctx context.Context, ids []uuid.
 	return nil, nil
 }
 
-func (f *fakeMediaQuerier) DeleteContent(ctx context.Context, id uuid.UUID) error {
+func (f *fakeMediaQuerier) UpdateMediaVariants(_ context.Context, arg UpdateMediaVariantsParams) error {
+	f.updateMediaVariantsArgs = append(f.updateMediaVariantsArgs, arg)
+	return nil
+}
+
+func (f *fakeMediaQuerier) ListUnfinishedMediaVariants(ctx context.Context) ([]Content, error) {
+	if f.listUnfinishedVariantsFn != nil {
+		return f.listUnfinishedVariantsFn(ctx)
+	}
+	return nil, nil
+}
+
+func (f *fakeMediaQuerier) UpdateTextContent(ctx context.Context, arg UpdateTextContentParams) (Content, error) {
+	f.updateTextContentArgs = append(f.updateTextContentArgs, arg)
+	if f.updateTextContentFn != nil {
+		return f.updateTextContentFn(ctx, arg)
+	}
+	return Content{}, nil
+}
+
+func (f *fakeMediaQuerier) ReplaceMediaContent(ctx context.Context, arg ReplaceMediaContentParams) (Content, error) {
+	f.replaceMediaContentArgs = append(f.replaceMediaContentArgs, arg)
+	if f.replaceMediaContentFn != nil {
+		return f.replaceMediaContentFn(ctx, arg)
+	}
+	return Content{}, nil
+}
+
+func (f *fakeMediaQuerier) DeleteContent(ctx context.Context, id uuid.UUID) (Content, error) {
 	if f.deleteContentFn != nil {
 		return f.deleteContentFn(ctx, id)
 	}
+	return Content{ID: id}, nil
+}
+
+func (f *fakeMediaQuerier) EnsureUserStorage(context.Context, uuid.UUID) error {
+	return nil
+}
+
+func (f *fakeMediaQuerier) ReserveUserStorage(ctx context.Context, arg ReserveUserStorageParams) (int64, error) {
+	f.reserveUserStorageArgs = append(f.reserveUserStorageArgs, arg)
+	if f.reserveUserStorageFn != nil {
+		return f.reserveUserStorageFn(ctx, arg)
+	}
+	return arg.Bytes, nil
+}
+
+func (f *fakeMediaQuerier) ReleaseUserStorage(_ context.Context, arg ReleaseUserStorageParams) error {
+	f.releaseUserStorageArgs = append(f.releaseUserStorageArgs, arg)
 	return nil
 }
 
+func (f *fakeMediaQuerier) GetUserStorage(ctx context.Context, userID uuid.UUID) (UserStorage, error) {
+	if f.getUserStorageFn != nil {
+		return f.getUserStorageFn(ctx, userID)
+	}
+	return UserStorage{}, pgx.ErrNoRows
+}
+
+func (f *fakeMediaQuerier) SearchTextContents(ctx context.Context, arg SearchTextContentsParams) ([]SearchTextContentsRow, error) {
+	f.searchTextContentsArgs = append(f.searchTextContentsArgs, arg)
+	if f.searchTextContentsFn != nil {
+		return f.searchTextContentsFn(ctx, arg)
+	}
+	return nil, nil
+}
+
+func (f *fakeMediaQuerier) RetrieveTextContents(ctx context.Context, arg RetrieveTextContentsParams) ([]RetrieveTextContentsRow, error) {
+	f.retrieveTextContentsArgs = append(f.retrieveTextContentsArgs, arg)
+	if f.retrieveTextContentsFn != nil {
+		return f.retrieveTextContentsFn(ctx, arg)
+	}
+	return nil, nil
+}
+
 func TestCreateMediaContent(t *testing.T) {
+	existingBlob := filepath.Join(t.TempDir(), "existing.png")
+	if err := os.WriteFile(existingBlob, []byte("hello world"), 0o644); err != nil {
+		t.Fatalf("write existing blob: %v", err)
+	}
+
 	tests := []struct {
 		name       string
 		raw        []byte
@@ -107,8 +295,8 @@ func TestCreateMediaContent(t *testing.T) {
 			raw:  []byte("hello world"),
 			file: "photo.png",
 			setup: func(q *fakeMediaQuerier) {
-				q.createMediaContentFn = func(_ context.Context, storedPath string) (Content, error) {
-					return Content{ID: uuid.New(), Type: "MEDIA", Content: storedPath}, nil
+				q.createMediaContentFn = func(_ context.Context, arg CreateMediaContentParams) (Content, error) {
+					return Content{ID: uuid.New(), Type: "MEDIA", Content: arg.Content, Sha256: arg.Sha256}, nil
 				}
 			},
 			assert: func(t *testing.T, _ string, q *fakeMediaQuerier, got Content) {
@@ -116,10 +304,19 @@ func TestCreateMediaContent(t *testing.T) {
 				if len(q.createMediaContentArgs) != 1 {
 					t.Fatalf("expected exactly one db call, got %d", len(q.createMediaContentArgs))
 				}
-				storedPath := q.createMediaContentArgs[0]
+				storedPath := q.createMediaContentArgs[0].Content
+				if q.createMediaContentArgs[0].Sha256.String != helloWorldSHA256 {
+					t.Fatalf("expected sha256 %s, got %s", helloWorldSHA256, q.createMediaContentArgs[0].Sha256.String)
+				}
+				if filepath.Base(storedPath) != helloWorldSHA256+".png" {
+					t.Fatalf("expected content-addressed filename, got %s", filepath.Base(storedPath))
+				}
 				if filepath.Ext(storedPath) != ".png" {
 					t.Fatalf("expected .png extension, got %s", filepath.Ext(storedPath))
 				}
+				if !slices.Equal(q.lockMediaBlobArgs, []string{helloWorldSHA256}) {
+					t.Fatalf("expected the blob lock on its digest, got %v", q.lockMediaBlobArgs)
+				}
 				fileContent, err := os.ReadFile(storedPath)
 				if err != nil {
 					t.Fatalf("read stored file: %v", err)
@@ -138,7 +335,7 @@ func TestCreateMediaContent(t *testing.T) {
 			file:       "x.txt",
 			wantAnyErr: true,
 			setup: func(q *fakeMediaQuerier) {
-				q.createMediaContentFn = func(_ context.Context, _ string) (Content, error) {
+				q.createMediaContentFn = func(_ context.Context, _ CreateMediaContentParams) (Content, error) {
 					return Content{}, errors.New("db boom")
 				}
 			},
@@ -153,6 +350,55 @@ func TestCreateMediaContent(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "duplicate upload reuses existing blob",
+			raw:  []byte("hello world"),
+			file: "copy.png",
+			setup: func(q *fakeMediaQuerier) {
+				q.getMediaContentBySHA256Fn = func(_ context.Context, sha256 pgtype.Text) (Content, error) {
+					return Content{ID: uuid.New(), Type: "MEDIA", Content: existingBlob, Sha256: sha256}, nil
+				}
+				q.createMediaContentFn = func(_ context.Context, arg CreateMediaContentParams) (Content, error) {
+					return Content{ID: uuid.New(), Type: "MEDIA", Content: arg.Content, Sha256: arg.Sha256}, nil
+				}
+			},
+			assert: func(t *testing.T, root string, q *fakeMediaQuerier, got Content) {
+				t.Helper()
+				if len(q.createMediaContentArgs) != 1 {
+					t.Fatalf("expected exactly one db call, got %d", len(q.createMediaContentArgs))
+				}
+				if got.Content != existingBlob {
+					t.Fatalf("expected existing blob to be reused, got %q", got.Content)
+				}
+				entries, err := os.ReadDir(root)
+				if err != nil {
+					t.Fatalf("read media root: %v", err)
+				}
+				if len(entries) != 0 {
+					t.Fatalf("expected temp file removed after reuse, found %d files", len(entries))
+				}
+			},
+		},
+		{
+			name:       "db error keeps reused blob",
+			raw:        []byte("hello world"),
+			file:       "copy.png",
+			wantAnyErr: true,
+			setup: func(q *fakeMediaQuerier) {
+				q.getMediaContentBySHA256Fn = func(_ context.Context, sha256 pgtype.Text) (Content, error) {
+					return Content{ID: uuid.New(), Type: "MEDIA", Content: existingBlob, Sha256: sha256}, nil
+				}
+				q.createMediaContentFn = func(_ context.Context, _ CreateMediaContentParams) (Content, error) {
+					return Content{}, errors.New("db boom")
+				}
+			},
+			assert: func(t *testing.T, _ string, _ *fakeMediaQuerier, _ Content) {
+				t.Helper()
+				if _, err := os.Stat(existingBlob); err != nil {
+					t.Fatalf("expected reused blob kept, stat err=%v", err)
+				}
+			},
+		},
 		{
 			name:    "empty payload",
 			raw:     nil,
@@ -191,10 +437,11 @@ func TestCreateMediaContent(t *testing.T) {
 			svc := NewService(q, zap.NewNop())
 
 			got, err := svc.CreateMediaContent(context.Background(), MediaUploadRequest{
-				Content:  bytes.NewReader(tt.raw),
-				Filename: tt.file,
-				Dir:      root,
-				MaxBytes: tt.maxBytes,
+				Content:         bytes.NewReader(tt.raw),
+				Filename:        tt.file,
+				Dir:             root,
+				MaxBytes:        tt.maxBytes,
+				ContentMetadata: ContentMetadata{CreatedBy: uuid.New()},
 			})
 			if tt.wantErr != nil {
 				if !errors.Is(err, tt.wantErr) {
@@ -215,28 +462,291 @@ func TestCreateMediaContent(t *testing.T) {
 	}
 }
 
+func TestCreateMediaContentVariants(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		raw        func(t *testing.T) []byte
+		queueFull  bool
+		wantStatus []string
+		wantWidths []int32
+	}{
+		{
+			name: "png gets narrower standard widths",
+			file: "diagram.png",
+			raw: func(t *testing.T) []byte {
+				t.Helper()
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+					t.Fatalf("encode png: %v", err)
+				}
+				return buf.Bytes()
+			},
+			wantStatus: []string{variantStatusProcessing, variantStatusReady},
+			wantWidths: []int32{160, 320},
+		},
+		{
+			name: "corrupt image marks failed",
+			file: "broken.jpg",
+			raw: func(*testing.T) []byte {
+				return []byte("not really a jpeg")
+			},
+			wantStatus: []string{variantStatusProcessing, variantStatusFailed},
+		},
+		{
+			name: "full queue marks failed",
+			file: "diagram.png",
+			raw: func(t *testing.T) []byte {
+				t.Helper()
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+					t.Fatalf("encode png: %v", err)
+				}
+				return buf.Bytes()
+			},
+			queueFull:  true,
+			wantStatus: []string{variantStatusFailed},
+		},
+		{
+			name: "non image skips variants",
+			file: "notes.pdf",
+			raw: func(*testing.T) []byte {
+				return []byte("%PDF-1.4")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			q := &fakeMediaQuerier{
+				createMediaContentFn: func(_ context.Context, arg CreateMediaContentParams) (Content, error) {
+					return Content{ID: uuid.New(), Type: "MEDIA", Content: arg.Content, VariantStatus: arg.VariantStatus}, nil
+				},
+			}
+			svc := NewService(q, zap.NewNop())
+			svc.runAsync = func(fn func()) bool {
+				if tt.queueFull {
+					return false
+				}
+				fn()
+				return true
+			}
+
+			got, err := svc.CreateMediaContent(context.Background(), MediaUploadRequest{
+				Content:         bytes.NewReader(tt.raw(t)),
+				Filename:        tt.file,
+				Dir:             root,
+				ContentMetadata: ContentMetadata{CreatedBy: uuid.New()},
+			})
+			if err != nil {
+				t.Fatalf("CreateMediaContent error: %v", err)
+			}
+
+			if len(q.updateMediaVariantsArgs) != len(tt.wantStatus) {
+				t.Fatalf("expected %d variant updates, got %d", len(tt.wantStatus), len(q.updateMediaVariantsArgs))
+			}
+			for i, want := range tt.wantStatus {
+				if q.updateMediaVariantsArgs[i].VariantStatus.String != want {
+					t.Fatalf("update %d: expected status %q, got %q", i, want, q.updateMediaVariantsArgs[i].VariantStatus.String)
+				}
+				if q.updateMediaVariantsArgs[i].BlobPath != got.Content {
+					t.Fatalf("update %d: expected blob %q, got %q", i, got.Content, q.updateMediaVariantsArgs[i].BlobPath)
+				}
+			}
+			if len(tt.wantStatus) == 0 {
+				return
+			}
+			last := q.updateMediaVariantsArgs[len(q.updateMediaVariantsArgs)-1]
+			if !slices.Equal(last.VariantWidths, tt.wantWidths) {
+				t.Fatalf("expected widths %v, got %v", tt.wantWidths, last.VariantWidths)
+			}
+			for _, width := range tt.wantWidths {
+				f, err := os.Open(variantPath(got.Content, int(width)))
+				if err != nil {
+					t.Fatalf("open variant %d: %v", width, err)
+				}
+				cfg, _, err := image.DecodeConfig(f)
+				_ = f.Close()
+				if err != nil {
+					t.Fatalf("decode variant %d: %v", width, err)
+				}
+				if cfg.Width != int(width) || cfg.Height != int(width)/2 {
+					t.Fatalf("variant %d has size %dx%d", width, cfg.Width, cfg.Height)
+				}
+			}
+		})
+	}
+}
+
+func TestResumeVariants(t *testing.T) {
+	tests := []struct {
+		name       string
+		queueFull  bool
+		wantStatus []string
+	}{
+		{
+			name:       "interrupted uploads are generated again",
+			wantStatus: []string{variantStatusProcessing, variantStatusReady, variantStatusProcessing, variantStatusReady},
+		},
+		{
+			name:       "full queue marks failed",
+			queueFull:  true,
+			wantStatus: []string{variantStatusFailed, variantStatusFailed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			var items []Content
+			for _, status := range []string{variantStatusPending, variantStatusProcessing} {
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+					t.Fatalf("encode png: %v", err)
+				}
+				blob := filepath.Join(root, status+".png")
+				if err := os.WriteFile(blob, buf.Bytes(), 0o644); err != nil {
+					t.Fatalf("write blob: %v", err)
+				}
+				items = append(items, Content{
+					ID:            uuid.New(),
+					Type:          "MEDIA",
+					Content:       blob,
+					VariantStatus: pgtype.Text{String: status, Valid: true},
+				})
+			}
+			q := &fakeMediaQuerier{
+				listUnfinishedVariantsFn: func(context.Context) ([]Content, error) {
+					return items, nil
+				},
+			}
+			svc := NewService(q, zap.NewNop())
+			svc.runAsync = func(fn func()) bool {
+				if tt.queueFull {
+					return false
+				}
+				fn()
+				return true
+			}
+
+			count, err := svc.ResumeVariants(context.Background())
+			if err != nil {
+				t.Fatalf("ResumeVariants error: %v", err)
+			}
+			if count != len(items) {
+				t.Fatalf("expected %d resumed uploads, got %d", len(items), count)
+			}
+			if len(q.updateMediaVariantsArgs) != len(tt.wantStatus) {
+				t.Fatalf("expected %d variant updates, got %d", len(tt.wantStatus), len(q.updateMediaVariantsArgs))
+			}
+			for i, want := range tt.wantStatus {
+				arg := q.updateMediaVariantsArgs[i]
+				item := items[i*len(items)/len(tt.wantStatus)]
+				if arg.VariantStatus.String != want || arg.ID != item.ID || arg.BlobPath != item.Content {
+					t.Fatalf("update %d: expected %q for %s at %q, got %q for %s at %q",
+						i, want, item.ID, item.Content, arg.VariantStatus.String, arg.ID, arg.BlobPath)
+				}
+			}
+		})
+	}
+}
+
+func TestVariantPoolBoundsWorkers(t *testing.T) {
+	pool := newVariantPool()
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	running, peak := 0, 0
+
+	jobs := variantWorkers * 3
+	wg.Add(jobs)
+	for range jobs {
+		queued := pool.submit(func() {
+			defer wg.Done()
+			lock.Lock()
+			running++
+			peak = max(peak, running)
+			lock.Unlock()
+			<-release
+			lock.Lock()
+			running--
+			lock.Unlock()
+		})
+		if !queued {
+			t.Fatal("expected the job to be queued")
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if peak != variantWorkers {
+		t.Fatalf("expected at most %d jobs at once, got %d", variantWorkers, peak)
+	}
+}
+
 func TestCreateTextContent(t *testing.T) {
+	owner := uuid.New()
 	tests := []struct {
 		name      string
-		input     string
+		input     TextContentRequest
 		setup     func(q *fakeMediaQuerier)
 		wantErr   error
 		wantSaved string
+		assert    func(t *testing.T, arg CreateTextContentParams)
 	}{
 		{
 			name:    "empty text",
-			input:   "   ",
+			input:   TextContentRequest{Content: "   "},
 			wantErr: errEmptyTextContent,
 		},
 		{
 			name:  "success trims before save",
-			input: "  hello  ",
+			input: TextContentRequest{Content: "  hello  "},
 			setup: func(q *fakeMediaQuerier) {
-				q.createTextContentFn = func(_ context.Context, content string) (Content, error) {
-					return Content{ID: uuid.New(), Type: "TEXT", Content: content}, nil
+				q.createTextContentFn = func(_ context.Context, arg CreateTextContentParams) (Content, error) {
+					return Content{ID: uuid.New(), Type: "TEXT", Content: arg.Content}, nil
+				}
+			},
+			wantSaved: "hello",
+			assert: func(t *testing.T, arg CreateTextContentParams) {
+				t.Helper()
+				if arg.Title.Valid || arg.CreatedBy.Valid {
+					t.Fatalf("expected unset title and owner, got %+v", arg)
 				}
+				if arg.Tags == nil || len(arg.Tags) != 0 {
+					t.Fatalf("expected empty non-nil tags, got %#v", arg.Tags)
+				}
+			},
+		},
+		{
+			name: "metadata is normalized",
+			input: TextContentRequest{
+				Content: "hello",
+				ContentMetadata: ContentMetadata{
+					Title:     "  Newton's laws ",
+					AltText:   "   ",
+					Tags:      []string{" Physics", "physics", "", "Mechanics"},
+					CreatedBy: owner,
+				},
 			},
 			wantSaved: "hello",
+			assert: func(t *testing.T, arg CreateTextContentParams) {
+				t.Helper()
+				if arg.Title.String != "Newton's laws" || !arg.Title.Valid {
+					t.Fatalf("unexpected title: %+v", arg.Title)
+				}
+				if arg.AltText.Valid {
+					t.Fatalf("expected blank alt text to be stored as NULL, got %+v", arg.AltText)
+				}
+				if len(arg.Tags) != 2 || arg.Tags[0] != "physics" || arg.Tags[1] != "mechanics" {
+					t.Fatalf("unexpected tags: %v", arg.Tags)
+				}
+				if !arg.CreatedBy.Valid || uuid.UUID(arg.CreatedBy.Bytes) != owner {
+					t.Fatalf("unexpected owner: %+v", arg.CreatedBy)
+				}
+			},
 		},
 	}
 
@@ -258,28 +768,32 @@ func TestCreateTextContent(t *testing.T) {
 			if err != nil {
 				t.Fatalf("CreateTextContent error: %v", err)
 			}
-			if len(q.createTextContentArgs) != 1 || q.createTextContentArgs[0] != tt.wantSaved {
+			if len(q.createTextContentArgs) != 1 || q.createTextContentArgs[0].Content != tt.wantSaved {
 				t.Fatalf("expected saved text %q, got %v", tt.wantSaved, q.createTextContentArgs)
 			}
+			if tt.assert != nil {
+				tt.assert(t, q.createTextContentArgs[0])
+			}
 		})
 	}
 }
 
 func TestListTextContents(t *testing.T) {
+	listOwner := uuid.New()
 	tests := []struct {
 		name           string
-		page           int32
-		pageSize       int32
+		filter         ContentListFilter
 		totalItems     int64
 		wantLimit      int32
 		wantOffset     int32
 		wantTotalPages int32
 		wantHasNext    bool
+		wantTag        pgtype.Text
+		wantOwner      pgtype.UUID
 	}{
 		{
 			name:           "defaults pagination",
-			page:           0,
-			pageSize:       0,
+			filter:         ContentListFilter{},
 			totalItems:     35,
 			wantLimit:      defaultPageSize,
 			wantOffset:     0,
@@ -288,23 +802,39 @@ func TestListTextContents(t *testing.T) {
 		},
 		{
 			name:           "caps max page size",
-			page:           2,
-			pageSize:       999,
+			filter:         ContentListFilter{Page: 2, PageSize: 999},
 			totalItems:     350,
 			wantLimit:      maxPageSize,
 			wantOffset:     maxPageSize,
 			wantTotalPages: 4,
 			wantHasNext:    true,
 		},
+		{
+			name:           "filters by tag and owner",
+			filter:         ContentListFilter{Tag: " Physics ", Owner: listOwner},
+			totalItems:     3,
+			wantLimit:      defaultPageSize,
+			wantOffset:     0,
+			wantTotalPages: 1,
+			wantHasNext:    false,
+			wantTag:        pgtype.Text{String: "physics", Valid: true},
+			wantOwner:      pgtype.UUID{Bytes: listOwner, Valid: true},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			q := &fakeMediaQuerier{
-				countTextContentsFn: func(context.Context) (int64, error) {
+				countTextContentsFn: func(_ context.Context, arg CountTextContentsParams) (int64, error) {
+					if arg.Tag != tt.wantTag || arg.CreatedBy != tt.wantOwner {
+						t.Fatalf("unexpected count filter: %+v", arg)
+					}
 					return tt.totalItems, nil
 				},
 				listTextContentsFn: func(_ context.Context, arg ListTextContentsParams) ([]Content, error) {
+					if arg.Tag != tt.wantTag || arg.CreatedBy != tt.wantOwner {
+						t.Fatalf("unexpected list filter: %+v", arg)
+					}
 					if arg.Limit != tt.wantLimit {
 						t.Fatalf("expected limit %d, got %d", tt.wantLimit, arg.Limit)
 					}
@@ -316,7 +846,7 @@ func TestListTextContents(t *testing.T) {
 			}
 			svc := NewService(q, zap.NewNop())
 
-			page, err := svc.ListTextContents(context.Background(), tt.page, tt.pageSize)
+			page, err := svc.ListTextContents(context.Background(), tt.filter)
 			if err != nil {
 				t.Fatalf("ListTextContents error: %v", err)
 			}
@@ -329,3 +859,934 @@ func TestListTextContents(t *testing.T) {
 		})
 	}
 }
+
+func TestListContentsByCursor(t *testing.T) {
+	base := time.Date(2026, 3, 1, 12, 0, 0, 123456000, time.UTC)
+	rows := make([]Content, 5)
+	for i := range rows {
+		rows[i] = Content{
+			ID:        uuid.New(),
+			Type:      "MEDIA",
+			CreatedAt: pgtype.Timestamptz{Time: base.Add(time.Duration(i) * time.Second), Valid: true},
+		}
+	}
+
+	// The fake emulates the keyset condition (created_at, id) > (after, afterID).
+	q := &fakeMediaQuerier{
+		listMediaByCursorFn: func(_ context.Context, arg ListMediaContentsByCursorParams) ([]Content, error) {
+			var out []Content
+			for _, row := range rows {
+				if arg.AfterCreatedAt.Valid && !row.CreatedAt.Time.After(arg.AfterCreatedAt.Time) {
+					continue
+				}
+				if len(out) == int(arg.Limit) {
+					break
+				}
+				out = append(out, row)
+			}
+			return out, nil
+		},
+	}
+	svc := NewService(q, zap.NewNop())
+
+	var seen []uuid.UUID
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(rows) {
+			t.Fatalf("pagination did not terminate")
+		}
+		page, err := svc.ListMediaContentsByCursor(context.Background(), CursorListFilter{Cursor: cursor, PageSize: 2})
+		if err != nil {
+			t.Fatalf("ListMediaContentsByCursor error: %v", err)
+		}
+		if len(page.Items) > 2 {
+			t.Fatalf("expected at most 2 items, got %d", len(page.Items))
+		}
+		for _, item := range page.Items {
+			seen = append(seen, item.ID)
+		}
+		if page.HasNextPage != (page.NextCursor != "") {
+			t.Fatalf("hasNextPage %t disagrees with cursor %q", page.HasNextPage, page.NextCursor)
+		}
+		if !page.HasNextPage {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != len(rows) {
+		t.Fatalf("expected %d items across pages, got %d", len(rows), len(seen))
+	}
+	for i, row := range rows {
+		if seen[i] != row.ID {
+			t.Fatalf("item %d out of order", i)
+		}
+	}
+
+	_, err := svc.ListMediaContentsByCursor(context.Background(), CursorListFilter{Cursor: "not-a-cursor!"})
+	if !errors.Is(err, errInvalidCursor) {
+		t.Fatalf("expected invalid cursor error, got %v", err)
+	}
+}
+
+func TestListMediaContents(t *testing.T) {
+	q := &fakeMediaQuerier{
+		countMediaContentsFn: func(context.Context, CountMediaContentsParams) (int64, error) {
+			return 3, nil
+		},
+		listMediaContentsFn: func(_ context.Context, arg ListMediaContentsParams) ([]Content, error) {
+			if arg.Limit != 2 || arg.Offset != 2 {
+				t.Fatalf("unexpected limit/offset %d/%d", arg.Limit, arg.Offset)
+			}
+			return []Content{{ID: uuid.New(), Type: "MEDIA"}}, nil
+		},
+	}
+	svc := NewService(q, zap.NewNop())
+
+	page, err := svc.ListMediaContents(context.Background(), ContentListFilter{Page: 2, PageSize: 2})
+	if err != nil {
+		t.Fatalf("ListMediaContents error: %v", err)
+	}
+	if page.TotalPages != 2 || page.HasNextPage || len(page.Items) != 1 {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+}
+
+func TestUpdateTextContent(t *testing.T) {
+	strPtr := func(v string) *string { return &v }
+	tests := []struct {
+		name    string
+		patch   TextContentPatch
+		wantErr error
+		assert  func(t *testing.T, arg UpdateTextContentParams)
+	}{
+		{
+			name:    "blank content",
+			patch:   TextContentPatch{Content: strPtr("  ")},
+			wantErr: errEmptyTextContent,
+		},
+		{
+			name:  "unset fields stay null",
+			patch: TextContentPatch{Content: strPtr(" fixed ")},
+			assert: func(t *testing.T, arg UpdateTextContentParams) {
+				t.Helper()
+				if arg.Content.String != "fixed" || !arg.Content.Valid {
+					t.Fatalf("unexpected content: %+v", arg.Content)
+				}
+				if arg.Title.Valid || arg.Description.Valid || arg.AltText.Valid || arg.Tags != nil {
+					t.Fatalf("expected untouched fields to be null, got %+v", arg)
+				}
+			},
+		},
+		{
+			name:  "empty values clear fields",
+			patch: TextContentPatch{Title: strPtr(""), Tags: &[]string{}},
+			assert: func(t *testing.T, arg UpdateTextContentParams) {
+				t.Helper()
+				if arg.Content.Valid {
+					t.Fatalf("expected content untouched, got %+v", arg.Content)
+				}
+				if !arg.Title.Valid || arg.Title.String != "" {
+					t.Fatalf("expected title to be cleared, got %+v", arg.Title)
+				}
+				if arg.Tags == nil || len(arg.Tags) != 0 {
+					t.Fatalf("expected tags to be cleared, got %#v", arg.Tags)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeMediaQuerier{}
+			svc := NewService(q, zap.NewNop())
+
+			_, err := svc.UpdateTextContent(context.Background(), uuid.New(), tt.patch)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				if len(q.updateTextContentArgs) != 0 {
+					t.Fatalf("expected no db call, got %d", len(q.updateTextContentArgs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UpdateTextContent error: %v", err)
+			}
+			if len(q.updateTextContentArgs) != 1 {
+				t.Fatalf("expected exactly one db call, got %d", len(q.updateTextContentArgs))
+			}
+			tt.assert(t, q.updateTextContentArgs[0])
+		})
+	}
+}
+
+func TestReplaceMediaContent(t *testing.T) {
+	owner, caller := uuid.New(), uuid.New()
+	tests := []struct {
+		name           string
+		referenceCount int64
+		replaceErr     error
+		missing        bool
+		// ownerless is a row without an owner; anonymous replaces without a caller.
+		ownerless   bool
+		anonymous   bool
+		wantErr     error
+		wantCharged uuid.UUID
+		wantOldKept bool
+		wantNewKept bool
+	}{
+		{
+			name:        "old blob removed after update",
+			wantCharged: owner,
+			wantOldKept: false,
+			wantNewKept: true,
+		},
+		{
+			name:           "shared old blob kept",
+			referenceCount: 1,
+			wantCharged:    owner,
+			wantOldKept:    true,
+			wantNewKept:    true,
+		},
+		{
+			name:        "missing content",
+			missing:     true,
+			wantErr:     handlerutil.NotFoundError{},
+			wantOldKept: true,
+		},
+		{
+			name:        "db error keeps old blob and discards new one",
+			replaceErr:  errors.New("db boom"),
+			wantErr:     errors.New("db boom"),
+			wantCharged: owner,
+			wantOldKept: true,
+			wantNewKept: false,
+		},
+		{
+			name:        "row without an owner is charged to the caller",
+			ownerless:   true,
+			wantCharged: caller,
+			wantNewKept: true,
+		},
+		{
+			name:        "anonymous caller",
+			anonymous:   true,
+			wantErr:     handlerutil.ErrUnauthorized,
+			wantOldKept: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			oldBlob := filepath.Join(root, "old.png")
+			if err := os.WriteFile(oldBlob, []byte("old image"), 0o644); err != nil {
+				t.Fatalf("write old blob: %v", err)
+			}
+			id := uuid.New()
+
+			var q *fakeMediaQuerier
+			q = &fakeMediaQuerier{
+				getMediaForUpdateFn: func(context.Context, uuid.UUID) (Content, error) {
+					if tt.missing {
+						return Content{}, pgx.ErrNoRows
+					}
+					item := Content{ID: id, Type: "MEDIA", Content: oldBlob}
+					if !tt.ownerless {
+						item.CreatedBy = pgtype.UUID{Bytes: owner, Valid: true}
+					}
+					return item, nil
+				},
+				replaceMediaContentFn: func(_ context.Context, arg ReplaceMediaContentParams) (Content, error) {
+					if tt.replaceErr != nil {
+						return Content{}, tt.replaceErr
+					}
+					return Content{ID: arg.ID, Type: "MEDIA", Content: arg.Content, Sha256: arg.Sha256}, nil
+				},
+			}
+			q.countMediaContentsByPathFn = func(context.Context, string) (int64, error) {
+				// The old blob is only checked once the replacing transaction is over.
+				if q.transactions != 2 {
+					t.Fatalf("old blob checked in transaction %d, want 2", q.transactions)
+				}
+				return tt.referenceCount, nil
+			}
+			svc := NewService(q, zap.NewNop())
+			svc.runAsync = func(func()) bool { return true }
+
+			upload := MediaUploadRequest{
+				Content:  bytes.NewReader([]byte("hello world")),
+				Filename: "new.png",
+				Dir:      root,
+			}
+			if !tt.anonymous {
+				upload.CreatedBy = caller
+			}
+			_, err := svc.ReplaceMediaContent(context.Background(), id, upload)
+			if (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != nil && tt.replaceErr == nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantCharged == uuid.Nil {
+				if len(q.reserveUserStorageArgs) != 0 || len(q.replaceMediaContentArgs) != 0 {
+					t.Fatalf("expected nothing charged or replaced, got %+v and %+v", q.reserveUserStorageArgs, q.replaceMediaContentArgs)
+				}
+			} else {
+				if len(q.replaceMediaContentArgs) != 1 || q.replaceMediaContentArgs[0].ID != id {
+					t.Fatalf("expected one replace call for %s, got %+v", id, q.replaceMediaContentArgs)
+				}
+				if arg := q.replaceMediaContentArgs[0]; arg.CreatedBy.Bytes != tt.wantCharged || arg.SizeBytes != 11 {
+					t.Fatalf("expected 11 bytes recorded for %s, got %+v", tt.wantCharged, arg)
+				}
+				if len(q.reserveUserStorageArgs) != 1 || q.reserveUserStorageArgs[0].UserID != tt.wantCharged {
+					t.Fatalf("expected the upload charged to %s, got %+v", tt.wantCharged, q.reserveUserStorageArgs)
+				}
+			}
+
+			newBlob := filepath.Join(root, helloWorldSHA256+".png")
+			if _, err := os.Stat(oldBlob); (err == nil) != tt.wantOldKept {
+				t.Fatalf("old blob kept=%t, want %t", err == nil, tt.wantOldKept)
+			}
+			if _, err := os.Stat(newBlob); (err == nil) != tt.wantNewKept {
+				t.Fatalf("new blob kept=%t, want %t", err == nil, tt.wantNewKept)
+			}
+		})
+	}
+}
+
+func TestOpenMediaContent(t *testing.T) {
+	root := t.TempDir()
+	blob := filepath.Join(root, "photo.png")
+	if err := os.WriteFile(blob, []byte("original"), 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	if err := os.WriteFile(variantPath(blob, 640), []byte("variant"), 0o644); err != nil {
+		t.Fatalf("write variant: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		item      Content
+		width     int
+		wantBody  string
+		wantError bool
+	}{
+		{
+			name:     "original",
+			item:     Content{Type: "MEDIA", Content: blob},
+			wantBody: "original",
+		},
+		{
+			name: "ready variant",
+			item: Content{Type: "MEDIA", Content: blob, VariantStatus: pgtype.Text{String: variantStatusReady, Valid: true},
+				VariantWidths: []int32{640}},
+			width:    640,
+			wantBody: "variant",
+		},
+		{
+			name:     "pending variant falls back to original",
+			item:     Content{Type: "MEDIA", Content: blob, VariantStatus: pgtype.Text{String: variantStatusPending, Valid: true}},
+			width:    640,
+			wantBody: "original",
+		},
+		{
+			name: "width without a variant falls back to original",
+			item: Content{Type: "MEDIA", Content: blob, VariantStatus: pgtype.Text{String: variantStatusReady, Valid: true},
+				VariantWidths: []int32{640}},
+			width:    1280,
+			wantBody: "original",
+		},
+		{
+			name:      "non standard width",
+			item:      Content{Type: "MEDIA", Content: blob},
+			width:     300,
+			wantError: true,
+		},
+		{
+			name:      "missing blob",
+			item:      Content{Type: "MEDIA", Content: filepath.Join(root, "gone.png")},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeMediaQuerier{
+				getMediaContentFn: func(context.Context, uuid.UUID) (Content, error) {
+					return tt.item, nil
+				},
+			}
+			svc := NewService(q, zap.NewNop())
+
+			_, f, err := svc.OpenMediaContent(context.Background(), uuid.New(), tt.width)
+			if tt.wantError {
+				if err == nil {
+					_ = f.Close()
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer func() { _ = f.Close() }()
+			body, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(body) != tt.wantBody {
+				t.Fatalf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRenderTextHTML(t *testing.T) {
+	svc := NewService(&fakeMediaQuerier{}, zap.NewNop())
+	id := uuid.New()
+
+	first := svc.RenderTextHTML(Content{ID: id, Type: "TEXT", Content: "*v1*", Format: formatMarkdown, Revision: 1})
+	if first != "<p><em>v1</em></p>\n" {
+		t.Fatalf("unexpected html: %q", first)
+	}
+
+	// Same revision is served from the cache even if the caller passes stale content.
+	cached := svc.RenderTextHTML(Content{ID: id, Type: "TEXT", Content: "*changed*", Format: formatMarkdown, Revision: 1})
+	if cached != first {
+		t.Fatalf("expected cached html %q, got %q", first, cached)
+	}
+
+	updated := svc.RenderTextHTML(Content{ID: id, Type: "TEXT", Content: "*v2*", Format: formatPlain, Revision: 2})
+	if updated != "<p>*v2*</p>\n" {
+		t.Fatalf("expected new revision to be rendered, got %q", updated)
+	}
+
+	if err := svc.DeleteContent(context.Background(), id); err != nil {
+		t.Fatalf("DeleteContent error: %v", err)
+	}
+	if _, ok := svc.renderCache.get(id, 2); ok {
+		t.Fatalf("expected cache entry removed after delete")
+	}
+}
+
+func TestReconcileMedia(t *testing.T) {
+	old := time.Now().Add(-2 * DefaultReconcileGracePeriod)
+	tests := []struct {
+		name          string
+		action        string
+		wantErr       error
+		wantOrphans   []string
+		wantOutcome   string
+		wantDeletes   int
+		wantRemaining []string
+	}{
+		{
+			name:          "report only",
+			action:        ReconcileActionReport,
+			wantOrphans:   []string{"orphan.png", "upload-123.png"},
+			wantRemaining: []string{"fresh.png", "kept.png", "kept_w160.png", "orphan.png", "upload-123.png"},
+		},
+		{
+			name:          "quarantine moves orphans aside",
+			action:        ReconcileActionQuarantine,
+			wantOrphans:   []string{"orphan.png", "upload-123.png"},
+			wantOutcome:   reconcileOutcomeQuarantined,
+			wantRemaining: []string{".quarantine", "fresh.png", "kept.png", "kept_w160.png"},
+		},
+		{
+			name:          "delete removes orphans and missing rows",
+			action:        ReconcileActionDelete,
+			wantOrphans:   []string{"orphan.png", "upload-123.png"},
+			wantOutcome:   reconcileOutcomeDeleted,
+			wantDeletes:   1,
+			wantRemaining: []string{"fresh.png", "kept.png", "kept_w160.png"},
+		},
+		{
+			name:    "unknown action",
+			action:  "shred",
+			wantErr: errInvalidReconcileAction,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range []string{"kept.png", "kept_w160.png", "orphan.png", "upload-123.png", "fresh.png"} {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+					t.Fatalf("write %s: %v", name, err)
+				}
+				if name != "fresh.png" {
+					if err := os.Chtimes(path, old, old); err != nil {
+						t.Fatalf("chtimes %s: %v", name, err)
+					}
+				}
+			}
+			keptID, missingID, owner := uuid.New(), uuid.New(), uuid.New()
+
+			q := &fakeMediaQuerier{
+				listMediaPathsFn: func(context.Context) ([]ListMediaPathsRow, error) {
+					return []ListMediaPathsRow{
+						{ID: keptID, Content: toStoredPath(filepath.Join(dir, "kept.png"))},
+						{ID: missingID, Content: toStoredPath(filepath.Join(dir, "gone.png"))},
+					}, nil
+				},
+				deleteMissingMediaFn: func(context.Context, DeleteMissingMediaContentParams) (DeleteMissingMediaContentRow, error) {
+					return DeleteMissingMediaContentRow{CreatedBy: pgtype.UUID{Bytes: owner, Valid: true}, SizeBytes: 42}, nil
+				},
+			}
+			svc := NewService(q, zap.NewNop())
+
+			report, err := svc.ReconcileMedia(context.Background(), ReconcileOptions{Action: tt.action, Dir: dir})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReconcileMedia error: %v", err)
+			}
+
+			var orphans []string
+			for _, orphan := range report.OrphanFiles {
+				orphans = append(orphans, filepath.Base(orphan.Path))
+				if orphan.Outcome != tt.wantOutcome {
+					t.Fatalf("orphan %s: expected outcome %q, got %q (%s)", orphan.Path, tt.wantOutcome, orphan.Outcome, orphan.Error)
+				}
+			}
+			if !slices.Equal(orphans, tt.wantOrphans) {
+				t.Fatalf("expected orphans %v, got %v", tt.wantOrphans, orphans)
+			}
+			if len(report.MissingFiles) != 1 || report.MissingFiles[0].ContentID != missingID {
+				t.Fatalf("expected row %s to be reported missing, got %+v", missingID, report.MissingFiles)
+			}
+			if len(q.deleteMissingMediaArgs) != tt.wantDeletes {
+				t.Fatalf("expected %d row deletions, got %d", tt.wantDeletes, len(q.deleteMissingMediaArgs))
+			}
+			if len(q.releaseUserStorageArgs) != tt.wantDeletes {
+				t.Fatalf("expected %d storage releases, got %+v", tt.wantDeletes, q.releaseUserStorageArgs)
+			}
+			for _, arg := range q.releaseUserStorageArgs {
+				if arg.UserID != owner || arg.Bytes != 42 {
+					t.Fatalf("expected 42 bytes released to %s, got %+v", owner, arg)
+				}
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("read media dir: %v", err)
+			}
+			var remaining []string
+			for _, entry := range entries {
+				remaining = append(remaining, entry.Name())
+			}
+			if !slices.Equal(remaining, tt.wantRemaining) {
+				t.Fatalf("expected files %v, got %v", tt.wantRemaining, remaining)
+			}
+		})
+	}
+}
+
+func TestParseStorageQuotas(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    StorageQuotas
+		wantErr bool
+	}{
+		{
+			name: "empty is unlimited",
+			spec: "",
+			want: StorageQuotas{Default: UnlimitedStorage, Roles: map[string]int64{}},
+		},
+		{
+			name: "units and roles",
+			spec: "default=1GiB, experimenter = 512MiB ,ADMIN=unlimited,STUDENT=1024",
+			want: StorageQuotas{Default: 1 << 30, Roles: map[string]int64{
+				"EXPERIMENTER": 512 << 20,
+				"ADMIN":        UnlimitedStorage,
+				"STUDENT":      1024,
+			}},
+		},
+		{name: "missing size", spec: "ADMIN", wantErr: true},
+		{name: "negative size", spec: "default=-1", wantErr: true},
+		{name: "unknown unit", spec: "default=1GB", wantErr: true},
+		{name: "overflow", spec: "default=9999999999TiB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseStorageQuotas(tt.spec)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidStorageQuota) {
+					t.Fatalf("expected errInvalidStorageQuota, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseStorageQuotas error: %v", err)
+			}
+			if got.Default != tt.want.Default || !maps.Equal(got.Roles, tt.want.Roles) {
+				t.Fatalf("quotas mismatch: want %+v got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCreateMediaContentQuota(t *testing.T) {
+	owner := uuid.New()
+	quotas := StorageQuotas{Default: 100, Roles: map[string]int64{auth.RoleExperimenter: 1000}}
+
+	tests := []struct {
+		name          string
+		user          *auth.User
+		anonymous     bool
+		setup         func(q *fakeMediaQuerier)
+		wantErr       error
+		wantRoleQuota pgtype.Int8
+		wantReserved  bool
+		wantReleased  bool
+		wantInserted  bool
+	}{
+		{
+			name:          "charged to owner with role quota",
+			user:          &auth.User{ID: owner, Roles: []string{auth.RoleStudent, auth.RoleExperimenter}},
+			wantRoleQuota: pgtype.Int8{Int64: 1000, Valid: true},
+			wantReserved:  true,
+			wantInserted:  true,
+		},
+		{
+			name:          "default quota for other owners",
+			user:          &auth.User{ID: uuid.New(), Roles: []string{auth.RoleExperimenter}},
+			wantRoleQuota: pgtype.Int8{Int64: 100, Valid: true},
+			wantReserved:  true,
+			wantInserted:  true,
+		},
+		{
+			name:      "anonymous upload",
+			anonymous: true,
+			wantErr:   handlerutil.ErrUnauthorized,
+		},
+		{
+			name: "over quota",
+			user: &auth.User{ID: owner, Roles: []string{auth.RoleStudent}},
+			setup: func(q *fakeMediaQuerier) {
+				q.reserveUserStorageFn = func(context.Context, ReserveUserStorageParams) (int64, error) {
+					return 0, pgx.ErrNoRows
+				}
+				q.getUserStorageFn = func(context.Context, uuid.UUID) (UserStorage, error) {
+					return UserStorage{UserID: owner, UsedBytes: 95}, nil
+				}
+			},
+			wantErr:       errStorageQuotaExceeded,
+			wantRoleQuota: pgtype.Int8{Int64: 100, Valid: true},
+			wantReserved:  true,
+		},
+		{
+			name: "insert failure releases reservation",
+			user: &auth.User{ID: owner, Roles: []string{auth.RoleStudent}},
+			setup: func(q *fakeMediaQuerier) {
+				q.createMediaContentFn = func(context.Context, CreateMediaContentParams) (Content, error) {
+					return Content{}, errors.New("db boom")
+				}
+			},
+			wantErr:       errors.New("db boom"),
+			wantRoleQuota: pgtype.Int8{Int64: 100, Valid: true},
+			wantReserved:  true,
+			wantReleased:  true,
+			wantInserted:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			q := &fakeMediaQuerier{}
+			if tt.setup != nil {
+				tt.setup(q)
+			}
+			svc := NewService(q, zap.NewNop())
+			svc.SetStorageQuotas(quotas)
+
+			ctx := context.Background()
+			if tt.user != nil {
+				ctx = auth.WithUser(ctx, *tt.user)
+			}
+			upload := MediaUploadRequest{
+				Content:  bytes.NewReader([]byte("hello world")),
+				Filename: "photo.png",
+				Dir:      root,
+			}
+			if !tt.anonymous {
+				upload.CreatedBy = owner
+			}
+			_, err := svc.CreateMediaContent(ctx, upload)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("CreateMediaContent error: %v", err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatalf("expected error %v, got nil", tt.wantErr)
+			case errors.Is(tt.wantErr, errStorageQuotaExceeded) && !errors.Is(err, errStorageQuotaExceeded):
+				t.Fatalf("expected errStorageQuotaExceeded, got %v", err)
+			case errors.Is(tt.wantErr, handlerutil.ErrUnauthorized) && !errors.Is(err, handlerutil.ErrUnauthorized):
+				t.Fatalf("expected handlerutil.ErrUnauthorized, got %v", err)
+			}
+
+			if tt.wantReserved {
+				want := ReserveUserStorageParams{Bytes: 11, UserID: owner, RoleQuota: tt.wantRoleQuota}
+				if len(q.reserveUserStorageArgs) != 1 || q.reserveUserStorageArgs[0] != want {
+					t.Fatalf("reserve mismatch: want %+v got %+v", want, q.reserveUserStorageArgs)
+				}
+			}
+			if tt.wantReleased != (len(q.releaseUserStorageArgs) == 1) {
+				t.Fatalf("release mismatch: want released=%v got %+v", tt.wantReleased, q.releaseUserStorageArgs)
+			}
+			if tt.wantInserted != (len(q.createMediaContentArgs) == 1) {
+				t.Fatalf("insert mismatch: want inserted=%v got %d calls", tt.wantInserted, len(q.createMediaContentArgs))
+			}
+			if tt.wantInserted && q.createMediaContentArgs[0].SizeBytes != 11 {
+				t.Fatalf("expected size 11 recorded, got %d", q.createMediaContentArgs[0].SizeBytes)
+			}
+			if tt.wantErr != nil {
+				entries, _ := os.ReadDir(root)
+				if len(entries) != 0 {
+					t.Fatalf("expected blob discarded, found %d files", len(entries))
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteContent(t *testing.T) {
+	writeBlob := func(t *testing.T) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), helloWorldSHA256+".png")
+		if err := os.WriteFile(path, []byte("hello world"), 0o644); err != nil {
+			t.Fatalf("write media file: %v", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name       string
+		kind       string
+		deleteErr  error
+		references int64
+		wantErr    bool
+		wantLock   bool
+		wantKept   bool
+	}{
+		{name: "media file removed", kind: "MEDIA", wantLock: true},
+		{name: "shared media file kept", kind: "MEDIA", references: 1, wantLock: true, wantKept: true},
+		{name: "delete error keeps media file", kind: "MEDIA", deleteErr: errors.New("boom"), wantErr: true, wantKept: true},
+		{name: "text content touches no file", kind: "TEXT", wantKept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeBlob(t)
+			q := &fakeMediaQuerier{
+				deleteContentFn: func(_ context.Context, id uuid.UUID) (Content, error) {
+					if tt.deleteErr != nil {
+						return Content{}, tt.deleteErr
+					}
+					return Content{ID: id, Type: tt.kind, Content: path}, nil
+				},
+				countMediaContentsByPathFn: func(context.Context, string) (int64, error) {
+					return tt.references, nil
+				},
+			}
+			svc := NewService(q, zap.NewNop())
+
+			err := svc.DeleteContent(context.Background(), uuid.New())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteContent error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantLock && !slices.Equal(q.lockMediaBlobArgs, []string{helloWorldSHA256}) {
+				t.Fatalf("expected the blob lock before removal, got %v", q.lockMediaBlobArgs)
+			}
+			_, statErr := os.Stat(path)
+			if tt.wantKept && statErr != nil {
+				t.Fatalf("expected media file kept, stat err=%v", statErr)
+			}
+			if !tt.wantKept && !errors.Is(statErr, os.ErrNotExist) {
+				t.Fatalf("expected media file deleted, stat err=%v", statErr)
+			}
+		})
+	}
+}
+
+func TestDeleteContentReleasesStorage(t *testing.T) {
+	owner := uuid.New()
+	q := &fakeMediaQuerier{
+		deleteContentFn: func(_ context.Context, id uuid.UUID) (Content, error) {
+			return Content{ID: id, Type: "MEDIA", CreatedBy: optionalUUID(owner), SizeBytes: 42}, nil
+		},
+	}
+	svc := NewService(q, zap.NewNop())
+
+	if err := svc.DeleteContent(context.Background(), uuid.New()); err != nil {
+		t.Fatalf("DeleteContent error: %v", err)
+	}
+	want := ReleaseUserStorageParams{Bytes: 42, UserID: owner}
+	if len(q.releaseUserStorageArgs) != 1 || q.releaseUserStorageArgs[0] != want {
+		t.Fatalf("release mismatch: want %+v got %+v", want, q.releaseUserStorageArgs)
+	}
+}
+
+func TestSearchTextContents(t *testing.T) {
+	rows := func(n int) []SearchTextContentsRow {
+		out := make([]SearchTextContentsRow, n)
+		for i := range out {
+			out[i] = SearchTextContentsRow{
+				Content: Content{ID: uuid.New(), Type: "TEXT", Content: "光合作用需要陽光"},
+				Rank:    float32(n - i),
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name         string
+		filter       SearchFilter
+		rows         []SearchTextContentsRow
+		wantErr      error
+		wantArg      SearchTextContentsParams
+		wantItems    int
+		wantNextPage bool
+	}{
+		{
+			name:    "blank query",
+			filter:  SearchFilter{Query: "  "},
+			wantErr: errEmptySearchQuery,
+		},
+		{
+			name:   "escapes like wildcards",
+			filter: SearchFilter{Query: " 100%_done ", Tag: " Physics "},
+			wantArg: SearchTextContentsParams{
+				Query:   "100%_done",
+				Pattern: `%100\%\_done%`,
+				Tag:     pgtype.Text{String: "physics", Valid: true},
+				Limit:   defaultPageSize + 1,
+				Offset:  0,
+			},
+		},
+		{
+			name:   "extra row means next page",
+			filter: SearchFilter{Query: "光合作用", Page: 2, PageSize: 2},
+			rows:   rows(3),
+			wantArg: SearchTextContentsParams{
+				Query:   "光合作用",
+				Pattern: "%光合作用%",
+				Limit:   3,
+				Offset:  2,
+			},
+			wantItems:    2,
+			wantNextPage: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeMediaQuerier{
+				searchTextContentsFn: func(context.Context, SearchTextContentsParams) ([]SearchTextContentsRow, error) {
+					return tt.rows, nil
+				},
+			}
+			svc := NewService(q, zap.NewNop())
+
+			got, err := svc.SearchTextContents(context.Background(), tt.filter)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				if len(q.searchTextContentsArgs) != 0 {
+					t.Fatalf("expected no db call, got %d", len(q.searchTextContentsArgs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SearchTextContents error: %v", err)
+			}
+			if len(q.searchTextContentsArgs) != 1 || q.searchTextContentsArgs[0] != tt.wantArg {
+				t.Fatalf("args mismatch: want %+v got %+v", tt.wantArg, q.searchTextContentsArgs)
+			}
+			if len(got.Items) != tt.wantItems || got.HasNextPage != tt.wantNextPage {
+				t.Fatalf("page mismatch: items=%d hasNext=%v", len(got.Items), got.HasNextPage)
+			}
+			for _, item := range got.Items {
+				if item.Snippet != "<mark>光合作用</mark>需要陽光" {
+					t.Fatalf("unexpected snippet %q", item.Snippet)
+				}
+			}
+		})
+	}
+}
+
+func TestRetrieveTextContents(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		limit    int32
+		wantCall bool
+		wantArg  RetrieveTextContentsParams
+	}{
+		{
+			name:  "blank text",
+			text:  "   ",
+			limit: 3,
+		},
+		{
+			name:  "no limit",
+			text:  "photosynthesis",
+			limit: 0,
+		},
+		{
+			name:     "any word may match",
+			text:     "Why does the Moon have phases? Phases, phases!",
+			limit:    3,
+			wantCall: true,
+			wantArg: RetrieveTextContentsParams{
+				Terms: "'moon' | 'phases'",
+				Query: "Why does the Moon have phases? Phases, phases!",
+				Limit: 3,
+			},
+		},
+		{
+			name:     "text without word boundaries is one term",
+			text:     "光合作用需要什麼？",
+			limit:    2,
+			wantCall: true,
+			wantArg: RetrieveTextContentsParams{
+				Terms: "'光合作用需要什麼'",
+				Query: "光合作用需要什麼？",
+				Limit: 2,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeMediaQuerier{}
+			svc := NewService(q, zap.NewNop())
+
+			if _, err := svc.RetrieveTextContents(context.Background(), tt.text, tt.limit); err != nil {
+				t.Fatalf("RetrieveTextContents error: %v", err)
+			}
+			if !tt.wantCall {
+				if len(q.retrieveTextContentsArgs) != 0 {
+					t.Fatalf("expected no db call, got %d", len(q.retrieveTextContentsArgs))
+				}
+				return
+			}
+			if len(q.retrieveTextContentsArgs) != 1 || q.retrieveTextContentsArgs[0] != tt.wantArg {
+				t.Fatalf("args mismatch: want %+v got %+v", tt.wantArg, q.retrieveTextContentsArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package content
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+const (
+	variantStatusPending    = "pending"
+	variantStatusProcessing = "processing"
+	variantStatusReady      = "ready"
+	variantStatusFailed     = "failed"
+)
+
+// thumbnailWidth is the smallest standard width and doubles as the thumbnail size.
+const thumbnailWidth = 160
+
+// maxVariantSourcePixels guards against decompression bombs when decoding uploads.
+const maxVariantSourcePixels = 50_000_000
+
+const variantUpdateTimeout = 10 * time.Second
+
+// variantWorkers bounds how many uploads are decoded and resized at once, since each
+// may hold a source image of up to maxVariantSourcePixels in memory.
+const variantWorkers = 2
+
+// variantQueueSize bounds the uploads waiting for a variant worker.
+const variantQueueSize = 256
+
+var standardVariantWidths = []int{thumbnailWidth, 320, 640, 1280}
+
+var errUnsupportedVariantWidth = errors.New("unsupported media variant width")
+
+// isVariantSourceExt reports whether uploads with this extension should get resized variants.
+func isVariantSourceExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	default:
+		return false
+	}
+}
+
+// variantPath returns where the variant of the given width is stored, next to the original.
+func variantPath(blobPath string, width int) string {
+	ext := filepath.Ext(blobPath)
+	return fmt.Sprintf("%s_w%d%s", strings.TrimSuffix(blobPath, ext), width, ext)
+}
+
+// resolveMediaPath picks the file to serve for a requested width. A zero width, or a width
+// whose variant is not ready (e.g. the original is narrower), falls back to the original.
+func resolveMediaPath(item Content, width int) (string, error) {
+	if width == 0 {
+		return item.Content, nil
+	}
+	if !slices.Contains(standardVariantWidths, width) {
+		return "", fmt.Errorf("%w: width must be one of %v", errUnsupportedVariantWidth, standardVariantWidths)
+	}
+	if item.VariantStatus.String != variantStatusReady || !slices.Contains(item.VariantWidths, int32(width)) {
+		return item.Content, nil
+	}
+	return variantPath(item.Content, width), nil
+}
+
+// removeMediaVariants deletes every variant that may exist next to a removed blob.
+func removeMediaVariants(blobPath string, logger *zap.Logger) {
+	for _, width := range standardVariantWidths {
+		path := variantPath(blobPath, width)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("failed to remove media variant", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
+
+// variantPool runs variant generation on a fixed number of workers, started with the
+// first job.
+type variantPool struct {
+	once sync.Once
+	jobs chan func()
+}
+
+func newVariantPool() *variantPool {
+	return &variantPool{jobs: make(chan func(), variantQueueSize)}
+}
+
+// submit queues fn and reports false when the queue is full.
+func (p *variantPool) submit(fn func()) bool {
+	p.once.Do(func() {
+		for range variantWorkers {
+			go func() {
+				for job := range p.jobs {
+					job()
+				}
+			}()
+		}
+	})
+	select {
+	case p.jobs <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// scheduleVariants generates variants in the background and records the outcome on the row.
+// When too many uploads are already waiting, the upload is served without variants.
+func (s *Service) scheduleVariants(item Content) {
+	if item.VariantStatus.String != variantStatusPending {
+		return
+	}
+	s.queueVariants(item)
+}
+
+func (s *Service) queueVariants(item Content) {
+	queued := s.runAsync(func() {
+		s.generateVariants(item.ID, item.Content)
+	})
+	if !queued {
+		logger := s.logger.With(zap.String("content_id", item.ID.String()), zap.String("path", item.Content))
+		logger.Warn("media variant queue is full, skipping variants")
+		s.updateVariantStatus(item.ID, item.Content, variantStatusFailed, []int32{}, logger)
+	}
+}
+
+// ResumeVariants queues the variants left pending or processing when the server last
+// stopped, and returns how many uploads it found. Generation keeps variants that were
+// already written, so resuming an upload that another replica is still working on is
+// harmless.
+func (s *Service) ResumeVariants(ctx context.Context) (int, error) {
+	items, err := s.querier.ListUnfinishedMediaVariants(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		s.queueVariants(item)
+	}
+	return len(items), nil
+}
+
+func (s *Service) generateVariants(id uuid.UUID, blobPath string) {
+	logger := s.logger.With(zap.String("content_id", id.String()), zap.String("path", blobPath))
+
+	s.updateVariantStatus(id, blobPath, variantStatusProcessing, []int32{}, logger)
+
+	widths, err := writeImageVariants(blobPath)
+	if err != nil {
+		logger.Warn("failed to generate media variants", zap.Error(err))
+		s.updateVariantStatus(id, blobPath, variantStatusFailed, []int32{}, logger)
+		return
+	}
+
+	s.updateVariantStatus(id, blobPath, variantStatusReady, widths, logger)
+}
+
+// updateVariantStatus records the variants of blobPath. The update is skipped when the
+// row was replaced with another blob meanwhile, whose variants are its own job's.
+func (s *Service) updateVariantStatus(id uuid.UUID, blobPath, status string, widths []int32, logger *zap.Logger) {
+	// Use a fresh context so the upload request finishing doesn't cancel the bookkeeping.
+	ctx, cancel := context.WithTimeout(context.Background(), variantUpdateTimeout)
+	defer cancel()
+
+	err := s.querier.UpdateMediaVariants(ctx, UpdateMediaVariantsParams{
+		ID:            id,
+		BlobPath:      blobPath,
+		VariantStatus: pgtype.Text{String: status, Valid: true},
+		VariantWidths: widths,
+	})
+	if err != nil {
+		logger.Warn("failed to update media variant status", zap.String("status", status), zap.Error(err))
+	}
+}
+
+// writeImageVariants decodes the blob and writes each standard width narrower than the
+// original. Variants that already exist (e.g. for a deduplicated blob) are kept as-is.
+func writeImageVariants(blobPath string) ([]int32, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return nil, fmt.Errorf("open media file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("decode image config: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxVariantSourcePixels {
+		return nil, fmt.Errorf("image dimensions %dx%d out of range", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("rewind media file: %w", err)
+	}
+
+	decoded, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	// Converted once here rather than for every width.
+	src := toNRGBA(decoded)
+
+	widths := make([]int32, 0, len(standardVariantWidths))
+	for _, width := range standardVariantWidths {
+		if width >= cfg.Width {
+			continue
+		}
+		path := variantPath(blobPath, width)
+		if _, err := os.Stat(path); err == nil {
+			widths = append(widths, int32(width))
+			continue
+		}
+		if err := writeVariantFile(path, format, resizeToWidth(src, width)); err != nil {
+			return nil, err
+		}
+		widths = append(widths, int32(width))
+	}
+
+	return widths, nil
+}
+
+func writeVariantFile(path, format string, img image.Image) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "variant-*"+filepath.Ext(path))
+	if err != nil {
+		return fmt.Errorf("create temp variant file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(tmpFile, img, &jpeg.Options{Quality: 85})
+	case "gif":
+		err = gif.Encode(tmpFile, img, nil)
+	default:
+		err = png.Encode(tmpFile, img)
+	}
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("encode %s variant: %w", format, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("persist variant file: %w", err)
+	}
+	return nil
+}
+
+// toNRGBA returns img as an NRGBA image whose bounds start at the origin, converting
+// it only when needed.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+// resizeToWidth downscales src with a box filter, keeping the aspect ratio.
+func resizeToWidth(src *image.NRGBA, width int) image.Image {
+	srcW, srcH := src.Rect.Dx(), src.Rect.Dy()
+	height := max(1, srcH*width/srcW)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := max(y0+1, (y+1)*srcH/height)
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := max(x0+1, (x+1)*srcW/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[offset])
+					g += uint64(src.Pix[offset+1])
+					b += uint64(src.Pix[offset+2])
+					a += uint64(src.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,4 @@
+ALTER TABLE contents
+    DROP CONSTRAINT IF EXISTS contents_variant_status_known,
+    DROP COLUMN IF EXISTS variant_widths,
+    DROP COLUMN IF EXISTS variant_status;
@@ -0,0 +1,8 @@
+-- Resized image variants are generated asynchronously after upload.
+ALTER TABLE contents
+    ADD COLUMN IF NOT EXISTS variant_status TEXT,
+    ADD COLUMN IF NOT EXISTS variant_widths INT[] NOT NULL DEFAULT '{}',
+    ADD CONSTRAINT contents_variant_status_known CHECK (
+        variant_status IS NULL
+        OR variant_status IN ('pending', 'processing', 'ready', 'failed')
+    );
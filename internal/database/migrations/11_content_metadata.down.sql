@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_contents_created_by;
+DROP INDEX IF EXISTS idx_contents_tags;
+
+ALTER TABLE contents
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS created_by,
+    DROP COLUMN IF EXISTS tags,
+    DROP COLUMN IF EXISTS alt_text,
+    DROP COLUMN IF EXISTS description,
+    DROP COLUMN IF EXISTS title;
@@ -0,0 +1,4 @@
+ALTER TABLE contents
+    DROP CONSTRAINT IF EXISTS contents_format_known,
+    DROP COLUMN IF EXISTS revision,
+    DROP COLUMN IF EXISTS format;
@@ -0,0 +1,6 @@
+-- Text contents declare how they should be rendered; revision changes on every update
+-- so rendered output can be cached per revision.
+ALTER TABLE contents
+    ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'plain',
+    ADD COLUMN IF NOT EXISTS revision INT NOT NULL DEFAULT 1,
+    ADD CONSTRAINT contents_format_known CHECK (format IN ('plain', 'markdown'));
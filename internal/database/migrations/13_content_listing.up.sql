@@ -0,0 +1,3 @@
+-- Keyset pagination walks contents of one type in (created_at, id) order.
+CREATE INDEX IF NOT EXISTS idx_contents_type_created_at_id
+ON contents(type, created_at, id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS user_storage;
+
+ALTER TABLE contents
+    DROP COLUMN IF EXISTS size_bytes;
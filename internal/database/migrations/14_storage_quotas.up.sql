@@ -0,0 +1,15 @@
+-- Media uploads are charged to their owner. Rows created before this migration
+-- have an unknown size and are not charged.
+ALTER TABLE contents
+    ADD COLUMN IF NOT EXISTS size_bytes BIGINT NOT NULL DEFAULT 0;
+
+-- Bytes charged to each user. quota_bytes overrides the role quota from the config
+-- for a single user; NULL means the role quota applies.
+CREATE TABLE IF NOT EXISTS user_storage (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    used_bytes BIGINT NOT NULL DEFAULT 0,
+    quota_bytes BIGINT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT user_storage_used_bytes_not_negative CHECK (used_bytes >= 0),
+    CONSTRAINT user_storage_quota_bytes_not_negative CHECK (quota_bytes IS NULL OR quota_bytes >= 0)
+);
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS contents_search_refresh ON contents;
+DROP FUNCTION IF EXISTS content_search_refresh();
+DROP TABLE IF EXISTS content_search;
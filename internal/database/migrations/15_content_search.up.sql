@@ -0,0 +1,65 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Search index of text contents. document serves word queries; body backs a trigram
+-- substring match for text without word boundaries such as Chinese.
+--
+-- It is a side table kept up to date by a trigger rather than generated columns on
+-- contents, for two reasons:
+--   * every contents query lists the columns of the Content model, and sqlc only
+--     returns that model while the columns match the table, so new columns would
+--     give each query its own row type and carry the index into every read;
+--   * array_to_string and concat_ws are only stable, and generated columns accept
+--     immutable expressions only.
+-- Rows follow their content: the trigger rewrites them on insert and on any change
+-- to the indexed columns, and ON DELETE CASCADE drops them with it.
+CREATE TABLE IF NOT EXISTS content_search (
+    content_id UUID PRIMARY KEY REFERENCES contents(id) ON DELETE CASCADE,
+    document TSVECTOR NOT NULL,
+    body TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_search_document
+ON content_search USING GIN (document);
+
+CREATE INDEX IF NOT EXISTS idx_content_search_body_trgm
+ON content_search USING GIN (body gin_trgm_ops);
+
+CREATE OR REPLACE FUNCTION content_search_refresh() RETURNS trigger AS $$
+BEGIN
+    IF NEW.type <> 'TEXT' THEN
+        RETURN NEW;
+    END IF;
+
+    INSERT INTO content_search (content_id, document, body)
+    VALUES (
+        NEW.id,
+        setweight(to_tsvector('simple', coalesce(NEW.title, '')), 'A')
+            || setweight(to_tsvector('simple', array_to_string(NEW.tags, ' ')), 'B')
+            || setweight(to_tsvector('simple', coalesce(NEW.description, '')), 'C')
+            || setweight(to_tsvector('simple', NEW.content), 'D'),
+        concat_ws(' ', NEW.title, NEW.description, array_to_string(NEW.tags, ' '), NEW.content)
+    )
+    ON CONFLICT (content_id) DO UPDATE
+    SET document = EXCLUDED.document,
+        body = EXCLUDED.body;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS contents_search_refresh ON contents;
+CREATE TRIGGER contents_search_refresh
+AFTER INSERT OR UPDATE OF content, title, description, tags ON contents
+FOR EACH ROW EXECUTE FUNCTION content_search_refresh();
+
+-- Backfill rows written before the trigger existed.
+INSERT INTO content_search (content_id, document, body)
+SELECT id,
+       setweight(to_tsvector('simple', coalesce(title, '')), 'A')
+           || setweight(to_tsvector('simple', array_to_string(tags, ' ')), 'B')
+           || setweight(to_tsvector('simple', coalesce(description, '')), 'C')
+           || setweight(to_tsvector('simple', content), 'D'),
+       concat_ws(' ', title, description, array_to_string(tags, ' '), content)
+FROM contents
+WHERE type = 'TEXT'
+ON CONFLICT (content_id) DO NOTHING;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_messages_chat_id_created_at;
+
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS current_leaf_id;
@@ -0,0 +1,6 @@
+-- The leaf of the branch a chat currently shows; NULL falls back to the newest message.
+ALTER TABLE chats
+    ADD COLUMN IF NOT EXISTS current_leaf_id UUID REFERENCES messages(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat_id_created_at
+ON messages(chat_id, created_at);
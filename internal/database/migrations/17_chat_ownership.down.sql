@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_chats_user_id_updated_at;
+
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS title,
+    DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,15 @@
+-- Chats belong to the user who created them. Chats created before sign-in existed
+-- keep a NULL owner and are only open to admins.
+ALTER TABLE chats
+    ADD COLUMN IF NOT EXISTS user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    ADD COLUMN IF NOT EXISTS title TEXT,
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+UPDATE chats
+SET updated_at = COALESCE(
+    (SELECT max(messages.created_at) FROM messages WHERE messages.chat_id = chats.id),
+    chats.created_at
+);
+
+CREATE INDEX IF NOT EXISTS idx_chats_user_id_updated_at
+ON chats(user_id, updated_at DESC, id);
@@ -0,0 +1,7 @@
+-- A summary of the branch from the root down to and including message_id, used in
+-- place of those turns once they no longer fit in the model's context.
+CREATE TABLE IF NOT EXISTS message_summaries (
+    message_id UUID PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
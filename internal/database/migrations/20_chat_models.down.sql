@@ -0,0 +1,9 @@
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS max_tokens,
+    DROP COLUMN IF EXISTS temperature,
+    DROP COLUMN IF EXISTS model;
+
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS max_tokens,
+    DROP COLUMN IF EXISTS temperature,
+    DROP COLUMN IF EXISTS model;
@@ -0,0 +1,11 @@
+-- Generation settings: chats keep the defaults chosen at creation, assistant messages
+-- record what was actually used to produce them.
+ALTER TABLE chats
+    ADD COLUMN IF NOT EXISTS model TEXT,
+    ADD COLUMN IF NOT EXISTS temperature REAL,
+    ADD COLUMN IF NOT EXISTS max_tokens INTEGER;
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS model TEXT,
+    ADD COLUMN IF NOT EXISTS temperature REAL,
+    ADD COLUMN IF NOT EXISTS max_tokens INTEGER;
@@ -0,0 +1,13 @@
+-- Uploaded media attached to a user message, sent to the LLM as image or audio parts.
+CREATE TABLE IF NOT EXISTS message_attachments (
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    content_id UUID NOT NULL REFERENCES contents(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL CHECK (kind IN ('image', 'audio')),
+    mime_type TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_attachments_content_id
+ON message_attachments(content_id);
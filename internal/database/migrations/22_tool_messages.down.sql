@@ -0,0 +1,9 @@
+-- Tool messages may have replies chained under them, so they are kept as system
+-- messages rather than deleted.
+UPDATE messages SET role = 'system' WHERE role = 'tool';
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS tool_call_id,
+    DROP COLUMN IF EXISTS tool_calls,
+    DROP CONSTRAINT IF EXISTS messages_role_check,
+    ADD CONSTRAINT messages_role_check CHECK (role IN ('user', 'assistant', 'system'));
@@ -0,0 +1,7 @@
+-- Tool calling: an assistant message may request tool calls, whose results are stored
+-- as tool messages answering them by call ID.
+ALTER TABLE messages
+    DROP CONSTRAINT IF EXISTS messages_role_check,
+    ADD CONSTRAINT messages_role_check CHECK (role IN ('user', 'assistant', 'system', 'tool')),
+    ADD COLUMN IF NOT EXISTS tool_calls JSONB,
+    ADD COLUMN IF NOT EXISTS tool_call_id TEXT;
@@ -0,0 +1,4 @@
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS question_id;
+
+DROP TABLE IF EXISTS question_tutor_policies;
@@ -0,0 +1,14 @@
+-- How the tutor may help with a question, set by experimenters. The answer key is
+-- only shown to the tutor when include_answer_key is set.
+CREATE TABLE IF NOT EXISTS question_tutor_policies (
+    question_id UUID PRIMARY KEY REFERENCES questions(id) ON DELETE CASCADE,
+    hint_level TEXT NOT NULL CHECK (hint_level IN ('none', 'nudge', 'guided', 'full')),
+    answer_key TEXT,
+    include_answer_key BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- A chat may be about one question, which is then part of the tutor's context.
+ALTER TABLE chats
+    ADD COLUMN IF NOT EXISTS question_id UUID REFERENCES questions(id) ON DELETE SET NULL;
@@ -0,0 +1,11 @@
+-- Lesson contents retrieved as context for an assistant reply, in prompt order.
+CREATE TABLE IF NOT EXISTS message_citations (
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    content_id UUID NOT NULL REFERENCES contents(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_citations_content_id
+ON message_citations(content_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_messages_streaming;
+DROP TABLE IF EXISTS message_streams;
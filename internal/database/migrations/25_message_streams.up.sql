@@ -0,0 +1,10 @@
+-- Generations in progress, one row per streaming message. The process running a
+-- generation refreshes checkpointed_at while it copies the partial content into
+-- messages.content; a streaming message whose row went stale has lost its process.
+CREATE TABLE IF NOT EXISTS message_streams (
+    message_id UUID PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    checkpointed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_streaming
+ON messages(created_at) WHERE status = 'streaming';
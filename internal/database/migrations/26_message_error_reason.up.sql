@@ -0,0 +1,3 @@
+-- Why a generation failed, shown with the failed message.
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS error_reason TEXT;
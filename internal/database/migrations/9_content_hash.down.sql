@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_contents_media_path;
+DROP INDEX IF EXISTS idx_contents_media_sha256;
+
+ALTER TABLE contents
+    DROP COLUMN IF EXISTS sha256;
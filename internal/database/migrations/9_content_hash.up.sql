@@ -0,0 +1,12 @@
+ALTER TABLE contents
+    ADD COLUMN IF NOT EXISTS sha256 TEXT;
+
+-- Media uploads are deduplicated by their SHA-256 digest.
+CREATE INDEX IF NOT EXISTS idx_contents_media_sha256
+ON contents(sha256)
+WHERE type = 'MEDIA';
+
+-- Deleting a media row must check whether other rows still share its blob.
+CREATE INDEX IF NOT EXISTS idx_contents_media_path
+ON contents(content)
+WHERE type = 'MEDIA';
@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
+
+	"sciedu-backend/internal/auth"
 
 	handlerutil "github.com/NYCU-SDC/summer/pkg/handler"
 	logutil "github.com/NYCU-SDC/summer/pkg/log"
@@ -15,10 +18,11 @@ import (
 )
 
 type Handler struct {
-	questionService *QuestionService
-	logger          *zap.Logger
-	problemWriter   *problemutil.HttpWriter
-	validator       *validator.Validate
+	questionService    *QuestionService
+	tutorPolicyService *TutorPolicyService
+	logger             *zap.Logger
+	problemWriter      *problemutil.HttpWriter
+	validator          *validator.Validate
 }
 
 type createUpdateOptionRequest struct {
@@ -45,14 +49,29 @@ type questionResponse struct {
 	Options []optionResponse `json:"options,omitempty"`
 }
 
-func NewHandler(questionService *QuestionService, logger *zap.Logger) *Handler {
+type tutorPolicyRequest struct {
+	HintLevel        string `json:"hintLevel" validate:"required,oneof=none nudge guided full"`
+	AnswerKey        string `json:"answerKey" validate:"max=4000"`
+	IncludeAnswerKey bool   `json:"includeAnswerKey"`
+}
+
+type tutorPolicyResponse struct {
+	QuestionID       uuid.UUID `json:"questionID"`
+	HintLevel        string    `json:"hintLevel"`
+	AnswerKey        string    `json:"answerKey,omitempty"`
+	IncludeAnswerKey bool      `json:"includeAnswerKey"`
+	UpdatedAt        time.Time `json:"updatedAt,omitzero"`
+}
+
+func NewHandler(questionService *QuestionService, tutorPolicyService *TutorPolicyService, logger *zap.Logger) *Handler {
 	if logger == nil {
 		logger = zap.NewNop()
 	}
 
 	return &Handler{
-		questionService: questionService,
-		logger:          logger,
+		questionService:    questionService,
+		tutorPolicyService: tutorPolicyService,
+		logger:             logger,
 		problemWriter: problemutil.NewWithMapping(func(err error) problemutil.Problem {
 			if errors.Is(err, errInvalidQuestionPayload) {
 				return problemutil.NewValidateProblem(err.Error())
@@ -76,6 +95,8 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux, middlewares *middlewareutil
 	handle("GET /api/questions/{id}", h.Get)
 	handle("PUT /api/questions/{id}", h.Update)
 	handle("DELETE /api/questions/{id}", h.Delete)
+	handle("GET /api/questions/{id}/tutor-policy", h.GetTutorPolicy)
+	handle("PUT /api/questions/{id}/tutor-policy", h.SetTutorPolicy)
 }
 
 func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
@@ -211,6 +232,85 @@ func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// GetTutorPolicy returns how the tutor may help with a question, answer key included.
+// Only experimenters and admins may call it.
+func (h *Handler) GetTutorPolicy(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	if err := requirePolicyEditor(ctx); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	id, err := h.parseID(r.PathValue("id"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	policy, err := h.tutorPolicyService.Get(ctx, id)
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, toTutorPolicyResponse(policy))
+}
+
+// SetTutorPolicy replaces the tutor policy of a question. Chats about the question
+// follow it from their next reply on. Only experimenters and admins may call it.
+func (h *Handler) SetTutorPolicy(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logutil.WithContext(ctx, h.logger)
+
+	if err := requirePolicyEditor(ctx); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	id, err := h.parseID(r.PathValue("id"))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	var req tutorPolicyRequest
+	if err := handlerutil.ParseAndValidateRequestBody(ctx, h.validator, r, &req); err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	policy, err := h.tutorPolicyService.Set(ctx, id, TutorPolicyRequest(req))
+	if err != nil {
+		h.problemWriter.WriteError(ctx, w, err, logger)
+		return
+	}
+
+	handlerutil.WriteJSONResponse(w, http.StatusOK, toTutorPolicyResponse(policy))
+}
+
+func requirePolicyEditor(ctx context.Context) error {
+	user, ok := auth.UserFromContext(ctx)
+	if !ok {
+		return handlerutil.ErrUnauthorized
+	}
+	if !user.HasRole(auth.RoleExperimenter) && !user.HasRole(auth.RoleAdmin) {
+		return handlerutil.ErrForbidden
+	}
+	return nil
+}
+
+func toTutorPolicyResponse(policy TutorPolicy) tutorPolicyResponse {
+	return tutorPolicyResponse{
+		QuestionID:       policy.QuestionID,
+		HintLevel:        policy.HintLevel,
+		AnswerKey:        policy.AnswerKey,
+		IncludeAnswerKey: policy.IncludeAnswerKey,
+		UpdatedAt:        policy.UpdatedAt,
+	}
+}
+
 func (h *Handler) parseID(raw string) (uuid.UUID, error) {
 	return handlerutil.ParseUUID(raw)
 }
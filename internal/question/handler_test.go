@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 
+	"sciedu-backend/internal/auth"
+
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"go.uber.org/zap"
@@ -25,11 +27,14 @@ type fakeQuerier struct {
 	createOptionFn          func(ctx context.Context, arg CreateOptionParams) (Option, error)
 	updateOptionFn          func(ctx context.Context, arg UpdateOptionParams) (Option, error)
 	deleteOptionFn          func(ctx context.Context, id uuid.UUID) error
+	getTutorPolicyFn        func(ctx context.Context, questionID uuid.UUID) (QuestionTutorPolicy, error)
+	upsertTutorPolicyFn     func(ctx context.Context, arg UpsertTutorPolicyParams) (QuestionTutorPolicy, error)
 
 	createQuestionCalls []CreateQuestionParams
 	updateQuestionCalls []UpdateQuestionParams
 	createOptionCalls   []CreateOptionParams
 	deleteOptionCalls   []uuid.UUID
+	upsertPolicyCalls   []UpsertTutorPolicyParams
 }
 
 func (f *fakeQuerier) ListQuestion(ctx context.Context) ([]Question, error) {
@@ -106,6 +111,26 @@ func (f *fakeQuerier) DeleteOption(ctx context.Context, id uuid.UUID) error {
 	return nil
 }
 
+func (f *fakeQuerier) GetTutorPolicy(ctx context.Context, questionID uuid.UUID) (QuestionTutorPolicy, error) {
+	if f.getTutorPolicyFn != nil {
+		return f.getTutorPolicyFn(ctx, questionID)
+	}
+	return QuestionTutorPolicy{}, pgx.ErrNoRows
+}
+
+func (f *fakeQuerier) UpsertTutorPolicy(ctx context.Context, arg UpsertTutorPolicyParams) (QuestionTutorPolicy, error) {
+	f.upsertPolicyCalls = append(f.upsertPolicyCalls, arg)
+	if f.upsertTutorPolicyFn != nil {
+		return f.upsertTutorPolicyFn(ctx, arg)
+	}
+	return QuestionTutorPolicy{
+		QuestionID:       arg.QuestionID,
+		HintLevel:        arg.HintLevel,
+		AnswerKey:        arg.AnswerKey,
+		IncludeAnswerKey: arg.IncludeAnswerKey,
+	}, nil
+}
+
 func (f *fakeQuerier) WithinTx(_ context.Context, fn func(QuestionQuerier, OptionQuerier) error) error {
 	return fn(f, f)
 }
@@ -114,7 +139,8 @@ func newTestMux(q *fakeQuerier) *http.ServeMux {
 	logger := zap.NewNop()
 	optionService := NewOptionService(q, logger)
 	questionService := NewQuestionService(q, optionService, logger)
-	handler := NewHandler(questionService, logger)
+	tutorPolicyService := NewTutorPolicyService(q, questionService, logger)
+	handler := NewHandler(questionService, tutorPolicyService, logger)
 
 	mux := http.NewServeMux()
 	handler.RegisterRoutes(mux, nil)
@@ -640,3 +666,116 @@ func TestValidateQuestionOptions_TableDriven(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerTutorPolicy_TableDriven(t *testing.T) {
+	qid := uuid.New()
+	experimenter := &auth.User{ID: uuid.New(), Roles: []string{auth.RoleExperimenter}}
+	student := &auth.User{ID: uuid.New(), Roles: []string{auth.RoleStudent}}
+	existingQuestion := func(context.Context, uuid.UUID) (Question, error) {
+		return Question{ID: qid, Type: "TEXT", Content: "q"}, nil
+	}
+
+	tests := []struct {
+		name            string
+		method          string
+		body            string
+		user            *auth.User
+		querier         *fakeQuerier
+		wantStatus      int
+		wantUpsertCalls int
+		assertBody      func(t *testing.T, body string)
+	}{
+		{
+			name:       "anonymous caller is unauthorized",
+			method:     http.MethodGet,
+			querier:    &fakeQuerier{getQuestionFn: existingQuestion},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "student cannot read the answer key",
+			method:     http.MethodGet,
+			user:       student,
+			querier:    &fakeQuerier{getQuestionFn: existingQuestion},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "question without policy gets the default",
+			method:     http.MethodGet,
+			user:       experimenter,
+			querier:    &fakeQuerier{getQuestionFn: existingQuestion},
+			wantStatus: http.StatusOK,
+			assertBody: func(t *testing.T, body string) {
+				t.Helper()
+				var got map[string]any
+				if err := json.Unmarshal([]byte(body), &got); err != nil {
+					t.Fatalf("failed to decode body: %v", err)
+				}
+				if got["hintLevel"] != DefaultHintLevel || got["includeAnswerKey"] != false {
+					t.Fatalf("expected default policy, got: %s", body)
+				}
+			},
+		},
+		{
+			name:   "question not found",
+			method: http.MethodGet,
+			user:   experimenter,
+			querier: &fakeQuerier{getQuestionFn: func(context.Context, uuid.UUID) (Question, error) {
+				return Question{}, pgx.ErrNoRows
+			}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:            "experimenter sets policy",
+			method:          http.MethodPut,
+			body:            `{"hintLevel":"nudge","answerKey":"42 N","includeAnswerKey":true}`,
+			user:            experimenter,
+			querier:         &fakeQuerier{getQuestionFn: existingQuestion},
+			wantStatus:      http.StatusOK,
+			wantUpsertCalls: 1,
+			assertBody: func(t *testing.T, body string) {
+				t.Helper()
+				if !strings.Contains(body, `"hintLevel":"nudge"`) || !strings.Contains(body, `"answerKey":"42 N"`) {
+					t.Fatalf("expected saved policy, got: %s", body)
+				}
+			},
+		},
+		{
+			name:       "unknown hint level",
+			method:     http.MethodPut,
+			body:       `{"hintLevel":"everything"}`,
+			user:       experimenter,
+			querier:    &fakeQuerier{getQuestionFn: existingQuestion},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "including a missing answer key",
+			method:     http.MethodPut,
+			body:       `{"hintLevel":"full","includeAnswerKey":true}`,
+			user:       experimenter,
+			querier:    &fakeQuerier{getQuestionFn: existingQuestion},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/api/questions/"+qid.String()+"/tutor-policy", strings.NewReader(tt.body))
+			if tt.user != nil {
+				req = req.WithContext(auth.WithUser(req.Context(), *tt.user))
+			}
+
+			newTestMux(tt.querier).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status mismatch: want %d got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if len(tt.querier.upsertPolicyCalls) != tt.wantUpsertCalls {
+				t.Fatalf("upsert calls mismatch: want %d got %d", tt.wantUpsertCalls, len(tt.querier.upsertPolicyCalls))
+			}
+			if tt.assertBody != nil {
+				tt.assertBody(t, rec.Body.String())
+			}
+		})
+	}
+}
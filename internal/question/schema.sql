@@ -17,3 +17,12 @@ CREATE TABLE IF NOT EXISTS options (
     updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     UNIQUE (question_id, label)
 );
+
+CREATE TABLE IF NOT EXISTS question_tutor_policies (
+    question_id UUID PRIMARY KEY REFERENCES questions(id) ON DELETE CASCADE,
+    hint_level TEXT NOT NULL CHECK (hint_level IN ('none', 'nudge', 'guided', 'full')),
+    answer_key TEXT,
+    include_answer_key BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,14 @@
+-- name: GetTutorPolicy :one
+SELECT question_id, hint_level, answer_key, include_answer_key, created_at, updated_at
+FROM question_tutor_policies
+WHERE question_id = $1;
+
+-- name: UpsertTutorPolicy :one
+INSERT INTO question_tutor_policies (question_id, hint_level, answer_key, include_answer_key)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (question_id) DO UPDATE
+SET hint_level = EXCLUDED.hint_level,
+    answer_key = EXCLUDED.answer_key,
+    include_answer_key = EXCLUDED.include_answer_key,
+    updated_at = NOW()
+RETURNING question_id, hint_level, answer_key, include_answer_key, created_at, updated_at;
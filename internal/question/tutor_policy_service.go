@@ -0,0 +1,125 @@
+package question
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	databaseutil "github.com/NYCU-SDC/summer/pkg/database"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"go.uber.org/zap"
+)
+
+// Hint levels, from least to most help the tutor gives on a question.
+const (
+	// HintLevelNone: the tutor only clarifies what the question asks.
+	HintLevelNone = "none"
+	// HintLevelNudge: the tutor points at the relevant ideas with guiding questions.
+	HintLevelNudge = "nudge"
+	// HintLevelGuided: the tutor walks through the reasoning but leaves the answer to the student.
+	HintLevelGuided = "guided"
+	// HintLevelFull: the tutor may work out the full solution.
+	HintLevelFull = "full"
+)
+
+// DefaultHintLevel applies to questions without a tutor policy.
+const DefaultHintLevel = HintLevelGuided
+
+type TutorPolicyQuerier interface {
+	GetTutorPolicy(ctx context.Context, questionID uuid.UUID) (QuestionTutorPolicy, error)
+	UpsertTutorPolicy(ctx context.Context, arg UpsertTutorPolicyParams) (QuestionTutorPolicy, error)
+}
+
+// TutorPolicy is how the tutor may help with a question. AnswerKey is only shown to
+// the tutor when IncludeAnswerKey is set.
+type TutorPolicy struct {
+	QuestionID       uuid.UUID
+	HintLevel        string
+	AnswerKey        string
+	IncludeAnswerKey bool
+	UpdatedAt        time.Time
+}
+
+type TutorPolicyRequest struct {
+	HintLevel        string
+	AnswerKey        string
+	IncludeAnswerKey bool
+}
+
+type TutorPolicyService struct {
+	logger          *zap.Logger
+	querier         TutorPolicyQuerier
+	questionService *QuestionService
+}
+
+func NewTutorPolicyService(querier TutorPolicyQuerier, questionService *QuestionService, logger *zap.Logger) *TutorPolicyService {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &TutorPolicyService{
+		logger:          logger,
+		querier:         querier,
+		questionService: questionService,
+	}
+}
+
+// Get returns the tutor policy of a question, or the default policy when none was
+// set. The result includes the answer key; callers decide who may see it.
+func (s *TutorPolicyService) Get(ctx context.Context, questionID uuid.UUID) (TutorPolicy, error) {
+	if _, err := s.questionService.Get(ctx, questionID); err != nil {
+		return TutorPolicy{}, err
+	}
+	policy, err := s.querier.GetTutorPolicy(ctx, questionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TutorPolicy{QuestionID: questionID, HintLevel: DefaultHintLevel}, nil
+	}
+	if err != nil {
+		return TutorPolicy{}, databaseutil.WrapDBErrorWithKeyValue(err, "question_tutor_policies", "question_id", questionID.String(), s.logger, "get tutor policy")
+	}
+	return toTutorPolicy(policy), nil
+}
+
+func (s *TutorPolicyService) Set(ctx context.Context, questionID uuid.UUID, arg TutorPolicyRequest) (TutorPolicy, error) {
+	if _, err := s.questionService.Get(ctx, questionID); err != nil {
+		return TutorPolicy{}, err
+	}
+	if err := validateTutorPolicy(arg); err != nil {
+		return TutorPolicy{}, err
+	}
+	policy, err := s.querier.UpsertTutorPolicy(ctx, UpsertTutorPolicyParams{
+		QuestionID:       questionID,
+		HintLevel:        arg.HintLevel,
+		AnswerKey:        pgtype.Text{String: arg.AnswerKey, Valid: arg.AnswerKey != ""},
+		IncludeAnswerKey: arg.IncludeAnswerKey,
+	})
+	if err != nil {
+		return TutorPolicy{}, databaseutil.WrapDBErrorWithKeyValue(err, "question_tutor_policies", "question_id", questionID.String(), s.logger, "set tutor policy")
+	}
+	return toTutorPolicy(policy), nil
+}
+
+func validateTutorPolicy(arg TutorPolicyRequest) error {
+	switch arg.HintLevel {
+	case HintLevelNone, HintLevelNudge, HintLevelGuided, HintLevelFull:
+	default:
+		return fmt.Errorf("%w: unsupported hint level", errInvalidQuestionPayload)
+	}
+	if arg.IncludeAnswerKey && arg.AnswerKey == "" {
+		return fmt.Errorf("%w: an answer key is required to include it", errInvalidQuestionPayload)
+	}
+	return nil
+}
+
+func toTutorPolicy(policy QuestionTutorPolicy) TutorPolicy {
+	return TutorPolicy{
+		QuestionID:       policy.QuestionID,
+		HintLevel:        policy.HintLevel,
+		AnswerKey:        policy.AnswerKey.String,
+		IncludeAnswerKey: policy.IncludeAnswerKey,
+		UpdatedAt:        policy.UpdatedAt.Time,
+	}
+}